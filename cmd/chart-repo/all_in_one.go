@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/helm/monocular/cmd/chartsvc/api"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Layout of the data directory of the all-in-one command
+const (
+	dataDirDatabase = "db"
+	dataDirBlobs    = "blobs"
+)
+
+var allInOneCmd = &cobra.Command{
+	Use:   "all-in-one",
+	Short: "serve the chartsvc API and keep the chart repositories listed in a config file in sync, without MongoDB",
+	Long: `Serve the chartsvc API and keep the chart repositories listed in a config file
+in sync in a single process, like the daemon command and chartsvc do together.
+The charts are stored in the data directory instead of MongoDB, so this is
+meant for running Monocular on a laptop or in CI rather than in production.
+
+There is no separate monocular binary: chart-repo already links the chartsvc
+API, so this command is the all-in-one mode.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		configFile, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatal(err)
+		}
+		pollInterval, err := cmd.Flags().GetDuration("config-poll-interval")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dataDir, err := cmd.Flags().GetString("data-dir")
+		if err != nil {
+			log.Fatal(err)
+		}
+		listen, err := cmd.Flags().GetString("listen")
+		if err != nil {
+			log.Fatal(err)
+		}
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+		if err := applyDownloadFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyLockFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyQueueFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyAllInOneMirrorFlags(cmd, dataDir); err != nil {
+			log.Fatal(err)
+		}
+
+		config, configData, err := loadDaemonConfig(configFile)
+		if err != nil {
+			log.Fatalf("Can't load config file %s: %v", configFile, err)
+		}
+
+		store, err := localstore.Open(filepath.Join(dataDir, dataDirDatabase))
+		if err != nil {
+			log.Fatalf("Can't open data directory %s: %v", dataDir, err)
+		}
+		defer store.Close()
+
+		server := &http.Server{Addr: listen, Handler: api.NewRouter(store, blobDir)}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Can't serve the API on %s: %v", listen, err)
+			}
+		}()
+		log.WithFields(log.Fields{"addr": listen, "dataDir": dataDir}).Info("Started chartsvc")
+
+		s := newScheduler(store)
+		if s.credentialsKeysFile, err = cmd.Flags().GetString("credentials-keys-file"); err != nil {
+			log.Fatal(err)
+		}
+		s.apply(config.Repos)
+		runScheduler(s, configFile, configData, pollInterval)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.WithError(err).Error("failed to stop the API server")
+		}
+	},
+}
+
+func init() {
+	allInOneCmd.Flags().String("config", "repos.yaml", "path to the file listing the chart repositories to sync")
+	allInOneCmd.Flags().Duration("config-poll-interval", 30*time.Second, "how often to check the config file for changes")
+	allInOneCmd.Flags().String("data-dir", "monocular-data", "directory the charts and mirrored tarballs are stored in")
+	allInOneCmd.Flags().String("listen", ":8080", "address the chartsvc API is served on")
+	allInOneCmd.Flags().StringVarP(&userAgentComment, "user-agent-comment", "", "", "UserAgent comment used during outbound requests")
+	allInOneCmd.Flags().Bool("debug", false, "verbose logging")
+	addDownloadFlags(allInOneCmd)
+	addLockFlags(allInOneCmd)
+	addQueueFlags(allInOneCmd)
+	addCredentialsKeysFlag(allInOneCmd)
+	addMirrorFlags(allInOneCmd)
+	allInOneCmd.Flags().Lookup("blob-dir").Usage = "directory the tarballs of mirrored repos are stored in, e.g. a mounted S3 bucket, blobs in the data directory if empty"
+}
+
+// applyAllInOneMirrorFlags sets where mirrored files are stored from the flags
+// of the command. Unless --blob-dir is set, the tarballs of mirrored repos are
+// kept as files next to the database rather than in it.
+func applyAllInOneMirrorFlags(cmd *cobra.Command, dataDir string) error {
+	if err := applyMirrorFlags(cmd); err != nil {
+		return err
+	}
+	if blobDir == "" {
+		blobDir = filepath.Join(dataDir, dataDirBlobs)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/chartsvc/api"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/spf13/cobra"
+)
+
+// Test_allInOne syncs a repo to the embedded datastore and reads it back
+// through the chartsvc API, like the all-in-one command
+func Test_allInOne(t *testing.T) {
+	dir, err := ioutil.TempDir("", "all-in-one")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+
+	tarball := writeTestChart(t, filepath.Join(dir, "repo"), "mysql", "1.0.0")
+	index := fmt.Sprintf(`apiVersion: v1
+entries:
+  mysql:
+  - name: mysql
+    version: 1.0.0
+    description: chart from a directory
+    urls: [mysql-1.0.0.tgz]
+    digest: %s
+    created: 2018-12-11T10:00:00Z
+`, sha256Hex(tarball))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, "repo", "index.yaml"), []byte(index), 0600))
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Join(dir, "repo"))))
+	defer server.Close()
+	netClient = server.Client()
+
+	store, err := localstore.Open(filepath.Join(dir, dataDirDatabase))
+	assert.NoErr(t, err)
+	defer store.Close()
+	// The tarballs are mirrored to the data directory
+	defer func() { blobDir = "" }()
+	assert.NoErr(t, applyAllInOneMirrorFlags(allInOneCmd, dir))
+	assert.NoErr(t, syncRepo(store, repo{Name: "test", URL: server.URL, Mirror: true}, nil))
+	has, err := (dirBlobStore{filepath.Join(dir, dataDirBlobs)}).has(sha256Hex(tarball))
+	assert.NoErr(t, err)
+	assert.True(t, has, "tarball in the data directory")
+
+	chartsvc := httptest.NewServer(api.NewRouter(store, blobDir))
+	defer chartsvc.Close()
+
+	t.Run("charts", func(t *testing.T) {
+		res, err := http.Get(chartsvc.URL + "/v1/charts?page=1&size=10")
+		assert.NoErr(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusOK, "status")
+		var body struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+			Meta struct {
+				TotalPages int `json:"totalPages"`
+			} `json:"meta"`
+		}
+		assert.NoErr(t, json.NewDecoder(res.Body).Decode(&body))
+		assert.Equal(t, len(body.Data), 1, "number of charts")
+		assert.Equal(t, body.Data[0].ID, "test/mysql", "chart ID without the generation")
+		assert.Equal(t, body.Meta.TotalPages, 1, "number of pages")
+	})
+
+	t.Run("mirrored tarball", func(t *testing.T) {
+		res, err := http.Get(chartsvc.URL + "/v1/assets/test/mysql/versions/1.0.0/mysql-1.0.0.tgz")
+		assert.NoErr(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusOK, "status")
+		data, err := ioutil.ReadAll(res.Body)
+		assert.NoErr(t, err)
+		assert.Equal(t, sha256Hex(data), sha256Hex(tarball), "tarball")
+	})
+
+	t.Run("readme", func(t *testing.T) {
+		res, err := http.Get(chartsvc.URL + "/v1/assets/test/mysql/versions/1.0.0/README.md")
+		assert.NoErr(t, err)
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		assert.NoErr(t, err)
+		assert.Equal(t, string(data), testChartReadme, "README")
+	})
+}
+
+func Test_applyAllInOneMirrorFlags(t *testing.T) {
+	defer func() { blobDir = "" }()
+	cmd := &cobra.Command{}
+	addMirrorFlags(cmd)
+	assert.NoErr(t, applyAllInOneMirrorFlags(cmd, "monocular-data"))
+	assert.Equal(t, blobDir, filepath.Join("monocular-data", dataDirBlobs), "blobs in the data directory by default")
+
+	assert.NoErr(t, cmd.Flags().Set("blob-dir", "/mnt/blobs"))
+	assert.NoErr(t, applyAllInOneMirrorFlags(cmd, "monocular-data"))
+	assert.Equal(t, blobDir, "/mnt/blobs", "blob dir set by --blob-dir")
+}
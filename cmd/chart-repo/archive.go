@@ -0,0 +1,517 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+)
+
+// archiveFormatVersion is the version of the layout of the archives written by
+// chart-repo export. Archives of other versions are rejected by chart-repo
+// import.
+const archiveFormatVersion = 1
+
+// Files of an archive. The documents of every repo are stored under
+// repos/<name>/, as BSON documents written one after the other so that their
+// types are kept.
+const (
+	archiveManifestFile    = "manifest.json"
+	archiveStatusFile      = "repo.bson"
+	archiveChartsFile      = "charts.bson"
+	archiveFilesFile       = "files.bson"
+	archiveCredentialsFile = "credentials.bson"
+)
+
+// What an import does with repos already in the database
+const (
+	conflictFail      = "fail"
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+)
+
+// archiveManifest describes the content of an archive
+type archiveManifest struct {
+	FormatVersion int       `json:"formatVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Repos         []string  `json:"repos"`
+}
+
+// archivedRepo holds the documents of a repo read from an archive
+type archivedRepo struct {
+	status      repoStatus
+	charts      []bson.M
+	files       []bson.M
+	credentials *storedCredentials
+}
+
+// exportRepos writes the active charts of the repos, along with their files,
+// icons and status, to a gzipped tar archive. All repos are exported if none
+// are given. The encrypted credentials of the repos are only exported if
+// includeCredentials is set.
+func exportRepos(dbSession datastore.Session, names []string, includeCredentials bool, w io.Writer) (archiveManifest, error) {
+	if len(names) == 0 {
+		var err error
+		if names, err = repoNames(dbSession); err != nil {
+			return archiveManifest{}, err
+		}
+	}
+	manifest := archiveManifest{FormatVersion: archiveFormatVersion, CreatedAt: time.Now().UTC(), Repos: names}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return archiveManifest{}, err
+	}
+	if err := writeArchiveFile(tw, archiveManifestFile, data, manifest.CreatedAt); err != nil {
+		return archiveManifest{}, err
+	}
+	for _, name := range names {
+		a, err := loadArchivedRepo(dbSession, name, includeCredentials)
+		if err != nil {
+			return archiveManifest{}, err
+		}
+		log.WithFields(log.Fields{"repo": name, "charts": len(a.charts), "files": len(a.files)}).Info("exporting repo")
+		if err := a.write(tw, manifest.CreatedAt); err != nil {
+			return archiveManifest{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return archiveManifest{}, err
+	}
+	return manifest, gw.Close()
+}
+
+// repoNames returns the names of the repos in the database
+func repoNames(dbSession datastore.Session) ([]string, error) {
+	db, closer := dbSession.DB()
+	defer closer()
+	var repos []repoStatus
+	if err := db.C(reposCollection).Find(bson.M{}).Select(bson.M{"_id": 1}).Sort("_id").All(&repos); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, r := range repos {
+		names = append(names, r.ID)
+	}
+	return names, nil
+}
+
+// loadArchivedRepo reads the documents of the active generation of the repo
+func loadArchivedRepo(dbSession datastore.Session, name string, includeCredentials bool) (archivedRepo, error) {
+	status, err := getRepoStatus(dbSession, name)
+	if err != nil {
+		return archivedRepo{}, err
+	}
+	if status.ID == "" {
+		return archivedRepo{}, fmt.Errorf("repo %s not found", name)
+	}
+	// Only the active generation is exported, so there's nothing to roll back to
+	status.PreviousGeneration = 0
+	// Mirrored files aren't exported, so the next sync of a mirrored repo
+	// mirrors the charts again
+	status.Index.Mirror = false
+	a := archivedRepo{status: status}
+
+	// The charts and files are read as raw documents, so that fields that
+	// aren't part of the chart types, like the icons, are exported too
+	if a.charts, err = newCatalog(dbSession).exportCharts(name, status.Generation); err != nil {
+		return archivedRepo{}, err
+	}
+	for _, doc := range a.charts {
+		versions, _ := doc["chartversions"].([]interface{})
+		for _, v := range versions {
+			if cv, ok := v.(bson.M); ok {
+				delete(cv, "mirror")
+			}
+		}
+	}
+	db, closer := dbSession.DB()
+	defer closer()
+	ids := a.filesIDs(status.Generation)
+	if err := db.C(chartFilesCollection).Find(bson.M{"_id": bson.M{"$in": ids}}).All(&a.files); err != nil {
+		return archivedRepo{}, err
+	}
+	if includeCredentials {
+		var c storedCredentials
+		err := db.C(credentialsCollection).FindId(name).One(&c)
+		if err != nil && err != mgo.ErrNotFound {
+			return archivedRepo{}, err
+		}
+		if err == nil {
+			a.credentials = &c
+		}
+	}
+	return a, nil
+}
+
+// write adds the documents of the repo to the archive
+func (a archivedRepo) write(tw *tar.Writer, modTime time.Time) error {
+	dir := path.Join("repos", a.status.ID)
+	files := []archiveFile{
+		{archiveStatusFile, []interface{}{a.status}},
+		{archiveChartsFile, bsonDocs(a.charts)},
+		{archiveFilesFile, bsonDocs(a.files)},
+	}
+	if a.credentials != nil {
+		files = append(files, archiveFile{archiveCredentialsFile, []interface{}{*a.credentials}})
+	}
+	for _, f := range files {
+		var buf bytes.Buffer
+		for _, doc := range f.docs {
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			buf.Write(data)
+		}
+		if err := writeArchiveFile(tw, path.Join(dir, f.name), buf.Bytes(), modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveFile is a file of BSON documents of an archived repo
+type archiveFile struct {
+	name string
+	docs []interface{}
+}
+
+func bsonDocs(docs []bson.M) []interface{} {
+	result := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		result[i] = doc
+	}
+	return result
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// readBSONDocs splits a file of consecutive BSON documents, each starting with
+// its length
+func readBSONDocs(data []byte) ([][]byte, error) {
+	var docs [][]byte
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, errors.New("truncated BSON document")
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if size < 5 || size > len(data) {
+			return nil, errors.New("truncated BSON document")
+		}
+		docs = append(docs, data[:size])
+		data = data[size:]
+	}
+	return docs, nil
+}
+
+// readArchive reads the manifest and the documents of the repos of an archive
+func readArchive(r io.Reader) (archiveManifest, map[string]*archivedRepo, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return archiveManifest{}, nil, fmt.Errorf("not a chart-repo archive: %v", err)
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	var manifest archiveManifest
+	repos := map[string]*archivedRepo{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return archiveManifest{}, nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return archiveManifest{}, nil, err
+		}
+
+		if hdr.Name == archiveManifestFile {
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return archiveManifest{}, nil, fmt.Errorf("invalid archive manifest: %v", err)
+			}
+			if manifest.FormatVersion != archiveFormatVersion {
+				return archiveManifest{}, nil, fmt.Errorf("unsupported archive format version %d, expected %d", manifest.FormatVersion, archiveFormatVersion)
+			}
+			continue
+		}
+		if manifest.FormatVersion == 0 {
+			return archiveManifest{}, nil, errors.New("not a chart-repo archive: the manifest must be its first file")
+		}
+		dir, file := path.Split(hdr.Name)
+		if !strings.HasPrefix(dir, "repos/") {
+			return archiveManifest{}, nil, fmt.Errorf("unexpected file %s in archive", hdr.Name)
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(dir, "repos/"), "/")
+		a, ok := repos[name]
+		if !ok {
+			a = &archivedRepo{}
+			repos[name] = a
+		}
+		docs, err := readBSONDocs(data)
+		if err != nil {
+			return archiveManifest{}, nil, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		for _, doc := range docs {
+			switch file {
+			case archiveStatusFile:
+				err = bson.Unmarshal(doc, &a.status)
+			case archiveChartsFile:
+				var m bson.M
+				err = bson.Unmarshal(doc, &m)
+				a.charts = append(a.charts, m)
+			case archiveFilesFile:
+				var m bson.M
+				err = bson.Unmarshal(doc, &m)
+				a.files = append(a.files, m)
+			case archiveCredentialsFile:
+				a.credentials = &storedCredentials{}
+				err = bson.Unmarshal(doc, a.credentials)
+			default:
+				err = errors.New("unexpected file in archive")
+			}
+			if err != nil {
+				return archiveManifest{}, nil, fmt.Errorf("%s: %v", hdr.Name, err)
+			}
+		}
+	}
+
+	if manifest.FormatVersion == 0 {
+		return archiveManifest{}, nil, errors.New("not a chart-repo archive: no manifest")
+	}
+	for _, name := range manifest.Repos {
+		if a, ok := repos[name]; !ok || a.status.ID != name {
+			return archiveManifest{}, nil, fmt.Errorf("repo %s is missing from the archive", name)
+		}
+	}
+	return manifest, repos, nil
+}
+
+// importRepos restores the repos of an archive. Repos already in the database
+// are left alone if they hold the same generation of the same index, so that
+// importing an archive again changes nothing. Otherwise onConflict decides
+// whether to fail, skip the repo or overwrite it. It returns the names of the
+// imported repos.
+func importRepos(dbSession datastore.Session, r io.Reader, onConflict string) ([]string, error) {
+	switch onConflict {
+	case conflictFail, conflictSkip, conflictOverwrite:
+	default:
+		return nil, fmt.Errorf("invalid --on-conflict %q, must be one of fail, skip or overwrite", onConflict)
+	}
+	manifest, repos, err := readArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Conflicts are checked before writing anything, so that a failed import
+	// leaves the database untouched
+	existing := map[string]repoStatus{}
+	for _, name := range manifest.Repos {
+		status, err := getRepoStatus(dbSession, name)
+		if err != nil {
+			return nil, err
+		}
+		if status.ID == "" {
+			continue
+		}
+		if !sameRepoContent(status, repos[name].status) && onConflict == conflictFail {
+			return nil, fmt.Errorf("repo %s already exists, use --on-conflict to skip or overwrite it", name)
+		}
+		existing[name] = status
+	}
+
+	imported := []string{}
+	for _, name := range manifest.Repos {
+		a := repos[name]
+		status, ok := existing[name]
+		if ok && sameRepoContent(status, a.status) {
+			log.WithFields(log.Fields{"repo": name}).Info("repo already imported, skipping")
+			continue
+		}
+		if ok && onConflict == conflictSkip {
+			log.WithFields(log.Fields{"repo": name}).Info("repo already exists, skipping")
+			continue
+		}
+		// The repo isn't written while being synced
+		err := withRepoLease(dbSession, name, exclusiveLocks(), func(*heldLease) error {
+			if !ok {
+				return a.restore(dbSession)
+			}
+			// The charts and files of the archive are restored to a new
+			// generation of the existing repo, which only becomes active once
+			// its status is written, so that the charts and files being served
+			// are left untouched if restoring fails. Archived credentials
+			// replace the stored ones though. The existing generation can be
+			// rolled back to afterwards.
+			generation, err := nextGeneration(dbSession, status)
+			if err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{"repo": name, "generation": status.Generation, "to": generation}).Info("overwriting repo")
+			overwrite := a.toGeneration(generation)
+			overwrite.status.PreviousGeneration = status.Generation
+			if err := overwrite.restore(dbSession); err != nil {
+				return err
+			}
+			if err := removeOldGenerations(dbSession, overwrite.status); err != nil {
+				log.WithFields(log.Fields{"repo": name}).WithError(err).Error("failed to remove old generations")
+			}
+			return nil
+		})
+		if err != nil {
+			return imported, fmt.Errorf("failed to import repo %s: %v", name, err)
+		}
+		log.WithFields(log.Fields{"repo": name, "charts": len(a.charts), "files": len(a.files)}).Info("imported repo")
+		imported = append(imported, name)
+	}
+	return imported, nil
+}
+
+// sameRepoContent returns whether both statuses describe the same index. The
+// generations may differ, as overwritten repos are restored to a new one.
+func sameRepoContent(a, b repoStatus) bool {
+	return a.URL == b.URL && a.Index.Checksum != "" && a.Index.Checksum == b.Index.Checksum
+}
+
+// nextGeneration returns a generation of the repo that no chart has been
+// written to, not even by an interrupted sync
+func nextGeneration(dbSession datastore.Session, status repoStatus) (int64, error) {
+	charts, err := newCatalog(dbSession).listCharts(status.ID)
+	if err != nil {
+		return 0, err
+	}
+	generation := status.Generation
+	for _, c := range charts {
+		if c.Generation > generation {
+			generation = c.Generation
+		}
+	}
+	return generation + 1, nil
+}
+
+// filesIDs returns the IDs of the files of the archived chart versions in the
+// given generation of the repo, in the order of the charts and their versions
+func (a archivedRepo) filesIDs(generation int64) []string {
+	r := repo{Name: a.status.ID, Generation: generation}
+	ids := []string{}
+	for _, doc := range a.charts {
+		name, _ := doc["name"].(string)
+		versions, _ := doc["chartversions"].([]interface{})
+		for _, v := range versions {
+			if cv, ok := v.(bson.M); ok {
+				version, _ := cv["version"].(string)
+				ids = append(ids, chartFilesID(r, name, version))
+			}
+		}
+	}
+	return ids
+}
+
+// toGeneration returns the archived repo with its charts and files moved to
+// the given generation
+func (a archivedRepo) toGeneration(generation int64) archivedRepo {
+	from, to := a.filesIDs(a.status.Generation), a.filesIDs(generation)
+	ids := map[string]string{}
+	for i := range from {
+		ids[from[i]] = to[i]
+	}
+	var files []bson.M
+	for _, doc := range a.files {
+		id, ok := ids[fmt.Sprint(doc["_id"])]
+		if !ok {
+			// Files of other generations, exported along with the active one
+			// by older versions
+			continue
+		}
+		f := bson.M{}
+		for k, v := range doc {
+			f[k] = v
+		}
+		f["_id"] = id
+		files = append(files, f)
+	}
+	a.files = files
+
+	charts := make([]bson.M, len(a.charts))
+	for i, doc := range a.charts {
+		c := bson.M{}
+		for k, v := range doc {
+			c[k] = v
+		}
+		name, _ := doc["name"].(string)
+		c["_id"] = chartDocID(repo{Name: a.status.ID, Generation: generation}, name)
+		c["generation"] = generation
+		charts[i] = c
+	}
+	a.charts = charts
+	a.status.Generation = generation
+	return a
+}
+
+// restore writes the documents of the repo to the database. The status is
+// written last, which makes the imported charts visible.
+func (a archivedRepo) restore(dbSession datastore.Session) error {
+	if err := newCatalog(dbSession).restoreCharts(a.charts); err != nil {
+		return err
+	}
+	db, closer := dbSession.DB()
+	defer closer()
+	if len(a.files) > 0 {
+		var pairs []interface{}
+		for _, doc := range a.files {
+			pairs = append(pairs, bson.M{"_id": doc["_id"]}, doc)
+		}
+		bulk := db.C(chartFilesCollection).Bulk()
+		bulk.Upsert(pairs...)
+		if _, err := bulk.Run(); err != nil {
+			return err
+		}
+	}
+	if a.credentials != nil {
+		if _, err := db.C(credentialsCollection).UpsertId(a.credentials.ID, *a.credentials); err != nil {
+			return err
+		}
+	}
+	_, err := db.C(reposCollection).UpsertId(a.status.ID, a.status)
+	return err
+}
@@ -0,0 +1,95 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export [REPO NAME...]",
+	Short: "write the charts, files and status of chart repositories to an archive, all repositories if none are given",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		includeCredentials, err := cmd.Flags().GetBool("include-credentials")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		dbSession := connectMongo(cmd)
+
+		var w io.Writer = os.Stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		manifest, err := exportRepos(dbSession, args, includeCredentials, w)
+		if err != nil {
+			logrus.Fatalf("Can't export chart repositories: %v", err)
+		}
+		logrus.Infof("Successfully exported the chart repositories %s", strings.Join(manifest.Repos, ", "))
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [ARCHIVE]",
+	Short: "restore the chart repositories of an archive written by export",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			logrus.Info("Need exactly one argument: [ARCHIVE]")
+			cmd.Help()
+			return
+		}
+		onConflict, err := cmd.Flags().GetString("on-conflict")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		dbSession := connectMongo(cmd)
+
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			defer f.Close()
+			r = f
+		}
+		imported, err := importRepos(dbSession, r, onConflict)
+		if err != nil {
+			logrus.Fatalf("Can't import chart repositories: %v", err)
+		}
+		logrus.Infof("Successfully imported %d chart repositories", len(imported))
+	},
+}
+
+func init() {
+	exportCmd.Flags().StringP("output", "o", "-", "file the archive is written to, - for the standard output")
+	exportCmd.Flags().Bool("include-credentials", false, "include the stored credentials of the repositories, which stay encrypted with the current credentials keys")
+	importCmd.Flags().String("on-conflict", conflictFail, "what to do with repositories that already exist with other charts: fail, skip or overwrite")
+}
@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/kubeapps/common/datastore"
+)
+
+var archivedStatus = repoStatus{ID: "stable", URL: "https://kubernetes-charts.storage.googleapis.com", Status: repoSyncSucceeded, Generation: 2, PreviousGeneration: 1, ChartCount: 1, VersionCount: 1, Index: repoIndexInfo{Checksum: "abc"}}
+
+// newArchivedStore returns a datastore holding a repo with a single chart,
+// icon and files
+func newArchivedStore(t *testing.T) *localstore.Store {
+	store := localstore.New()
+	assert.NoErr(t, updateRepoStatus(store, archivedStatus))
+	assert.NoErr(t, store.Insert(chartCollection,
+		bson.M{"_id": "stable/mysql@1", "name": "mysql", "generation": int64(1), "repo": bson.M{"name": "stable"},
+			"chartversions": []interface{}{bson.M{"version": "1.0.0"}}},
+		bson.M{"_id": "stable/mysql@2", "name": "mysql", "generation": int64(2), "raw_icon": []byte{1, 2, 3}, "repo": bson.M{"name": "stable"},
+			"chartversions": []interface{}{bson.M{"version": "1.0.0", "mirror": bson.M{"tarball": testDigest}}}},
+	))
+	assert.NoErr(t, store.Insert(chartFilesCollection,
+		bson.M{"_id": "stable/mysql-1.0.0@1", "readme": "# Old MySQL", "repo": bson.M{"name": "stable"}},
+		bson.M{"_id": "stable/mysql-1.0.0@2", "readme": "# MySQL", "repo": bson.M{"name": "stable"}},
+	))
+	assert.NoErr(t, store.Insert(credentialsCollection, storedCredentials{ID: "stable", KeyID: "key1", Ciphertext: []byte("secret")}))
+	return store
+}
+
+// exportTestArchive exports a repo with a single chart, icon and files
+func exportTestArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	manifest, err := exportRepos(newArchivedStore(t), []string{"stable"}, true, &buf)
+	assert.NoErr(t, err)
+	assert.Equal(t, manifest.Repos, []string{"stable"}, "exported repos")
+	return buf.Bytes()
+}
+
+// getChartDocs returns the raw documents of the charts of the repo
+func getChartDocs(t *testing.T, dbSession datastore.Session, repoName string) []bson.M {
+	db, closer := dbSession.DB()
+	defer closer()
+	var docs []bson.M
+	assert.NoErr(t, db.C(chartCollection).Find(bson.M{"repo.name": repoName}).All(&docs))
+	return docs
+}
+
+func Test_exportImportRepos(t *testing.T) {
+	archive := exportTestArchive(t)
+
+	store := localstore.New()
+	imported, err := importRepos(store, bytes.NewReader(archive), conflictFail)
+	assert.NoErr(t, err)
+	assert.Equal(t, imported, []string{"stable"}, "imported repos")
+
+	status, err := getRepoStatus(store, "stable")
+	assert.NoErr(t, err)
+	assert.Equal(t, status.Generation, int64(2), "active generation")
+	assert.Equal(t, status.PreviousGeneration, int64(0), "previous generation")
+	assert.Equal(t, status.Index.Checksum, "abc", "index checksum")
+
+	// Only the active generation is exported
+	charts := getChartDocs(t, store, "stable")
+	assert.Equal(t, len(charts), 1, "number of charts")
+	assert.Equal(t, charts[0]["_id"], "stable/mysql@2", "chart ID")
+	assert.Equal(t, charts[0]["raw_icon"], []byte{1, 2, 3}, "icon")
+	assert.Equal(t, charts[0]["generation"], int64(2), "chart generation")
+	// Mirrored files aren't exported
+	assert.Equal(t, charts[0]["chartversions"], []interface{}{bson.M{"version": "1.0.0"}}, "chart versions")
+
+	assert.Equal(t, documentIDs(t, store, chartFilesCollection), []string{"stable/mysql-1.0.0@2"}, "files")
+	db, closer := store.DB()
+	defer closer()
+	var files bson.M
+	assert.NoErr(t, db.C(chartFilesCollection).FindId("stable/mysql-1.0.0@2").One(&files))
+	assert.Equal(t, files["readme"], "# MySQL", "readme")
+	var credentials storedCredentials
+	assert.NoErr(t, db.C(credentialsCollection).FindId("stable").One(&credentials))
+	assert.Equal(t, credentials.Ciphertext, []byte("secret"), "encrypted credentials")
+}
+
+func Test_importReposConflicts(t *testing.T) {
+	archive := exportTestArchive(t)
+	conflicting := repoStatus{ID: "stable", Generation: 5, Index: repoIndexInfo{Checksum: "def"}}
+	tests := []struct {
+		name       string
+		existing   repoStatus
+		onConflict string
+		wantErr    bool
+		wantImport bool
+	}{
+		{"same content", archivedStatus, conflictFail, false, false},
+		{"fail", conflicting, conflictFail, true, false},
+		{"skip", conflicting, conflictSkip, false, false},
+		{"overwrite", conflicting, conflictOverwrite, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := localstore.New()
+			assert.NoErr(t, updateRepoStatus(store, tt.existing))
+			existingChart := bson.M{"_id": "stable/mariadb@5", "name": "mariadb", "generation": int64(5), "repo": bson.M{"name": "stable"},
+				"chartversions": []interface{}{bson.M{"version": "1.0.0"}}}
+			assert.NoErr(t, store.Insert(chartCollection, existingChart))
+			assert.NoErr(t, store.Insert(chartFilesCollection, bson.M{"_id": "stable/mariadb-1.0.0@5", "readme": "# MariaDB", "repo": bson.M{"name": "stable"}}))
+
+			imported, err := importRepos(store, bytes.NewReader(archive), tt.onConflict)
+			assert.Equal(t, err != nil, tt.wantErr, "error")
+			assert.Equal(t, len(imported) == 1, tt.wantImport, "imported")
+			status, err := getRepoStatus(store, "stable")
+			assert.NoErr(t, err)
+			charts := getChartDocs(t, store, "stable")
+			if tt.wantImport {
+				// The archived repo is restored to a new generation, and the
+				// existing one can be rolled back to
+				assert.Equal(t, status.Generation, int64(6), "active generation")
+				assert.Equal(t, status.PreviousGeneration, tt.existing.Generation, "previous generation")
+				assert.Equal(t, status.Index, archivedStatus.Index, "index of the archived repo")
+				assert.Equal(t, len(charts), 2, "number of charts")
+				assert.Equal(t, charts[0], existingChart, "chart of the existing repo")
+				assert.Equal(t, charts[1]["_id"], "stable/mysql@6", "imported chart")
+				assert.Equal(t, charts[1]["generation"], int64(6), "generation of the imported chart")
+				// The files are restored to the new generation as well, next
+				// to the files being served
+				assert.Equal(t, documentIDs(t, store, chartFilesCollection), []string{"stable/mariadb-1.0.0@5", "stable/mysql-1.0.0@6"}, "files")
+
+				// Importing the archive again changes nothing
+				imported, err := importRepos(store, bytes.NewReader(archive), conflictFail)
+				assert.NoErr(t, err)
+				assert.Equal(t, len(imported), 0, "imported again")
+			} else {
+				assert.Equal(t, status.Generation, tt.existing.Generation, "active generation")
+				assert.Equal(t, status.Index, tt.existing.Index, "index of the existing repo")
+				assert.Equal(t, charts, []bson.M{existingChart}, "charts of the existing repo")
+				assert.Equal(t, documentIDs(t, store, chartFilesCollection), []string{"stable/mariadb-1.0.0@5"}, "files of the existing repo")
+			}
+		})
+	}
+}
+
+func Test_readArchive(t *testing.T) {
+	newArchive := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for _, name := range []string{archiveManifestFile, "repos/stable/repo.bson"} {
+			if data, ok := files[name]; ok {
+				assert.NoErr(t, writeArchiveFile(tw, name, []byte(data), time.Now()))
+			}
+		}
+		tw.Close()
+		gw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{"not gzipped", []byte("index.yaml")},
+		{"no manifest", newArchive(map[string]string{})},
+		{"unsupported version", newArchive(map[string]string{archiveManifestFile: `{"formatVersion": 2, "repos": []}`})},
+		{"missing repo", newArchive(map[string]string{archiveManifestFile: `{"formatVersion": 1, "repos": ["stable"]}`})},
+		{"truncated document", newArchive(map[string]string{archiveManifestFile: `{"formatVersion": 1, "repos": ["stable"]}`, "repos/stable/repo.bson": "\x10\x00\x00\x00"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readArchive(bytes.NewReader(tt.archive))
+			assert.ExistsErr(t, err, "invalid archive")
+		})
+	}
+
+	_, err := importRepos(nil, bytes.NewReader(exportTestArchive(t)), "replace")
+	assert.ExistsErr(t, err, "invalid conflict mode")
+}
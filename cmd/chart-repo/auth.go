@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// repoAuthConfig holds the credentials of a repo. Secrets are referenced by
+// environment variable or file rather than written in the config, and are read
+// before every sync so that rotated credentials are picked up.
+type repoAuthConfig struct {
+	// Value of the Authorization header sent to the repo
+	Header string `json:"header"`
+	// Environment variable containing the value of the Authorization header
+	HeaderEnv string `json:"headerEnv"`
+	// Basic authentication, with the password read from passwordEnv or
+	// passwordFile
+	Username     string `json:"username"`
+	PasswordEnv  string `json:"passwordEnv"`
+	PasswordFile string `json:"passwordFile"`
+	// Bearer token, read from tokenEnv or tokenFile
+	TokenEnv  string `json:"tokenEnv"`
+	TokenFile string `json:"tokenFile"`
+}
+
+func (a repoAuthConfig) validate() error {
+	methods := 0
+	if a.Header != "" || a.HeaderEnv != "" {
+		methods++
+	}
+	if a.Username != "" {
+		methods++
+		if (a.PasswordEnv == "") == (a.PasswordFile == "") {
+			return errors.New("auth: exactly one of passwordEnv and passwordFile must be set with username")
+		}
+	} else if a.PasswordEnv != "" || a.PasswordFile != "" {
+		return errors.New("auth: password set without username")
+	}
+	if a.TokenEnv != "" || a.TokenFile != "" {
+		methods++
+		if a.TokenEnv != "" && a.TokenFile != "" {
+			return errors.New("auth: only one of tokenEnv and tokenFile can be set")
+		}
+	}
+	if methods > 1 {
+		return errors.New("auth: only one of header, username and token can be set")
+	}
+	return nil
+}
+
+// authorizationHeader returns the Authorization header sent to the repo, if
+// any
+func (a repoAuthConfig) authorizationHeader() (string, error) {
+	switch {
+	case a.HeaderEnv != "":
+		return readSecret(a.HeaderEnv, "")
+	case a.Username != "":
+		password, err := readSecret(a.PasswordEnv, a.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.Username+":"+password)), nil
+	case a.TokenEnv != "" || a.TokenFile != "":
+		token, err := readSecret(a.TokenEnv, a.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + strings.TrimSpace(token), nil
+	}
+	return a.Header, nil
+}
+
+// readSecret reads a secret from an environment variable or a file. The line
+// break that usually ends files is trimmed.
+func readSecret(env, file string) (string, error) {
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
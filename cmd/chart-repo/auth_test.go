@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func Test_repoAuthConfigValidate(t *testing.T) {
+	valid := []repoAuthConfig{
+		{},
+		{Header: "Bearer abc"},
+		{HeaderEnv: "REPO_AUTH"},
+		{Username: "user", PasswordEnv: "REPO_PASSWORD"},
+		{Username: "user", PasswordFile: "/etc/password"},
+		{TokenFile: "/var/run/secrets/token"},
+	}
+	for _, a := range valid {
+		assert.NoErr(t, a.validate())
+	}
+
+	invalid := []repoAuthConfig{
+		{Username: "user"},
+		{Username: "user", PasswordEnv: "REPO_PASSWORD", PasswordFile: "/etc/password"},
+		{PasswordFile: "/etc/password"},
+		{TokenEnv: "REPO_TOKEN", TokenFile: "/var/run/secrets/token"},
+		{HeaderEnv: "REPO_AUTH", TokenFile: "/var/run/secrets/token"},
+		{Username: "user", PasswordEnv: "REPO_PASSWORD", TokenEnv: "REPO_TOKEN"},
+	}
+	for _, a := range invalid {
+		assert.ExistsErr(t, a.validate(), "invalid auth config")
+	}
+}
+
+func Test_repoAuthConfigAuthorizationHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-repo-auth")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+
+	header, err := repoAuthConfig{Header: "Bearer abc"}.authorizationHeader()
+	assert.NoErr(t, err)
+	assert.Equal(t, header, "Bearer abc", "inline header")
+
+	// Basic authentication
+	os.Setenv("TEST_REPO_PASSWORD", "pass")
+	defer os.Unsetenv("TEST_REPO_PASSWORD")
+	header, err = repoAuthConfig{Username: "user", PasswordEnv: "TEST_REPO_PASSWORD"}.authorizationHeader()
+	assert.NoErr(t, err)
+	assert.Equal(t, header, "Basic dXNlcjpwYXNz", "basic authentication")
+	passwordFile := filepath.Join(dir, "password")
+	assert.NoErr(t, ioutil.WriteFile(passwordFile, []byte("pass\n"), 0600))
+	header, err = repoAuthConfig{Username: "user", PasswordFile: passwordFile}.authorizationHeader()
+	assert.NoErr(t, err)
+	assert.Equal(t, header, "Basic dXNlcjpwYXNz", "basic authentication with a password file")
+
+	// The token file is read every time, so that rotated tokens are used
+	tokenFile := filepath.Join(dir, "token")
+	auth := repoAuthConfig{TokenFile: tokenFile}
+	_, err = auth.authorizationHeader()
+	assert.ExistsErr(t, err, "missing token file")
+	assert.NoErr(t, ioutil.WriteFile(tokenFile, []byte("first\n"), 0600))
+	header, err = auth.authorizationHeader()
+	assert.NoErr(t, err)
+	assert.Equal(t, header, "Bearer first", "bearer token")
+	assert.NoErr(t, ioutil.WriteFile(tokenFile, []byte("second"), 0600))
+	header, err = auth.authorizationHeader()
+	assert.NoErr(t, err)
+	assert.Equal(t, header, "Bearer second", "rotated bearer token")
+}
+
+// writeClientCertificate writes a self-signed client certificate and its key
+// to the directory
+func writeClientCertificate(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoErr(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "monocular"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoErr(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoErr(t, err)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	assert.NoErr(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoErr(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	return cert, certFile, keyFile
+}
+
+func Test_repoTLSClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-repo-tls")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+
+	clientCert, certFile, keyFile := writeClientCertificate(t, dir)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(emptyRepoIndexYAML))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.NoErr(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	tests := []struct {
+		name    string
+		r       repo
+		wantErr bool
+	}{
+		{"client certificate", repo{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, false},
+		{"unknown CA", repo{CertFile: certFile, KeyFile: keyFile}, true},
+		{"no client certificate", repo{CAFile: caFile}, true},
+		{"insecure", repo{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.r.Name = "private"
+			tt.r.URL = server.URL
+			_, _, err := fetchRepoIndex(tt.r, repoIndexInfo{})
+			if tt.wantErr {
+				assert.ExistsErr(t, err, tt.name)
+			} else {
+				assert.NoErr(t, err)
+			}
+		})
+	}
+
+	// Repos with the same TLS configuration share their client
+	c1, err := repoTLSClient(repo{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	assert.NoErr(t, err)
+	c2, err := repoTLSClient(repo{Name: "other", CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	assert.NoErr(t, err)
+	assert.True(t, c1 == c2, "shared client")
+
+	_, err = repoTLSClient(repo{CertFile: caFile, KeyFile: caFile})
+	assert.ExistsErr(t, err, "invalid key pair")
+}
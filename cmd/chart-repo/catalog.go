@@ -0,0 +1,279 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/kubeapps/common/datastore"
+	"github.com/spf13/cobra"
+)
+
+// Backends of the chart catalog
+const (
+	catalogMongoDB    = "mongodb"
+	catalogPostgreSQL = "postgresql"
+)
+
+// chartCatalog stores the charts of the repos
+type chartCatalog interface {
+	// listCharts returns the charts of every generation of the repo, or of
+	// every repo if repoName is empty
+	listCharts(repoName string) ([]chart, error)
+	// listGeneration returns the charts of a generation of the repo,
+	// generation 0 being the charts written before generations existed
+	listGeneration(repoName string, generation int64) ([]chart, error)
+	// listChartsWithIcon returns the IDs of the charts of a generation of the
+	// repo whose icon has been imported
+	listChartsWithIcon(repoName string, generation int64) ([]string, error)
+	// getChart returns the chart with the given ID, or mgo.ErrNotFound
+	getChart(id string) (chart, error)
+	// upsertCharts writes the charts of a generation of a repo, keeping the
+	// icons of the charts already written, and removes the other charts of
+	// that generation
+	upsertCharts(charts []chart) error
+	// setChartIcon sets the icon of the chart with the given ID
+	setChartIcon(id string, icon []byte) error
+	// updateChartVersion sets the given fields, by their BSON name, of the
+	// i-th version of the chart with the given ID
+	updateChartVersion(id string, i int, fields bson.M) error
+	// deleteCharts removes the charts of the repo, except the ones of the
+	// generations to keep
+	deleteCharts(repoName string, keep ...int64) error
+	// deleteOtherRepos removes the charts of the repos other than the given
+	// ones, and returns how many were removed
+	deleteOtherRepos(repoNames []string) (int, error)
+	// exportCharts returns the charts of a generation of the repo as raw
+	// documents, including their icons
+	exportCharts(repoName string, generation int64) ([]bson.M, error)
+	// restoreCharts writes charts exported by exportCharts
+	restoreCharts(docs []bson.M) error
+}
+
+// With --catalog=postgresql, the charts are stored in the charts table of
+// postgresCatalog and the other collections in the documents table of
+// postgresStore, both nil otherwise
+var (
+	postgresCatalog *pgCatalog
+	postgresStore   *localstore.Store
+)
+
+// newCatalog returns the catalog set by --catalog
+func newCatalog(dbSession datastore.Session) chartCatalog {
+	if postgresCatalog != nil {
+		return postgresCatalog
+	}
+	return mongoCatalog{dbSession}
+}
+
+// newSession returns the datastore set by --catalog, connecting to MongoDB
+// with the given config unless the documents are stored in PostgreSQL
+func newSession(config datastore.Config) (datastore.Session, error) {
+	if postgresStore != nil {
+		return postgresStore, nil
+	}
+	return datastore.NewSession(config)
+}
+
+// addCatalogFlags adds the flags selecting where the charts and the other
+// documents are stored
+func addCatalogFlags(cmd *cobra.Command) {
+	cmd.Flags().String("catalog", catalogMongoDB, "backend the charts, repos and files are stored in, mongodb or postgresql")
+	cmd.Flags().String("postgresql-url", "", "PostgreSQL connection string for --catalog=postgresql (see https://godoc.org/github.com/lib/pq for format), the password can be set with PGPASSWORD")
+}
+
+// applyCatalogFlags opens the PostgreSQL database set by the flags of the
+// command, if any
+func applyCatalogFlags(cmd *cobra.Command) error {
+	if cmd.Flags().Lookup("catalog") == nil {
+		return nil
+	}
+	backend, err := cmd.Flags().GetString("catalog")
+	if err != nil {
+		return err
+	}
+	switch backend {
+	case catalogMongoDB:
+		return nil
+	case catalogPostgreSQL:
+	default:
+		return fmt.Errorf("invalid --catalog %q, must be one of %s or %s", backend, catalogMongoDB, catalogPostgreSQL)
+	}
+	url, err := cmd.Flags().GetString("postgresql-url")
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		return fmt.Errorf("--postgresql-url is required with --catalog=%s", catalogPostgreSQL)
+	}
+	if postgresCatalog, err = openPGCatalog(url); err != nil {
+		return err
+	}
+	postgresStore, err = localstore.OpenPostgreSQL(url)
+	return err
+}
+
+// mongoCatalog stores the charts in the charts collection of the datastore
+type mongoCatalog struct {
+	dbSession datastore.Session
+}
+
+func (c mongoCatalog) listCharts(repoName string) ([]chart, error) {
+	var selector bson.M
+	if repoName != "" {
+		selector = bson.M{"repo.name": repoName}
+	}
+	return c.find(selector)
+}
+
+func (c mongoCatalog) listGeneration(repoName string, generation int64) ([]chart, error) {
+	return c.find(activeChartsQuery(repoStatus{ID: repoName, Generation: generation}))
+}
+
+func (c mongoCatalog) find(selector bson.M) ([]chart, error) {
+	db, closer := c.dbSession.DB()
+	defer closer()
+	var charts []chart
+	err := db.C(chartCollection).Find(selector).Select(bson.M{"raw_icon": 0}).All(&charts)
+	return charts, err
+}
+
+func (c mongoCatalog) listChartsWithIcon(repoName string, generation int64) ([]string, error) {
+	selector := activeChartsQuery(repoStatus{ID: repoName, Generation: generation})
+	selector["raw_icon"] = bson.M{"$exists": true}
+	db, closer := c.dbSession.DB()
+	defer closer()
+	var charts []chart
+	if err := db.C(chartCollection).Find(selector).Select(bson.M{"_id": 1}).All(&charts); err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, ch := range charts {
+		ids = append(ids, ch.ID)
+	}
+	return ids, nil
+}
+
+func (c mongoCatalog) getChart(id string) (chart, error) {
+	db, closer := c.dbSession.DB()
+	defer closer()
+	var ch chart
+	err := db.C(chartCollection).FindId(id).One(&ch)
+	return ch, err
+}
+
+func (c mongoCatalog) upsertCharts(charts []chart) error {
+	var pairs []interface{}
+	var chartIDs []string
+	for _, c := range charts {
+		chartIDs = append(chartIDs, c.ID)
+		// charts to upsert - pair of selector, update. The charts are updated
+		// in place, keeping the icons imported by an interrupted sync of the
+		// same generation.
+		selector := bson.M{"_id": c.ID}
+		c.ID = ""
+		pairs = append(pairs, selector, bson.M{"$set": c})
+	}
+
+	db, closer := c.dbSession.DB()
+	defer closer()
+	bulk := db.C(chartCollection).Bulk()
+
+	// Upsert pairs of selectors, charts
+	bulk.Upsert(pairs...)
+
+	// Remove charts no longer existing in index, left by a previous attempt
+	// to write the same generation
+	bulk.RemoveAll(bson.M{
+		"_id": bson.M{
+			"$nin": chartIDs,
+		},
+		"repo.name":  charts[0].Repo.Name,
+		"generation": charts[0].Generation,
+	})
+
+	_, err := bulk.Run()
+	return err
+}
+
+func (c mongoCatalog) setChartIcon(id string, icon []byte) error {
+	db, closer := c.dbSession.DB()
+	defer closer()
+	return db.C(chartCollection).UpdateId(id, bson.M{"$set": bson.M{"raw_icon": icon}})
+}
+
+func (c mongoCatalog) updateChartVersion(id string, i int, fields bson.M) error {
+	db, closer := c.dbSession.DB()
+	defer closer()
+	update := bson.M{}
+	for k, v := range fields {
+		update[fmt.Sprintf("chartversions.%d.%s", i, k)] = v
+	}
+	return db.C(chartCollection).UpdateId(id, bson.M{"$set": update})
+}
+
+func (c mongoCatalog) deleteCharts(repoName string, keep ...int64) error {
+	db, closer := c.dbSession.DB()
+	defer closer()
+	selector := bson.M{"repo.name": repoName}
+	if len(keep) > 0 {
+		// Charts without a generation are matched too
+		selector["generation"] = bson.M{"$nin": keep}
+	}
+	_, err := db.C(chartCollection).RemoveAll(selector)
+	return err
+}
+
+func (c mongoCatalog) deleteOtherRepos(repoNames []string) (int, error) {
+	db, closer := c.dbSession.DB()
+	defer closer()
+	info, err := db.C(chartCollection).RemoveAll(bson.M{
+		"repo.name": bson.M{
+			"$nin": repoNames,
+		},
+	})
+	if err != nil || info == nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (c mongoCatalog) exportCharts(repoName string, generation int64) ([]bson.M, error) {
+	db, closer := c.dbSession.DB()
+	defer closer()
+	var docs []bson.M
+	err := db.C(chartCollection).Find(activeChartsQuery(repoStatus{ID: repoName, Generation: generation})).All(&docs)
+	return docs, err
+}
+
+func (c mongoCatalog) restoreCharts(docs []bson.M) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	db, closer := c.dbSession.DB()
+	defer closer()
+	var pairs []interface{}
+	for _, doc := range docs {
+		pairs = append(pairs, bson.M{"_id": doc["_id"]}, doc)
+	}
+	bulk := db.C(chartCollection).Bulk()
+	bulk.Upsert(pairs...)
+	_, err := bulk.Run()
+	return err
+}
@@ -0,0 +1,212 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/spf13/cobra"
+)
+
+func Test_chartCatalog(t *testing.T) {
+	t.Run("mongodb", func(t *testing.T) {
+		testChartCatalog(t, mongoCatalog{localstore.New()})
+	})
+	t.Run("postgresql", func(t *testing.T) {
+		url := os.Getenv("MONOCULAR_TEST_POSTGRESQL_URL")
+		if url == "" {
+			t.Skip("MONOCULAR_TEST_POSTGRESQL_URL is not set")
+		}
+		c, err := openPGCatalog(url)
+		assert.NoErr(t, err)
+		defer c.db.Close()
+		_, err = c.db.Exec(`DELETE FROM charts`)
+		assert.NoErr(t, err)
+		testChartCatalog(t, c)
+	})
+}
+
+// testChartCatalog checks the behavior shared by the catalogs, starting from an
+// empty catalog
+func testChartCatalog(t *testing.T, c chartCatalog) {
+	stable := repo{Name: "stable", URL: "https://kubernetes-charts.storage.googleapis.com"}
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	mysql := func(generation int64) chart {
+		return chart{
+			ID:            fmt.Sprintf("stable/mysql@%d", generation),
+			Name:          "mysql",
+			Repo:          stable,
+			Keywords:      []string{"database"},
+			ChartVersions: []chartVersion{{Version: "0.2.0", Created: created, Digest: "2"}, {Version: "0.1.0", Created: created, Digest: "1"}},
+			Generation:    generation,
+		}
+	}
+	wordpress := chart{ID: "stable/wordpress@1", Name: "wordpress", Repo: stable, Generation: 1}
+	kafka := chart{ID: "incubator/kafka@1", Name: "kafka", Repo: repo{Name: "incubator"}, Generation: 1}
+
+	assert.NoErr(t, c.upsertCharts([]chart{mysql(1), wordpress}))
+	assert.NoErr(t, c.upsertCharts([]chart{mysql(2)}))
+	assert.NoErr(t, c.upsertCharts([]chart{kafka}))
+
+	charts, err := c.listCharts("stable")
+	assert.NoErr(t, err)
+	assert.Equal(t, sortedChartIDs(charts), []string{"stable/mysql@1", "stable/mysql@2", "stable/wordpress@1"}, "charts of the repo")
+	charts, err = c.listCharts("")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(charts), 4, "number of charts")
+	charts, err = c.listGeneration("stable", 1)
+	assert.NoErr(t, err)
+	assert.Equal(t, sortedChartIDs(charts), []string{"stable/mysql@1", "stable/wordpress@1"}, "charts of the generation")
+
+	ch, err := c.getChart("stable/mysql@2")
+	assert.NoErr(t, err)
+	assert.Equal(t, ch.Repo, stable, "repo")
+	assert.Equal(t, ch.Keywords, []string{"database"}, "keywords")
+	assert.Equal(t, len(ch.ChartVersions), 2, "number of versions")
+	assert.True(t, ch.ChartVersions[0].Created.Equal(created), "creation time")
+	_, err = c.getChart("stable/mysql@3")
+	assert.Equal(t, err, mgo.ErrNotFound, "missing chart")
+
+	// The icons are kept when the generation is written again, and the
+	// charts it no longer has are removed
+	assert.NoErr(t, c.setChartIcon("stable/mysql@1", []byte("icon")))
+	assert.Equal(t, c.setChartIcon("stable/redis@1", []byte("icon")), mgo.ErrNotFound, "icon of a missing chart")
+	assert.NoErr(t, c.upsertCharts([]chart{mysql(1)}))
+	ids, err := c.listChartsWithIcon("stable", 1)
+	assert.NoErr(t, err)
+	assert.Equal(t, ids, []string{"stable/mysql@1"}, "charts with an icon")
+	charts, err = c.listGeneration("stable", 1)
+	assert.NoErr(t, err)
+	assert.Equal(t, sortedChartIDs(charts), []string{"stable/mysql@1"}, "charts of the generation written again")
+
+	assert.NoErr(t, c.updateChartVersion("stable/mysql@2", 1, bson.M{"digestmismatch": true, "provenance": provenance{State: provenanceVerified}}))
+	ch, err = c.getChart("stable/mysql@2")
+	assert.NoErr(t, err)
+	assert.False(t, ch.ChartVersions[0].DigestMismatch, "other version")
+	assert.True(t, ch.ChartVersions[1].DigestMismatch, "updated version")
+	assert.Equal(t, ch.ChartVersions[1].Provenance.State, provenanceVerified, "provenance of the updated version")
+
+	docs, err := c.exportCharts("stable", 1)
+	assert.NoErr(t, err)
+	assert.Equal(t, len(docs), 1, "number of exported charts")
+	assert.Equal(t, docs[0]["raw_icon"], []byte("icon"), "exported icon")
+
+	assert.NoErr(t, c.deleteCharts("stable", 2))
+	charts, err = c.listCharts("stable")
+	assert.NoErr(t, err)
+	assert.Equal(t, sortedChartIDs(charts), []string{"stable/mysql@2"}, "charts kept")
+	assert.NoErr(t, c.restoreCharts(docs))
+	ids, err = c.listChartsWithIcon("stable", 1)
+	assert.NoErr(t, err)
+	assert.Equal(t, ids, []string{"stable/mysql@1"}, "restored chart with its icon")
+
+	n, err := c.deleteOtherRepos([]string{"stable"})
+	assert.NoErr(t, err)
+	assert.Equal(t, n, 1, "number of charts of other repos")
+	assert.NoErr(t, c.deleteCharts("stable"))
+	charts, err = c.listCharts("")
+	assert.NoErr(t, err)
+	assert.Equal(t, len(charts), 0, "number of charts left")
+}
+
+func sortedChartIDs(charts []chart) []string {
+	ids := []string{}
+	for _, ch := range charts {
+		ids = append(ids, ch.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func Test_mongoCatalog(t *testing.T) {
+	t.Run("delete charts", func(t *testing.T) {
+		store := localstore.New()
+		stable := repo{Name: "stable"}
+		assert.NoErr(t, store.Insert(chartCollection,
+			chart{ID: "stable/mysql", Name: "mysql", Repo: stable},
+			chart{ID: "stable/mysql@1", Name: "mysql", Repo: stable, Generation: 1},
+			chart{ID: "stable/mysql@2", Name: "mysql", Repo: stable, Generation: 2},
+			chart{ID: "stable/mysql@3", Name: "mysql", Repo: stable, Generation: 3},
+			chart{ID: "incubator/kafka@1", Name: "kafka", Repo: repo{Name: "incubator"}, Generation: 1},
+		))
+		c := mongoCatalog{store}
+		assert.NoErr(t, c.deleteCharts("stable", 3, 2))
+		assert.Equal(t, documentIDs(t, store, chartCollection), []string{"stable/mysql@2", "stable/mysql@3", "incubator/kafka@1"}, "charts kept")
+	})
+
+	t.Run("update chart version", func(t *testing.T) {
+		store := localstore.New()
+		assert.NoErr(t, store.Insert(chartCollection, chart{ID: "stable/mysql@2", Name: "mysql", Generation: 2, ChartVersions: []chartVersion{{Version: "1.1.0"}, {Version: "1.0.0"}}}))
+		c := mongoCatalog{store}
+		assert.NoErr(t, c.updateChartVersion("stable/mysql@2", 1, bson.M{"digestmismatch": true}))
+		ch, err := c.getChart("stable/mysql@2")
+		assert.NoErr(t, err)
+		assert.False(t, ch.ChartVersions[0].DigestMismatch, "other version")
+		assert.True(t, ch.ChartVersions[1].DigestMismatch, "updated version")
+	})
+
+	t.Run("restore no charts", func(t *testing.T) {
+		c := mongoCatalog{localstore.New()}
+		assert.NoErr(t, c.restoreCharts(nil))
+		charts, err := c.listCharts("")
+		assert.NoErr(t, err)
+		assert.Equal(t, len(charts), 0, "number of charts")
+	})
+}
+
+func Test_applyCatalogFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		catalog string
+		wantErr string
+	}{
+		{"default", "", ""},
+		{"mongodb", catalogMongoDB, ""},
+		{"postgresql without url", catalogPostgreSQL, "--postgresql-url is required"},
+		{"unknown backend", "cassandra", "invalid --catalog"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &cobra.Command{}
+			addCatalogFlags(cmd)
+			if tt.catalog != "" {
+				assert.NoErr(t, cmd.Flags().Set("catalog", tt.catalog))
+			}
+			err := applyCatalogFlags(cmd)
+			if tt.wantErr != "" {
+				assert.ExistsErr(t, err, tt.wantErr)
+				return
+			}
+			assert.NoErr(t, err)
+			_, ok := newCatalog(nil).(mongoCatalog)
+			assert.True(t, ok, "charts are stored in the datastore")
+			assert.True(t, postgresStore == nil, "documents are stored in the datastore")
+		})
+	}
+
+	t.Run("command without catalog", func(t *testing.T) {
+		assert.NoErr(t, applyCatalogFlags(&cobra.Command{}))
+	})
+}
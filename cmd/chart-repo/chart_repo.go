@@ -19,6 +19,8 @@ package main
 import (
 	"os"
 
+	"github.com/kubeapps/common/datastore"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -28,6 +30,10 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
 	},
+	// The PostgreSQL database is opened before running any command
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return applyCatalogFlags(cmd)
+	},
 }
 
 func main() {
@@ -38,16 +44,48 @@ func main() {
 }
 
 func init() {
-	cmds := []*cobra.Command{syncCmd, deleteCmd}
+	cmds := []*cobra.Command{syncCmd, syncGitCmd, deleteCmd, daemonCmd, gcCmd, rollbackCmd, setCredentialsCmd, deleteCredentialsCmd, rotateCredentialsCmd, workerCmd, exportCmd, importCmd}
 
 	for _, cmd := range cmds {
 		rootCmd.AddCommand(cmd)
 		cmd.Flags().String("mongo-url", "localhost", "MongoDB URL (see https://godoc.org/github.com/globalsign/mgo#Dial for format)")
 		cmd.Flags().String("mongo-database", "charts", "MongoDB database")
 		cmd.Flags().String("mongo-user", "", "MongoDB user")
+		addCatalogFlags(cmd)
 		// see version.go
 		cmd.Flags().StringVarP(&userAgentComment, "user-agent-comment", "", "", "UserAgent comment used during outbound requests")
 		cmd.Flags().Bool("debug", false, "verbose logging")
 	}
-	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(allInOneCmd, versionCmd)
+}
+
+// connectMongo connects to the database set by the flags of the command,
+// setting up logging on the way
+func connectMongo(cmd *cobra.Command) datastore.Session {
+	mongoURL, err := cmd.Flags().GetString("mongo-url")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	mongoDB, err := cmd.Flags().GetString("mongo-database")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	mongoUser, err := cmd.Flags().GetString("mongo-user")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	mongoPW := os.Getenv("MONGO_PASSWORD")
+	debug, err := cmd.Flags().GetBool("debug")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	mongoConfig := datastore.Config{URL: mongoURL, Database: mongoDB, Username: mongoUser, Password: mongoPW}
+	dbSession, err := newSession(mongoConfig)
+	if err != nil {
+		logrus.Fatalf("Can't connect to mongoDB: %v", err)
+	}
+	return dbSession
 }
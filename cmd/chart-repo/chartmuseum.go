@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"path"
+
+	helmrepo "k8s.io/helm/pkg/repo"
+)
+
+const chartMuseumSourceType = "chartmuseum"
+
+// chartMuseumSource is a ChartMuseum server, whose JSON API is used instead of
+// the index.yaml. The path of the repo URL is the tenant of multitenant
+// servers, e.g. https://chartmuseum.example.com/org1/repo1 for a server
+// started with --depth=2, so every tenant is synced as its own repo.
+// Tarballs and provenance files are downloaded like in any other repository.
+type chartMuseumSource struct {
+	httpSource
+}
+
+func newChartMuseumSource(r repo) (chartSource, error) {
+	return chartMuseumSource{httpSource{r}}, nil
+}
+
+func (s chartMuseumSource) index(lastIndex repoIndexInfo) (*helmrepo.IndexFile, repoIndexInfo, error) {
+	apiURL, err := parseRepoUrl(s.r.URL)
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	// The API of the tenant /org1/repo1 is served under /api/org1/repo1
+	apiURL.Path = path.Join("/api", apiURL.Path, "charts")
+	body, info, err := fetchRepoDocument(s.r, apiURL.String(), lastIndex)
+	if err != nil {
+		return nil, info, err
+	}
+
+	// The API returns the entries of the index, keyed by chart name
+	index := helmrepo.NewIndexFile()
+	if err := json.Unmarshal(body, &index.Entries); err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	index.SortEntries()
+	return index, info, nil
+}
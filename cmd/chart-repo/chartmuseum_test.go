@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+// newChartMuseumStub starts a server behaving like a multitenant ChartMuseum
+// (--depth=2), serving a mysql chart for each tenant
+func newChartMuseumStub(tenants ...string) *httptest.Server {
+	tarball := (&goodTarballClient{c: chart{Name: "mysql"}}).tarball()
+	mux := http.NewServeMux()
+	for _, tenant := range tenants {
+		tenant := tenant
+		mux.HandleFunc("/api/"+tenant+"/charts", func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Authorization") != "Basic dXNlcjpwYXNz" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"mysql": [
+  {"name": "mysql", "version": "1.1.0", "description": "MySQL for %s", "appVersion": "5.7", "urls": ["charts/mysql-1.1.0.tgz"], "created": "2018-12-11T10:00:00Z", "digest": "%s"},
+  {"name": "mysql", "version": "1.0.0", "description": "MySQL for %s", "urls": ["charts/mysql-1.0.0.tgz"], "created": "2018-12-10T10:00:00Z", "digest": "%s"}
+]}`, tenant, tarballDigest(tarball), tenant, tarballDigest(tarball))
+		})
+		mux.HandleFunc("/"+tenant+"/charts/", func(w http.ResponseWriter, req *http.Request) {
+			if !strings.HasSuffix(req.URL.Path, ".tgz") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(tarball)
+		})
+	}
+	// ChartMuseum doesn't serve an index for the root of multitenant servers
+	mux.HandleFunc("/index.yaml", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	return httptest.NewServer(mux)
+}
+
+func Test_chartMuseumSource(t *testing.T) {
+	server := newChartMuseumStub("org1/repo1", "org2/repo1")
+	defer server.Close()
+	netClient = server.Client()
+
+	r := repo{Name: "org2-charts", URL: server.URL + "/org2/repo1", SourceType: chartMuseumSourceType, AuthorizationHeader: "Basic dXNlcjpwYXNz"}
+	source, err := newChartSource(r)
+	assert.NoErr(t, err)
+
+	index, info, err := source.index(repoIndexInfo{})
+	assert.NoErr(t, err)
+	mysql := index.Entries["mysql"]
+	assert.Equal(t, len(mysql), 2, "number of mysql versions")
+	assert.Equal(t, mysql[0].Version, "1.1.0", "latest version")
+	assert.Equal(t, mysql[0].Description, "MySQL for org2/repo1", "description of the tenant chart")
+	assert.Equal(t, mysql[0].AppVersion, "5.7", "app version")
+	assert.Equal(t, mysql[0].Created, time.Date(2018, time.December, 11, 10, 0, 0, 0, time.UTC), "created")
+
+	_, _, err = source.index(info)
+	assert.Err(t, errIndexNotModified, err)
+
+	// The tarballs are relative to the tenant
+	charts := chartsFromIndex(index, r)
+	cv := charts[0].ChartVersions[0]
+	assert.Equal(t, chartTarballURL(r, cv), server.URL+"/org2/repo1/charts/mysql-1.1.0.tgz", "tarball URL")
+	dbSession := localstore.New()
+	err = fetchAndImportFiles(dbSession, "mysql", r, cv)
+	assert.NoErr(t, err)
+	id := chartFilesID(r, "mysql", cv.Version)
+	assert.Equal(t, getChartFiles(t, dbSession, id), chartFiles{id, testChartReadme, testChartValues, storedRepo(r), cv.Digest, nil}, "files")
+
+	// Unknown tenant
+	r.URL = server.URL + "/org3/repo1"
+	source, err = newChartSource(r)
+	assert.NoErr(t, err)
+	_, _, err = source.index(repoIndexInfo{})
+	assert.ExistsErr(t, err, "unknown tenant")
+}
@@ -0,0 +1,260 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	credentialsCollection = "credentials"
+	// Environment variable holding the credentials keys, when they aren't read
+	// from a file
+	credentialsKeysEnv = "CREDENTIALS_KEYS"
+)
+
+// storedCredentials are the encrypted credentials of a repo, keyed by the name
+// of the repo
+type storedCredentials struct {
+	ID string `bson:"_id"`
+	// ID of the key the credentials are encrypted with
+	KeyID      string    `bson:"keyid"`
+	Nonce      []byte    `bson:"nonce"`
+	Ciphertext []byte    `bson:"ciphertext"`
+	UpdatedAt  time.Time `bson:"updatedat"`
+}
+
+// repoSecrets are the credentials of a repo, stored encrypted
+type repoSecrets struct {
+	AuthorizationHeader string `json:"authorizationHeader"`
+}
+
+// credentialsKeys are the AES keys used to encrypt the stored credentials. The
+// first key encrypts new credentials, the others are only used to decrypt
+// credentials until they're rotated to the first key.
+type credentialsKeys []credentialsKey
+
+type credentialsKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// parseCredentialsKeys parses keys written one per line or separated by
+// commas, as <id>:<base64 encoded AES key>, e.g. to rotate from key 2018-12 to
+// key 2019-01:
+//
+//	2019-01:cGxlYXNlIGRvbid0IHVzZSB0aGlzIGtleSBhdCBhbGw=
+//	2018-12:dGhpcyBrZXkgaXMgb25seSBhbiBleGFtcGxlIGtleQ==
+func parseCredentialsKeys(data string) (credentialsKeys, error) {
+	var keys credentialsKeys
+	ids := map[string]bool{}
+	for _, line := range strings.FieldsFunc(data, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("credentials keys must be written as <id>:<base64 encoded key>")
+		}
+		id := parts[0]
+		if ids[id] {
+			return nil, fmt.Errorf("credentials key %s is listed more than once", id)
+		}
+		ids[id] = true
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("credentials key %s: %v", id, err)
+		}
+		// AES-128, AES-192 or AES-256 depending on the length of the key
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, fmt.Errorf("credentials key %s: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, credentialsKey{id, aead})
+	}
+	return keys, nil
+}
+
+// loadCredentialsKeys loads the keys from the file, or from the
+// CREDENTIALS_KEYS environment variable if no file is given. No keys means that
+// stored credentials aren't used.
+func loadCredentialsKeys(file string) (credentialsKeys, error) {
+	data := os.Getenv(credentialsKeysEnv)
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		data = string(b)
+	}
+	return parseCredentialsKeys(data)
+}
+
+func (keys credentialsKeys) current() (credentialsKey, error) {
+	if len(keys) == 0 {
+		return credentialsKey{}, errors.New("no credentials key, set --credentials-keys-file or " + credentialsKeysEnv)
+	}
+	return keys[0], nil
+}
+
+// encrypt encrypts the secrets of a repo with the current key. The name of the
+// repo is authenticated too, so that credentials can't be moved to another
+// repo.
+func (keys credentialsKeys) encrypt(repoName string, secrets repoSecrets) (storedCredentials, error) {
+	key, err := keys.current()
+	if err != nil {
+		return storedCredentials{}, err
+	}
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return storedCredentials{}, err
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return storedCredentials{}, err
+	}
+	return storedCredentials{
+		ID:         repoName,
+		KeyID:      key.id,
+		Nonce:      nonce,
+		Ciphertext: key.aead.Seal(nil, nonce, plaintext, []byte(repoName)),
+		UpdatedAt:  time.Now(),
+	}, nil
+}
+
+func (keys credentialsKeys) decrypt(c storedCredentials) (repoSecrets, error) {
+	for _, key := range keys {
+		if key.id != c.KeyID {
+			continue
+		}
+		if len(c.Nonce) != key.aead.NonceSize() {
+			return repoSecrets{}, fmt.Errorf("can't decrypt credentials of repo %s: invalid nonce", c.ID)
+		}
+		plaintext, err := key.aead.Open(nil, c.Nonce, c.Ciphertext, []byte(c.ID))
+		if err != nil {
+			return repoSecrets{}, fmt.Errorf("can't decrypt credentials of repo %s: %v", c.ID, err)
+		}
+		var secrets repoSecrets
+		err = json.Unmarshal(plaintext, &secrets)
+		return secrets, err
+	}
+	return repoSecrets{}, fmt.Errorf("credentials of repo %s are encrypted with unknown key %s", c.ID, c.KeyID)
+}
+
+func saveCredentials(dbSession datastore.Session, keys credentialsKeys, repoName string, secrets repoSecrets) error {
+	c, err := keys.encrypt(repoName, secrets)
+	if err != nil {
+		return err
+	}
+	db, closer := dbSession.DB()
+	defer closer()
+	_, err = db.C(credentialsCollection).UpsertId(c.ID, c)
+	return err
+}
+
+// loadCredentials returns the decrypted credentials of the repo, and false if
+// it has none
+func loadCredentials(dbSession datastore.Session, keys credentialsKeys, repoName string) (repoSecrets, bool, error) {
+	db, closer := dbSession.DB()
+	defer closer()
+	var c storedCredentials
+	err := db.C(credentialsCollection).FindId(repoName).One(&c)
+	if err == mgo.ErrNotFound {
+		return repoSecrets{}, false, nil
+	}
+	if err != nil {
+		return repoSecrets{}, false, err
+	}
+	secrets, err := keys.decrypt(c)
+	return secrets, err == nil, err
+}
+
+func deleteCredentials(dbSession datastore.Session, repoName string) error {
+	db, closer := dbSession.DB()
+	defer closer()
+	_, err := db.C(credentialsCollection).RemoveAll(bson.M{"_id": repoName})
+	return err
+}
+
+// rotateCredentials re-encrypts with the current key the credentials
+// encrypted with older keys, and returns the number of re-encrypted
+// credentials. Once done, the older keys can be removed.
+func rotateCredentials(dbSession datastore.Session, keys credentialsKeys) (int, error) {
+	key, err := keys.current()
+	if err != nil {
+		return 0, err
+	}
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var stale []storedCredentials
+	if err := db.C(credentialsCollection).Find(bson.M{"keyid": bson.M{"$ne": key.id}}).All(&stale); err != nil {
+		return 0, err
+	}
+	for _, c := range stale {
+		secrets, err := keys.decrypt(c)
+		if err != nil {
+			return 0, err
+		}
+		rotated, err := keys.encrypt(c.ID, secrets)
+		if err != nil {
+			return 0, err
+		}
+		log.WithFields(log.Fields{"repo": c.ID, "from": c.KeyID, "to": rotated.KeyID}).Debug("re-encrypting credentials")
+		if err := db.C(credentialsCollection).UpdateId(c.ID, rotated); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
+
+// withStoredCredentials sets the credentials stored for the repo, unless the
+// repo already has its own or no keys are configured
+func withStoredCredentials(dbSession datastore.Session, keys credentialsKeys, r repo) (repo, error) {
+	if len(keys) == 0 || r.AuthorizationHeader != "" {
+		return r, nil
+	}
+	secrets, ok, err := loadCredentials(dbSession, keys, r.Name)
+	if err != nil || !ok {
+		return r, err
+	}
+	log.WithFields(log.Fields{"repo": r.Name}).Debug("using stored credentials")
+	r.AuthorizationHeader = secrets.AuthorizationHeader
+	r.StoredCredentials = true
+	return r, nil
+}
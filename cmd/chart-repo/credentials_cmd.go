@@ -0,0 +1,124 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var setCredentialsCmd = &cobra.Command{
+	Use:   "set-credentials [REPO NAME]",
+	Short: "store the encrypted credentials of a chart repository, used when syncing it",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			logrus.Info("Need exactly one argument: [REPO NAME]")
+			cmd.Help()
+			return
+		}
+		keys := credentialsKeysFromFlags(cmd)
+		username, err := cmd.Flags().GetString("username")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		tokenFile, err := cmd.Flags().GetString("token-file")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		auth := repoAuthConfig{Header: os.Getenv("AUTHORIZATION_HEADER"), Username: username, TokenFile: tokenFile}
+		if username != "" {
+			auth.PasswordEnv = "REPO_PASSWORD"
+		}
+		if err := auth.validate(); err != nil {
+			logrus.Fatal(err)
+		}
+		header, err := auth.authorizationHeader()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if header == "" {
+			logrus.Fatal(errors.New("no credentials, set --username, --token-file or AUTHORIZATION_HEADER"))
+		}
+
+		dbSession := connectMongo(cmd)
+		if err := saveCredentials(dbSession, keys, args[0], repoSecrets{AuthorizationHeader: header}); err != nil {
+			logrus.Fatalf("Can't store the credentials of %s: %v", args[0], err)
+		}
+		logrus.Infof("Successfully stored the credentials of %s", args[0])
+	},
+}
+
+var deleteCredentialsCmd = &cobra.Command{
+	Use:   "delete-credentials [REPO NAME]",
+	Short: "delete the stored credentials of a chart repository",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			logrus.Info("Need exactly one argument: [REPO NAME]")
+			cmd.Help()
+			return
+		}
+		dbSession := connectMongo(cmd)
+		if err := deleteCredentials(dbSession, args[0]); err != nil {
+			logrus.Fatalf("Can't delete the credentials of %s: %v", args[0], err)
+		}
+		logrus.Infof("Successfully deleted the credentials of %s", args[0])
+	},
+}
+
+var rotateCredentialsCmd = &cobra.Command{
+	Use:   "rotate-credentials",
+	Short: "re-encrypt the stored credentials with the first credentials key",
+	Run: func(cmd *cobra.Command, args []string) {
+		keys := credentialsKeysFromFlags(cmd)
+		dbSession := connectMongo(cmd)
+		n, err := rotateCredentials(dbSession, keys)
+		if err != nil {
+			logrus.Fatalf("Can't rotate credentials: %v", err)
+		}
+		logrus.Infof("Re-encrypted the credentials of %d repositories", n)
+	},
+}
+
+func init() {
+	setCredentialsCmd.Flags().String("username", "", "username for basic authentication, the password is read from the REPO_PASSWORD environment variable")
+	setCredentialsCmd.Flags().String("token-file", "", "file containing a bearer token sent to the repo")
+	for _, cmd := range []*cobra.Command{setCredentialsCmd, rotateCredentialsCmd} {
+		addCredentialsKeysFlag(cmd)
+	}
+}
+
+// addCredentialsKeysFlag adds the flag setting the keys of the stored
+// credentials
+func addCredentialsKeysFlag(cmd *cobra.Command) {
+	cmd.Flags().String("credentials-keys-file", "", "file containing the keys used to encrypt the stored credentials, read from the "+credentialsKeysEnv+" environment variable if empty")
+}
+
+func credentialsKeysFromFlags(cmd *cobra.Command) credentialsKeys {
+	file, err := cmd.Flags().GetString("credentials-keys-file")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	keys, err := loadCredentialsKeys(file)
+	if err != nil {
+		logrus.Fatalf("Can't load credentials keys: %v", err)
+	}
+	return keys
+}
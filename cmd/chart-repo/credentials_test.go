@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+const (
+	// base64 encoded 256 bits keys
+	testCredentialsKey1 = "2018-12:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testCredentialsKey2 = "2019-01:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func mustParseCredentialsKeys(t *testing.T, data string) credentialsKeys {
+	keys, err := parseCredentialsKeys(data)
+	assert.NoErr(t, err)
+	return keys
+}
+
+func Test_parseCredentialsKeys(t *testing.T) {
+	keys := mustParseCredentialsKeys(t, "# current key first\n"+testCredentialsKey2+"\n"+testCredentialsKey1+"\n")
+	assert.Equal(t, len(keys), 2, "number of keys")
+	assert.Equal(t, keys[0].id, "2019-01", "current key")
+	keys = mustParseCredentialsKeys(t, testCredentialsKey2+","+testCredentialsKey1)
+	assert.Equal(t, len(keys), 2, "number of comma separated keys")
+	keys = mustParseCredentialsKeys(t, "")
+	assert.Equal(t, len(keys), 0, "no keys")
+
+	invalid := []string{
+		"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		"short:MDEyMzQ1Njc4OQ==",
+		"notbase64:***",
+		testCredentialsKey1 + "\n" + testCredentialsKey1,
+	}
+	for _, data := range invalid {
+		_, err := parseCredentialsKeys(data)
+		assert.ExistsErr(t, err, data)
+	}
+}
+
+func Test_credentialsKeysEncrypt(t *testing.T) {
+	keys := mustParseCredentialsKeys(t, testCredentialsKey1)
+	secrets := repoSecrets{AuthorizationHeader: "Basic dXNlcjpwYXNz"}
+	c, err := keys.encrypt("private", secrets)
+	assert.NoErr(t, err)
+	assert.Equal(t, c.ID, "private", "repo name")
+	assert.Equal(t, c.KeyID, "2018-12", "key ID")
+	assert.False(t, bytes.Contains(c.Ciphertext, []byte("dXNlcjpwYXNz")), "credentials are encrypted")
+
+	decrypted, err := keys.decrypt(c)
+	assert.NoErr(t, err)
+	assert.Equal(t, decrypted, secrets, "decrypted credentials")
+
+	// Credentials are bound to their repo
+	moved := c
+	moved.ID = "other"
+	_, err = keys.decrypt(moved)
+	assert.ExistsErr(t, err, "credentials of another repo")
+
+	_, err = mustParseCredentialsKeys(t, testCredentialsKey2).decrypt(c)
+	assert.ExistsErr(t, err, "unknown key")
+
+	_, err = credentialsKeys{}.encrypt("private", secrets)
+	assert.ExistsErr(t, err, "no keys")
+}
+
+func Test_rotateCredentials(t *testing.T) {
+	oldKeys := mustParseCredentialsKeys(t, testCredentialsKey1)
+	stale, err := oldKeys.encrypt("private", repoSecrets{AuthorizationHeader: "Bearer abc"})
+	assert.NoErr(t, err)
+
+	keys := mustParseCredentialsKeys(t, testCredentialsKey2+"\n"+testCredentialsKey1)
+	dbSession := localstore.New()
+	assert.NoErr(t, dbSession.Insert(credentialsCollection, stale))
+
+	n, err := rotateCredentials(dbSession, keys)
+	assert.NoErr(t, err)
+	assert.Equal(t, n, 1, "rotated credentials")
+	db, closer := dbSession.DB()
+	defer closer()
+	var rotated storedCredentials
+	assert.NoErr(t, db.C(credentialsCollection).FindId("private").One(&rotated))
+	assert.Equal(t, rotated.KeyID, "2019-01", "new key ID")
+
+	// The old key is no longer needed
+	secrets, err := mustParseCredentialsKeys(t, testCredentialsKey2).decrypt(rotated)
+	assert.NoErr(t, err)
+	assert.Equal(t, secrets.AuthorizationHeader, "Bearer abc", "rotated credentials")
+}
+
+func Test_withStoredCredentials(t *testing.T) {
+	keys := mustParseCredentialsKeys(t, testCredentialsKey1)
+	stored, err := keys.encrypt("private", repoSecrets{AuthorizationHeader: "Bearer abc"})
+	assert.NoErr(t, err)
+
+	dbSession := localstore.New()
+	assert.NoErr(t, dbSession.Insert(credentialsCollection, stored))
+	r, err := withStoredCredentials(dbSession, keys, repo{Name: "private"})
+	assert.NoErr(t, err)
+	assert.Equal(t, r.AuthorizationHeader, "Bearer abc", "stored credentials")
+	assert.True(t, r.StoredCredentials, "credentials flagged as stored")
+
+	// Credentials set in the config take precedence
+	r, err = withStoredCredentials(dbSession, keys, repo{Name: "private", AuthorizationHeader: "Bearer xyz"})
+	assert.NoErr(t, err)
+	assert.Equal(t, r.AuthorizationHeader, "Bearer xyz", "config credentials")
+	assert.False(t, r.StoredCredentials, "credentials not flagged as stored")
+
+	// Repos without stored credentials
+	r, err = withStoredCredentials(dbSession, keys, repo{Name: "public"})
+	assert.NoErr(t, err)
+	assert.Equal(t, r.AuthorizationHeader, "", "no credentials")
+}
+
+func Test_saveAndDeleteCredentials(t *testing.T) {
+	keys := mustParseCredentialsKeys(t, testCredentialsKey1)
+	dbSession := localstore.New()
+
+	assert.NoErr(t, saveCredentials(dbSession, keys, "private", repoSecrets{AuthorizationHeader: "Bearer abc"}))
+	secrets, found, err := loadCredentials(dbSession, keys, "private")
+	assert.NoErr(t, err)
+	assert.True(t, found, "credentials saved")
+	assert.Equal(t, secrets.AuthorizationHeader, "Bearer abc", "saved credentials")
+
+	assert.NoErr(t, deleteCredentials(dbSession, "private"))
+	_, found, err = loadCredentials(dbSession, keys, "private")
+	assert.NoErr(t, err)
+	assert.False(t, found, "credentials deleted")
+}
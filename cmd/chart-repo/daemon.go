@@ -0,0 +1,422 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const defaultSyncSchedule = "0 * * * *"
+
+// daemonConfig is the configuration file read by the daemon command, e.g.
+//
+//	repos:
+//	- name: stable
+//	  url: https://kubernetes-charts.storage.googleapis.com
+//	  schedule: "*/30 * * * *"
+//	- name: private
+//	  url: https://charts.example.com
+//	  auth:
+//	    username: monocular
+//	    passwordFile: /etc/monocular/private-repo/password
+//	  caFile: /etc/ssl/private-ca.crt
+//	  certFile: /etc/ssl/monocular.crt
+//	  keyFile: /etc/ssl/monocular.key
+type daemonConfig struct {
+	Repos []repoConfig `json:"repos"`
+}
+
+type repoConfig struct {
+	Name     string         `json:"name"`
+	URL      string         `json:"url"`
+	Schedule string         `json:"schedule"`
+	Auth     repoAuthConfig `json:"auth"`
+	// TLS configuration: CA bundle, client certificate and key for mutual TLS,
+	// and whether to skip the verification of the certificate of the repo
+	CAFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	Keyring            string `json:"keyring"`
+	// Use plain HTTP to talk to an OCI registry
+	PlainHTTP bool `json:"plainHTTP"`
+	// Type of the chart source, guessed from the URL if empty
+	SourceType string `json:"sourceType"`
+	// Ref and web interface of Git repositories
+	GitRef    string `json:"gitRef"`
+	GitWebURL string `json:"gitWebURL"`
+	// Copy the tarballs of the charts to the blob store, and serve them from
+	// chartsvc
+	Mirror bool `json:"mirror"`
+}
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "keep the chart repositories listed in a config file in sync",
+	Run: func(cmd *cobra.Command, args []string) {
+		configFile, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatal(err)
+		}
+		pollInterval, err := cmd.Flags().GetDuration("config-poll-interval")
+		if err != nil {
+			log.Fatal(err)
+		}
+		mongoURL, err := cmd.Flags().GetString("mongo-url")
+		if err != nil {
+			log.Fatal(err)
+		}
+		mongoDB, err := cmd.Flags().GetString("mongo-database")
+		if err != nil {
+			log.Fatal(err)
+		}
+		mongoUser, err := cmd.Flags().GetString("mongo-user")
+		if err != nil {
+			log.Fatal(err)
+		}
+		mongoPW := os.Getenv("MONGO_PASSWORD")
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+		if err := applyDownloadFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyLockFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyQueueFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyMirrorFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+
+		config, configData, err := loadDaemonConfig(configFile)
+		if err != nil {
+			log.Fatalf("Can't load config file %s: %v", configFile, err)
+		}
+
+		mongoConfig := datastore.Config{URL: mongoURL, Database: mongoDB, Username: mongoUser, Password: mongoPW}
+		dbSession, err := newSession(mongoConfig)
+		if err != nil {
+			log.Fatalf("Can't connect to mongoDB: %v", err)
+		}
+
+		s := newScheduler(dbSession)
+		if s.credentialsKeysFile, err = cmd.Flags().GetString("credentials-keys-file"); err != nil {
+			log.Fatal(err)
+		}
+		s.apply(config.Repos)
+		runScheduler(s, configFile, configData, pollInterval)
+	},
+}
+
+func init() {
+	daemonCmd.Flags().String("config", "repos.yaml", "path to the file listing the chart repositories to sync")
+	daemonCmd.Flags().Duration("config-poll-interval", 30*time.Second, "how often to check the config file for changes")
+	addDownloadFlags(daemonCmd)
+	addLockFlags(daemonCmd)
+	addQueueFlags(daemonCmd)
+	addMirrorFlags(daemonCmd)
+	addCredentialsKeysFlag(daemonCmd)
+}
+
+// runScheduler reloads the config file whenever it changes until the process
+// is interrupted, then stops the scheduler
+func runScheduler(s *scheduler, configFile string, configData []byte, pollInterval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			data, err := ioutil.ReadFile(configFile)
+			if err != nil {
+				log.WithError(err).Errorf("Can't read config file %s, keeping current config", configFile)
+				continue
+			}
+			if bytes.Equal(data, configData) {
+				continue
+			}
+			config, err := parseDaemonConfig(data)
+			if err != nil {
+				log.WithError(err).Errorf("Invalid config file %s, keeping current config", configFile)
+				continue
+			}
+			log.Infof("Config file %s changed, reloading", configFile)
+			configData = data
+			s.apply(config.Repos)
+		case sig := <-signals:
+			log.Infof("Received %s, waiting for running syncs to finish", sig)
+			s.stop()
+			return
+		}
+	}
+}
+
+func loadDaemonConfig(path string) (daemonConfig, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return daemonConfig{}, nil, err
+	}
+	config, err := parseDaemonConfig(data)
+	return config, data, err
+}
+
+func parseDaemonConfig(data []byte) (daemonConfig, error) {
+	var config daemonConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return daemonConfig{}, err
+	}
+
+	names := map[string]bool{}
+	for i := range config.Repos {
+		rc := &config.Repos[i]
+		if rc.Name == "" {
+			return daemonConfig{}, fmt.Errorf("repo #%d has no name", i+1)
+		}
+		if names[rc.Name] {
+			return daemonConfig{}, fmt.Errorf("repo %s is listed more than once", rc.Name)
+		}
+		names[rc.Name] = true
+		if err := rc.validate(); err != nil {
+			return daemonConfig{}, fmt.Errorf("repo %s: %v", rc.Name, err)
+		}
+		if rc.Schedule == "" {
+			rc.Schedule = defaultSyncSchedule
+		}
+		if _, err := parseSchedule(rc.Schedule); err != nil {
+			return daemonConfig{}, fmt.Errorf("repo %s: %v", rc.Name, err)
+		}
+	}
+	return config, nil
+}
+
+// repo returns the repo to sync, resolving the references to the environment
+// and files holding its credentials
+func (rc repoConfig) repo() (repo, error) {
+	header, err := rc.Auth.authorizationHeader()
+	if err != nil {
+		return repo{}, err
+	}
+	return repo{
+		Name:                rc.Name,
+		URL:                 rc.URL,
+		AuthorizationHeader: header,
+		CAFile:              rc.CAFile,
+		CertFile:            rc.CertFile,
+		KeyFile:             rc.KeyFile,
+		InsecureSkipVerify:  rc.InsecureSkipVerify,
+		Keyring:             rc.Keyring,
+		PlainHTTP:           rc.PlainHTTP,
+		SourceType:          rc.SourceType,
+		GitRef:              rc.GitRef,
+		GitWebURL:           rc.GitWebURL,
+		Mirror:              rc.Mirror,
+	}, nil
+}
+
+// validate checks the parts of the config that don't depend on the
+// environment
+func (rc repoConfig) validate() error {
+	if _, err := parseRepoUrl(rc.URL); err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if _, err := repoSourceType(repo{URL: rc.URL, SourceType: rc.SourceType}); err != nil {
+		return err
+	}
+	if err := rc.Auth.validate(); err != nil {
+		return err
+	}
+	if (rc.CertFile == "") != (rc.KeyFile == "") {
+		return errors.New("certFile and keyFile must be set together")
+	}
+	return nil
+}
+
+// scheduler runs the sync of each configured repo in its own goroutine,
+// following the schedule of the repo
+type scheduler struct {
+	dbSession datastore.Session
+	// sync and delete are overridden in tests
+	sync   func(datastore.Session, repo) error
+	delete func(datastore.Session, string) error
+	now    func() time.Time
+	// Keys of the stored credentials, read before every sync
+	credentialsKeysFile string
+
+	mutex sync.Mutex
+	jobs  map[string]*scheduledRepo
+	// Deletions of the repos removed from the config
+	deletions sync.WaitGroup
+}
+
+type scheduledRepo struct {
+	config repoConfig
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newScheduler(dbSession datastore.Session) *scheduler {
+	return &scheduler{
+		dbSession: dbSession,
+		sync:      syncRepoWithLease,
+		delete:    deleteRepoWithLease,
+		now:       time.Now,
+		jobs:      map[string]*scheduledRepo{},
+	}
+}
+
+// apply updates the scheduled repos to match the given list. New repos are
+// synced straight away, repos with a different config are restarted and
+// repos no longer listed are stopped and deleted from the database.
+func (s *scheduler) apply(repos []repoConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wanted := map[string]repoConfig{}
+	for _, rc := range repos {
+		wanted[rc.Name] = rc
+	}
+
+	// Jobs being replaced, the new job waits for the previous one to finish
+	replaced := map[string]*scheduledRepo{}
+	for name, job := range s.jobs {
+		rc, ok := wanted[name]
+		if ok && reflect.DeepEqual(rc, job.config) {
+			continue
+		}
+		close(job.stop)
+		delete(s.jobs, name)
+		replaced[name] = job
+		if !ok {
+			log.WithFields(log.Fields{"repo": name}).Info("repo removed from config")
+			s.deletions.Add(1)
+			go func(name string, job *scheduledRepo) {
+				defer s.deletions.Done()
+				<-job.done
+				if err := s.delete(s.dbSession, name); err != nil {
+					log.WithFields(log.Fields{"repo": name}).WithError(err).Error("failed to delete repo")
+				}
+			}(name, job)
+		}
+	}
+
+	for _, rc := range repos {
+		if _, ok := s.jobs[rc.Name]; ok {
+			continue
+		}
+		// The schedule has already been validated when parsing the config
+		sched, err := parseSchedule(rc.Schedule)
+		if err != nil {
+			log.WithFields(log.Fields{"repo": rc.Name}).WithError(err).Error("invalid schedule")
+			continue
+		}
+		job := &scheduledRepo{config: rc, stop: make(chan struct{}), done: make(chan struct{})}
+		s.jobs[rc.Name] = job
+		log.WithFields(log.Fields{"repo": rc.Name, "schedule": rc.Schedule}).Info("scheduling repo sync")
+		go s.run(job, sched, replaced[rc.Name])
+	}
+}
+
+// stop stops all the scheduled repos, waiting for running syncs and
+// deletions to finish
+func (s *scheduler) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, job := range s.jobs {
+		close(job.stop)
+		<-job.done
+		delete(s.jobs, name)
+	}
+	s.deletions.Wait()
+}
+
+func (s *scheduler) run(job *scheduledRepo, sched schedule, previous *scheduledRepo) {
+	defer close(job.done)
+	if previous != nil {
+		<-previous.done
+	}
+
+	for {
+		s.syncOnce(job.config)
+
+		next := sched.Next(s.now())
+		if next.IsZero() {
+			log.WithFields(log.Fields{"repo": job.config.Name}).Error("schedule never matches, stopping")
+			return
+		}
+		log.WithFields(log.Fields{"repo": job.config.Name, "next": next}).Debug("waiting for next sync")
+		timer := time.NewTimer(next.Sub(s.now()))
+		select {
+		case <-timer.C:
+		case <-job.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (s *scheduler) syncOnce(rc repoConfig) {
+	r, err := rc.repo()
+	if err == nil {
+		r, err = s.withStoredCredentials(r)
+	}
+	if err == nil {
+		log.WithFields(log.Fields{"repo": rc.Name}).Info("syncing repo")
+		err = s.sync(s.dbSession, r)
+	}
+	if err == errSyncSkipped {
+		// The holder of the lease has been logged already
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"repo": rc.Name}).WithError(err).Error("failed to sync repo")
+		return
+	}
+	log.WithFields(log.Fields{"repo": rc.Name}).Info("successfully synced repo")
+}
+
+// withStoredCredentials sets the stored credentials of the repo, if it doesn't
+// have its own. The keys are loaded every time so that rotated keys are used
+// without a restart.
+func (s *scheduler) withStoredCredentials(r repo) (repo, error) {
+	keys, err := loadCredentialsKeys(s.credentialsKeysFile)
+	if err != nil {
+		return repo{}, err
+	}
+	return withStoredCredentials(s.dbSession, keys, r)
+}
@@ -0,0 +1,210 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/kubeapps/common/datastore"
+)
+
+func Test_parseDaemonConfig(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		config, err := parseDaemonConfig([]byte(`
+repos:
+- name: stable
+  url: https://kubernetes-charts.storage.googleapis.com
+- name: private
+  url: https://charts.example.com
+  schedule: "*/5 * * * *"
+  auth:
+    headerEnv: PRIVATE_AUTH
+  caFile: /etc/ssl/ca.crt
+`))
+		assert.NoErr(t, err)
+		assert.Equal(t, len(config.Repos), 2, "number of repos")
+		assert.Equal(t, config.Repos[0].Schedule, defaultSyncSchedule, "default schedule")
+		assert.Equal(t, config.Repos[1], repoConfig{
+			Name:     "private",
+			URL:      "https://charts.example.com",
+			Schedule: "*/5 * * * *",
+			Auth:     repoAuthConfig{HeaderEnv: "PRIVATE_AUTH"},
+			CAFile:   "/etc/ssl/ca.crt",
+		}, "repo config")
+	})
+
+	invalid := []struct {
+		name   string
+		config string
+	}{
+		{"not yaml", "repos: ["},
+		{"missing name", "repos: [{url: 'https://charts.example.com'}]"},
+		{"duplicated name", "repos: [{name: a, url: 'https://a.com'}, {name: a, url: 'https://b.com'}]"},
+		{"invalid url", "repos: [{name: a, url: 'not-a-url'}]"},
+		{"invalid schedule", "repos: [{name: a, url: 'https://a.com', schedule: 'often'}]"},
+		{"unknown source type", "repos: [{name: a, url: 'https://a.com', sourceType: svn}]"},
+		{"username without password", "repos: [{name: a, url: 'https://a.com', auth: {username: user}}]"},
+		{"several auth methods", "repos: [{name: a, url: 'https://a.com', auth: {headerEnv: AUTH, tokenFile: /token}}]"},
+		{"certificate without key", "repos: [{name: a, url: 'https://a.com', certFile: /etc/ssl/client.crt}]"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDaemonConfig([]byte(tt.config))
+			assert.ExistsErr(t, err, tt.name)
+		})
+	}
+}
+
+func Test_repoConfigRepo(t *testing.T) {
+	rc := repoConfig{Name: "private", URL: "https://charts.example.com", Auth: repoAuthConfig{HeaderEnv: "TEST_REPO_AUTHORIZATION_HEADER"}}
+	_, err := rc.repo()
+	assert.ExistsErr(t, err, "unset environment variable")
+
+	os.Setenv("TEST_REPO_AUTHORIZATION_HEADER", "Bearer ThisSecretAccessTokenAuthenticatesTheClient")
+	defer os.Unsetenv("TEST_REPO_AUTHORIZATION_HEADER")
+	r, err := rc.repo()
+	assert.NoErr(t, err)
+	assert.Equal(t, r, repo{Name: "private", URL: "https://charts.example.com", AuthorizationHeader: "Bearer ThisSecretAccessTokenAuthenticatesTheClient"}, "repo")
+
+	rc = repoConfig{
+		Name:               "private",
+		URL:                "https://charts.example.com",
+		Auth:               repoAuthConfig{Username: "user", PasswordEnv: "TEST_REPO_PASSWORD"},
+		CAFile:             "/etc/ssl/ca.crt",
+		CertFile:           "/etc/ssl/client.crt",
+		KeyFile:            "/etc/ssl/client.key",
+		InsecureSkipVerify: true,
+	}
+	os.Setenv("TEST_REPO_PASSWORD", "pass")
+	defer os.Unsetenv("TEST_REPO_PASSWORD")
+	r, err = rc.repo()
+	assert.NoErr(t, err)
+	assert.Equal(t, r, repo{
+		Name:                "private",
+		URL:                 "https://charts.example.com",
+		AuthorizationHeader: "Basic dXNlcjpwYXNz",
+		CAFile:              "/etc/ssl/ca.crt",
+		CertFile:            "/etc/ssl/client.crt",
+		KeyFile:             "/etc/ssl/client.key",
+		InsecureSkipVerify:  true,
+	}, "repo with basic authentication and mutual TLS")
+}
+
+// fakeSyncs records the syncs and deletions performed by a scheduler
+type fakeSyncs struct {
+	synced  chan repo
+	deleted chan string
+}
+
+func newTestScheduler() (*scheduler, *fakeSyncs) {
+	f := &fakeSyncs{synced: make(chan repo, 10), deleted: make(chan string, 10)}
+	s := newScheduler(localstore.New())
+	s.sync = func(_ datastore.Session, r repo) error {
+		// Don't block the scheduler if the test doesn't consume the syncs
+		select {
+		case f.synced <- r:
+		default:
+		}
+		return nil
+	}
+	s.delete = func(_ datastore.Session, name string) error {
+		f.deleted <- name
+		return nil
+	}
+	return s, f
+}
+
+func expectSync(t *testing.T, f *fakeSyncs, name string) {
+	select {
+	case r := <-f.synced:
+		assert.Equal(t, r.Name, name, "synced repo")
+	case <-time.After(time.Second):
+		t.Fatalf("repo %s wasn't synced", name)
+	}
+}
+
+func Test_schedulerApply(t *testing.T) {
+	s, f := newTestScheduler()
+	defer s.stop()
+
+	stable := repoConfig{Name: "stable", URL: "https://stable.example.com", Schedule: "@hourly"}
+	incubator := repoConfig{Name: "incubator", URL: "https://incubator.example.com", Schedule: "@hourly"}
+
+	// New repos are synced straight away
+	s.apply([]repoConfig{stable})
+	expectSync(t, f, "stable")
+
+	// Unchanged repos aren't restarted
+	s.apply([]repoConfig{stable, incubator})
+	expectSync(t, f, "incubator")
+	assert.Equal(t, len(f.synced), 0, "pending syncs")
+
+	// Changed repos are restarted
+	stable.URL = "https://new-stable.example.com"
+	s.apply([]repoConfig{stable, incubator})
+	expectSync(t, f, "stable")
+
+	// Removed repos are deleted
+	s.apply([]repoConfig{stable})
+	select {
+	case name := <-f.deleted:
+		assert.Equal(t, name, "incubator", "deleted repo")
+	case <-time.After(time.Second):
+		t.Fatal("repo incubator wasn't deleted")
+	}
+	assert.Equal(t, len(s.jobs), 1, "scheduled repos")
+}
+
+func Test_schedulerStopWaitsForDeletions(t *testing.T) {
+	s, f := newTestScheduler()
+	deleted := make(chan string, 1)
+	s.delete = func(_ datastore.Session, name string) error {
+		time.Sleep(20 * time.Millisecond)
+		deleted <- name
+		return nil
+	}
+
+	s.apply([]repoConfig{{Name: "stable", URL: "https://stable.example.com", Schedule: "@hourly"}})
+	expectSync(t, f, "stable")
+	s.apply(nil)
+	s.stop()
+	assert.Equal(t, len(deleted), 1, "finished deletions")
+}
+
+func Test_schedulerRun(t *testing.T) {
+	s, f := newTestScheduler()
+	defer s.stop()
+
+	// Pretend every sync takes a minute, so the next one is due immediately
+	now := time.Date(2018, time.December, 11, 10, 0, 0, 0, time.UTC)
+	var mutex sync.Mutex
+	s.now = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now = now.Add(time.Minute)
+		return now
+	}
+
+	s.apply([]repoConfig{{Name: "stable", URL: "https://stable.example.com", Schedule: "* * * * *"}})
+	expectSync(t, f, "stable")
+	expectSync(t, f, "stable")
+}
@@ -54,11 +54,11 @@ var deleteCmd = &cobra.Command{
 			logrus.SetLevel(logrus.DebugLevel)
 		}
 		mongoConfig := datastore.Config{URL: mongoURL, Database: mongoDB, Username: mongoUser, Password: mongoPW}
-		dbSession, err := datastore.NewSession(mongoConfig)
+		dbSession, err := newSession(mongoConfig)
 		if err != nil {
 			logrus.Fatalf("Can't connect to mongoDB: %v", err)
 		}
-		if err = deleteRepo(dbSession, args[0]); err != nil {
+		if err = deleteRepoWithLease(dbSession, args[0]); err != nil {
 			logrus.Fatalf("Can't delete chart repository %s from database: %v", args[0], err)
 		}
 
@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	helmrepo "k8s.io/helm/pkg/repo"
+)
+
+const fileScheme = "file"
+
+// dirSource is a directory of chart tarballs, e.g. file:///srv/charts, with
+// or without an index.yaml
+type dirSource struct {
+	r   repo
+	dir string
+}
+
+func newDirSource(r repo) (chartSource, error) {
+	u, err := url.Parse(strings.TrimSpace(r.URL))
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("no directory in URL %s", r.URL)
+	}
+	return dirSource{r: r, dir: filepath.FromSlash(u.Path)}, nil
+}
+
+// index reads the index.yaml of the directory, or builds the index from the
+// tarballs found in the directory and its subdirectories if there's none
+func (s dirSource) index(lastIndex repoIndexInfo) (*helmrepo.IndexFile, repoIndexInfo, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "index.yaml"))
+	if err == nil {
+		info := repoIndexInfo{Checksum: fmt.Sprintf("%x", sha256.Sum256(data))}
+		if lastIndex.Checksum != "" && info.Checksum == lastIndex.Checksum {
+			return nil, info, errIndexNotModified
+		}
+		index, err := parseRepoIndex(data)
+		if err != nil {
+			return nil, repoIndexInfo{}, err
+		}
+		return index, info, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, repoIndexInfo{}, err
+	}
+
+	// Loading every tarball is expensive, so only do it if any of them changed
+	archives, err := s.archives()
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	checksum := sha256.New()
+	for _, a := range archives {
+		fmt.Fprintf(checksum, "%s %d %d\n", a.path, a.info.Size(), a.info.ModTime().UnixNano())
+	}
+	info := repoIndexInfo{Checksum: fmt.Sprintf("%x", checksum.Sum(nil))}
+	if lastIndex.Checksum != "" && info.Checksum == lastIndex.Checksum {
+		return nil, info, errIndexNotModified
+	}
+
+	log.WithFields(log.Fields{"repo": s.r.Name, "dir": s.dir}).Info("no index.yaml, building index from the chart tarballs")
+	index, err := helmrepo.IndexDirectory(s.dir, "")
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	// The creation time of the chart versions is the time the index is built,
+	// use the modification time of the tarballs instead
+	modTimes := map[string]os.FileInfo{}
+	for _, a := range archives {
+		modTimes[a.path] = a.info
+	}
+	for _, versions := range index.Entries {
+		for _, cv := range versions {
+			if fi, ok := modTimes[filepath.FromSlash(cv.URLs[0])]; ok {
+				cv.Created = fi.ModTime()
+			}
+		}
+	}
+	index.SortEntries()
+	return index, info, nil
+}
+
+type archive struct {
+	// Path relative to the directory of the source
+	path string
+	info os.FileInfo
+}
+
+// archives lists the tarballs that would be indexed by helmrepo.IndexDirectory
+func (s dirSource) archives() ([]archive, error) {
+	var paths []string
+	for _, pattern := range []string{"*.tgz", "*/*.tgz"} {
+		matches, err := filepath.Glob(filepath.Join(s.dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	var archives []archive
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return nil, err
+		}
+		archives = append(archives, archive{rel, fi})
+	}
+	return archives, nil
+}
+
+// chartPath returns the path of the tarball of a chart version. URLs of other
+// schemes, e.g. in an index.yaml copied from a remote repository, refer to a
+// tarball of the same name in the directory.
+func (s dirSource) chartPath(cv chartVersion) string {
+	ref := cv.URLs[0]
+	u, err := url.Parse(ref)
+	if err != nil {
+		return filepath.Join(s.dir, filepath.FromSlash(ref))
+	}
+	if u.Scheme == fileScheme {
+		return filepath.FromSlash(u.Path)
+	}
+	if u.IsAbs() {
+		return filepath.Join(s.dir, path.Base(u.Path))
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(u.Path))
+}
+
+func (s dirSource) openTarball(name string, cv chartVersion) (io.ReadCloser, error) {
+	return os.Open(s.chartPath(cv))
+}
+
+func (s dirSource) openProvenance(cv chartVersion) (io.ReadCloser, error) {
+	f, err := os.Open(s.chartPath(cv) + ".prov")
+	if os.IsNotExist(err) {
+		return nil, errFileNotFound
+	}
+	return f, err
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+// writeTestChart packages a chart into the directory and returns the tarball
+func writeTestChart(t *testing.T, dir, name, version string) []byte {
+	var b bytes.Buffer
+	gzw := gzip.NewWriter(&b)
+	createTestTarball(gzw, []tarballFile{
+		{name + "/Chart.yaml", fmt.Sprintf("name: %s\nversion: %s\ndescription: chart from a directory\n", name, version)},
+		{name + "/values.yaml", testChartValues},
+		{name + "/README.md", testChartReadme},
+	})
+	gzw.Close()
+	assert.NoErr(t, os.MkdirAll(dir, 0700))
+	assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%s-%s.tgz", name, version)), b.Bytes(), 0600))
+	return b.Bytes()
+}
+
+func Test_dirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-repo-test")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	mysql := writeTestChart(t, dir, "mysql", "1.0.0")
+	writeTestChart(t, dir, "mysql", "1.1.0")
+	writeTestChart(t, filepath.Join(dir, "incubator"), "redis", "0.1.0")
+	created := time.Date(2018, time.December, 11, 10, 0, 0, 0, time.UTC)
+	assert.NoErr(t, os.Chtimes(filepath.Join(dir, "mysql-1.0.0.tgz"), created, created))
+
+	r := repo{Name: "local", URL: "file://" + dir}
+	source, err := newChartSource(r)
+	assert.NoErr(t, err)
+
+	t.Run("without index", func(t *testing.T) {
+		index, info, err := source.index(repoIndexInfo{})
+		assert.NoErr(t, err)
+		assert.Equal(t, len(index.Entries), 2, "number of charts")
+		versions := index.Entries["mysql"]
+		assert.Equal(t, len(versions), 2, "number of mysql versions")
+		assert.Equal(t, versions[1].Version, "1.0.0", "oldest mysql version")
+		assert.Equal(t, versions[1].Digest, tarballDigest(mysql), "digest")
+		assert.Equal(t, versions[1].Created.UTC(), created, "created")
+		assert.Equal(t, index.Entries["redis"][0].URLs, []string{"incubator/redis-0.1.0.tgz"}, "URLs of chart in subdirectory")
+
+		_, _, err = source.index(info)
+		assert.Err(t, errIndexNotModified, err)
+
+		// Adding a tarball changes the index
+		writeTestChart(t, dir, "mysql", "1.2.0")
+		defer os.Remove(filepath.Join(dir, "mysql-1.2.0.tgz"))
+		index, _, err = source.index(info)
+		assert.NoErr(t, err)
+		assert.Equal(t, len(index.Entries["mysql"]), 3, "number of mysql versions")
+	})
+
+	t.Run("tarballs", func(t *testing.T) {
+		f, err := source.openTarball("mysql", chartVersion{URLs: []string{"mysql-1.0.0.tgz"}})
+		assert.NoErr(t, err)
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		assert.NoErr(t, err)
+		assert.Equal(t, data, mysql, "relative tarball")
+
+		// Indexes copied from remote repositories refer to their own URLs
+		f, err = source.openTarball("mysql", chartVersion{URLs: []string{"https://charts.example.com/mysql-1.0.0.tgz"}})
+		assert.NoErr(t, err)
+		f.Close()
+
+		_, err = source.openProvenance(chartVersion{URLs: []string{"mysql-1.0.0.tgz"}})
+		assert.Err(t, errFileNotFound, err)
+	})
+
+	t.Run("with index", func(t *testing.T) {
+		indexYAML := []byte("apiVersion: v1\nentries:\n  mysql:\n  - name: mysql\n    version: 1.0.0\n    urls:\n    - https://charts.example.com/mysql-1.0.0.tgz\n")
+		assert.NoErr(t, ioutil.WriteFile(filepath.Join(dir, "index.yaml"), indexYAML, 0600))
+		defer os.Remove(filepath.Join(dir, "index.yaml"))
+		index, info, err := source.index(repoIndexInfo{})
+		assert.NoErr(t, err)
+		assert.Equal(t, len(index.Entries), 1, "number of charts")
+		_, _, err = source.index(info)
+		assert.Err(t, errIndexNotModified, err)
+	})
+}
+
+func Test_fetchAndImportFilesDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-repo-test")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	tarball := writeTestChart(t, dir, "mysql", "1.0.0")
+
+	r := repo{Name: "local", URL: "file://" + dir}
+	cv := chartVersion{Version: "1.0.0", URLs: []string{"mysql-1.0.0.tgz"}, Digest: tarballDigest(tarball)}
+	dbSession := localstore.New()
+	err = fetchAndImportFiles(dbSession, "mysql", r, cv)
+	assert.NoErr(t, err)
+	id := chartFilesID(r, "mysql", cv.Version)
+	assert.Equal(t, getChartFiles(t, dbSession, id), chartFiles{id, testChartReadme, testChartValues, storedRepo(r), cv.Digest, nil}, "files")
+}
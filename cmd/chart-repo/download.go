@@ -0,0 +1,304 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// downloadConfig controls the requests made on behalf of the repos
+type downloadConfig struct {
+	// Number of charts imported concurrently
+	workers int
+	// Maximum number of concurrent requests to the same host
+	maxRequestsPerHost int
+	connectTimeout     time.Duration
+	// Maximum time without receiving any data from the server
+	readTimeout time.Duration
+	// Requests failing with transient errors are retried with an exponential
+	// backoff, starting at retryBaseDelay
+	maxRetries     int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	// Responses asking to retry later than this aren't retried
+	maxRetryAfter time.Duration
+}
+
+var defaultDownloadConfig = downloadConfig{
+	workers:            10,
+	maxRequestsPerHost: 10,
+	connectTimeout:     10 * time.Second,
+	readTimeout:        30 * time.Second,
+	maxRetries:         3,
+	retryBaseDelay:     500 * time.Millisecond,
+	retryMaxDelay:      30 * time.Second,
+	maxRetryAfter:      5 * time.Minute,
+}
+
+var downloads = defaultDownloadConfig
+
+// addDownloadFlags adds the flags setting the download config
+func addDownloadFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("workers", defaultDownloadConfig.workers, "number of charts imported concurrently")
+	cmd.Flags().Int("max-requests-per-host", defaultDownloadConfig.maxRequestsPerHost, "maximum number of concurrent requests to the same host")
+	cmd.Flags().Duration("connect-timeout", defaultDownloadConfig.connectTimeout, "timeout for establishing connections to the repos")
+	cmd.Flags().Duration("read-timeout", defaultDownloadConfig.readTimeout, "timeout for receiving data from the repos")
+	cmd.Flags().Int("max-retries", defaultDownloadConfig.maxRetries, "number of times requests failing with a transient error are retried")
+}
+
+// applyDownloadFlags sets the download config from the flags of the command
+func applyDownloadFlags(cmd *cobra.Command) error {
+	var err error
+	config := defaultDownloadConfig
+	if config.workers, err = cmd.Flags().GetInt("workers"); err != nil {
+		return err
+	}
+	if config.maxRequestsPerHost, err = cmd.Flags().GetInt("max-requests-per-host"); err != nil {
+		return err
+	}
+	if config.connectTimeout, err = cmd.Flags().GetDuration("connect-timeout"); err != nil {
+		return err
+	}
+	if config.readTimeout, err = cmd.Flags().GetDuration("read-timeout"); err != nil {
+		return err
+	}
+	if config.maxRetries, err = cmd.Flags().GetInt("max-retries"); err != nil {
+		return err
+	}
+	if config.workers < 1 || config.maxRequestsPerHost < 1 {
+		return errors.New("--workers and --max-requests-per-host must be at least 1")
+	}
+
+	downloads = config
+	// Clients are created with the download config in use at the time
+	client, err := initNetClient(additionalCAFile)
+	if err != nil {
+		return err
+	}
+	netClient = client
+	repoNetClientsMutex.Lock()
+	repoNetClients = map[repoTLSConfig]httpClient{}
+	repoNetClientsMutex.Unlock()
+	return nil
+}
+
+// newTransport returns the transport of the clients, applying the download
+// config
+func newTransport(base *http.Transport) http.RoundTripper {
+	config := downloads
+	dialer := &net.Dialer{Timeout: config.connectTimeout, KeepAlive: 30 * time.Second}
+	base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || config.readTimeout <= 0 {
+			return conn, err
+		}
+		return &readTimeoutConn{conn, config.readTimeout}, nil
+	}
+	base.TLSHandshakeTimeout = config.connectTimeout
+	base.IdleConnTimeout = 90 * time.Second
+	return &retryTransport{transport: base, config: config}
+}
+
+// readTimeoutConn fails reads that don't receive anything for a while, unlike
+// a timeout of the whole request which would fail the download of large
+// tarballs on slow connections
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *readTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// retryTransport retries requests failing with transient errors, and limits
+// the number of concurrent requests to each host
+type retryTransport struct {
+	transport http.RoundTripper
+	config    downloadConfig
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		release, err := hostSlots.acquire(req.Context(), req.URL.Host, t.config.maxRequestsPerHost)
+		if err != nil {
+			return nil, err
+		}
+		res, err := t.transport.RoundTrip(req)
+
+		delay, retry := t.retryDelay(req, res, err, attempt)
+		if !retry {
+			if err != nil {
+				release()
+				return nil, err
+			}
+			// The slot is held until the body has been read
+			res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+			return res, nil
+		}
+		fields := log.Fields{"url": req.URL.String(), "attempt": attempt + 1, "delay": delay}
+		if err != nil {
+			log.WithFields(fields).WithError(err).Info("request failed, retrying")
+		} else {
+			fields["status"] = res.StatusCode
+			log.WithFields(fields).Info("request failed, retrying")
+			// Drain the body so that the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+			res.Body.Close()
+		}
+		release()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying the request, if it
+// should be retried at all
+func (t *retryTransport) retryDelay(req *http.Request, res *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= t.config.maxRetries || req.Context().Err() != nil {
+		return 0, false
+	}
+	// Only requests that can be sent again are retried
+	if (req.Method != "GET" && req.Method != "HEAD") || (req.Body != nil && req.Body != http.NoBody) {
+		return 0, false
+	}
+	if err != nil {
+		return t.backoff(attempt), transientError(err)
+	}
+	if res.StatusCode != http.StatusTooManyRequests && (res.StatusCode < 500 || res.StatusCode == http.StatusNotImplemented) {
+		return 0, false
+	}
+	if after, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+		return after, after <= t.config.maxRetryAfter
+	}
+	return t.backoff(attempt), true
+}
+
+// backoff returns the exponential delay before a retry, with half of it
+// randomized so that clients don't retry all at the same time
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.config.retryBaseDelay << uint(attempt)
+	if delay > t.config.retryMaxDelay || delay <= 0 {
+		delay = t.config.retryMaxDelay
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number
+// of seconds or a date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		delay := time.Until(t)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// transientError returns whether the error of a request may not happen again,
+// e.g. a connection reset or a timeout, unlike invalid certificates
+func transientError(err error) bool {
+	switch err := err.(type) {
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return false
+	case *net.OpError:
+		// Connection refused or reset, and timeouts
+		return err.Op == "dial" || err.Op == "read" || err.Timeout()
+	case net.Error:
+		return err.Timeout() || err.Temporary()
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// hostLimiter limits the number of concurrent requests to each host
+type hostLimiter struct {
+	mutex sync.Mutex
+	slots map[string]chan struct{}
+}
+
+var hostSlots = &hostLimiter{slots: map[string]chan struct{}{}}
+
+// acquire waits for a slot to send a request to the host, and returns the
+// function releasing it
+func (l *hostLimiter) acquire(ctx context.Context, host string, limit int) (func(), error) {
+	l.mutex.Lock()
+	slots, ok := l.slots[host]
+	if !ok || cap(slots) != limit {
+		slots = make(chan struct{}, limit)
+		l.slots[host] = slots
+	}
+	l.mutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+// releasingBody releases the slot of the request once its body has been read
+// or closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,170 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+// testDownloadClient returns a client using the download config, with short
+// retry delays
+func testDownloadClient(config downloadConfig) *http.Client {
+	config.retryBaseDelay = time.Millisecond
+	config.retryMaxDelay = 10 * time.Millisecond
+	previous := downloads
+	downloads = config
+	defer func() { downloads = previous }()
+	return &http.Client{Transport: newTransport(&http.Transport{})}
+}
+
+func Test_retryTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		retryAfter string
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"success", []int{200}, "", 200, 1},
+		{"transient errors", []int{502, 503, 200}, "", 200, 3},
+		{"rate limited", []int{429, 200}, "0", 200, 2},
+		{"retries exhausted", []int{500, 500, 500, 500, 500}, "", 500, 4},
+		{"not found", []int{404, 200}, "", 404, 1},
+		{"not implemented", []int{501, 200}, "", 501, 1},
+		{"retry after too long", []int{429, 200}, "3600", 429, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer server.Close()
+
+			client := testDownloadClient(defaultDownloadConfig)
+			res, err := client.Get(server.URL)
+			assert.NoErr(t, err)
+			res.Body.Close()
+			assert.Equal(t, res.StatusCode, tt.wantStatus, "status")
+			assert.Equal(t, atomic.LoadInt32(&calls), tt.wantCalls, "requests sent")
+		})
+	}
+}
+
+func Test_retryTransportConnectionErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	config := defaultDownloadConfig
+	config.maxRetries = 2
+	client := testDownloadClient(config)
+	_, err := client.Get(url)
+	assert.ExistsErr(t, err, "connection refused")
+}
+
+func Test_maxRequestsPerHost(t *testing.T) {
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	config := defaultDownloadConfig
+	config.maxRequestsPerHost = 2
+	client := testDownloadClient(config)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL)
+			if err == nil {
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, maxRunning, 2, "concurrent requests")
+}
+
+func Test_readTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	config := defaultDownloadConfig
+	config.readTimeout = 50 * time.Millisecond
+	config.maxRetries = 0
+	client := testDownloadClient(config)
+	res, err := client.Get(server.URL)
+	assert.NoErr(t, err)
+	defer res.Body.Close()
+	_, err = ioutil.ReadAll(res.Body)
+	assert.ExistsErr(t, err, "stalled download")
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	delay, ok := parseRetryAfter("120")
+	assert.True(t, ok, "seconds")
+	assert.Equal(t, delay, 2*time.Minute, "delay")
+
+	delay, ok = parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, ok, "date")
+	assert.True(t, delay > 59*time.Minute && delay <= time.Hour, "delay until date")
+
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok, "invalid value")
+}
+
+func Test_backoff(t *testing.T) {
+	tr := &retryTransport{config: defaultDownloadConfig}
+	for attempt := 0; attempt < 10; attempt++ {
+		max := defaultDownloadConfig.retryBaseDelay << uint(attempt)
+		if max > defaultDownloadConfig.retryMaxDelay {
+			max = defaultDownloadConfig.retryMaxDelay
+		}
+		delay := tr.backoff(attempt)
+		assert.True(t, delay >= max/2 && delay <= max, "delay within bounds")
+	}
+}
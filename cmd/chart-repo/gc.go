@@ -0,0 +1,200 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Number of documents removed by each query during garbage collection
+const gcBatchSize = 1000
+
+// Blobs stored more recently are kept even if no chart version references
+// them, as the sync that stored them may not have recorded them yet
+const blobGracePeriod = time.Hour
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "remove chart files, charts and mirrored blobs that no longer belong to any chart repository",
+	Run: func(cmd *cobra.Command, args []string) {
+		pruneUnknownRepos, err := cmd.Flags().GetBool("prune-unknown-repos")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		mongoURL, err := cmd.Flags().GetString("mongo-url")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		mongoDB, err := cmd.Flags().GetString("mongo-database")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		mongoUser, err := cmd.Flags().GetString("mongo-user")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		mongoPW := os.Getenv("MONGO_PASSWORD")
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		if err := applyMirrorFlags(cmd); err != nil {
+			logrus.Fatal(err)
+		}
+		mongoConfig := datastore.Config{URL: mongoURL, Database: mongoDB, Username: mongoUser, Password: mongoPW}
+		dbSession, err := newSession(mongoConfig)
+		if err != nil {
+			logrus.Fatalf("Can't connect to mongoDB: %v", err)
+		}
+
+		if pruneUnknownRepos {
+			n, err := gcCharts(dbSession)
+			if err != nil {
+				logrus.Fatalf("Can't remove charts of unknown repositories: %v", err)
+			}
+			logrus.Infof("Removed %d charts of unknown repositories", n)
+		}
+
+		n, err := gcChartFiles(dbSession)
+		if err != nil {
+			logrus.Fatalf("Can't remove orphaned chart files: %v", err)
+		}
+		logrus.Infof("Removed %d orphaned chart files", n)
+
+		// Blobs stored in MongoDB before --blob-dir was set are removed too
+		stores := []blobStore{gridFSBlobStore{dbSession}}
+		if blobDir != "" {
+			stores = append(stores, dirBlobStore{blobDir})
+		}
+		for _, store := range stores {
+			n, err := gcBlobs(dbSession, store, time.Now().Add(-blobGracePeriod))
+			if err != nil {
+				logrus.Fatalf("Can't remove orphaned blobs: %v", err)
+			}
+			logrus.Infof("Removed %d orphaned blobs", n)
+		}
+	},
+}
+
+func init() {
+	gcCmd.Flags().Bool("prune-unknown-repos", false, "also remove the charts of repositories that have never been synced by this version of chart-repo or have been deleted")
+	addMirrorFlags(gcCmd)
+}
+
+// gcCharts removes the charts of repositories missing from the repos collection
+func gcCharts(dbSession datastore.Session) (int, error) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var repos []repoStatus
+	if err := db.C(reposCollection).Find(nil).Select(bson.M{"_id": 1}).All(&repos); err != nil {
+		return 0, err
+	}
+	repoNames := []string{}
+	for _, r := range repos {
+		repoNames = append(repoNames, r.ID)
+	}
+
+	return newCatalog(dbSession).deleteOtherRepos(repoNames)
+}
+
+// gcChartFiles removes the files whose chart version can't be found in the
+// catalog
+func gcChartFiles(dbSession datastore.Session) (int, error) {
+	charts, err := newCatalog(dbSession).listCharts("")
+	if err != nil {
+		return 0, err
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+	ids := map[string]bool{}
+	for _, c := range charts {
+		for _, cv := range c.ChartVersions {
+			ids[chartFilesID(chartGeneration(c), c.Name, cv.Version)] = true
+		}
+	}
+
+	var files []chartFiles
+	if err := db.C(chartFilesCollection).Find(nil).Select(bson.M{"_id": 1}).All(&files); err != nil {
+		return 0, err
+	}
+	var orphans []string
+	for _, f := range files {
+		if !ids[f.ID] {
+			orphans = append(orphans, f.ID)
+		}
+	}
+
+	removed := len(orphans)
+	for len(orphans) > 0 {
+		batch := orphans
+		if len(batch) > gcBatchSize {
+			batch = batch[:gcBatchSize]
+		}
+		orphans = orphans[len(batch):]
+		logrus.WithFields(logrus.Fields{"count": len(batch)}).Debug("removing orphaned chart files")
+		if _, err := db.C(chartFilesCollection).RemoveAll(bson.M{"_id": bson.M{"$in": batch}}); err != nil {
+			return 0, err
+		}
+	}
+	return removed, nil
+}
+
+// gcBlobs removes the blobs of the store stored before the given time that no
+// chart version of any generation references
+func gcBlobs(dbSession datastore.Session, store blobStore, before time.Time) (int, error) {
+	charts, err := newCatalog(dbSession).listCharts("")
+	if err != nil {
+		return 0, err
+	}
+	referenced := map[string]bool{}
+	for _, c := range charts {
+		for _, cv := range c.ChartVersions {
+			if cv.Mirror != nil {
+				referenced[cv.Mirror.Tarball] = true
+				referenced[cv.Mirror.Provenance] = true
+			}
+		}
+	}
+
+	blobs, err := store.list()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for digest, stored := range blobs {
+		if referenced[digest] || !stored.Before(before) {
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"digest": digest}).Debug("removing orphaned blob")
+		if err := store.remove(digest); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+func Test_pruneChartFiles(t *testing.T) {
+	dbSession := localstore.New()
+	assert.NoErr(t, dbSession.Insert(chartFilesCollection,
+		chartFiles{ID: "test/wordpress-1.0.0@2", Repo: repo{Name: "test"}},
+		chartFiles{ID: "test/wordpress-0.8.0@2", Repo: repo{Name: "test"}},
+		chartFiles{ID: "test/wordpress-1.0.0@1", Repo: repo{Name: "test"}},
+		chartFiles{ID: "test/mysql-2.0.0", Repo: repo{Name: "test"}},
+		chartFiles{ID: "other/wordpress-0.8.0", Repo: repo{Name: "other"}},
+	))
+	charts := []chart{
+		{Name: "wordpress", Generation: 2, ChartVersions: []chartVersion{{Version: "1.0.0"}, {Version: "0.9.0"}}},
+		// Chart written before generations existed
+		{Name: "mysql", ChartVersions: []chartVersion{{Version: "2.0.0"}}},
+	}
+
+	err := pruneChartFiles(dbSession, "test", charts)
+	assert.NoErr(t, err)
+	assert.Equal(t, documentIDs(t, dbSession, chartFilesCollection), []string{"test/wordpress-1.0.0@2", "test/mysql-2.0.0", "other/wordpress-0.8.0"}, "files kept")
+}
+
+func Test_gcChartFiles(t *testing.T) {
+	dbSession := localstore.New()
+	assert.NoErr(t, dbSession.Insert(chartCollection,
+		chart{ID: "stable/wordpress", Name: "wordpress", Repo: repo{Name: "stable"}, ChartVersions: []chartVersion{{Version: "1.0.0"}}},
+		chart{ID: "bitnami/wordpress", Name: "wordpress", Repo: repo{Name: "bitnami"}, ChartVersions: []chartVersion{{Version: "2.0.0"}}},
+	))
+	assert.NoErr(t, dbSession.Insert(chartFilesCollection,
+		chartFiles{ID: "stable/wordpress-1.0.0"},
+		chartFiles{ID: "stable/wordpress-0.9.0"},
+		chartFiles{ID: "bitnami/wordpress-2.0.0"},
+		chartFiles{ID: "deleted/mysql-1.0.0"},
+	))
+
+	n, err := gcChartFiles(dbSession)
+	assert.NoErr(t, err)
+	assert.Equal(t, n, 2, "removed files")
+	assert.Equal(t, documentIDs(t, dbSession, chartFilesCollection), []string{"stable/wordpress-1.0.0", "bitnami/wordpress-2.0.0"}, "files kept")
+}
+
+func Test_gcCharts(t *testing.T) {
+	dbSession := localstore.New()
+	for _, name := range []string{"stable", "incubator"} {
+		assert.NoErr(t, updateRepoStatus(dbSession, repoStatus{ID: name}))
+	}
+	assert.NoErr(t, dbSession.Insert(chartCollection,
+		chart{ID: "stable/wordpress", Name: "wordpress", Repo: repo{Name: "stable"}},
+		chart{ID: "deleted/mysql", Name: "mysql", Repo: repo{Name: "deleted"}},
+		chart{ID: "incubator/kafka", Name: "kafka", Repo: repo{Name: "incubator"}},
+	))
+
+	n, err := gcCharts(dbSession)
+	assert.NoErr(t, err)
+	assert.Equal(t, n, 1, "removed charts")
+	assert.Equal(t, documentIDs(t, dbSession, chartCollection), []string{"stable/wordpress", "incubator/kafka"}, "charts kept")
+}
+
+func Test_gcBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-repo-blobs")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	dbSession := localstore.New()
+
+	for name, store := range map[string]blobStore{"dir": dirBlobStore{dir}, "gridfs": gridFSBlobStore{dbSession}} {
+		t.Run(name, func(t *testing.T) {
+			digests := map[string]string{}
+			for _, content := range []string{"tarball", "provenance", "old tarball"} {
+				digest, err := store.put(bytes.NewReader([]byte(content)), "")
+				assert.NoErr(t, err)
+				digests[content] = digest
+			}
+			// The blobs are referenced by any generation of the repo
+			assert.NoErr(t, dbSession.Insert(chartCollection, chart{
+				ID: "stable/mysql@1-" + name, Name: "mysql", Repo: repo{Name: "stable"}, Generation: 1,
+				ChartVersions: []chartVersion{{Version: "1.0.0", Mirror: &mirroredFiles{Tarball: digests["tarball"], Provenance: digests["provenance"]}}},
+			}))
+
+			// Blobs stored during the grace period are kept
+			n, err := gcBlobs(dbSession, store, time.Now().Add(-time.Hour))
+			assert.NoErr(t, err)
+			assert.Equal(t, n, 0, "removed blobs")
+
+			n, err = gcBlobs(dbSession, store, time.Now().Add(time.Second))
+			assert.NoErr(t, err)
+			assert.Equal(t, n, 1, "removed blobs")
+			for content, digest := range digests {
+				ok, err := store.has(digest)
+				assert.NoErr(t, err)
+				assert.Equal(t, ok, content != "old tarball", "blob of the "+content+" kept")
+			}
+		})
+	}
+	assert.Equal(t, documentIDs(t, dbSession, blobChunksCollection), []string{
+		sha256Hex([]byte("tarball")) + "/0", sha256Hex([]byte("provenance")) + "/0",
+	}, "chunks kept")
+}
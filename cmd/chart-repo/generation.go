@@ -0,0 +1,111 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+)
+
+// chartDocID returns the ID of the document of a chart in the generation of
+// the repo. Charts written before generations existed have no generation in
+// their ID.
+func chartDocID(r repo, name string) string {
+	if r.Generation == 0 {
+		return fmt.Sprintf("%s/%s", r.Name, name)
+	}
+	return fmt.Sprintf("%s/%s@%d", r.Name, name, r.Generation)
+}
+
+// activeChartsQuery selects the charts of the active generation of the repo
+func activeChartsQuery(status repoStatus) bson.M {
+	if status.Generation == 0 {
+		// Charts written before generations existed
+		return bson.M{"repo.name": status.ID, "generation": bson.M{"$exists": false}}
+	}
+	return bson.M{"repo.name": status.ID, "generation": status.Generation}
+}
+
+// removeOldGenerations removes the charts of the generations of the repo
+// other than the active and previous ones, and the files only they used
+func removeOldGenerations(dbSession datastore.Session, status repoStatus) error {
+	catalog := newCatalog(dbSession)
+	keep := []int64{status.Generation}
+	if status.PreviousGeneration != 0 {
+		keep = append(keep, status.PreviousGeneration)
+	}
+	// Charts without a generation are removed too
+	if err := catalog.deleteCharts(status.ID, keep...); err != nil {
+		return err
+	}
+
+	charts, err := catalog.listCharts(status.ID)
+	if err != nil {
+		return err
+	}
+	return pruneChartFiles(dbSession, status.ID, charts)
+}
+
+// rollbackRepo makes the previous generation of the repo active again, and
+// removes the generation rolled back from. The next sync imports the index
+// again, as a new generation. It waits for the running sync of the repo to
+// finish.
+func rollbackRepo(dbSession datastore.Session, repoName string) (repoStatus, error) {
+	var status repoStatus
+	err := withRepoLease(dbSession, repoName, exclusiveLocks(), func(*heldLease) error {
+		var err error
+		status, err = rollbackGeneration(dbSession, repoName)
+		return err
+	})
+	return status, err
+}
+
+// rollbackGeneration rolls back the repo, while holding its lease
+func rollbackGeneration(dbSession datastore.Session, repoName string) (repoStatus, error) {
+	status, err := getRepoStatus(dbSession, repoName)
+	if err != nil {
+		return repoStatus{}, err
+	}
+	if status.PreviousGeneration == 0 {
+		return repoStatus{}, fmt.Errorf("repo %s has no previous generation to roll back to", repoName)
+	}
+
+	charts, err := newCatalog(dbSession).listGeneration(repoName, status.PreviousGeneration)
+	if err != nil {
+		return repoStatus{}, err
+	}
+	if len(charts) == 0 {
+		return repoStatus{}, fmt.Errorf("generation %d of repo %s has been removed", status.PreviousGeneration, repoName)
+	}
+
+	log.WithFields(log.Fields{"repo": repoName, "from": status.Generation, "to": status.PreviousGeneration}).Info("rolling back repo")
+	status.Generation, status.PreviousGeneration = status.PreviousGeneration, 0
+	status.Index = repoIndexInfo{}
+	status.ChartCount = len(charts)
+	status.VersionCount = 0
+	for _, c := range charts {
+		status.VersionCount += len(c.ChartVersions)
+	}
+	if err := updateRepoStatus(dbSession, status); err != nil {
+		return repoStatus{}, err
+	}
+	// Only the generation rolled back to is kept
+	return status, removeOldGenerations(dbSession, status)
+}
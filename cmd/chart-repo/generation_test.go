@@ -0,0 +1,234 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+func Test_chartDocID(t *testing.T) {
+	assert.Equal(t, chartDocID(repo{Name: "stable"}, "mysql"), "stable/mysql", "without generation")
+	assert.Equal(t, chartDocID(repo{Name: "stable", Generation: 3}, "mysql"), "stable/mysql@3", "with generation")
+}
+
+// newSingleChartRepo serves an index with a single chart, or an index without
+// valid charts if broken is set
+func newSingleChartRepo(broken *bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if *broken {
+			fmt.Fprint(w, "apiVersion: v1\nentries:\n  mysql:\n  - name: mysql\n    version: 1.0.0\n")
+			return
+		}
+		fmt.Fprintf(w, `apiVersion: v1
+entries:
+  mysql:
+  - name: mysql
+    version: 1.0.0
+    urls: [mysql-1.0.0.tgz]
+    digest: %s
+    created: 2018-12-11T10:00:00Z
+`, testDigest)
+	}))
+}
+
+func Test_syncRepoGenerations(t *testing.T) {
+	broken := false
+	server := newSingleChartRepo(&broken)
+	defer server.Close()
+	netClient = server.Client()
+
+	lastSync := repoStatus{ID: "test", URL: server.URL, Status: repoSyncSucceeded, Generation: 2, PreviousGeneration: 1}
+	newStore := func() *localstore.Store {
+		store := localstore.New()
+		assert.NoErr(t, updateRepoStatus(store, lastSync))
+		r := repo{Name: "test", URL: server.URL}
+		assert.NoErr(t, store.Insert(chartCollection,
+			chart{ID: "test/mysql@1", Name: "mysql", Repo: r, Generation: 1},
+			chart{ID: "test/mysql@2", Name: "mysql", Repo: r, Generation: 2, ChartVersions: []chartVersion{{Version: "1.0.0", Digest: testDigest}}},
+		))
+		// The files have already been imported
+		assert.NoErr(t, store.Insert(chartFilesCollection, chartFiles{ID: "test/mysql-1.0.0@2", Repo: r, Digest: testDigest}))
+		return store
+	}
+
+	t.Run("new generation", func(t *testing.T) {
+		store := newStore()
+		err := syncRepo(store, repo{Name: "test", URL: server.URL}, nil)
+		assert.NoErr(t, err)
+
+		status, err := getRepoStatus(store, "test")
+		assert.NoErr(t, err)
+		assert.Equal(t, status.Generation, int64(3), "active generation")
+		assert.Equal(t, status.PreviousGeneration, int64(2), "previous generation")
+
+		// The charts are written to the next generation, and the generations
+		// older than the previous one are removed
+		assert.Equal(t, documentIDs(t, store, chartCollection), []string{"test/mysql@2", "test/mysql@3"}, "charts")
+		c, err := newCatalog(store).getChart("test/mysql@3")
+		assert.NoErr(t, err)
+		assert.Equal(t, c.Generation, int64(3), "chart generation")
+		assert.Equal(t, documentIDs(t, store, jobsCollection), []string{}, "import jobs removed")
+		// The files of the unchanged version are copied to the new generation
+		assert.Equal(t, documentIDs(t, store, chartFilesCollection), []string{"test/mysql-1.0.0@2", "test/mysql-1.0.0@3"}, "files")
+	})
+
+	t.Run("failed sync", func(t *testing.T) {
+		broken = true
+		defer func() { broken = false }()
+		store := newStore()
+		err := syncRepo(store, repo{Name: "test", URL: server.URL}, nil)
+		assert.ExistsErr(t, err, "no valid charts")
+
+		// The active generation is kept
+		assert.Equal(t, documentIDs(t, store, chartCollection), []string{"test/mysql@1", "test/mysql@2"}, "charts")
+		status, err := getRepoStatus(store, "test")
+		assert.NoErr(t, err)
+		assert.Equal(t, status.Status, repoSyncFailed, "status")
+		assert.Equal(t, status.Generation, int64(2), "active generation")
+		assert.Equal(t, status.PreviousGeneration, int64(1), "previous generation")
+	})
+
+	t.Run("lease lost", func(t *testing.T) {
+		store := newStore()
+		config := lockConfig{mode: lockModeFail, ttl: time.Hour}
+		err := withRepoLease(store, "test", config, func(held *heldLease) error {
+			takeOverLease(t, store, "test")
+			return syncRepo(store, repo{Name: "test", URL: server.URL}, held)
+		})
+		assert.Err(t, errLeaseLost, err)
+
+		// The new generation isn't activated
+		status, err := getRepoStatus(store, "test")
+		assert.NoErr(t, err)
+		assert.Equal(t, status.Generation, int64(2), "active generation")
+		assert.True(t, status.LastSyncStart.IsZero(), "status left untouched")
+	})
+}
+
+func Test_rollbackRepo(t *testing.T) {
+	current := repoStatus{ID: "test", Status: repoSyncSucceeded, Generation: 3, PreviousGeneration: 2, ChartCount: 1, VersionCount: 1, Index: repoIndexInfo{Checksum: "abc"}}
+	dbSession := localstore.New()
+	assert.NoErr(t, updateRepoStatus(dbSession, current))
+	r := repo{Name: "test"}
+	assert.NoErr(t, dbSession.Insert(chartCollection,
+		chart{ID: "test/wordpress@2", Name: "wordpress", Repo: r, Generation: 2, ChartVersions: []chartVersion{{Version: "1.0.0"}, {Version: "0.9.0"}}},
+		chart{ID: "test/mysql@2", Name: "mysql", Repo: r, Generation: 2, ChartVersions: []chartVersion{{Version: "2.0.0"}}},
+		chart{ID: "test/wordpress@3", Name: "wordpress", Repo: r, Generation: 3, ChartVersions: []chartVersion{{Version: "1.1.0"}}},
+	))
+	assert.NoErr(t, dbSession.Insert(chartFilesCollection,
+		chartFiles{ID: "test/wordpress-1.0.0@2", Repo: r},
+		chartFiles{ID: "test/wordpress-1.1.0@3", Repo: r},
+	))
+
+	// The rollback waits for the running sync
+	other := newLease("test", time.Hour)
+	assert.NoErr(t, tryAcquireLease(dbSession, other))
+	locks.pollInterval = 5 * time.Millisecond
+	defer func() { locks = defaultLockConfig }()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		releaseLease(dbSession, other)
+	}()
+
+	status, err := rollbackRepo(dbSession, "test")
+	assert.NoErr(t, err)
+	assert.Equal(t, status.Generation, int64(2), "active generation")
+	assert.Equal(t, status.PreviousGeneration, int64(0), "previous generation")
+	assert.Equal(t, status.Index, repoIndexInfo{}, "index info reset")
+	assert.Equal(t, status.ChartCount, 2, "chart count")
+	assert.Equal(t, status.VersionCount, 3, "version count")
+	stored, err := getRepoStatus(dbSession, "test")
+	assert.NoErr(t, err)
+	assert.Equal(t, stored.Generation, int64(2), "stored active generation")
+
+	// The generation rolled back from is removed, along with its files
+	assert.Equal(t, documentIDs(t, dbSession, chartCollection), []string{"test/wordpress@2", "test/mysql@2"}, "charts")
+	assert.Equal(t, documentIDs(t, dbSession, chartFilesCollection), []string{"test/wordpress-1.0.0@2"}, "files")
+	_, held := getLease(t, dbSession, "test")
+	assert.False(t, held, "lease released")
+
+	// There's nothing to roll back to anymore
+	_, err = rollbackRepo(dbSession, "test")
+	assert.ExistsErr(t, err, "no previous generation")
+}
+
+func Test_rollbackRepoFiles(t *testing.T) {
+	newTarball := func(readme string) []byte {
+		var b bytes.Buffer
+		gzw := gzip.NewWriter(&b)
+		createTestTarball(gzw, []tarballFile{{"mysql/Chart.yaml", "name: mysql"}, {"mysql/README.md", readme}})
+		gzw.Close()
+		return b.Bytes()
+	}
+	var mu sync.Mutex
+	tarballs := map[string][]byte{
+		"mysql-0.9.0.tgz": newTarball("first release"),
+		"mysql-1.0.0.tgz": newTarball("original README"),
+	}
+	downloads := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.URL.Path == "/index.yaml" {
+			fmt.Fprint(w, "apiVersion: v1\nentries:\n  mysql:\n")
+			for _, v := range []string{"1.0.0", "0.9.0"} {
+				fmt.Fprintf(w, "  - name: mysql\n    version: %s\n    urls: [mysql-%s.tgz]\n    digest: %s\n    created: 2018-12-11T10:00:00Z\n", v, v, tarballDigest(tarballs["mysql-"+v+".tgz"]))
+			}
+			return
+		}
+		name := path.Base(req.URL.Path)
+		downloads[name]++
+		w.Write(tarballs[name])
+	}))
+	defer server.Close()
+	netClient = server.Client()
+	dbSession := localstore.New()
+	r := repo{Name: "test", URL: server.URL}
+	assert.NoErr(t, syncRepo(dbSession, r, nil))
+
+	// The README of a version changes, along with its digest
+	mu.Lock()
+	tarballs["mysql-1.0.0.tgz"] = newTarball("updated README")
+	mu.Unlock()
+	assert.NoErr(t, syncRepo(dbSession, r, nil))
+	assert.Equal(t, getChartFiles(t, dbSession, "test/mysql-1.0.0@2").Readme, "updated README", "README of the new generation")
+	assert.Equal(t, getChartFiles(t, dbSession, "test/mysql-1.0.0@1").Readme, "original README", "README of the previous generation")
+	mu.Lock()
+	assert.Equal(t, downloads, map[string]int{"mysql-0.9.0.tgz": 1, "mysql-1.0.0.tgz": 2}, "downloads")
+	mu.Unlock()
+
+	// The files of the generation rolled back to are served again, and the
+	// files of the generation rolled back from are removed
+	_, err := rollbackRepo(dbSession, "test")
+	assert.NoErr(t, err)
+	assert.Equal(t, getChartFiles(t, dbSession, "test/mysql-1.0.0@1").Readme, "original README", "README after rollback")
+	ids := documentIDs(t, dbSession, chartFilesCollection)
+	sort.Strings(ids)
+	assert.Equal(t, ids, []string{"test/mysql-0.9.0@1", "test/mysql-1.0.0@1"}, "files")
+}
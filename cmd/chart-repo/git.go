@@ -0,0 +1,314 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	log "github.com/sirupsen/logrus"
+	helmchart "k8s.io/helm/pkg/proto/hapi/chart"
+	helmrepo "k8s.io/helm/pkg/repo"
+)
+
+const (
+	gitSourceType = "git"
+	// Scheme of the URLs of the chart versions found in a Git repository, e.g.
+	// git+file:///src/charts@stable/mysql?ref=<commit>
+	gitScheme = "git+file"
+)
+
+// gitSource indexes the unpackaged charts of a Git repository, as found in the
+// tree of a ref. Every commit changing the version in the Chart.yaml of a chart
+// is a chart version, and its tarball is built from the tree of that commit.
+type gitSource struct {
+	r repo
+	// Path of the clone or bare repository
+	dir string
+	ref string
+}
+
+func newGitSource(r repo) (chartSource, error) {
+	ref := r.GitRef
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return gitSource{r: r, dir: strings.TrimSpace(r.URL), ref: ref}, nil
+}
+
+func (s gitSource) git(args ...string) ([]byte, error) {
+	return s.gitWithInput(nil, args...)
+}
+
+func (s gitSource) gitWithInput(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", s.dir}, args...)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (s gitSource) index(lastIndex repoIndexInfo) (*helmrepo.IndexFile, repoIndexInfo, error) {
+	out, err := s.git("rev-parse", "--verify", s.ref+"^{commit}")
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	commit := strings.TrimSpace(string(out))
+	// The index only depends on the history of the ref
+	info := repoIndexInfo{Checksum: commit}
+	if lastIndex.Checksum != "" && info.Checksum == lastIndex.Checksum {
+		return nil, info, errIndexNotModified
+	}
+
+	out, err = s.git("ls-tree", "-r", "--name-only", "-z", commit)
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	index := helmrepo.NewIndexFile()
+	for _, file := range strings.Split(string(out), "\x00") {
+		if path.Base(file) != "Chart.yaml" {
+			continue
+		}
+		chartDir := path.Dir(file)
+		versions, err := s.chartVersions(commit, chartDir)
+		if err != nil {
+			return nil, repoIndexInfo{}, err
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		name := versions[len(versions)-1].Name
+		if _, ok := index.Entries[name]; ok {
+			log.WithFields(log.Fields{"name": name, "path": chartDir}).Warn("skipping chart with the same name as another one")
+			continue
+		}
+		index.Entries[name] = versions
+	}
+	index.SortEntries()
+	return index, info, nil
+}
+
+// chartVersions returns a chart version for each commit that changed the
+// version of the chart in the given directory, up to the given commit
+func (s gitSource) chartVersions(commit, chartDir string) (helmrepo.ChartVersions, error) {
+	chartFile := path.Join(chartDir, "Chart.yaml")
+	out, err := s.git("log", "--reverse", "--format=%H %ct", commit, "--", chartFile)
+	if err != nil {
+		return nil, err
+	}
+
+	type chartCommit struct {
+		commit    string
+		timestamp string
+		md        helmchart.Metadata
+	}
+	var commits []chartCommit
+	seen := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		c, timestamp := fields[0], fields[1]
+		data, err := s.git("show", c+":"+chartFile)
+		if err != nil {
+			// Chart.yaml was deleted by this commit
+			continue
+		}
+		var md helmchart.Metadata
+		if err := yaml.Unmarshal(data, &md); err != nil || md.Name == "" || md.Version == "" {
+			log.WithFields(log.Fields{"path": chartFile, "commit": c}).Debug("skipping invalid Chart.yaml")
+			continue
+		}
+		if seen[md.Version] {
+			continue
+		}
+		seen[md.Version] = true
+		commits = append(commits, chartCommit{c, timestamp, md})
+	}
+	if len(commits) == 0 {
+		return nil, nil
+	}
+
+	// The chart keeps the name it has at the indexed commit, and the tarballs
+	// of all its versions are rooted at that name, like the files imported
+	// from them expect
+	name := commits[len(commits)-1].md.Name
+	var versions helmrepo.ChartVersions
+	for _, cc := range commits {
+		md := cc.md
+		md.Name = name
+		tarball, err := s.archive(cc.commit, chartDir, name)
+		if err != nil {
+			return nil, err
+		}
+		link := s.link(cc.commit, chartDir)
+		md.Home = link
+		md.Sources = append([]string{link}, md.Sources...)
+		cv := &helmrepo.ChartVersion{
+			Metadata: &md,
+			URLs:     []string{fmt.Sprintf("%s://%s@%s?ref=%s", gitScheme, s.dir, chartDir, cc.commit)},
+			Digest:   fmt.Sprintf("%x", sha256.Sum256(tarball)),
+		}
+		if t, err := strconv.ParseInt(cc.timestamp, 10, 64); err == nil {
+			cv.Created = time.Unix(t, 0).UTC()
+		}
+		versions = append(versions, cv)
+	}
+	return versions, nil
+}
+
+// link returns the link to the chart directory at a commit, in the web
+// interface of the repository if any
+func (s gitSource) link(commit, chartDir string) string {
+	ref := commit
+	// Prefer the name of a tag pointing at the commit
+	if out, err := s.git("tag", "--points-at", commit); err == nil {
+		if tags := strings.Fields(string(out)); len(tags) > 0 {
+			ref = tags[0]
+		}
+	}
+	if s.r.GitWebURL != "" {
+		return fmt.Sprintf("%s/tree/%s/%s", strings.TrimSuffix(s.r.GitWebURL, "/"), ref, chartDir)
+	}
+	return fmt.Sprintf("%s://%s@%s?ref=%s", gitScheme, s.dir, chartDir, ref)
+}
+
+// archive packages the chart directory at a commit. The tarball only depends
+// on the content of the tree, so packaging it again gives the same digest.
+func (s gitSource) archive(commit, chartDir, name string) ([]byte, error) {
+	out, err := s.git("ls-tree", "-r", "-z", commit+":"+chartDir)
+	if err != nil {
+		return nil, err
+	}
+	type blob struct {
+		mode int64
+		hash string
+		path string
+	}
+	var blobs []blob
+	var hashes bytes.Buffer
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> <type> <hash>\t<path>
+		tab := strings.Index(entry, "\t")
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(entry[:tab])
+		// Skip submodules
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		mode, err := strconv.ParseInt(fields[0], 8, 64)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob{mode, fields[2], entry[tab+1:]})
+		fmt.Fprintln(&hashes, fields[2])
+	}
+
+	contents, err := s.gitWithInput(&hashes, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	gzw := gzip.NewWriter(&b)
+	tarw := tar.NewWriter(gzw)
+	for _, bl := range blobs {
+		// <hash> blob <size>\n<content>\n
+		nl := bytes.IndexByte(contents, '\n')
+		if nl < 0 {
+			return nil, fmt.Errorf("unexpected output of git cat-file for %s", bl.hash)
+		}
+		header := strings.Fields(string(contents[:nl]))
+		if len(header) != 3 {
+			return nil, fmt.Errorf("can't read %s: %s", bl.hash, contents[:nl])
+		}
+		size, err := strconv.Atoi(header[2])
+		if err != nil || nl+1+size > len(contents) {
+			return nil, fmt.Errorf("unexpected output of git cat-file for %s", bl.hash)
+		}
+		data := contents[nl+1 : nl+1+size]
+		contents = bytes.TrimPrefix(contents[nl+1+size:], []byte("\n"))
+
+		hdr := &tar.Header{Name: name + "/" + bl.path, Mode: bl.mode & 0777, ModTime: time.Unix(0, 0)}
+		if bl.mode&0170000 == 0120000 {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(data)
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(size)
+		}
+		if err := tarw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tarw.Write(data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tarw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// openTarball packages the chart directory at the commit of the chart version,
+// rooted at the name of the chart in the index, which is the name it has at the
+// indexed commit even if the chart was renamed since the version
+func (s gitSource) openTarball(name string, cv chartVersion) (io.ReadCloser, error) {
+	u, err := url.Parse(cv.URLs[0])
+	if err != nil {
+		return nil, err
+	}
+	i := strings.LastIndex(u.Path, "@")
+	if u.Scheme != gitScheme || i < 0 {
+		return nil, fmt.Errorf("invalid chart URL %s", cv.URLs[0])
+	}
+	chartDir := u.Path[i+1:]
+	commit := u.Query().Get("ref")
+	tarball, err := s.archive(commit, chartDir, name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(tarball)), nil
+}
+
+// Charts in Git repositories aren't signed
+func (s gitSource) openProvenance(cv chartVersion) (io.ReadCloser, error) {
+	return nil, errFileNotFound
+}
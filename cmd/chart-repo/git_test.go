@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+// testGitRepo is a Git repository created for a test
+type testGitRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestGitRepo(t *testing.T) *testGitRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "chart-repo-test")
+	assert.NoErr(t, err)
+	g := &testGitRepo{t, dir}
+	g.git("init", "-q")
+	return g
+}
+
+func (g *testGitRepo) git(args ...string) {
+	cmd := exec.Command("git", append([]string{"-C", g.dir, "-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		g.t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+}
+
+func (g *testGitRepo) commit(files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(g.dir, name)
+		assert.NoErr(g.t, os.MkdirAll(filepath.Dir(p), 0700))
+		assert.NoErr(g.t, ioutil.WriteFile(p, []byte(content), 0600))
+	}
+	g.git("add", "-A")
+	g.git("commit", "-q", "-m", "update charts")
+}
+
+func Test_gitSource(t *testing.T) {
+	g := newTestGitRepo(t)
+	defer os.RemoveAll(g.dir)
+	g.commit(map[string]string{
+		"charts/mysql/Chart.yaml":  "name: mysql\nversion: 1.0.0\n",
+		"charts/mysql/README.md":   "old readme",
+		"charts/mysql/values.yaml": testChartValues,
+	})
+	// Changes that don't bump the version aren't new versions
+	g.commit(map[string]string{"charts/mysql/README.md": testChartReadme})
+	g.commit(map[string]string{"charts/mysql/Chart.yaml": "name: mysql\nversion: 1.0.0\ndescription: MySQL\n"})
+	g.commit(map[string]string{"charts/mysql/Chart.yaml": "name: mysql\nversion: 1.1.0\ndescription: MySQL\nsources:\n- https://github.com/mysql/mysql-server\n"})
+	g.git("tag", "mysql-1.1.0")
+	g.commit(map[string]string{"redis/Chart.yaml": "name: redis\nversion: 0.1.0\n", "README.md": "not a chart"})
+
+	r := repo{Name: "monorepo", URL: g.dir, SourceType: gitSourceType, GitWebURL: "https://git.example.com/charts"}
+	source, err := newChartSource(r)
+	assert.NoErr(t, err)
+
+	index, info, err := source.index(repoIndexInfo{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(index.Entries), 2, "number of charts")
+	mysql := index.Entries["mysql"]
+	assert.Equal(t, len(mysql), 2, "number of mysql versions")
+	assert.Equal(t, mysql[0].Version, "1.1.0", "latest version")
+	assert.Equal(t, mysql[0].Home, "https://git.example.com/charts/tree/mysql-1.1.0/charts/mysql", "home of tagged version")
+	assert.Equal(t, mysql[0].Sources, []string{"https://git.example.com/charts/tree/mysql-1.1.0/charts/mysql", "https://github.com/mysql/mysql-server"}, "sources")
+	assert.Equal(t, mysql[1].Version, "1.0.0", "first version")
+
+	// Unchanged ref
+	_, _, err = source.index(info)
+	assert.Err(t, errIndexNotModified, err)
+
+	// The tarballs match the digests of the index
+	again, _, err := source.index(repoIndexInfo{})
+	assert.NoErr(t, err)
+	assert.Equal(t, again.Entries["mysql"][1].Digest, mysql[1].Digest, "digest of the same version")
+
+	// The files of the first version are the ones of its commit
+	cv := chartVersion{Version: "1.0.0", URLs: mysql[1].URLs, Digest: mysql[1].Digest}
+	dbSession := localstore.New()
+	err = fetchAndImportFiles(dbSession, "mysql", r, cv)
+	assert.NoErr(t, err)
+	id := chartFilesID(r, "mysql", cv.Version)
+	assert.Equal(t, getChartFiles(t, dbSession, id), chartFiles{id, "old readme", testChartValues, storedRepo(r), cv.Digest, nil}, "files")
+
+	// Indexing another ref
+	r.GitRef = "mysql-1.1.0"
+	source, err = newChartSource(r)
+	assert.NoErr(t, err)
+	index, _, err = source.index(repoIndexInfo{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(index.Entries), 1, "number of charts at tag")
+}
+
+func Test_gitSourceRenamedChart(t *testing.T) {
+	g := newTestGitRepo(t)
+	defer os.RemoveAll(g.dir)
+	g.commit(map[string]string{
+		"charts/db/Chart.yaml":  "name: mysql\nversion: 1.0.0\n",
+		"charts/db/README.md":   testChartReadme,
+		"charts/db/values.yaml": testChartValues,
+	})
+	g.commit(map[string]string{"charts/db/Chart.yaml": "name: mariadb\nversion: 2.0.0\n"})
+
+	r := repo{Name: "monorepo", URL: g.dir, SourceType: gitSourceType}
+	source, err := newChartSource(r)
+	assert.NoErr(t, err)
+	index, _, err := source.index(repoIndexInfo{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(index.Entries), 1, "number of charts")
+	mariadb := index.Entries["mariadb"]
+	assert.Equal(t, len(mariadb), 2, "number of versions")
+	assert.Equal(t, mariadb[1].Name, "mariadb", "name of the version before the rename")
+
+	// The tarball of the version before the rename is rooted at the name of
+	// the chart in the index, so its files are found
+	cv := chartVersion{Version: "1.0.0", URLs: mariadb[1].URLs, Digest: mariadb[1].Digest}
+	dbSession := localstore.New()
+	assert.NoErr(t, fetchAndImportFiles(dbSession, "mariadb", r, cv))
+	id := chartFilesID(r, "mariadb", cv.Version)
+	assert.Equal(t, getChartFiles(t, dbSession, id), chartFiles{id, testChartReadme, testChartValues, storedRepo(r), cv.Digest, nil}, "files")
+}
@@ -0,0 +1,362 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const leasesCollection = "leases"
+
+// What a sync does when another one holds the lease of the repo
+const (
+	lockModeWait = "wait"
+	lockModeSkip = "skip"
+	lockModeFail = "fail"
+)
+
+// lease is held by the process syncing a repo. It's renewed by heartbeats
+// while the sync runs, and can be taken over by another process once it has
+// expired, e.g. if the holder crashed.
+type lease struct {
+	// Name of the repo
+	ID string `bson:"_id"`
+	// Host and process holding the lease, for humans
+	Holder string
+	// Identifies the holder, a process can restart with the same host and pid
+	Token      string
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
+
+// leaseHeldError is returned when the lease of a repo is held by another sync
+type leaseHeldError struct {
+	lease lease
+}
+
+func (e leaseHeldError) Error() string {
+	return fmt.Sprintf("repo %s is being synced by %s since %s (lease expires at %s)",
+		e.lease.ID, e.lease.Holder, e.lease.AcquiredAt.Format(time.RFC3339), e.lease.ExpiresAt.Format(time.RFC3339))
+}
+
+// errSyncSkipped is returned when a sync is skipped because another one holds
+// the lease of the repo
+var errSyncSkipped = errors.New("sync skipped, the repo is being synced by another process")
+
+// errLeaseLost is returned when renewing a lease taken over by another sync
+var errLeaseLost = errors.New("lease taken over by another process")
+
+// lockConfig controls how syncs of the same repo are serialized
+type lockConfig struct {
+	mode string
+	// Time after which a lease that hasn't been renewed can be taken over
+	ttl time.Duration
+	// Maximum time waiting for a lease, in the wait mode
+	waitTimeout time.Duration
+	// How often a waiting sync checks if the lease has been released
+	pollInterval time.Duration
+}
+
+var defaultLockConfig = lockConfig{
+	mode:         lockModeWait,
+	ttl:          time.Minute,
+	waitTimeout:  10 * time.Minute,
+	pollInterval: 5 * time.Second,
+}
+
+var locks = defaultLockConfig
+
+// addLockFlags adds the flags setting the lock config
+func addLockFlags(cmd *cobra.Command) {
+	cmd.Flags().String("lock-mode", defaultLockConfig.mode, "what to do if the repo is already being synced: wait, skip or fail")
+	cmd.Flags().Duration("lock-ttl", defaultLockConfig.ttl, "time after which the lease of a sync that stopped renewing it can be taken over")
+	cmd.Flags().Duration("lock-wait-timeout", defaultLockConfig.waitTimeout, "maximum time waiting for another sync of the repo to finish")
+}
+
+// applyLockFlags sets the lock config from the flags of the command
+func applyLockFlags(cmd *cobra.Command) error {
+	var err error
+	config := defaultLockConfig
+	if config.mode, err = cmd.Flags().GetString("lock-mode"); err != nil {
+		return err
+	}
+	if config.ttl, err = cmd.Flags().GetDuration("lock-ttl"); err != nil {
+		return err
+	}
+	if config.waitTimeout, err = cmd.Flags().GetDuration("lock-wait-timeout"); err != nil {
+		return err
+	}
+	switch config.mode {
+	case lockModeWait, lockModeSkip, lockModeFail:
+	default:
+		return fmt.Errorf("invalid --lock-mode %q, must be one of wait, skip or fail", config.mode)
+	}
+	if config.ttl < time.Second {
+		return errors.New("--lock-ttl must be at least 1s")
+	}
+	locks = config
+	return nil
+}
+
+// newLease returns a lease of the repo held by this process
+func newLease(repoName string, ttl time.Duration) lease {
+	now := time.Now()
+	return lease{
+		ID:         repoName,
+		Holder:     processName(),
+		Token:      randomToken(),
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+// processName identifies this process in the leases and jobs it holds
+func processName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s (pid %d)", hostname, os.Getpid())
+}
+
+// randomToken returns a token telling apart the holders of a lease or job
+func randomToken() string {
+	token := make([]byte, 8)
+	rand.Read(token)
+	return fmt.Sprintf("%x", token)
+}
+
+// tryAcquireLease stores the lease, taking over the current one if it has
+// expired. It returns a leaseHeldError if another process holds the lease.
+func tryAcquireLease(dbSession datastore.Session, l lease) error {
+	db, closer := dbSession.DB()
+	defer closer()
+	c := db.C(leasesCollection)
+
+	// The ID is unique, so only one of the processes inserting it succeeds
+	err := c.Insert(l)
+	if mgo.IsDup(err) {
+		if _, err := c.RemoveAll(bson.M{"_id": l.ID, "expiresat": bson.M{"$lt": l.AcquiredAt}}); err != nil {
+			return err
+		}
+		err = c.Insert(l)
+	}
+	if !mgo.IsDup(err) {
+		return err
+	}
+
+	var current lease
+	if err := c.FindId(l.ID).One(&current); err != nil {
+		if err == mgo.ErrNotFound {
+			// Released in the meantime
+			return leaseHeldError{lease{ID: l.ID, Holder: "another process"}}
+		}
+		return err
+	}
+	return leaseHeldError{current}
+}
+
+// renewLease extends the lease, returning errLeaseLost if it has been taken
+// over
+func renewLease(dbSession datastore.Session, l lease) error {
+	db, closer := dbSession.DB()
+	defer closer()
+	// The lease isn't upserted, so that a lease taken over and then released
+	// by another process isn't created again
+	err := updateDoc(db.C(leasesCollection), bson.M{"_id": l.ID, "token": l.Token}, bson.M{"$set": bson.M{"expiresat": l.ExpiresAt}})
+	if err == mgo.ErrNotFound {
+		return errLeaseLost
+	}
+	return err
+}
+
+// updateDoc updates the first document of the collection matching the
+// selector, or returns mgo.ErrNotFound. datastore.Collection only updates
+// documents by ID, while the collections of both MongoDB and localstore
+// sessions can update them by selector.
+func updateDoc(c datastore.Collection, selector, update interface{}) error {
+	u, ok := c.(interface {
+		Update(selector, update interface{}) error
+	})
+	if !ok {
+		return fmt.Errorf("%T can't update documents by selector", c)
+	}
+	return u.Update(selector, update)
+}
+
+// releaseLease removes the lease if it's still held by this process
+func releaseLease(dbSession datastore.Session, l lease) error {
+	db, closer := dbSession.DB()
+	defer closer()
+	_, err := db.C(leasesCollection).RemoveAll(bson.M{"_id": l.ID, "token": l.Token})
+	return err
+}
+
+// acquireLease acquires the lease of the repo, waiting for it, skipping or
+// failing if it's held by another process depending on the mode
+func acquireLease(dbSession datastore.Session, repoName string, config lockConfig) (lease, error) {
+	deadline := time.Now().Add(config.waitTimeout)
+	for {
+		l := newLease(repoName, config.ttl)
+		err := tryAcquireLease(dbSession, l)
+		held, ok := err.(leaseHeldError)
+		if !ok {
+			return l, err
+		}
+
+		fields := log.Fields{"repo": repoName, "holder": held.lease.Holder, "since": held.lease.AcquiredAt, "expires": held.lease.ExpiresAt}
+		switch config.mode {
+		case lockModeSkip:
+			log.WithFields(fields).Info("repo is being synced by another process, skipping sync")
+			return lease{}, errSyncSkipped
+		case lockModeWait:
+			if time.Now().Add(config.pollInterval).Before(deadline) {
+				log.WithFields(fields).Info("repo is being synced by another process, waiting")
+				time.Sleep(config.pollInterval)
+				continue
+			}
+		}
+		return lease{}, held
+	}
+}
+
+// heldLease is the lease of a repo held while running the function given to
+// withRepoLease
+type heldLease struct {
+	dbSession datastore.Session
+	ttl       time.Duration
+	mutex     sync.Mutex
+	lease     lease
+	// Closed once the lease has been taken over by another process
+	lost chan struct{}
+}
+
+// renew extends the lease, returning errLeaseLost if it has been taken over.
+// A nil lease is never lost, e.g. when syncing without a lease in the tests.
+func (h *heldLease) renew() error {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	select {
+	case <-h.lost:
+		return errLeaseLost
+	default:
+	}
+	h.lease.ExpiresAt = time.Now().Add(h.ttl)
+	err := renewLease(h.dbSession, h.lease)
+	if err == errLeaseLost {
+		close(h.lost)
+	}
+	return err
+}
+
+// stopped returns a channel closed once the lease has been lost, telling the
+// holder to stop
+func (h *heldLease) stopped() <-chan struct{} {
+	if h == nil {
+		return nil
+	}
+	return h.lost
+}
+
+// err returns errLeaseLost if the lease has been lost
+func (h *heldLease) err() error {
+	select {
+	case <-h.stopped():
+		return errLeaseLost
+	default:
+		return nil
+	}
+}
+
+// withRepoLease runs f while holding the lease of the repo, renewing it until
+// f returns. If the lease is taken over in the meantime, e.g. because this
+// process was paused for longer than its TTL, the channel returned by
+// stopped() is closed and f should stop as soon as possible.
+func withRepoLease(dbSession datastore.Session, repoName string, config lockConfig, f func(held *heldLease) error) error {
+	l, err := acquireLease(dbSession, repoName, config)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"repo": repoName, "holder": l.Holder}).Debug("acquired lease")
+	held := &heldLease{dbSession: dbSession, ttl: config.ttl, lease: l, lost: make(chan struct{})}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(config.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := held.renew(); err == errLeaseLost {
+					log.WithFields(log.Fields{"repo": repoName}).Error("lease taken over by another process, stopping")
+					return
+				} else if err != nil {
+					log.WithFields(log.Fields{"repo": repoName}).WithError(err).Error("failed to renew lease")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err = f(held)
+	close(stop)
+	<-done
+	if releaseErr := releaseLease(dbSession, held.lease); releaseErr != nil {
+		log.WithFields(log.Fields{"repo": repoName}).WithError(releaseErr).Error("failed to release lease")
+	}
+	return err
+}
+
+// exclusiveLocks returns the lock config of the operations changing a repo
+// outside of a sync, such as deleting it, which wait for the running sync of
+// the repo whatever the lock mode
+func exclusiveLocks() lockConfig {
+	config := locks
+	config.mode = lockModeWait
+	return config
+}
+
+// syncRepoWithLease syncs the repo unless another process is syncing it
+func syncRepoWithLease(dbSession datastore.Session, r repo) error {
+	return withRepoLease(dbSession, r.Name, locks, func(held *heldLease) error {
+		return syncRepo(dbSession, r, held)
+	})
+}
+
+// deleteRepoWithLease deletes the repo once no process is syncing it
+func deleteRepoWithLease(dbSession datastore.Session, repoName string) error {
+	return withRepoLease(dbSession, repoName, exclusiveLocks(), func(*heldLease) error {
+		return deleteRepo(dbSession, repoName)
+	})
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/kubeapps/common/datastore"
+)
+
+// getLease returns the lease of the repo stored in the datastore
+func getLease(t *testing.T, dbSession datastore.Session, repoName string) (lease, bool) {
+	db, closer := dbSession.DB()
+	defer closer()
+	var l lease
+	err := db.C(leasesCollection).FindId(repoName).One(&l)
+	if err == mgo.ErrNotFound {
+		return lease{}, false
+	}
+	assert.NoErr(t, err)
+	return l, true
+}
+
+// takeOverLease makes another process take over the lease of the repo, as if
+// it had expired
+func takeOverLease(t *testing.T, dbSession datastore.Session, repoName string) lease {
+	db, closer := dbSession.DB()
+	defer closer()
+	assert.NoErr(t, db.C(leasesCollection).UpdateId(repoName, bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Second)}}))
+	other := newLease(repoName, time.Hour)
+	assert.NoErr(t, tryAcquireLease(dbSession, other))
+	return other
+}
+
+func Test_tryAcquireLease(t *testing.T) {
+	store := localstore.New()
+	first := newLease("stable", time.Minute)
+	assert.NoErr(t, tryAcquireLease(store, first))
+
+	// The lease is held by the first sync
+	err := tryAcquireLease(store, newLease("stable", time.Minute))
+	held, ok := err.(leaseHeldError)
+	assert.True(t, ok, "lease held error")
+	assert.Equal(t, held.lease.Token, first.Token, "holder of the lease")
+	assert.True(t, strings.Contains(err.Error(), first.Holder), "error reports the holder")
+
+	// Other repos have their own lease
+	assert.NoErr(t, tryAcquireLease(store, newLease("incubator", time.Minute)))
+
+	// An expired lease is taken over
+	db, closer := store.DB()
+	defer closer()
+	assert.NoErr(t, db.C(leasesCollection).UpdateId("stable", bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Second)}}))
+	second := newLease("stable", time.Minute)
+	assert.NoErr(t, tryAcquireLease(store, second))
+	current, _ := getLease(t, store, "stable")
+	assert.Equal(t, current.Token, second.Token, "holder of the lease")
+
+	// The first sync can't renew or release the lease anymore
+	assert.Err(t, errLeaseLost, renewLease(store, first))
+	assert.NoErr(t, releaseLease(store, first))
+	current, _ = getLease(t, store, "stable")
+	assert.Equal(t, current.Token, second.Token, "holder of the lease")
+
+	assert.NoErr(t, releaseLease(store, second))
+	_, ok = getLease(t, store, "stable")
+	assert.False(t, ok, "lease released")
+
+	// Nor create it again once released by the process that took it over
+	assert.Err(t, errLeaseLost, renewLease(store, first))
+	_, ok = getLease(t, store, "stable")
+	assert.False(t, ok, "lease not renewed after being released")
+}
+
+func Test_withRepoLease(t *testing.T) {
+	config := lockConfig{mode: lockModeFail, ttl: 30 * time.Millisecond, waitTimeout: time.Second, pollInterval: 5 * time.Millisecond}
+
+	t.Run("renews and releases the lease", func(t *testing.T) {
+		store := localstore.New()
+		err := withRepoLease(store, "stable", config, func(*heldLease) error {
+			acquired, ok := getLease(t, store, "stable")
+			assert.True(t, ok, "lease held during the sync")
+			time.Sleep(50 * time.Millisecond)
+			renewed, _ := getLease(t, store, "stable")
+			assert.True(t, renewed.ExpiresAt.After(acquired.ExpiresAt), "lease renewed")
+			return errors.New("sync failed")
+		})
+		assert.ExistsErr(t, err, "error of the sync")
+		_, ok := getLease(t, store, "stable")
+		assert.False(t, ok, "lease released")
+	})
+
+	t.Run("stops when the lease is taken over", func(t *testing.T) {
+		store := localstore.New()
+		var other lease
+		err := withRepoLease(store, "stable", config, func(held *heldLease) error {
+			other = takeOverLease(t, store, "stable")
+			select {
+			case <-held.stopped():
+				return held.err()
+			case <-time.After(time.Second):
+				return errors.New("not stopped")
+			}
+		})
+		assert.Err(t, errLeaseLost, err)
+		current, _ := getLease(t, store, "stable")
+		assert.Equal(t, current.Token, other.Token, "holder of the lease")
+	})
+
+	tests := []struct {
+		name    string
+		mode    string
+		release bool
+		wantErr error
+		wantRun bool
+	}{
+		{"fail", lockModeFail, false, leaseHeldError{}, false},
+		{"skip", lockModeSkip, false, errSyncSkipped, false},
+		{"wait until released", lockModeWait, true, nil, true},
+		{"wait timeout", lockModeWait, false, leaseHeldError{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := localstore.New()
+			other := newLease("stable", time.Hour)
+			other.Holder = "other-host (pid 1)"
+			assert.NoErr(t, tryAcquireLease(store, other))
+			if tt.release {
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					releaseLease(store, other)
+				}()
+			}
+
+			c := config
+			c.mode = tt.mode
+			c.waitTimeout = 100 * time.Millisecond
+			ran := false
+			err := withRepoLease(store, "stable", c, func(*heldLease) error {
+				ran = true
+				return nil
+			})
+			assert.Equal(t, ran, tt.wantRun, "sync ran")
+			switch tt.wantErr.(type) {
+			case leaseHeldError:
+				held, ok := err.(leaseHeldError)
+				assert.True(t, ok, "lease held error")
+				assert.Equal(t, held.lease.Holder, other.Holder, "holder of the lease")
+			default:
+				assert.Equal(t, err, tt.wantErr, "error")
+			}
+		})
+	}
+}
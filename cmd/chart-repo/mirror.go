@@ -0,0 +1,318 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Collections of the blobs stored in MongoDB, laid out like GridFS with the
+// blobs prefix
+const (
+	blobFilesCollection  = "blobs.files"
+	blobChunksCollection = "blobs.chunks"
+	// Default chunk size of GridFS
+	blobChunkSize = 255 * 1024
+)
+
+// gzipMagic starts every chart tarball
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// mirroredFiles are the digests of the blobs holding the tarball and
+// provenance file of a mirrored chart version
+type mirroredFiles struct {
+	Tarball string
+	// Empty if the chart version isn't signed
+	Provenance string `bson:",omitempty"`
+}
+
+// blobStore stores the files of mirrored chart versions by the SHA-256 digest
+// of their content
+type blobStore interface {
+	// has returns whether the blob with the given digest is stored
+	has(digest string) (bool, error)
+	// put stores the content read from r and returns its digest. It fails
+	// without storing anything if expectedDigest is set and doesn't match.
+	put(r io.Reader, expectedDigest string) (string, error)
+	// list returns the digests of the stored blobs, along with the time they
+	// were stored
+	list() (map[string]time.Time, error)
+	// remove removes the blob with the given digest, if stored
+	remove(digest string) error
+}
+
+// blobDir is the directory the blobs are stored in, or empty to store them in
+// MongoDB
+var blobDir string
+
+// addMirrorFlags adds the flags setting where mirrored files are stored
+func addMirrorFlags(cmd *cobra.Command) {
+	cmd.Flags().String("blob-dir", "", "directory the tarballs of mirrored repos are stored in, e.g. a mounted S3 bucket, stored in MongoDB if empty")
+}
+
+// applyMirrorFlags sets where mirrored files are stored from the flags of the
+// command
+func applyMirrorFlags(cmd *cobra.Command) error {
+	var err error
+	blobDir, err = cmd.Flags().GetString("blob-dir")
+	return err
+}
+
+// newBlobStore returns the store configured by --blob-dir
+func newBlobStore(dbSession datastore.Session) blobStore {
+	if blobDir != "" {
+		return dirBlobStore{blobDir}
+	}
+	return gridFSBlobStore{dbSession}
+}
+
+// mirrorChartVersion copies the tarball and provenance file of the chart
+// version to the blob store, and records their digests in the chart version
+func mirrorChartVersion(dbSession datastore.Session, store blobStore, r repo, name string, cv chartVersion) error {
+	var mirrored mirroredFiles
+	// The blob of a tarball is found by the digest of the index, so tarballs
+	// already mirrored, e.g. by an earlier sync, aren't downloaded again
+	if cv.Digest != "" {
+		ok, err := store.has(cv.Digest)
+		if err != nil {
+			return err
+		}
+		if ok {
+			mirrored.Tarball = cv.Digest
+		}
+	}
+
+	source, err := newChartSource(r)
+	if err != nil {
+		return err
+	}
+	if mirrored.Tarball == "" {
+		log.WithFields(log.Fields{"name": name, "version": cv.Version}).Debug("mirroring tarball")
+		tarball, err := source.openTarball(name, cv)
+		if err != nil {
+			return err
+		}
+		defer tarball.Close()
+		// Without a digest, the gzip header is all there is to tell a tarball
+		// from e.g. an error page
+		body := bufio.NewReader(tarball)
+		if magic, err := body.Peek(2); err != nil || !bytes.Equal(magic, gzipMagic) {
+			return fmt.Errorf("tarball of %s %s is not a gzip archive", name, cv.Version)
+		}
+		if mirrored.Tarball, err = store.put(body, cv.Digest); err != nil {
+			return err
+		}
+	}
+
+	prov, err := source.openProvenance(cv)
+	if err != nil && err != errFileNotFound {
+		return err
+	}
+	if err == nil {
+		mirrored.Provenance, err = store.put(prov, "")
+		prov.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return updateChartVersion(dbSession, r, name, cv.Version, bson.M{"mirror": mirrored})
+}
+
+// dirBlobStore stores blobs in a directory, as sha256/<2 first digits>/<digest>
+type dirBlobStore struct {
+	dir string
+}
+
+func (s dirBlobStore) path(digest string) string {
+	return filepath.Join(s.dir, "sha256", digest[:2], digest)
+}
+
+func (s dirBlobStore) has(digest string) (bool, error) {
+	if len(digest) < 2 {
+		return false, nil
+	}
+	_, err := os.Stat(s.path(digest))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s dirBlobStore) put(r io.Reader, expectedDigest string) (string, error) {
+	// The blob is written to a temporary file first, so that a blob is never
+	// seen partially written
+	tmpDir := filepath.Join(s.dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(tmpDir, "blob")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	digest := fmt.Sprintf("%x", h.Sum(nil))
+	if expectedDigest != "" && digest != expectedDigest {
+		return "", fmt.Errorf("digest mismatch: expected %s, got %s", expectedDigest, digest)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path(digest)), 0755); err != nil {
+		return "", err
+	}
+	return digest, os.Rename(f.Name(), s.path(digest))
+}
+
+func (s dirBlobStore) list() (map[string]time.Time, error) {
+	blobs := map[string]time.Time{}
+	paths, err := filepath.Glob(filepath.Join(s.dir, "sha256", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			blobs[filepath.Base(path)] = info.ModTime()
+		}
+	}
+	return blobs, nil
+}
+
+func (s dirBlobStore) remove(digest string) error {
+	err := os.Remove(s.path(digest))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// blobFile is the document describing a blob stored in MongoDB, following the
+// GridFS spec
+type blobFile struct {
+	ID         string    `bson:"_id"`
+	Length     int64     `bson:"length"`
+	ChunkSize  int       `bson:"chunkSize"`
+	UploadDate time.Time `bson:"uploadDate"`
+}
+
+// blobChunk is a part of a blob stored in MongoDB
+type blobChunk struct {
+	FilesID string `bson:"files_id"`
+	N       int    `bson:"n"`
+	Data    []byte `bson:"data"`
+}
+
+// gridFSBlobStore stores blobs in MongoDB, in the GridFS collections with the
+// blobs prefix. The blobs are written through the datastore interface, which
+// doesn't expose GridFS, so the chunks are stored by hand.
+type gridFSBlobStore struct {
+	dbSession datastore.Session
+}
+
+func (s gridFSBlobStore) has(digest string) (bool, error) {
+	db, closer := s.dbSession.DB()
+	defer closer()
+	err := db.C(blobFilesCollection).FindId(digest).One(&blobFile{})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s gridFSBlobStore) put(r io.Reader, expectedDigest string) (string, error) {
+	// Chart tarballs are small enough to be read into memory, see
+	// fetchAndImportFiles
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	digest := fmt.Sprintf("%x", sha256.Sum256(data))
+	if expectedDigest != "" && digest != expectedDigest {
+		return "", fmt.Errorf("digest mismatch: expected %s, got %s", expectedDigest, digest)
+	}
+
+	db, closer := s.dbSession.DB()
+	defer closer()
+	var pairs []interface{}
+	buf := bytes.NewBuffer(data)
+	for n := 0; buf.Len() > 0; n++ {
+		pairs = append(pairs, bson.M{"_id": fmt.Sprintf("%s/%d", digest, n)}, blobChunk{FilesID: digest, N: n, Data: buf.Next(blobChunkSize)})
+	}
+	if len(pairs) > 0 {
+		bulk := db.C(blobChunksCollection).Bulk()
+		bulk.Upsert(pairs...)
+		if _, err := bulk.Run(); err != nil {
+			return "", err
+		}
+	}
+	// The file document is written last, so that blobs are only found once
+	// all of their chunks are stored
+	_, err = db.C(blobFilesCollection).UpsertId(digest, blobFile{ID: digest, Length: int64(len(data)), ChunkSize: blobChunkSize, UploadDate: time.Now()})
+	return digest, err
+}
+
+func (s gridFSBlobStore) list() (map[string]time.Time, error) {
+	db, closer := s.dbSession.DB()
+	defer closer()
+	var files []blobFile
+	if err := db.C(blobFilesCollection).Find(nil).Select(bson.M{"_id": 1, "uploadDate": 1}).All(&files); err != nil {
+		return nil, err
+	}
+	blobs := map[string]time.Time{}
+	for _, f := range files {
+		blobs[f.ID] = f.UploadDate
+	}
+	return blobs, nil
+}
+
+func (s gridFSBlobStore) remove(digest string) error {
+	db, closer := s.dbSession.DB()
+	defer closer()
+	// The file document is removed first, so that the blob isn't found anymore
+	// if removing the chunks fails
+	if _, err := db.C(blobFilesCollection).RemoveAll(bson.M{"_id": digest}); err != nil {
+		return err
+	}
+	_, err := db.C(blobChunksCollection).RemoveAll(bson.M{"files_id": digest})
+	return err
+}
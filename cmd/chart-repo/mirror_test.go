@@ -0,0 +1,147 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+func sha256Hex(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func Test_dirBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-repo-blobs")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	store := dirBlobStore{dir}
+
+	content := []byte("chart tarball")
+	digest := sha256Hex(content)
+	ok, err := store.has(digest)
+	assert.NoErr(t, err)
+	assert.False(t, ok, "blob stored")
+
+	_, err = store.put(bytes.NewReader(content), strings.Repeat("0", 64))
+	assert.ExistsErr(t, err, "digest mismatch")
+	ok, _ = store.has(digest)
+	assert.False(t, ok, "blob stored despite the digest mismatch")
+
+	stored, err := store.put(bytes.NewReader(content), digest)
+	assert.NoErr(t, err)
+	assert.Equal(t, stored, digest, "digest")
+	ok, _ = store.has(digest)
+	assert.True(t, ok, "blob stored")
+	data, err := ioutil.ReadFile(store.path(digest))
+	assert.NoErr(t, err)
+	assert.Equal(t, data, content, "blob content")
+}
+
+func Test_gridFSBlobStore(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), blobChunkSize+10)
+	digest := sha256Hex(content)
+
+	dbSession := localstore.New()
+	store := gridFSBlobStore{dbSession}
+	ok, err := store.has(digest)
+	assert.NoErr(t, err)
+	assert.False(t, ok, "blob stored")
+
+	_, err = store.put(bytes.NewReader(content), strings.Repeat("0", 64))
+	assert.ExistsErr(t, err, "digest mismatch")
+	assert.Equal(t, documentIDs(t, dbSession, blobChunksCollection), []string{}, "chunks stored despite the digest mismatch")
+
+	stored, err := store.put(bytes.NewReader(content), "")
+	assert.NoErr(t, err)
+	assert.Equal(t, stored, digest, "digest")
+	ok, err = store.has(digest)
+	assert.NoErr(t, err)
+	assert.True(t, ok, "blob stored")
+
+	assert.Equal(t, documentIDs(t, dbSession, blobChunksCollection), []string{digest + "/0", digest + "/1"}, "chunk IDs")
+	db, closer := dbSession.DB()
+	defer closer()
+	var chunk blobChunk
+	assert.NoErr(t, db.C(blobChunksCollection).FindId(digest+"/1").One(&chunk))
+	assert.Equal(t, chunk.FilesID, digest, "blob of the chunk")
+	assert.Equal(t, len(chunk.Data), 10, "size of the last chunk")
+	var file blobFile
+	assert.NoErr(t, db.C(blobFilesCollection).FindId(digest).One(&file))
+	assert.Equal(t, file.Length, int64(len(content)), "blob length")
+	assert.Equal(t, file.ChunkSize, blobChunkSize, "chunk size")
+}
+
+func Test_mirrorChartVersion(t *testing.T) {
+	tarball := []byte("\x1f\x8bmysql tarball")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/mysql-1.0.0.tgz":
+			w.Write(tarball)
+		case "/mysql-1.0.0.tgz.prov":
+			w.Write([]byte("signature"))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+	netClient = server.Client()
+
+	dir, err := ioutil.TempDir("", "chart-repo-blobs")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	store := dirBlobStore{dir}
+
+	r := repo{Name: "stable", URL: server.URL, Generation: 2, Mirror: true}
+	tests := []struct {
+		name     string
+		version  string
+		digest   string
+		wantErr  bool
+		wantProv bool
+	}{
+		{"signed chart version", "1.0.0", sha256Hex(tarball), false, true},
+		{"digest mismatch", "1.0.0", strings.Repeat("0", 64), true, false},
+		{"missing tarball", "2.0.0", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cv := chartVersion{Version: tt.version, Digest: tt.digest, URLs: []string{fmt.Sprintf("mysql-%s.tgz", tt.version)}}
+			dbSession := localstore.New()
+			assert.NoErr(t, dbSession.Insert(chartCollection, chart{ID: "stable/mysql@2", Name: "mysql", Generation: 2, ChartVersions: []chartVersion{cv}}))
+			err := mirrorChartVersion(dbSession, store, r, "mysql", cv)
+			assert.Equal(t, err != nil, tt.wantErr, "error")
+			c, getErr := newCatalog(dbSession).getChart("stable/mysql@2")
+			assert.NoErr(t, getErr)
+			if tt.wantErr {
+				assert.True(t, c.ChartVersions[0].Mirror == nil, "mirrored files recorded")
+				return
+			}
+			assert.Equal(t, *c.ChartVersions[0].Mirror, mirroredFiles{Tarball: tt.digest, Provenance: sha256Hex([]byte("signature"))}, "mirrored files")
+		})
+	}
+}
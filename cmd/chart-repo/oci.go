@@ -0,0 +1,444 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	helmchart "k8s.io/helm/pkg/proto/hapi/chart"
+	helmrepo "k8s.io/helm/pkg/repo"
+)
+
+const (
+	ociScheme                 = "oci"
+	ociManifestMediaType      = "application/vnd.oci.image.manifest.v1+json"
+	ociCreatedAnnotation      = "org.opencontainers.image.created"
+	helmChartConfigMediaType  = "application/vnd.cncf.helm.config.v1+json"
+	helmChartContentMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	// Media type of the chart layer pushed by early versions of Helm 3
+	helmChartLegacyContentMediaType = "application/tar+gzip"
+)
+
+// errNotAChart is returned by fetchOCIChartVersion for images that aren't
+// Helm charts
+var errNotAChart = errors.New("not a helm chart")
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type ociManifest struct {
+	Config      ociDescriptor     `json:"config"`
+	Layers      []ociDescriptor   `json:"layers"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// ociList is a page of the catalog or of the tags list of a repository
+type ociList struct {
+	Repositories []string `json:"repositories"`
+	Tags         []string `json:"tags"`
+}
+
+// isOCIRepo returns whether the repo is an OCI registry, e.g.
+// oci://registry.example.com/charts
+func isOCIRepo(r repo) bool {
+	u, err := url.Parse(strings.TrimSpace(r.URL))
+	return err == nil && u.Scheme == ociScheme
+}
+
+// ociRegistryURL returns the base URL of the distribution API of a registry
+func ociRegistryURL(r repo, host string) string {
+	if r.PlainHTTP {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// ociSource is an OCI registry storing charts, as pushed by helm push
+type ociSource struct {
+	r repo
+}
+
+func newOCISource(r repo) (chartSource, error) {
+	return ociSource{r}, nil
+}
+
+func (s ociSource) index(lastIndex repoIndexInfo) (*helmrepo.IndexFile, repoIndexInfo, error) {
+	return fetchOCIIndex(s.r, lastIndex)
+}
+
+func (s ociSource) openTarball(name string, cv chartVersion) (io.ReadCloser, error) {
+	return openRepoFile(s.r, ociBlobURL(s.r, cv.URLs[0], cv.Digest))
+}
+
+// Provenance files aren't stored in registries
+func (s ociSource) openProvenance(cv chartVersion) (io.ReadCloser, error) {
+	return nil, errFileNotFound
+}
+
+// fetchOCIIndex builds the index of an OCI registry from the charts found in
+// the repositories under the path of the repo URL, using the catalog and the
+// tags list of each repository. Every tag is a chart version.
+func fetchOCIIndex(r repo, lastIndex repoIndexInfo) (*helmrepo.IndexFile, repoIndexInfo, error) {
+	u, err := url.Parse(strings.TrimSpace(r.URL))
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	registry := ociRegistryURL(r, u.Host)
+	prefix := strings.Trim(u.Path, "/")
+
+	catalog, err := fetchOCIList(r, registry, "/v2/_catalog")
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+
+	index := helmrepo.NewIndexFile()
+	for _, name := range catalog.Repositories {
+		if prefix != "" && name != prefix && !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		tags, err := fetchOCIList(r, registry, fmt.Sprintf("/v2/%s/tags/list", name))
+		if err != nil {
+			return nil, repoIndexInfo{}, err
+		}
+		for _, tag := range tags.Tags {
+			cv, err := fetchOCIChartVersion(r, registry, u.Host, name, tag)
+			if err == errNotAChart {
+				log.WithFields(log.Fields{"repository": name, "tag": tag}).Debug("skipping image that isn't a chart")
+				continue
+			}
+			if err != nil {
+				return nil, repoIndexInfo{}, err
+			}
+			index.Entries[cv.Name] = append(index.Entries[cv.Name], cv)
+		}
+	}
+
+	// Registries don't provide validators for the whole set of charts, so
+	// compare the content of the index instead
+	data, err := json.Marshal(index.Entries)
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	info := repoIndexInfo{Checksum: fmt.Sprintf("%x", sha256.Sum256(data))}
+	if lastIndex.Checksum != "" && info.Checksum == lastIndex.Checksum {
+		return nil, info, errIndexNotModified
+	}
+
+	index.SortEntries()
+	return index, info, nil
+}
+
+// fetchOCIChartVersion reads the metadata of the chart stored in a tag from
+// its config blob
+func fetchOCIChartVersion(r repo, registry, host, name, tag string) (*helmrepo.ChartVersion, error) {
+	var manifest ociManifest
+	if err := fetchOCIJSON(r, fmt.Sprintf("%s/v2/%s/manifests/%s", registry, name, tag), ociManifestMediaType, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Config.MediaType != helmChartConfigMediaType {
+		return nil, errNotAChart
+	}
+	var layer *ociDescriptor
+	for i, l := range manifest.Layers {
+		if l.MediaType == helmChartContentMediaType || l.MediaType == helmChartLegacyContentMediaType {
+			layer = &manifest.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return nil, errNotAChart
+	}
+
+	var md helmchart.Metadata
+	if err := fetchOCIJSON(r, fmt.Sprintf("%s/v2/%s/blobs/%s", registry, name, manifest.Config.Digest), helmChartConfigMediaType, &md); err != nil {
+		return nil, err
+	}
+
+	cv := &helmrepo.ChartVersion{
+		Metadata: &md,
+		// Reference of the chart as used by helm pull
+		URLs:   []string{fmt.Sprintf("%s://%s/%s:%s", ociScheme, host, name, tag)},
+		Digest: strings.TrimPrefix(layer.Digest, "sha256:"),
+	}
+	if created, ok := manifest.Annotations[ociCreatedAnnotation]; ok {
+		cv.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	return cv, nil
+}
+
+// fetchOCIList fetches all the pages of a catalog or tags list
+func fetchOCIList(r repo, registry, path string) (ociList, error) {
+	var list ociList
+	next := registry + path
+	for next != "" {
+		var page ociList
+		res, err := ociGet(r, next, "application/json")
+		if err != nil {
+			return ociList{}, err
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		link := res.Header.Get("Link")
+		res.Body.Close()
+		if err != nil {
+			return ociList{}, err
+		}
+		list.Repositories = append(list.Repositories, page.Repositories...)
+		list.Tags = append(list.Tags, page.Tags...)
+
+		next, err = ociNextPage(next, link)
+		if err != nil {
+			return ociList{}, err
+		}
+	}
+	return list, nil
+}
+
+var ociLinkRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="?next"?`)
+
+// ociNextPage returns the URL of the next page given in a Link header, if any
+func ociNextPage(current, link string) (string, error) {
+	m := ociLinkRegexp.FindStringSubmatch(link)
+	if m == nil {
+		return "", nil
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	next, err := base.Parse(m[1])
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
+
+func fetchOCIJSON(r repo, url, accept string, v interface{}) error {
+	res, err := ociGet(r, url, accept)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func ociGet(r repo, url, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Accept", accept)
+	if len(r.AuthorizationHeader) > 0 {
+		req.Header.Set("Authorization", r.AuthorizationHeader)
+	}
+
+	client, err := repoNetClient(r)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("%d %s", res.StatusCode, url)
+	}
+	return res, nil
+}
+
+// ociBlobURL returns the URL of the chart layer referenced by a chart version
+// of an OCI repo, e.g. oci://registry.example.com/charts/mysql:1.0.0
+func ociBlobURL(r repo, ref, digest string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		// The error is caught when making the request
+		return ref
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return fmt.Sprintf("%s/v2/%s/blobs/sha256:%s", ociRegistryURL(r, u.Host), name, digest)
+}
+
+// ociClient authenticates the requests made to a registry, following the token
+// flow of the distribution API when challenged. The Authorization header of
+// the repo, if any, is sent to the token endpoint.
+type ociClient struct {
+	client httpClient
+
+	mutex sync.Mutex
+	// Tokens indexed by scope
+	tokens map[string]string
+}
+
+type ociClientKey struct {
+	url           string
+	authorization string
+	client        httpClient
+}
+
+// Clients for OCI repos, reused so that tokens are cached between syncs
+var (
+	ociClients      = map[ociClientKey]*ociClient{}
+	ociClientsMutex sync.Mutex
+)
+
+func ociRegistryClient(r repo, client httpClient) *ociClient {
+	ociClientsMutex.Lock()
+	defer ociClientsMutex.Unlock()
+	key := ociClientKey{r.URL, r.AuthorizationHeader, client}
+	if c, ok := ociClients[key]; ok {
+		return c
+	}
+	c := &ociClient{client: client, tokens: map[string]string{}}
+	ociClients[key] = c
+	return c
+}
+
+var (
+	ociChallengeRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	ociScopeRegexp     = regexp.MustCompile(`^/v2/(.+)/(tags|manifests|blobs)/`)
+)
+
+// ociScope returns the scope of the token needed for a request
+func ociScope(req *http.Request) string {
+	if req.URL.Path == "/v2/_catalog" {
+		return "registry:catalog:*"
+	}
+	if m := ociScopeRegexp.FindStringSubmatch(req.URL.Path); m != nil {
+		return fmt.Sprintf("repository:%s:pull", m[1])
+	}
+	return ""
+}
+
+func (c *ociClient) Do(req *http.Request) (*http.Response, error) {
+	scope := ociScope(req)
+	c.mutex.Lock()
+	token, ok := c.tokens[scope]
+	c.mutex.Unlock()
+	sent := req
+	if ok {
+		sent = withAuthorization(req, "Bearer "+token)
+	}
+
+	res, err := c.client.Do(sent)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	challenge := res.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return res, nil
+	}
+	res.Body.Close()
+
+	params := map[string]string{}
+	for _, m := range ociChallengeRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["scope"] != "" {
+		scope = params["scope"]
+	}
+	token, err = c.fetchToken(req, params["realm"], params["service"], scope)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.tokens[ociScope(req)] = token
+	c.mutex.Unlock()
+	return c.client.Do(withAuthorization(req, "Bearer "+token))
+}
+
+func (c *ociClient) fetchToken(orig *http.Request, realm, service, scope string) (string, error) {
+	if realm == "" {
+		return "", errors.New("registry challenge has no realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	// The Authorization header of the repo holds the credentials of the
+	// registry, unless it's already a token
+	if auth := orig.Header.Get("Authorization"); auth != "" && !strings.HasPrefix(auth, "Bearer ") {
+		req.Header.Set("Authorization", auth)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%d %s", res.StatusCode, realm)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("registry returned an empty token")
+}
+
+// withAuthorization returns a copy of the request with the given
+// Authorization header
+func withAuthorization(req *http.Request, authorization string) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = http.Header{}
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", authorization)
+	return r
+}
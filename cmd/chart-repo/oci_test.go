@@ -0,0 +1,186 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+// fakeRegistry is a stand-in for an OCI registry serving charts, which
+// requires a token obtained from its token endpoint
+type fakeRegistry struct {
+	// Tags of each repository, every tag is a chart version
+	repos map[string][]string
+	// Images that aren't charts
+	images map[string]bool
+	// Number of tokens issued
+	tokens int
+}
+
+const fakeRegistryToken = "ThisTokenAuthorizesPulls"
+
+func (f *fakeRegistry) Do(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	path := req.URL.Path
+
+	if path == "/token" {
+		if req.Header.Get("Authorization") != "Basic dXNlcjpwYXNz" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return w.Result(), nil
+		}
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]string{"token": fakeRegistryToken})
+		return w.Result(), nil
+	}
+	if req.Header.Get("Authorization") != "Bearer "+fakeRegistryToken {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://registry.example.com/token",service="registry.example.com"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return w.Result(), nil
+	}
+
+	switch {
+	case path == "/v2/_catalog":
+		var names []string
+		for name := range f.repos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		// Return a page per repository
+		page := 0
+		fmt.Sscanf(req.URL.Query().Get("last"), "%d", &page)
+		if page+1 < len(names) {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?last=%d>; rel="next"`, page+1))
+		}
+		json.NewEncoder(w).Encode(ociList{Repositories: names[page : page+1]})
+	case strings.HasSuffix(path, "/tags/list"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list")
+		json.NewEncoder(w).Encode(ociList{Tags: f.repos[name]})
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/v2/"), "/manifests/")
+		name, tag := parts[0], parts[1]
+		if f.images[name] {
+			json.NewEncoder(w).Encode(ociManifest{Config: ociDescriptor{MediaType: "application/vnd.oci.image.config.v1+json"}})
+			break
+		}
+		json.NewEncoder(w).Encode(ociManifest{
+			Config:      ociDescriptor{MediaType: helmChartConfigMediaType, Digest: "sha256:config-" + tag},
+			Layers:      []ociDescriptor{{MediaType: helmChartContentMediaType, Digest: "sha256:" + f.layerDigest(name)}},
+			Annotations: map[string]string{ociCreatedAnnotation: "2018-12-11T10:00:00Z"},
+		})
+	case strings.Contains(path, "/blobs/sha256:config-"):
+		parts := strings.Split(strings.TrimPrefix(path, "/v2/"), "/blobs/sha256:config-")
+		name := parts[0][strings.LastIndex(parts[0], "/")+1:]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"apiVersion":  "v2",
+			"name":        name,
+			"version":     parts[1],
+			"description": "chart from a registry",
+			"appVersion":  "1.0",
+		})
+	case strings.Contains(path, "/blobs/"):
+		name := strings.Split(strings.TrimPrefix(path, "/v2/"), "/blobs/")[0]
+		w.Write(f.layer(name))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return w.Result(), nil
+}
+
+func (f *fakeRegistry) layer(name string) []byte {
+	return (&goodTarballClient{c: chart{Name: name[strings.LastIndex(name, "/")+1:]}}).tarball()
+}
+
+func (f *fakeRegistry) layerDigest(name string) string {
+	return tarballDigest(f.layer(name))
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		repos: map[string][]string{
+			"charts/mysql":  {"1.0.0", "1.1.0"},
+			"charts/redis":  {"2.0.0"},
+			"charts/nginx":  {"latest"},
+			"other/mongodb": {"3.0.0"},
+		},
+		images: map[string]bool{"charts/nginx": true},
+	}
+}
+
+func Test_isOCIRepo(t *testing.T) {
+	assert.True(t, isOCIRepo(repo{URL: "oci://registry.example.com/charts"}), "oci URL")
+	assert.False(t, isOCIRepo(repo{URL: "https://charts.example.com"}), "https URL")
+}
+
+func Test_fetchOCIIndex(t *testing.T) {
+	registry := newFakeRegistry()
+	netClient = registry
+	r := repo{Name: "registry", URL: "oci://registry.example.com/charts", AuthorizationHeader: "Basic dXNlcjpwYXNz"}
+
+	index, info, err := fetchOCIIndex(r, repoIndexInfo{})
+	assert.NoErr(t, err)
+	assert.Equal(t, len(index.Entries), 2, "number of charts")
+	mysql := index.Entries["mysql"]
+	assert.Equal(t, len(mysql), 2, "number of mysql versions")
+	assert.Equal(t, mysql[0].Version, "1.1.0", "latest mysql version")
+	assert.Equal(t, mysql[0].AppVersion, "1.0", "app version")
+	assert.Equal(t, mysql[0].URLs, []string{"oci://registry.example.com/charts/mysql:1.1.0"}, "chart URLs")
+	assert.Equal(t, mysql[0].Digest, registry.layerDigest("charts/mysql"), "chart digest")
+	assert.Equal(t, mysql[0].Created, time.Date(2018, time.December, 11, 10, 0, 0, 0, time.UTC), "created")
+	assert.Equal(t, registry.tokens, 4, "tokens issued, one per scope")
+
+	// The index is unchanged on the next sync
+	_, _, err = fetchOCIIndex(r, info)
+	assert.Err(t, errIndexNotModified, err)
+	assert.Equal(t, registry.tokens, 4, "tokens issued after reusing cached tokens")
+
+	// The registry credentials are required
+	r.AuthorizationHeader = ""
+	_, _, err = fetchOCIIndex(r, repoIndexInfo{})
+	assert.ExistsErr(t, err, "missing credentials")
+}
+
+func Test_ociBlobURL(t *testing.T) {
+	r := repo{URL: "oci://localhost:5000/charts", PlainHTTP: true}
+	cv := chartVersion{URLs: []string{"oci://localhost:5000/charts/mysql:1.0.0"}, Digest: "123"}
+	assert.Equal(t, ociBlobURL(r, cv.URLs[0], cv.Digest), "http://localhost:5000/v2/charts/mysql/blobs/sha256:123", "tarball URL")
+}
+
+func Test_fetchAndImportFilesOCI(t *testing.T) {
+	netClient = newFakeRegistry()
+	r := repo{Name: "registry", URL: "oci://registry.example.com/charts", AuthorizationHeader: "Basic dXNlcjpwYXNz"}
+	index, _, err := fetchOCIIndex(r, repoIndexInfo{})
+	assert.NoErr(t, err)
+	charts := chartsFromIndex(index, r)
+	c := charts[0]
+	cv := c.ChartVersions[0]
+
+	dbSession := localstore.New()
+	err = fetchAndImportFiles(dbSession, c.Name, c.Repo, cv)
+	assert.NoErr(t, err)
+	id := chartFilesID(r, c.Name, cv.Version)
+	assert.Equal(t, getChartFiles(t, dbSession, id), chartFiles{id, testChartReadme, testChartValues, storedRepo(r), cv.Digest, nil}, "files")
+}
@@ -0,0 +1,240 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/kubeapps/common/datastore"
+)
+
+// Output formats of the sync plan
+const (
+	planOutputText = "text"
+	planOutputJSON = "json"
+)
+
+// syncPlan describes what a sync of the repo would change, compared to the
+// charts of its active generation
+type syncPlan struct {
+	Repo string `json:"repo"`
+	URL  string `json:"url"`
+	// Set if the repo hasn't been synced before
+	NewRepo bool `json:"newRepo"`
+	// Set if the URL differs from the one of the last sync
+	PreviousURL     string         `json:"previousURL,omitempty"`
+	AddedCharts     []string       `json:"addedCharts"`
+	RemovedCharts   []string       `json:"removedCharts"`
+	AddedVersions   []planVersion  `json:"addedVersions"`
+	RemovedVersions []planVersion  `json:"removedVersions"`
+	ChangedDigests  []planDigest   `json:"changedDigests"`
+	Validation      []indexProblem `json:"validation"`
+	Counts          map[string]int `json:"counts"`
+}
+
+// planVersion is a chart version added or removed by a sync
+type planVersion struct {
+	Chart   string `json:"chart"`
+	Version string `json:"version"`
+}
+
+// planDigest is a chart version whose digest changed since the last sync
+type planDigest struct {
+	Chart          string `json:"chart"`
+	Version        string `json:"version"`
+	PreviousDigest string `json:"previousDigest"`
+	Digest         string `json:"digest"`
+}
+
+// hasChanges returns whether the sync would change the charts of the repo
+func (p syncPlan) hasChanges() bool {
+	return len(p.AddedCharts)+len(p.RemovedCharts)+len(p.AddedVersions)+len(p.RemovedVersions)+len(p.ChangedDigests) > 0
+}
+
+// planSync fetches the index of the repo and compares it to the charts of the
+// active generation, without writing anything to the database
+func planSync(dbSession datastore.Session, r repo) (syncPlan, error) {
+	url, err := parseRepoUrl(r.URL)
+	if err != nil {
+		return syncPlan{}, err
+	}
+	r.URL = url.String()
+
+	status, err := getRepoStatus(dbSession, r.Name)
+	if err != nil {
+		return syncPlan{}, err
+	}
+	plan := syncPlan{Repo: r.Name, URL: r.URL, NewRepo: status.ID == ""}
+	if !plan.NewRepo && status.URL != r.URL {
+		plan.PreviousURL = status.URL
+	}
+
+	source, err := newChartSource(r)
+	if err != nil {
+		return syncPlan{}, err
+	}
+	// The index is always fetched, as the plan compares it to the charts
+	index, _, err := source.index(repoIndexInfo{})
+	if err != nil {
+		return syncPlan{}, err
+	}
+	plan.Validation = validateIndex(index)
+	current, err := activeCharts(dbSession, status)
+	if err != nil {
+		return syncPlan{}, err
+	}
+	diffCharts(&plan, current, chartsFromIndex(index, r))
+	return plan, nil
+}
+
+// activeCharts returns the names, versions and digests of the charts of the
+// active generation of the repo
+func activeCharts(dbSession datastore.Session, status repoStatus) ([]chart, error) {
+	if status.ID == "" {
+		return nil, nil
+	}
+	return newCatalog(dbSession).listGeneration(status.ID, status.Generation)
+}
+
+// diffCharts fills the plan with the differences between the current charts
+// and the ones in the index
+func diffCharts(plan *syncPlan, current, next []chart) {
+	plan.AddedCharts = []string{}
+	plan.RemovedCharts = []string{}
+	plan.AddedVersions = []planVersion{}
+	plan.RemovedVersions = []planVersion{}
+	plan.ChangedDigests = []planDigest{}
+	if plan.Validation == nil {
+		plan.Validation = []indexProblem{}
+	}
+
+	currentByName := map[string]chart{}
+	for _, c := range current {
+		currentByName[c.Name] = c
+	}
+	nextByName := map[string]chart{}
+	versions := 0
+	for _, c := range next {
+		nextByName[c.Name] = c
+		versions += len(c.ChartVersions)
+	}
+	plan.Counts = map[string]int{"charts": len(next), "versions": versions}
+
+	for _, c := range next {
+		old, ok := currentByName[c.Name]
+		if !ok {
+			plan.AddedCharts = append(plan.AddedCharts, c.Name)
+		}
+		oldDigests := map[string]string{}
+		for _, cv := range old.ChartVersions {
+			oldDigests[cv.Version] = cv.Digest
+		}
+		for _, cv := range c.ChartVersions {
+			digest, ok := oldDigests[cv.Version]
+			switch {
+			case !ok:
+				plan.AddedVersions = append(plan.AddedVersions, planVersion{c.Name, cv.Version})
+			case digest != cv.Digest:
+				plan.ChangedDigests = append(plan.ChangedDigests, planDigest{c.Name, cv.Version, digest, cv.Digest})
+			}
+		}
+	}
+	for _, c := range current {
+		next, ok := nextByName[c.Name]
+		if !ok {
+			plan.RemovedCharts = append(plan.RemovedCharts, c.Name)
+		}
+		nextVersions := map[string]bool{}
+		for _, cv := range next.ChartVersions {
+			nextVersions[cv.Version] = true
+		}
+		for _, cv := range c.ChartVersions {
+			if !nextVersions[cv.Version] {
+				plan.RemovedVersions = append(plan.RemovedVersions, planVersion{c.Name, cv.Version})
+			}
+		}
+	}
+
+	sort.Strings(plan.AddedCharts)
+	sort.Strings(plan.RemovedCharts)
+	sortPlanVersions(plan.AddedVersions)
+	sortPlanVersions(plan.RemovedVersions)
+	sort.Slice(plan.ChangedDigests, func(i, j int) bool {
+		a, b := plan.ChangedDigests[i], plan.ChangedDigests[j]
+		return a.Chart < b.Chart || a.Chart == b.Chart && a.Version < b.Version
+	})
+}
+
+func sortPlanVersions(versions []planVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		return a.Chart < b.Chart || a.Chart == b.Chart && a.Version < b.Version
+	})
+}
+
+// printSyncPlan writes the plan in the given output format
+func printSyncPlan(w io.Writer, plan syncPlan, output string) error {
+	switch output {
+	case planOutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	case planOutputText:
+	default:
+		return fmt.Errorf("invalid --output %q, must be one of text or json", output)
+	}
+
+	switch {
+	case plan.NewRepo:
+		fmt.Fprintf(w, "Sync of the new repository %s from %s:\n", plan.Repo, plan.URL)
+	case plan.PreviousURL != "":
+		fmt.Fprintf(w, "Sync of the repository %s, changing its URL from %s to %s:\n", plan.Repo, plan.PreviousURL, plan.URL)
+	default:
+		fmt.Fprintf(w, "Sync of the repository %s from %s:\n", plan.Repo, plan.URL)
+	}
+	fmt.Fprintf(w, "The index has %d charts and %d chart versions\n", plan.Counts["charts"], plan.Counts["versions"])
+	if !plan.hasChanges() {
+		fmt.Fprintln(w, "No changes")
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CHANGE\tCHART\tVERSION\tDIGEST")
+		for _, name := range plan.AddedCharts {
+			fmt.Fprintf(tw, "add chart\t%s\t\t\n", name)
+		}
+		for _, name := range plan.RemovedCharts {
+			fmt.Fprintf(tw, "remove chart\t%s\t\t\n", name)
+		}
+		for _, v := range plan.AddedVersions {
+			fmt.Fprintf(tw, "add version\t%s\t%s\t\n", v.Chart, v.Version)
+		}
+		for _, v := range plan.RemovedVersions {
+			fmt.Fprintf(tw, "remove version\t%s\t%s\t\n", v.Chart, v.Version)
+		}
+		for _, d := range plan.ChangedDigests {
+			fmt.Fprintf(tw, "change digest\t%s\t%s\t%s -> %s\n", d.Chart, d.Version, d.PreviousDigest, d.Digest)
+		}
+		tw.Flush()
+	}
+	if len(plan.Validation) > 0 {
+		printValidationReport(w, plan.Repo, plan.Validation)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+func Test_diffCharts(t *testing.T) {
+	current := []chart{
+		{Name: "mysql", ChartVersions: []chartVersion{{Version: "1.0.0", Digest: "a"}, {Version: "0.9.0", Digest: "b"}}},
+		{Name: "redis", ChartVersions: []chartVersion{{Version: "2.0.0", Digest: "c"}}},
+	}
+	next := []chart{
+		{Name: "mysql", ChartVersions: []chartVersion{{Version: "1.1.0", Digest: "d"}, {Version: "1.0.0", Digest: "e"}}},
+		{Name: "wordpress", ChartVersions: []chartVersion{{Version: "0.7.5", Digest: "f"}}},
+	}
+
+	var plan syncPlan
+	diffCharts(&plan, current, next)
+	assert.Equal(t, plan.AddedCharts, []string{"wordpress"}, "added charts")
+	assert.Equal(t, plan.RemovedCharts, []string{"redis"}, "removed charts")
+	assert.Equal(t, plan.AddedVersions, []planVersion{{"mysql", "1.1.0"}, {"wordpress", "0.7.5"}}, "added versions")
+	assert.Equal(t, plan.RemovedVersions, []planVersion{{"mysql", "0.9.0"}, {"redis", "2.0.0"}}, "removed versions")
+	assert.Equal(t, plan.ChangedDigests, []planDigest{{"mysql", "1.0.0", "a", "e"}}, "changed digests")
+	assert.Equal(t, plan.Counts, map[string]int{"charts": 2, "versions": 3}, "counts")
+	assert.True(t, plan.hasChanges(), "has changes")
+
+	diffCharts(&plan, next, next)
+	assert.False(t, plan.hasChanges(), "has changes")
+}
+
+func Test_planSync(t *testing.T) {
+	broken := false
+	server := newSingleChartRepo(&broken)
+	defer server.Close()
+	netClient = server.Client()
+
+	dbSession := localstore.New()
+	assert.NoErr(t, updateRepoStatus(dbSession, repoStatus{ID: "test", URL: "https://old.example.com", Generation: 2}))
+	assert.NoErr(t, dbSession.Insert(chartCollection, chart{ID: "test/mysql@2", Name: "mysql", Repo: repo{Name: "test"}, Generation: 2, ChartVersions: []chartVersion{{Version: "1.0.0", Digest: "old"}}}))
+	plan, err := planSync(dbSession, repo{Name: "test", URL: server.URL})
+	assert.NoErr(t, err)
+
+	// Nothing is written
+	status, err := getRepoStatus(dbSession, "test")
+	assert.NoErr(t, err)
+	assert.Equal(t, status.URL, "https://old.example.com", "URL of the repo")
+	assert.Equal(t, status.Generation, int64(2), "active generation")
+	assert.Equal(t, documentIDs(t, dbSession, chartCollection), []string{"test/mysql@2"}, "charts")
+	assert.Equal(t, documentIDs(t, dbSession, chartFilesCollection), []string{}, "files")
+	assert.Equal(t, documentIDs(t, dbSession, jobsCollection), []string{}, "import jobs")
+	assert.Equal(t, plan.PreviousURL, "https://old.example.com", "previous URL")
+	assert.Equal(t, plan.ChangedDigests, []planDigest{{"mysql", "1.0.0", "old", testDigest}}, "changed digests")
+	assert.Equal(t, len(plan.AddedCharts)+len(plan.RemovedCharts), 0, "added and removed charts")
+
+	var buf bytes.Buffer
+	assert.NoErr(t, printSyncPlan(&buf, plan, planOutputJSON))
+	var decoded map[string]interface{}
+	assert.NoErr(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, decoded["previousURL"], "https://old.example.com", "previous URL")
+	assert.Equal(t, decoded["addedCharts"], []interface{}{}, "added charts")
+	assert.Equal(t, len(decoded["changedDigests"].([]interface{})), 1, "changed digests")
+
+	buf.Reset()
+	assert.NoErr(t, printSyncPlan(&buf, plan, planOutputText))
+	assert.True(t, strings.Contains(buf.String(), "change digest  mysql  1.0.0    old -> "+testDigest), "text plan:\n%s", buf.String())
+	assert.ExistsErr(t, printSyncPlan(&buf, plan, "yaml"), "invalid output")
+}
@@ -0,0 +1,322 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/lib/pq"
+)
+
+// pgSchema creates the table of the charts. The documents are stored as BSON
+// extended JSON, so that they are the same as in MongoDB, without their ID and
+// icon, which have their own columns. Charts written before generations
+// existed have generation 0.
+const pgSchema = `
+CREATE TABLE IF NOT EXISTS charts (
+	id text PRIMARY KEY,
+	repo text NOT NULL,
+	name text NOT NULL,
+	generation bigint NOT NULL DEFAULT 0,
+	raw_icon bytea,
+	doc jsonb NOT NULL
+);
+CREATE INDEX IF NOT EXISTS charts_repo_generation ON charts (repo, generation);
+CREATE INDEX IF NOT EXISTS charts_name ON charts (name);
+`
+
+// pgCatalog stores the charts in PostgreSQL
+type pgCatalog struct {
+	db *sql.DB
+}
+
+// openPGCatalog connects to PostgreSQL and creates the table of the charts if
+// needed
+func openPGCatalog(url string) (*pgCatalog, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(pgSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't create the catalog in PostgreSQL: %v", err)
+	}
+	return &pgCatalog{db}, nil
+}
+
+func (c *pgCatalog) listCharts(repoName string) ([]chart, error) {
+	if repoName == "" {
+		return c.query(`SELECT id, doc FROM charts ORDER BY id`)
+	}
+	return c.query(`SELECT id, doc FROM charts WHERE repo = $1 ORDER BY id`, repoName)
+}
+
+func (c *pgCatalog) listGeneration(repoName string, generation int64) ([]chart, error) {
+	return c.query(`SELECT id, doc FROM charts WHERE repo = $1 AND generation = $2 ORDER BY id`, repoName, generation)
+}
+
+func (c *pgCatalog) listChartsWithIcon(repoName string, generation int64) ([]string, error) {
+	rows, err := c.db.Query(`SELECT id FROM charts WHERE repo = $1 AND generation = $2 AND raw_icon IS NOT NULL ORDER BY id`, repoName, generation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (c *pgCatalog) query(query string, args ...interface{}) ([]chart, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var charts []chart
+	for rows.Next() {
+		var ch chart
+		if err := scanPGChart(rows, &ch, false); err != nil {
+			return nil, err
+		}
+		charts = append(charts, ch)
+	}
+	return charts, rows.Err()
+}
+
+func (c *pgCatalog) getChart(id string) (chart, error) {
+	var ch chart
+	err := scanPGChart(c.db.QueryRow(`SELECT id, doc FROM charts WHERE id = $1`, id), &ch, false)
+	if err == sql.ErrNoRows {
+		err = mgo.ErrNotFound
+	}
+	return ch, err
+}
+
+func (c *pgCatalog) upsertCharts(charts []chart) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var chartIDs []string
+	for _, ch := range charts {
+		chartIDs = append(chartIDs, ch.ID)
+		doc, err := toBSONDoc(ch)
+		if err != nil {
+			return err
+		}
+		if err := upsertPGChart(tx, doc); err != nil {
+			return err
+		}
+	}
+	// Remove charts no longer existing in index, left by a previous attempt
+	// to write the same generation
+	if _, err := tx.Exec(`DELETE FROM charts WHERE repo = $1 AND generation = $2 AND id <> ALL($3)`,
+		charts[0].Repo.Name, charts[0].Generation, pq.Array(chartIDs)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *pgCatalog) setChartIcon(id string, icon []byte) error {
+	res, err := c.db.Exec(`UPDATE charts SET raw_icon = $2 WHERE id = $1`, id, icon)
+	return pgUpdated(res, err)
+}
+
+func (c *pgCatalog) updateChartVersion(id string, i int, fields bson.M) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for k, v := range fields {
+		// Structs are marshalled through BSON, to get the same field names as
+		// in the rest of the document
+		if doc, ok := toBSONValue(v); ok {
+			v = doc
+		}
+		value, err := bson.MarshalJSON(v)
+		if err != nil {
+			return err
+		}
+		path := []string{"chartversions", fmt.Sprint(i), k}
+		res, err := tx.Exec(`UPDATE charts SET doc = jsonb_set(doc, $2, $3::jsonb) WHERE id = $1`, id, pq.Array(path), string(value))
+		if err := pgUpdated(res, err); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (c *pgCatalog) deleteCharts(repoName string, keep ...int64) error {
+	if len(keep) == 0 {
+		_, err := c.db.Exec(`DELETE FROM charts WHERE repo = $1`, repoName)
+		return err
+	}
+	_, err := c.db.Exec(`DELETE FROM charts WHERE repo = $1 AND generation <> ALL($2)`, repoName, pq.Array(keep))
+	return err
+}
+
+func (c *pgCatalog) deleteOtherRepos(repoNames []string) (int, error) {
+	res, err := c.db.Exec(`DELETE FROM charts WHERE repo <> ALL($1)`, pq.Array(repoNames))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (c *pgCatalog) exportCharts(repoName string, generation int64) ([]bson.M, error) {
+	rows, err := c.db.Query(`SELECT id, doc, raw_icon FROM charts WHERE repo = $1 AND generation = $2 ORDER BY id`, repoName, generation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var docs []bson.M
+	for rows.Next() {
+		var doc bson.M
+		if err := scanPGChart(rows, &doc, true); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (c *pgCatalog) restoreCharts(docs []bson.M) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, doc := range docs {
+		if err := upsertPGChart(tx, doc); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// upsertPGChart writes the chart document. The icon of the chart is only
+// replaced if the document has one.
+func upsertPGChart(tx *sql.Tx, doc bson.M) error {
+	var ch chart
+	if err := fromBSONDoc(doc, &ch); err != nil {
+		return err
+	}
+	icon, _ := doc["raw_icon"].([]byte)
+	rest := bson.M{}
+	for k, v := range doc {
+		if k != "_id" && k != "raw_icon" {
+			rest[k] = v
+		}
+	}
+	data, err := bson.MarshalJSON(rest)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+INSERT INTO charts (id, repo, name, generation, raw_icon, doc) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (id) DO UPDATE SET repo = excluded.repo, name = excluded.name, generation = excluded.generation,
+	raw_icon = COALESCE(excluded.raw_icon, charts.raw_icon), doc = excluded.doc`,
+		ch.ID, ch.Repo.Name, ch.Name, ch.Generation, icon, string(data))
+	return err
+}
+
+// scanPGChart reads a row of ID, document and optionally icon into v
+func scanPGChart(row interface {
+	Scan(...interface{}) error
+}, v interface{}, withIcon bool) error {
+	var id, data string
+	var icon []byte
+	dest := []interface{}{&id, &data}
+	if withIcon {
+		dest = append(dest, &icon)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	var doc bson.M
+	if err := bson.UnmarshalJSON([]byte(data), &doc); err != nil {
+		return fmt.Errorf("invalid document of chart %s: %v", id, err)
+	}
+	doc["_id"] = id
+	if icon != nil {
+		doc["raw_icon"] = icon
+	}
+	if m, ok := v.(*bson.M); ok {
+		*m = doc
+		return nil
+	}
+	return fromBSONDoc(doc, v)
+}
+
+// pgUpdated returns mgo.ErrNotFound if the statement didn't update any row,
+// like UpdateId
+func pgUpdated(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = mgo.ErrNotFound
+	}
+	return err
+}
+
+// toBSONDoc returns the document v is stored as in MongoDB
+func toBSONDoc(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// toBSONValue returns the document a struct is stored as in MongoDB, and
+// false for values that aren't stored as documents
+func toBSONValue(v interface{}) (bson.M, bool) {
+	data, err := bson.Marshal(bson.M{"v": v})
+	if err != nil {
+		return nil, false
+	}
+	var doc struct{ V bson.M }
+	if err := bson.Unmarshal(data, &doc); err != nil || doc.V == nil {
+		return nil, false
+	}
+	return doc.V, true
+}
+
+// fromBSONDoc reads a document into v, like when it's read from MongoDB
+func fromBSONDoc(doc bson.M, v interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, v)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/globalsign/mgo/bson"
+)
+
+// fakePGRow is a row read from PostgreSQL
+type fakePGRow []interface{}
+
+func (r fakePGRow) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *string:
+			*d = r[i].(string)
+		case *[]byte:
+			*d = r[i].([]byte)
+		}
+	}
+	return nil
+}
+
+// pgRow returns the row the document is stored as in PostgreSQL
+func pgRow(t *testing.T, doc bson.M) fakePGRow {
+	rest := bson.M{}
+	for k, v := range doc {
+		if k != "_id" && k != "raw_icon" {
+			rest[k] = v
+		}
+	}
+	data, err := bson.MarshalJSON(rest)
+	assert.NoErr(t, err)
+	icon, _ := doc["raw_icon"].([]byte)
+	return fakePGRow{doc["_id"], string(data), icon}
+}
+
+func Test_scanPGChart(t *testing.T) {
+	c := chart{
+		ID:         "stable/mysql@2",
+		Name:       "mysql",
+		Repo:       repo{Name: "stable", URL: "https://kubernetes-charts.storage.googleapis.com"},
+		Keywords:   []string{"database"},
+		Generation: 2,
+		ChartVersions: []chartVersion{{
+			Version:    "0.1.0",
+			Created:    time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+			Digest:     "123",
+			URLs:       []string{"mysql-0.1.0.tgz"},
+			Provenance: &provenance{State: provenanceVerified, SignedBy: "Helm"},
+		}},
+	}
+	doc, err := toBSONDoc(c)
+	assert.NoErr(t, err)
+
+	t.Run("chart", func(t *testing.T) {
+		var got chart
+		assert.NoErr(t, scanPGChart(pgRow(t, doc), &got, false))
+		assert.Equal(t, got.ID, c.ID, "ID")
+		assert.Equal(t, got.Generation, c.Generation, "generation")
+		assert.Equal(t, got.Repo, c.Repo, "repo")
+		assert.Equal(t, got.Keywords, c.Keywords, "keywords")
+		assert.Equal(t, len(got.ChartVersions), 1, "number of versions")
+		assert.True(t, got.ChartVersions[0].Created.Equal(c.ChartVersions[0].Created), "creation time")
+		assert.Equal(t, *got.ChartVersions[0].Provenance, *c.ChartVersions[0].Provenance, "provenance")
+	})
+
+	t.Run("exported document", func(t *testing.T) {
+		doc["raw_icon"] = []byte("icon")
+		var got bson.M
+		assert.NoErr(t, scanPGChart(pgRow(t, doc), &got, true))
+		assert.Equal(t, got["_id"], c.ID, "ID")
+		assert.Equal(t, got["raw_icon"], []byte("icon"), "icon")
+		assert.Equal(t, got["name"], c.Name, "name")
+	})
+}
+
+func Test_toBSONValue(t *testing.T) {
+	doc, ok := toBSONValue(mirroredFiles{Tarball: "123"})
+	assert.True(t, ok, "structs are documents")
+	assert.Equal(t, doc, bson.M{"tarball": "123"}, "document")
+
+	_, ok = toBSONValue(true)
+	assert.False(t, ok, "booleans aren't documents")
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	helmprovenance "k8s.io/helm/pkg/provenance"
+)
+
+// verifyProvenance verifies the provenance file of a chart version against
+// the keyring of the repo. Chart versions without a provenance file are
+// reported as unsigned.
+func verifyProvenance(r repo, source chartSource, name string, cv chartVersion, tarball []byte) (*provenance, error) {
+	provReader, err := source.openProvenance(cv)
+	if err == errFileNotFound {
+		return &provenance{State: provenanceUnsigned}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer provReader.Close()
+	prov, err := ioutil.ReadAll(provReader)
+	if err != nil {
+		return nil, err
+	}
+
+	signatory, err := helmprovenance.NewFromKeyring(r.Keyring, "")
+	if err != nil {
+		return nil, fmt.Errorf("can't load keyring %s: %v", r.Keyring, err)
+	}
+
+	// The provenance package only verifies files, named after the tarball since
+	// its name is part of the signed message
+	dir, err := ioutil.TempDir("", "chart-repo-provenance")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	chartPath := filepath.Join(dir, tarballFileName(name, cv))
+	if err := ioutil.WriteFile(chartPath, tarball, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(chartPath+".prov", prov, 0600); err != nil {
+		return nil, err
+	}
+
+	verification, err := signatory.Verify(chartPath, chartPath+".prov")
+	if err != nil {
+		return &provenance{State: provenanceInvalid, Error: err.Error()}, nil
+	}
+	return &provenance{
+		State:          provenanceVerified,
+		SignedBy:       signerIdentity(verification.SignedBy),
+		KeyFingerprint: fmt.Sprintf("%X", verification.SignedBy.PrimaryKey.Fingerprint),
+	}, nil
+}
+
+// signerIdentity returns the primary identity of the key, or the first one in
+// alphabetical order if none is marked as primary
+func signerIdentity(e *openpgp.Entity) string {
+	var names []string
+	for name, id := range e.Identities {
+		if id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil && *id.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// loadKnownProvenance sets the provenance of the chart versions that have
+// already been verified, according to the files of the generation of the repo,
+// so that upserting the charts doesn't clear it
+func loadKnownProvenance(dbSession datastore.Session, r repo, charts []chart) error {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	ids := []string{}
+	for _, c := range charts {
+		for _, cv := range c.ChartVersions {
+			ids = append(ids, chartFilesID(r, c.Name, cv.Version))
+		}
+	}
+	var files []chartFiles
+	err := db.C(chartFilesCollection).Find(bson.M{
+		"_id":        bson.M{"$in": ids},
+		"provenance": bson.M{"$exists": true},
+	}).Select(bson.M{"_id": 1, "digest": 1, "provenance": 1}).All(&files)
+	if err != nil {
+		return err
+	}
+	known := map[string]chartFiles{}
+	for _, f := range files {
+		known[f.ID] = f
+	}
+
+	for i := range charts {
+		for j := range charts[i].ChartVersions {
+			cv := &charts[i].ChartVersions[j]
+			if f, ok := known[chartFilesID(r, charts[i].Name, cv.Version)]; ok && f.Digest == cv.Digest {
+				cv.Provenance = f.Provenance
+			}
+		}
+	}
+	log.WithFields(log.Fields{"repo": r.Name, "count": len(files)}).Debug("loaded known provenance")
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// newTestKeyring generates a signing key and writes its public key to a
+// keyring file
+func newTestKeyring(t *testing.T, dir string) (*openpgp.Entity, string) {
+	e, err := openpgp.NewEntity("Chart Signer", "", "signer@example.com", nil)
+	assert.NoErr(t, err)
+	// Serializing the private key signs the identities and subkeys, which is
+	// required to serialize the public key
+	assert.NoErr(t, e.SerializePrivate(ioutil.Discard, nil))
+	var b bytes.Buffer
+	assert.NoErr(t, e.Serialize(&b))
+	f, err := ioutil.TempFile(dir, "pubring")
+	assert.NoErr(t, err)
+	defer f.Close()
+	_, err = f.Write(b.Bytes())
+	assert.NoErr(t, err)
+	return e, f.Name()
+}
+
+// signTarball returns the provenance file of the tarball, as generated by helm
+// package --sign
+func signTarball(t *testing.T, e *openpgp.Entity, filename string, tarball []byte) []byte {
+	message := fmt.Sprintf("name: test\nversion: 1.0.0\n\n...\nfiles:\n  %s: sha256:%s\n", filename, tarballDigest(tarball))
+	var b bytes.Buffer
+	w, err := clearsign.Encode(&b, e.PrivateKey, nil)
+	assert.NoErr(t, err)
+	_, err = w.Write([]byte(message))
+	assert.NoErr(t, err)
+	assert.NoErr(t, w.Close())
+	return b.Bytes()
+}
+
+// signedTarballClient serves a tarball and its provenance file, if any
+type signedTarballClient struct {
+	tarball []byte
+	prov    []byte
+}
+
+func (h *signedTarballClient) Do(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	switch {
+	case strings.HasSuffix(req.URL.Path, ".prov") && h.prov != nil:
+		w.Write(h.prov)
+	case strings.HasSuffix(req.URL.Path, ".tgz"):
+		w.Write(h.tarball)
+	default:
+		w.WriteHeader(404)
+	}
+	return w.Result(), nil
+}
+
+func Test_verifyProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-repo-test")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	signer, keyring := newTestKeyring(t, dir)
+	other, _ := newTestKeyring(t, dir)
+	r := repo{Name: "test", URL: "http://testrepo.com", Keyring: keyring}
+	cv := chartVersion{Version: "1.0.0", URLs: []string{"http://testrepo.com/charts/test-1.0.0.tgz"}}
+	tarball := (&goodTarballClient{c: chart{Name: "test"}}).tarball()
+
+	t.Run("verified", func(t *testing.T) {
+		netClient = &signedTarballClient{tarball: tarball, prov: signTarball(t, signer, "test-1.0.0.tgz", tarball)}
+		prov, err := verifyProvenance(r, httpSource{r}, "test", cv, tarball)
+		assert.NoErr(t, err)
+		assert.Equal(t, *prov, provenance{
+			State:          provenanceVerified,
+			SignedBy:       "Chart Signer <signer@example.com>",
+			KeyFingerprint: fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint),
+		}, "provenance")
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		netClient = &signedTarballClient{tarball: tarball}
+		prov, err := verifyProvenance(r, httpSource{r}, "test", cv, tarball)
+		assert.NoErr(t, err)
+		assert.Equal(t, *prov, provenance{State: provenanceUnsigned}, "provenance")
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		netClient = &signedTarballClient{tarball: tarball, prov: signTarball(t, other, "test-1.0.0.tgz", tarball)}
+		prov, err := verifyProvenance(r, httpSource{r}, "test", cv, tarball)
+		assert.NoErr(t, err)
+		assert.Equal(t, prov.State, provenanceInvalid, "provenance state")
+	})
+
+	t.Run("tampered tarball", func(t *testing.T) {
+		netClient = &signedTarballClient{tarball: tarball, prov: signTarball(t, signer, "test-1.0.0.tgz", []byte("original tarball"))}
+		prov, err := verifyProvenance(r, httpSource{r}, "test", cv, tarball)
+		assert.NoErr(t, err)
+		assert.Equal(t, prov.State, provenanceInvalid, "provenance state")
+	})
+
+	t.Run("missing keyring", func(t *testing.T) {
+		netClient = &signedTarballClient{tarball: tarball, prov: signTarball(t, signer, "test-1.0.0.tgz", tarball)}
+		r := r
+		r.Keyring = filepath.Join(dir, "missing.gpg")
+		_, err := verifyProvenance(r, httpSource{r}, "test", cv, tarball)
+		assert.ExistsErr(t, err, "missing keyring")
+	})
+}
+
+func Test_fetchAndImportFilesProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-repo-test")
+	assert.NoErr(t, err)
+	defer os.RemoveAll(dir)
+	signer, keyring := newTestKeyring(t, dir)
+
+	index, _ := parseRepoIndex([]byte(validRepoIndexYAML))
+	charts := chartsFromIndex(index, repo{Name: "test", URL: "http://testrepo.com", Keyring: keyring})
+	cv := charts[0].ChartVersions[0]
+	tarball := (&goodTarballClient{c: charts[0]}).tarball()
+	cv.Digest = tarballDigest(tarball)
+	filename := filepath.Base(chartTarballURL(charts[0].Repo, cv))
+	netClient = &signedTarballClient{tarball: tarball, prov: signTarball(t, signer, filename, tarball)}
+
+	prov := &provenance{
+		State:          provenanceVerified,
+		SignedBy:       "Chart Signer <signer@example.com>",
+		KeyFingerprint: fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint),
+	}
+	dbSession := localstore.New()
+	assert.NoErr(t, dbSession.Insert(chartCollection, charts[0]))
+
+	err = fetchAndImportFiles(dbSession, charts[0].Name, charts[0].Repo, cv)
+	assert.NoErr(t, err)
+	c, err := newCatalog(dbSession).getChart(charts[0].ID)
+	assert.NoErr(t, err)
+	assert.Equal(t, c.ChartVersions[0].Provenance, prov, "provenance of the chart version")
+	chartFilesID := chartFilesID(charts[0].Repo, charts[0].Name, cv.Version)
+	assert.Equal(t, getChartFiles(t, dbSession, chartFilesID), chartFiles{chartFilesID, testChartReadme, testChartValues, storedRepo(charts[0].Repo), cv.Digest, prov}, "files")
+}
+
+func Test_loadKnownProvenance(t *testing.T) {
+	prov := &provenance{State: provenanceVerified, SignedBy: "Chart Signer <signer@example.com>"}
+	dbSession := localstore.New()
+	assert.NoErr(t, dbSession.Insert(chartFilesCollection,
+		chartFiles{ID: "test/wordpress-1.0.0@2", Repo: repo{Name: "test"}, Digest: "123", Provenance: prov},
+		chartFiles{ID: "test/wordpress-0.9.0@2", Repo: repo{Name: "test"}, Digest: "old", Provenance: prov},
+		// Files of another generation are ignored
+		chartFiles{ID: "test/wordpress-0.9.0@1", Repo: repo{Name: "test"}, Digest: "new", Provenance: prov},
+	))
+	charts := []chart{
+		{Name: "wordpress", ChartVersions: []chartVersion{{Version: "1.0.0", Digest: "123"}, {Version: "0.9.0", Digest: "new"}}},
+	}
+
+	err := loadKnownProvenance(dbSession, repo{Name: "test", Generation: 2}, charts)
+	assert.NoErr(t, err)
+	assert.Equal(t, charts[0].ChartVersions[0].Provenance, prov, "provenance of unchanged version")
+	assert.Nil(t, charts[0].ChartVersions[1].Provenance, "provenance of changed version")
+}
@@ -0,0 +1,564 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const jobsCollection = "jobs"
+
+// Kinds of import jobs
+const (
+	iconJobKind   = "icon"
+	filesJobKind  = "files"
+	mirrorJobKind = "mirror"
+)
+
+// States of import jobs
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Jobs are claimed by increasing priority, so that the icons and then the
+// files of the latest version of every chart are imported first, and the
+// tarballs of mirrored repos are copied last
+const (
+	iconJobPriority = iota
+	latestFilesJobPriority
+	filesJobPriority
+	mirrorJobPriority
+)
+
+// importJob imports the icon of a chart or the files of a chart version. The
+// jobs of a sync are stored in the jobs collection, and can be run by any
+// process until the sync completes.
+type importJob struct {
+	ID           string `bson:"_id,omitempty"`
+	Kind         string
+	Repo         queuedRepo
+	Generation   int64
+	Priority     int
+	ChartID      string
+	ChartName    string
+	Icon         string `bson:",omitempty"`
+	ChartVersion chartVersion
+	State        string
+	Attempts     int
+	Error        string `bson:",omitempty"`
+	// The job can be claimed from then on. A running job that isn't completed
+	// by then, e.g. because its worker was killed, is claimed again.
+	VisibleAt time.Time
+	// Changed by every claim, so that only the worker holding the job
+	// completes it
+	ClaimToken string
+	Worker     string `bson:",omitempty"`
+}
+
+// queuedRepo is the configuration of a repo needed to run its jobs, without
+// its credentials
+type queuedRepo struct {
+	Name               string
+	URL                string
+	SourceType         string
+	Keyring            string
+	PlainHTTP          bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	GitRef             string
+	GitWebURL          string
+	Mirror             bool
+	// Set if the repo has credentials that aren't stored in the database, so
+	// only the sync that enqueued its jobs can run them
+	Local bool
+}
+
+func newQueuedRepo(r repo) queuedRepo {
+	return queuedRepo{
+		Name:               r.Name,
+		URL:                r.URL,
+		SourceType:         r.SourceType,
+		Keyring:            r.Keyring,
+		PlainHTTP:          r.PlainHTTP,
+		CAFile:             r.CAFile,
+		CertFile:           r.CertFile,
+		KeyFile:            r.KeyFile,
+		InsecureSkipVerify: r.InsecureSkipVerify,
+		GitRef:             r.GitRef,
+		GitWebURL:          r.GitWebURL,
+		Mirror:             r.Mirror,
+		Local:              r.AuthorizationHeader != "" && !r.StoredCredentials,
+	}
+}
+
+func (qr queuedRepo) repo(generation int64) repo {
+	return repo{
+		Name:               qr.Name,
+		URL:                qr.URL,
+		SourceType:         qr.SourceType,
+		Keyring:            qr.Keyring,
+		PlainHTTP:          qr.PlainHTTP,
+		CAFile:             qr.CAFile,
+		CertFile:           qr.CertFile,
+		KeyFile:            qr.KeyFile,
+		InsecureSkipVerify: qr.InsecureSkipVerify,
+		GitRef:             qr.GitRef,
+		GitWebURL:          qr.GitWebURL,
+		Mirror:             qr.Mirror,
+		Generation:         generation,
+	}
+}
+
+// queueConfig controls how the import jobs are run
+type queueConfig struct {
+	// Time a worker has to complete a job before it's claimed again
+	visibilityTimeout time.Duration
+	// Failed jobs are retried until they've been attempted this many times
+	maxAttempts int
+	retryDelay  time.Duration
+	// How often idle workers check for new jobs
+	pollInterval time.Duration
+}
+
+var defaultQueueConfig = queueConfig{
+	visibilityTimeout: 5 * time.Minute,
+	maxAttempts:       3,
+	retryDelay:        10 * time.Second,
+	pollInterval:      2 * time.Second,
+}
+
+var queue = defaultQueueConfig
+
+// addQueueFlags adds the flags setting the queue config
+func addQueueFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("job-visibility-timeout", defaultQueueConfig.visibilityTimeout, "time to run an import job before it's claimed by another worker")
+	cmd.Flags().Int("job-max-attempts", defaultQueueConfig.maxAttempts, "number of times a failing import job is attempted")
+	cmd.Flags().Duration("job-poll-interval", defaultQueueConfig.pollInterval, "how often idle workers check for new import jobs")
+}
+
+// applyQueueFlags sets the queue config from the flags of the command
+func applyQueueFlags(cmd *cobra.Command) error {
+	var err error
+	config := defaultQueueConfig
+	if config.visibilityTimeout, err = cmd.Flags().GetDuration("job-visibility-timeout"); err != nil {
+		return err
+	}
+	if config.maxAttempts, err = cmd.Flags().GetInt("job-max-attempts"); err != nil {
+		return err
+	}
+	if config.pollInterval, err = cmd.Flags().GetDuration("job-poll-interval"); err != nil {
+		return err
+	}
+	if config.maxAttempts < 1 {
+		return errors.New("--job-max-attempts must be at least 1")
+	}
+	if config.visibilityTimeout < time.Second {
+		return errors.New("--job-visibility-timeout must be at least 1s")
+	}
+	queue = config
+	return nil
+}
+
+// newImportJobs returns the jobs importing the icons and files of the charts
+func newImportJobs(r repo, charts []chart) []importJob {
+	qr := newQueuedRepo(r)
+	prefix := fmt.Sprintf("%s@%d", r.Name, r.Generation)
+	var result []importJob
+	for _, c := range charts {
+		result = append(result, importJob{
+			ID:         fmt.Sprintf("%s/icon/%s", prefix, c.Name),
+			Kind:       iconJobKind,
+			Repo:       qr,
+			Generation: r.Generation,
+			Priority:   iconJobPriority,
+			ChartID:    c.ID,
+			ChartName:  c.Name,
+			Icon:       c.Icon,
+		})
+	}
+	for _, c := range charts {
+		for i, cv := range c.ChartVersions {
+			priority := filesJobPriority
+			if i == 0 {
+				priority = latestFilesJobPriority
+			}
+			// The digest is part of the ID, so that changed chart versions are
+			// imported again when resuming a sync
+			result = append(result, importJob{
+				ID:           fmt.Sprintf("%s/files/%s-%s@%s", prefix, c.Name, cv.Version, cv.Digest),
+				Kind:         filesJobKind,
+				Repo:         qr,
+				Generation:   r.Generation,
+				Priority:     priority,
+				ChartID:      c.ID,
+				ChartName:    c.Name,
+				ChartVersion: cv,
+			})
+		}
+	}
+	if r.Mirror {
+		for _, c := range charts {
+			for _, cv := range c.ChartVersions {
+				result = append(result, importJob{
+					ID:           fmt.Sprintf("%s/mirror/%s-%s@%s", prefix, c.Name, cv.Version, cv.Digest),
+					Kind:         mirrorJobKind,
+					Repo:         qr,
+					Generation:   r.Generation,
+					Priority:     mirrorJobPriority,
+					ChartID:      c.ID,
+					ChartName:    c.Name,
+					ChartVersion: cv,
+				})
+			}
+		}
+	}
+	return result
+}
+
+// missingImportJobs returns the jobs importing the icons, files and mirrored
+// tarballs of the charts that haven't been imported
+func missingImportJobs(dbSession datastore.Session, r repo, charts []chart) ([]importJob, error) {
+	withIcon, err := newCatalog(dbSession).listChartsWithIcon(r.Name, r.Generation)
+	if err != nil {
+		return nil, err
+	}
+	hasIcon := map[string]bool{}
+	for _, id := range withIcon {
+		hasIcon[id] = true
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+	var files []chartFiles
+	err = db.C(chartFilesCollection).Find(bson.M{"repo.name": r.Name}).Select(bson.M{"_id": 1, "digest": 1, "provenance": 1}).All(&files)
+	if err != nil {
+		return nil, err
+	}
+	imported := map[string]chartFiles{}
+	for _, f := range files {
+		imported[f.ID] = f
+	}
+
+	var missing []importJob
+	for _, j := range newImportJobs(r, charts) {
+		switch j.Kind {
+		case iconJobKind:
+			if j.Icon == "" || hasIcon[j.ChartID] {
+				continue
+			}
+		case filesJobKind:
+			// Same check as fetchAndImportFiles
+			f, ok := imported[chartFilesID(r, j.ChartName, j.ChartVersion.Version)]
+			if ok && f.Digest == j.ChartVersion.Digest && (r.Keyring == "" || f.Provenance != nil) {
+				continue
+			}
+		case mirrorJobKind:
+			if j.ChartVersion.Mirror != nil {
+				continue
+			}
+		}
+		missing = append(missing, j)
+	}
+	return missing, nil
+}
+
+// enqueueImportJobs stores the jobs as pending. Jobs already stored by an
+// interrupted sync of the same generation are kept as they are, so that the
+// sync resumes where it stopped.
+func enqueueImportJobs(dbSession datastore.Session, r repo, importJobs []importJob) error {
+	now := time.Now()
+	var pairs []interface{}
+	ids := []string{}
+	for _, j := range importJobs {
+		j.State = jobPending
+		j.VisibleAt = now
+		j.ClaimToken = randomToken()
+		ids = append(ids, j.ID)
+		selector := bson.M{"_id": j.ID}
+		j.ID = ""
+		pairs = append(pairs, selector, bson.M{"$setOnInsert": j})
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+	bulk := db.C(jobsCollection).Bulk()
+	bulk.Upsert(pairs...)
+	// Remove the jobs of an interrupted sync for charts no longer in the index
+	bulk.RemoveAll(bson.M{
+		"_id":        bson.M{"$nin": ids},
+		"repo.name":  r.Name,
+		"generation": r.Generation,
+	})
+	_, err := bulk.Run()
+	return err
+}
+
+// claimableJobs returns the selector of the jobs that can be claimed now,
+// among the ones matching the given selector
+func claimableJobs(selector bson.M) bson.M {
+	claimable := bson.M{
+		"state":     bson.M{"$in": []string{jobPending, jobRunning}},
+		"visibleat": bson.M{"$lte": time.Now()},
+	}
+	for k, v := range selector {
+		claimable[k] = v
+	}
+	return claimable
+}
+
+// claimImportJob claims the next job matching the selector for the worker,
+// returning nil if there's none
+func claimImportJob(dbSession datastore.Session, selector bson.M, worker string) (*importJob, error) {
+	db, closer := dbSession.DB()
+	defer closer()
+	c := db.C(jobsCollection)
+
+	for {
+		var job importJob
+		err := c.Find(claimableJobs(selector)).Sort("priority", "visibleat").One(&job)
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Claiming the job changes its token, so only one of the workers
+		// claiming it at the same time matches its previous token. The others
+		// fail to upsert a document with the same ID.
+		token := randomToken()
+		info, err := c.Upsert(
+			bson.M{"_id": job.ID, "claimtoken": job.ClaimToken},
+			bson.M{
+				"$set": bson.M{"state": jobRunning, "claimtoken": token, "worker": worker, "visibleat": time.Now().Add(queue.visibilityTimeout)},
+				"$inc": bson.M{"attempts": 1},
+			},
+		)
+		if mgo.IsDup(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info != nil && info.UpsertedId != nil {
+			// The job was removed in the meantime
+			c.RemoveAll(bson.M{"_id": job.ID, "claimtoken": token})
+			continue
+		}
+		job.State = jobRunning
+		job.ClaimToken = token
+		job.Worker = worker
+		job.Attempts++
+		return &job, nil
+	}
+}
+
+// extendImportJob postpones the time the running job can be claimed again by
+// another worker, failing if it has been claimed by another worker already
+func extendImportJob(dbSession datastore.Session, job importJob) error {
+	db, closer := dbSession.DB()
+	defer closer()
+	err := updateDoc(db.C(jobsCollection),
+		bson.M{"_id": job.ID, "claimtoken": job.ClaimToken},
+		bson.M{"$set": bson.M{"visibleat": time.Now().Add(queue.visibilityTimeout)}},
+	)
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("job %s has been claimed by another worker or removed", job.ID)
+	}
+	return err
+}
+
+// completeImportJob records the outcome of the job. Failed jobs are retried
+// later, until they've been attempted queue.maxAttempts times.
+func completeImportJob(dbSession datastore.Session, job importJob, jobErr error) error {
+	update := bson.M{"state": jobDone, "error": ""}
+	if jobErr != nil {
+		update = bson.M{"state": jobFailed, "error": jobErr.Error()}
+		if job.Attempts < queue.maxAttempts {
+			update["state"] = jobPending
+			update["visibleat"] = time.Now().Add(queue.retryDelay << uint(job.Attempts-1))
+		}
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+	// The job is only updated if it hasn't been claimed again by another worker
+	c := db.C(jobsCollection)
+	info, err := c.Upsert(bson.M{"_id": job.ID, "claimtoken": job.ClaimToken}, bson.M{"$set": update})
+	if mgo.IsDup(err) {
+		return fmt.Errorf("job %s has been claimed by another worker", job.ID)
+	}
+	if err == nil && info != nil && info.UpsertedId != nil {
+		c.RemoveAll(bson.M{"_id": job.ID, "claimtoken": job.ClaimToken})
+	}
+	return err
+}
+
+// runImportJob runs the job on behalf of the repo
+func runImportJob(dbSession datastore.Session, job importJob, r repo) error {
+	switch job.Kind {
+	case iconJobKind:
+		log.WithFields(log.Fields{"name": job.ChartName}).Debug("importing icon")
+		return fetchAndImportIcon(dbSession, chart{ID: job.ChartID, Name: job.ChartName, Icon: job.Icon, Repo: r})
+	case filesJobKind:
+		log.WithFields(log.Fields{"name": job.ChartName, "version": job.ChartVersion.Version}).Debug("importing readme and values")
+		return fetchAndImportFiles(dbSession, job.ChartName, r, job.ChartVersion)
+	case mirrorJobKind:
+		log.WithFields(log.Fields{"name": job.ChartName, "version": job.ChartVersion.Version}).Debug("mirroring chart version")
+		return mirrorChartVersion(dbSession, newBlobStore(dbSession), r, job.ChartName, job.ChartVersion)
+	}
+	return fmt.Errorf("unknown job kind %q", job.Kind)
+}
+
+// processImportJobs claims and runs the jobs matching the selector until
+// there's none left to claim, or until stopped. The repo of a job is resolved
+// by repoOf.
+func processImportJobs(dbSession datastore.Session, selector bson.M, worker string, repoOf func(importJob) (repo, error), stop <-chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		job, err := claimImportJob(dbSession, selector, worker)
+		if err != nil || job == nil {
+			return err
+		}
+		err = runClaimedImportJob(dbSession, *job, repoOf)
+		fields := log.Fields{"job": job.ID, "attempt": job.Attempts}
+		if err != nil {
+			log.WithFields(fields).WithError(err).Error("import job failed")
+		}
+		if err := completeImportJob(dbSession, *job, err); err != nil {
+			log.WithFields(fields).WithError(err).Error("failed to complete import job")
+		}
+	}
+}
+
+// runClaimedImportJob runs the job claimed by the worker, extending its claim
+// until it completes so that it isn't claimed by another worker in the
+// meantime, however long it takes
+func runClaimedImportJob(dbSession datastore.Session, job importJob, repoOf func(importJob) (repo, error)) error {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(queue.visibilityTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := extendImportJob(dbSession, job); err != nil {
+					log.WithFields(log.Fields{"job": job.ID}).WithError(err).Error("failed to extend import job")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	r, err := repoOf(job)
+	if err != nil {
+		return err
+	}
+	return runImportJob(dbSession, job, r)
+}
+
+// runSyncImportJobs runs the jobs of the generation of the repo being synced,
+// along with any other worker, and waits for all of them to complete or until
+// stopped
+func runSyncImportJobs(dbSession datastore.Session, r repo, stop <-chan struct{}) error {
+	selector := bson.M{"repo.name": r.Name, "generation": r.Generation}
+	repoOf := func(importJob) (repo, error) { return r, nil }
+	worker := processName()
+
+	numWorkers := downloads.workers
+	log.Debugf("starting %d workers", numWorkers)
+	errs := make(chan error, numWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := processImportJobs(dbSession, selector, worker, repoOf, stop); err != nil {
+					errs <- err
+					return
+				}
+				// Wait for the jobs run by other workers, or to be retried
+				done, err := importJobsDone(dbSession, selector)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if done {
+					return
+				}
+				select {
+				case <-stop:
+					return
+				case <-time.After(queue.pollInterval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// importJobsDone returns whether all the jobs matching the selector are done
+// or have failed for good
+func importJobsDone(dbSession datastore.Session, selector bson.M) (bool, error) {
+	db, closer := dbSession.DB()
+	defer closer()
+	unfinished := bson.M{"state": bson.M{"$in": []string{jobPending, jobRunning}}}
+	for k, v := range selector {
+		unfinished[k] = v
+	}
+	err := db.C(jobsCollection).Find(unfinished).Select(bson.M{"_id": 1}).One(&importJob{})
+	if err == mgo.ErrNotFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// removeImportJobs removes the jobs of the repo up to the given generation
+func removeImportJobs(dbSession datastore.Session, repoName string, generation int64) error {
+	db, closer := dbSession.DB()
+	defer closer()
+	_, err := db.C(jobsCollection).RemoveAll(bson.M{"repo.name": repoName, "generation": bson.M{"$lte": generation}})
+	return err
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/kubeapps/common/datastore"
+)
+
+// getJob returns the job stored in the datastore
+func getJob(t *testing.T, dbSession datastore.Session, id string) importJob {
+	db, closer := dbSession.DB()
+	defer closer()
+	var j importJob
+	assert.NoErr(t, db.C(jobsCollection).FindId(id).One(&j))
+	return j
+}
+
+// countJobs returns the number of jobs stored in the datastore
+func countJobs(t *testing.T, dbSession datastore.Session) int {
+	db, closer := dbSession.DB()
+	defer closer()
+	n, err := db.C(jobsCollection).Count()
+	assert.NoErr(t, err)
+	return n
+}
+
+func Test_newImportJobs(t *testing.T) {
+	r := repo{Name: "stable", URL: "https://my.examplerepo.com", Generation: 3, AuthorizationHeader: "Bearer ThisSecretAccessTokenAuthenticatesTheClient"}
+	charts := []chart{{ID: "stable/acs-engine-autoscaler@3", Name: "acs-engine-autoscaler", Icon: "https://my.examplerepo.com/icon.png", ChartVersions: []chartVersion{
+		{Version: "2.1.1", Digest: "abc"},
+		{Version: "2.1.0", Digest: "def"},
+	}}}
+
+	jobs := newImportJobs(r, charts)
+	assert.Equal(t, len(jobs), 3, "number of jobs")
+	assert.Equal(t, jobs[0].ID, "stable@3/icon/acs-engine-autoscaler", "icon job ID")
+	assert.Equal(t, jobs[0].Priority, iconJobPriority, "icon job priority")
+	assert.Equal(t, jobs[0].Icon, charts[0].Icon, "icon URL")
+	assert.Equal(t, jobs[1].ID, "stable@3/files/acs-engine-autoscaler-2.1.1@abc", "files job ID")
+	assert.Equal(t, jobs[1].Priority, latestFilesJobPriority, "latest files job priority")
+	assert.Equal(t, jobs[2].ID, "stable@3/files/acs-engine-autoscaler-2.1.0@def", "files job ID")
+	assert.Equal(t, jobs[2].Priority, filesJobPriority, "files job priority")
+	for _, j := range jobs {
+		assert.Equal(t, j.Generation, int64(3), "generation")
+		assert.Equal(t, j.ChartID, charts[0].ID, "chart ID")
+		assert.True(t, j.Repo.Local, "credentials given on the command line are only known to the sync")
+	}
+
+	// Workers load stored credentials themselves
+	r.StoredCredentials = true
+	jobs = newImportJobs(r, charts)
+	assert.False(t, jobs[0].Repo.Local, "stored credentials are known to the workers")
+	assert.Equal(t, jobs[0].Repo.repo(3).URL, r.URL, "URL of the repo")
+}
+
+func Test_runSyncImportJobs(t *testing.T) {
+	defer func(q queueConfig) { queue = q }(queue)
+	queue.visibilityTimeout = 10 * time.Millisecond
+	queue.pollInterval = 5 * time.Millisecond
+
+	store := localstore.New()
+	r := repo{Name: "stable", URL: "https://my.examplerepo.com", Generation: 2}
+	charts := []chart{
+		{ID: "stable/acs-engine-autoscaler@2", Name: "acs-engine-autoscaler", ChartVersions: []chartVersion{{Version: "2.1.1", Digest: "abc"}}},
+		{ID: "stable/wordpress@2", Name: "wordpress", ChartVersions: []chartVersion{{Version: "0.7.5", Digest: "def"}}},
+	}
+	// The files of the chart versions have been imported already, so that the
+	// jobs succeed without fetching them
+	assert.NoErr(t, store.Insert(chartFilesCollection,
+		chartFiles{ID: "stable/acs-engine-autoscaler-2.1.1@2", Repo: r, Digest: "abc"},
+		chartFiles{ID: "stable/wordpress-0.7.5@2", Repo: r, Digest: "def"},
+	))
+	jobs := newImportJobs(r, charts)
+	assert.NoErr(t, enqueueImportJobs(store, r, jobs))
+	assert.Equal(t, countJobs(t, store), 4, "number of jobs")
+
+	// An interrupted sync completed a job, and was killed while running another
+	selector := bson.M{"repo.name": r.Name, "generation": r.Generation}
+	completed, err := claimImportJob(store, selector, "killed")
+	assert.NoErr(t, err)
+	assert.Equal(t, completed.Kind, iconJobKind, "icons are imported first")
+	assert.NoErr(t, completeImportJob(store, *completed, nil))
+	killed, err := claimImportJob(store, selector, "killed")
+	assert.NoErr(t, err)
+	assert.Equal(t, getJob(t, store, killed.ID).State, jobRunning, "state of the killed job")
+
+	// The next sync resumes it once its claim has expired
+	assert.NoErr(t, enqueueImportJobs(store, r, jobs))
+	assert.NoErr(t, runSyncImportJobs(store, r, nil))
+	for _, j := range jobs {
+		assert.Equal(t, getJob(t, store, j.ID).State, jobDone, "state of "+j.ID)
+	}
+	assert.Equal(t, getJob(t, store, completed.ID).Attempts, 1, "attempts of the completed job")
+	assert.Equal(t, getJob(t, store, killed.ID).Attempts, 2, "attempts of the killed job")
+
+	// The killed worker can't complete the job anymore
+	assert.ExistsErr(t, completeImportJob(store, *killed, nil), "stale claim")
+
+	assert.NoErr(t, removeImportJobs(store, r.Name, r.Generation))
+	assert.Equal(t, countJobs(t, store), 0, "number of jobs")
+}
+
+func Test_processImportJobsExtendsClaim(t *testing.T) {
+	defer func(q queueConfig) { queue = q }(queue)
+	queue.visibilityTimeout = 30 * time.Millisecond
+
+	store := localstore.New()
+	r := repo{Name: "stable", URL: "https://my.examplerepo.com", Generation: 1}
+	jobs := newImportJobs(r, []chart{{ID: "stable/wordpress@1", Name: "wordpress", Icon: "https://my.examplerepo.com/icon.png"}})
+	assert.NoErr(t, enqueueImportJobs(store, r, jobs))
+	selector := bson.M{"repo.name": r.Name}
+
+	// The job runs for longer than the visibility timeout
+	other := make(chan *importJob, 1)
+	repoOf := func(importJob) (repo, error) {
+		time.Sleep(50 * time.Millisecond)
+		job, err := claimImportJob(store, selector, "other")
+		assert.NoErr(t, err)
+		other <- job
+		time.Sleep(50 * time.Millisecond)
+		return repo{}, errors.New("unknown repo")
+	}
+	assert.NoErr(t, processImportJobs(store, selector, "worker", repoOf, nil))
+	assert.True(t, <-other == nil, "running job claimed by another worker")
+	j := getJob(t, store, jobs[0].ID)
+	assert.Equal(t, j.Attempts, 1, "attempts")
+	assert.Equal(t, j.Worker, "worker", "worker of the job")
+}
+
+func Test_extendImportJob(t *testing.T) {
+	store := localstore.New()
+	r := repo{Name: "stable", URL: "https://my.examplerepo.com", Generation: 1}
+	assert.NoErr(t, enqueueImportJobs(store, r, newImportJobs(r, []chart{{ID: "stable/wordpress@1", Name: "wordpress", Icon: "https://my.examplerepo.com/icon.png"}})))
+	job, err := claimImportJob(store, bson.M{"repo.name": r.Name}, "worker")
+	assert.NoErr(t, err)
+	assert.NoErr(t, extendImportJob(store, *job))
+
+	// The jobs of a removed generation aren't created again
+	assert.NoErr(t, removeImportJobs(store, r.Name, r.Generation))
+	assert.ExistsErr(t, extendImportJob(store, *job), "removed job")
+	assert.Equal(t, countJobs(t, store), 0, "number of jobs")
+}
+
+func Test_completeImportJob(t *testing.T) {
+	defer func(q queueConfig) { queue = q }(queue)
+	defer func(c httpClient) { netClient = c }(netClient)
+	netClient = &badIconClient{}
+	queue.maxAttempts = 2
+
+	store := localstore.New()
+	r := repo{Name: "stable", URL: "https://my.examplerepo.com", Generation: 1}
+	charts := []chart{{ID: "stable/wordpress@1", Name: "wordpress", Icon: "https://my.examplerepo.com/icon.png"}}
+	assert.NoErr(t, enqueueImportJobs(store, r, newImportJobs(r, charts)))
+	selector := bson.M{"repo.name": r.Name}
+	repoOf := func(importJob) (repo, error) { return r, nil }
+
+	// The failed job is retried later
+	assert.NoErr(t, processImportJobs(store, selector, "worker", repoOf, nil))
+	j := getJob(t, store, "stable@1/icon/wordpress")
+	assert.Equal(t, j.State, jobPending, "state of the failed job")
+	assert.True(t, j.VisibleAt.After(time.Now()), "job retried later")
+	assert.True(t, j.Error != "", "error of the job")
+
+	// Until it has been attempted queue.maxAttempts times
+	db, closer := store.DB()
+	defer closer()
+	assert.NoErr(t, db.C(jobsCollection).UpdateId(j.ID, bson.M{"$set": bson.M{"visibleat": time.Now()}}))
+	assert.NoErr(t, processImportJobs(store, selector, "worker", repoOf, nil))
+	j = getJob(t, store, j.ID)
+	assert.Equal(t, j.State, jobFailed, "state of the failed job")
+	assert.Equal(t, j.Attempts, 2, "attempts")
+	done, err := importJobsDone(store, selector)
+	assert.NoErr(t, err)
+	assert.True(t, done, "failed jobs are finished")
+
+	// Jobs of a repo that can't be resolved fail too
+	jobs := newImportJobs(r, []chart{{ID: "stable/redis@1", Name: "redis"}})
+	assert.NoErr(t, enqueueImportJobs(store, r, jobs))
+	queue.maxAttempts = 1
+	assert.NoErr(t, processImportJobs(store, selector, "worker", func(importJob) (repo, error) {
+		return repo{}, errors.New("unknown repo")
+	}, nil))
+	assert.Equal(t, getJob(t, store, jobs[0].ID).State, jobFailed, "state of the job")
+}
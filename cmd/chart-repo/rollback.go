@@ -0,0 +1,40 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback [REPO NAME]",
+	Short: "make the charts imported by the previous sync of a chart repository visible again",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			logrus.Info("Need exactly one argument: [REPO NAME]")
+			cmd.Help()
+			return
+		}
+		dbSession := connectMongo(cmd)
+		status, err := rollbackRepo(dbSession, args[0])
+		if err != nil {
+			logrus.Fatalf("Can't roll back chart repository %s: %v", args[0], err)
+		}
+		logrus.Infof("Successfully rolled back the chart repository %s to generation %d", args[0], status.Generation)
+	},
+}
@@ -0,0 +1,44 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// schedule returns the next time a job should run after the given time, or
+// the zero time if it never runs again
+type schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// parseSchedule parses a cron expression in the same format used by
+// Kubernetes CronJobs, e.g. "0 * * * *", "*/15 9-17 * * mon-fri" or "@hourly".
+// "@every <duration>" is also accepted.
+func parseSchedule(spec string) (schedule, error) {
+	s, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+	}
+	if every, ok := s.(cron.ConstantDelaySchedule); ok && every.Delay < time.Minute {
+		return nil, fmt.Errorf("invalid schedule %q: interval must be at least 1m", spec)
+	}
+	return s, nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arschles/assert"
+)
+
+func Test_parseSchedule(t *testing.T) {
+	// Tuesday
+	from := time.Date(2018, time.December, 11, 10, 42, 30, 0, time.UTC)
+	tests := []struct {
+		name string
+		spec string
+		next time.Time
+	}{
+		{"every minute", "* * * * *", time.Date(2018, time.December, 11, 10, 43, 0, 0, time.UTC)},
+		{"hourly", "0 * * * *", time.Date(2018, time.December, 11, 11, 0, 0, 0, time.UTC)},
+		{"hourly descriptor", "@hourly", time.Date(2018, time.December, 11, 11, 0, 0, 0, time.UTC)},
+		{"daily descriptor", "@daily", time.Date(2018, time.December, 12, 0, 0, 0, 0, time.UTC)},
+		{"step", "*/5 * * * *", time.Date(2018, time.December, 11, 10, 45, 0, 0, time.UTC)},
+		{"step from value", "50/5 * * * *", time.Date(2018, time.December, 11, 10, 50, 0, 0, time.UTC)},
+		{"list", "10,20 * * * *", time.Date(2018, time.December, 11, 11, 10, 0, 0, time.UTC)},
+		{"range", "0 9-17 * * *", time.Date(2018, time.December, 11, 11, 0, 0, 0, time.UTC)},
+		{"day of week names", "0 0 * * sat,sun", time.Date(2018, time.December, 15, 0, 0, 0, 0, time.UTC)},
+		{"month names", "0 0 1 jan *", time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"day of month or week", "0 0 13 * fri", time.Date(2018, time.December, 13, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"never", "0 0 30 2 *", time.Time{}},
+		{"every", "@every 90m", from.Add(90 * time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseSchedule(tt.spec)
+			assert.NoErr(t, err)
+			assert.Equal(t, s.Next(from), tt.next, "next time")
+		})
+	}
+
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 7", "*/0 * * * *", "5-1 * * * *", "* * * foo *", "@every 1s", "@every forever"}
+	for _, spec := range invalid {
+		t.Run("invalid "+spec, func(t *testing.T) {
+			_, err := parseSchedule(spec)
+			assert.ExistsErr(t, err, spec)
+		})
+	}
+}
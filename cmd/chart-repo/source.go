@@ -0,0 +1,186 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	helmrepo "k8s.io/helm/pkg/repo"
+)
+
+// chartSource lists the chart versions of a repo and opens their files. The
+// import of the charts is the same for every source.
+type chartSource interface {
+	// index returns the index of the repo, or errIndexNotModified if it's the
+	// same as the one described by lastIndex
+	index(lastIndex repoIndexInfo) (*helmrepo.IndexFile, repoIndexInfo, error)
+	// openTarball opens the tarball of a version of the chart with the given
+	// name in the index
+	openTarball(name string, cv chartVersion) (io.ReadCloser, error)
+	// openProvenance opens the provenance file of a chart version, or returns
+	// errFileNotFound if it isn't signed
+	openProvenance(cv chartVersion) (io.ReadCloser, error)
+}
+
+// errFileNotFound is returned by sources for missing files
+var errFileNotFound = errors.New("file not found")
+
+// Source types, used when the repo doesn't set one explicitly
+const (
+	httpSourceType = "http"
+	ociSourceType  = "oci"
+	dirSourceType  = "file"
+)
+
+// chartSources are the available source types
+var chartSources = map[string]func(repo) (chartSource, error){
+	httpSourceType:        newHTTPSource,
+	ociSourceType:         newOCISource,
+	dirSourceType:         newDirSource,
+	gitSourceType:         newGitSource,
+	chartMuseumSourceType: newChartMuseumSource,
+}
+
+// sourceTypesByScheme maps URL schemes to the source type used by default
+var sourceTypesByScheme = map[string]string{
+	"http":     httpSourceType,
+	"https":    httpSourceType,
+	ociScheme:  ociSourceType,
+	fileScheme: dirSourceType,
+}
+
+// newChartSource returns the source of the repo, of the type set in the repo
+// or else of the type matching the scheme of its URL
+func newChartSource(r repo) (chartSource, error) {
+	sourceType, err := repoSourceType(r)
+	if err != nil {
+		return nil, err
+	}
+	return chartSources[sourceType](r)
+}
+
+func repoSourceType(r repo) (string, error) {
+	if r.SourceType != "" {
+		if _, ok := chartSources[r.SourceType]; !ok {
+			return "", fmt.Errorf("unknown source type %q, must be one of %s", r.SourceType, strings.Join(chartSourceTypes(), ", "))
+		}
+		return r.SourceType, nil
+	}
+	u, err := url.Parse(strings.TrimSpace(r.URL))
+	if err != nil {
+		return "", err
+	}
+	sourceType, ok := sourceTypesByScheme[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("no source type for URL scheme %q", u.Scheme)
+	}
+	return sourceType, nil
+}
+
+func chartSourceTypes() []string {
+	var types []string
+	for t := range chartSources {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// httpSource is a classic chart repository served over HTTP, with an
+// index.yaml at its root
+type httpSource struct {
+	r repo
+}
+
+func newHTTPSource(r repo) (chartSource, error) {
+	return httpSource{r}, nil
+}
+
+func (s httpSource) index(lastIndex repoIndexInfo) (*helmrepo.IndexFile, repoIndexInfo, error) {
+	return fetchRepoIndex(s.r, lastIndex)
+}
+
+func (s httpSource) openTarball(name string, cv chartVersion) (io.ReadCloser, error) {
+	res, err := repoGet(s.r, chartTarballURL(s.r, cv))
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s httpSource) openProvenance(cv chartVersion) (io.ReadCloser, error) {
+	u, err := url.Parse(chartTarballURL(s.r, cv))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += ".prov"
+	return openRepoFile(s.r, u.String())
+}
+
+// repoGet sends a GET request on behalf of the repo
+func repoGet(r repo, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	if len(r.AuthorizationHeader) > 0 {
+		req.Header.Set("Authorization", r.AuthorizationHeader)
+	}
+
+	client, err := repoNetClient(r)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// openRepoFile downloads a file of the repo, returning errFileNotFound if it
+// doesn't exist
+func openRepoFile(r repo, url string) (io.ReadCloser, error) {
+	res, err := repoGet(r, url)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errFileNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("%d %s", res.StatusCode, url)
+	}
+	return res.Body, nil
+}
+
+// tarballFileName returns the file name of the tarball of a chart version,
+// which is part of the message signed in its provenance file
+func tarballFileName(name string, cv chartVersion) string {
+	if len(cv.URLs) > 0 {
+		if u, err := url.Parse(cv.URLs[0]); err == nil && path.Ext(u.Path) == ".tgz" {
+			return path.Base(u.Path)
+		}
+	}
+	return fmt.Sprintf("%s-%s.tgz", name, cv.Version)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/arschles/assert"
+)
+
+func Test_newChartSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		r      repo
+		source chartSource
+	}{
+		{"https URL", repo{URL: "https://charts.example.com"}, httpSource{repo{URL: "https://charts.example.com"}}},
+		{"http URL", repo{URL: "http://charts.example.com"}, httpSource{repo{URL: "http://charts.example.com"}}},
+		{"oci URL", repo{URL: "oci://registry.example.com/charts"}, ociSource{repo{URL: "oci://registry.example.com/charts"}}},
+		{"explicit type", repo{URL: "https://registry.example.com", SourceType: "oci"}, ociSource{repo{URL: "https://registry.example.com", SourceType: "oci"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := newChartSource(tt.r)
+			assert.NoErr(t, err)
+			assert.Equal(t, source, tt.source, "source")
+		})
+	}
+
+	_, err := newChartSource(repo{URL: "https://charts.example.com", SourceType: "svn"})
+	assert.ExistsErr(t, err, "unknown source type")
+	_, err = newChartSource(repo{URL: "ftp://charts.example.com"})
+	assert.ExistsErr(t, err, "unknown URL scheme")
+}
+
+func Test_tarballFileName(t *testing.T) {
+	assert.Equal(t, tarballFileName("mysql", chartVersion{Version: "1.0.0", URLs: []string{"https://charts.example.com/mysql-1.0.0.tgz?token=1"}}), "mysql-1.0.0.tgz", "absolute URL")
+	assert.Equal(t, tarballFileName("mysql", chartVersion{Version: "1.0.0", URLs: []string{"charts/mysql-1.0.0.tgz"}}), "mysql-1.0.0.tgz", "relative URL")
+	assert.Equal(t, tarballFileName("mysql", chartVersion{Version: "1.0.0", URLs: []string{"oci://registry.example.com/charts/mysql:1.0.0"}}), "mysql-1.0.0.tgz", "OCI reference")
+}
@@ -17,7 +17,9 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/kubeapps/common/datastore"
 	"github.com/sirupsen/logrus"
@@ -34,6 +36,26 @@ var syncCmd = &cobra.Command{
 			return
 		}
 
+		keyring, err := cmd.Flags().GetString("keyring")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		plainHTTP, err := cmd.Flags().GetBool("plain-http")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		sourceType, err := cmd.Flags().GetString("source-type")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			logrus.Fatal(err)
+		}
 		mongoURL, err := cmd.Flags().GetString("mongo-url")
 		if err != nil {
 			logrus.Fatal(err)
@@ -54,17 +76,124 @@ var syncCmd = &cobra.Command{
 		if debug {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		if err := applyDownloadFlags(cmd); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := applyLockFlags(cmd); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := applyQueueFlags(cmd); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := applyMirrorFlags(cmd); err != nil {
+			logrus.Fatal(err)
+		}
+		mirror, err := cmd.Flags().GetBool("mirror")
+		if err != nil {
+			logrus.Fatal(err)
+		}
 		mongoConfig := datastore.Config{URL: mongoURL, Database: mongoDB, Username: mongoUser, Password: mongoPW}
-		dbSession, err := datastore.NewSession(mongoConfig)
+		dbSession, err := newSession(mongoConfig)
 		if err != nil {
 			logrus.Fatalf("Can't connect to mongoDB: %v", err)
 		}
 
-		authorizationHeader := os.Getenv("AUTHORIZATION_HEADER")
-		if err = syncRepo(dbSession, args[0], args[1], authorizationHeader); err != nil {
+		rc := repoConfig{
+			Name:       args[0],
+			URL:        args[1],
+			Keyring:    keyring,
+			PlainHTTP:  plainHTTP,
+			SourceType: sourceType,
+			Auth:       repoAuthConfig{Header: os.Getenv("AUTHORIZATION_HEADER")},
+			Mirror:     mirror,
+		}
+		if err := repoCredentialsFromFlags(cmd, &rc); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := rc.validate(); err != nil {
+			logrus.Fatal(err)
+		}
+		r, err := rc.repo()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		r, err = withStoredCredentials(dbSession, credentialsKeysFromFlags(cmd), r)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if dryRun {
+			plan, err := planSync(dbSession, r)
+			if err != nil {
+				logrus.Fatalf("Can't plan the sync of the chart repository: %v", err)
+			}
+			if err := printSyncPlan(os.Stdout, plan, output); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		}
+		err = syncRepoWithLease(dbSession, r)
+		if err == errSyncSkipped {
+			logrus.Infof("Skipped the sync of the chart repository %s, it is being synced by another process", r.Name)
+			return
+		}
+		// The index may have been validated even if the sync failed
+		if status, statusErr := getRepoStatus(dbSession, r.Name); statusErr == nil && status.Validation != nil {
+			printValidationReport(os.Stdout, r.Name, status.Validation)
+		}
+		if err != nil {
 			logrus.Fatalf("Can't add chart repository to database: %v", err)
 		}
 
 		logrus.Infof("Successfully added the chart repository %s to database", args[0])
 	},
 }
+
+func init() {
+	syncCmd.Flags().String("source-type", "", fmt.Sprintf("type of the chart repository (%s), guessed from the URL scheme if empty", strings.Join(chartSourceTypes(), ", ")))
+	syncCmd.Flags().Bool("plain-http", false, "use plain HTTP instead of HTTPS to talk to OCI registries")
+	addDownloadFlags(syncCmd)
+	addLockFlags(syncCmd)
+	addQueueFlags(syncCmd)
+	addMirrorFlags(syncCmd)
+	syncCmd.Flags().Bool("mirror", false, "copy the tarballs and provenance files of the charts to the blob store, to be served by chartsvc")
+	addRepoCredentialsFlags(syncCmd)
+	addCredentialsKeysFlag(syncCmd)
+	syncCmd.Flags().Bool("dry-run", false, "print the changes the sync would make to the charts of the repo, without writing anything")
+	syncCmd.Flags().String("output", planOutputText, "format of the plan printed by --dry-run: text or json")
+	syncCmd.Flags().String("keyring", "", "PGP keyring used to verify the provenance files of the charts, charts aren't verified if empty")
+}
+
+// addRepoCredentialsFlags adds the flags setting the credentials and TLS
+// configuration of a repo
+func addRepoCredentialsFlags(cmd *cobra.Command) {
+	cmd.Flags().String("username", "", "username for basic authentication, the password is read from the REPO_PASSWORD environment variable")
+	cmd.Flags().String("token-file", "", "file containing a bearer token sent to the repo")
+	cmd.Flags().String("ca-file", "", "CA bundle used to verify the certificate of the repo")
+	cmd.Flags().String("cert-file", "", "client certificate used to authenticate to the repo")
+	cmd.Flags().String("key-file", "", "key of the client certificate")
+	cmd.Flags().Bool("insecure-skip-tls-verify", false, "skip the verification of the certificate of the repo")
+}
+
+func repoCredentialsFromFlags(cmd *cobra.Command, rc *repoConfig) error {
+	var err error
+	if rc.Auth.Username, err = cmd.Flags().GetString("username"); err != nil {
+		return err
+	}
+	if rc.Auth.Username != "" {
+		rc.Auth.PasswordEnv = "REPO_PASSWORD"
+	}
+	if rc.Auth.TokenFile, err = cmd.Flags().GetString("token-file"); err != nil {
+		return err
+	}
+	if rc.CAFile, err = cmd.Flags().GetString("ca-file"); err != nil {
+		return err
+	}
+	if rc.CertFile, err = cmd.Flags().GetString("cert-file"); err != nil {
+		return err
+	}
+	if rc.KeyFile, err = cmd.Flags().GetString("key-file"); err != nil {
+		return err
+	}
+	rc.InsecureSkipVerify, err = cmd.Flags().GetBool("insecure-skip-tls-verify")
+	return err
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kubeapps/common/datastore"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var syncGitCmd = &cobra.Command{
+	Use:   "sync-git [REPO NAME] [PATH]",
+	Short: "index the unpackaged charts of a local Git repository as a chart repository",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			logrus.Info("Need exactly two arguments: [REPO NAME] [PATH]")
+			cmd.Help()
+			return
+		}
+
+		ref, err := cmd.Flags().GetString("ref")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		webURL, err := cmd.Flags().GetString("web-url")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		mongoURL, err := cmd.Flags().GetString("mongo-url")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		mongoDB, err := cmd.Flags().GetString("mongo-database")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		mongoUser, err := cmd.Flags().GetString("mongo-user")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		mongoPW := os.Getenv("MONGO_PASSWORD")
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		if err := applyDownloadFlags(cmd); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := applyLockFlags(cmd); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := applyQueueFlags(cmd); err != nil {
+			logrus.Fatal(err)
+		}
+
+		path, err := filepath.Abs(args[1])
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		mongoConfig := datastore.Config{URL: mongoURL, Database: mongoDB, Username: mongoUser, Password: mongoPW}
+		dbSession, err := newSession(mongoConfig)
+		if err != nil {
+			logrus.Fatalf("Can't connect to mongoDB: %v", err)
+		}
+
+		r := repo{Name: args[0], URL: path, SourceType: gitSourceType, GitRef: ref, GitWebURL: webURL}
+		err = syncRepoWithLease(dbSession, r)
+		if err == errSyncSkipped {
+			logrus.Infof("Skipped the sync of the Git repository %s, it is being synced by another process", r.Name)
+			return
+		}
+		if err != nil {
+			logrus.Fatalf("Can't add Git repository to database: %v", err)
+		}
+
+		logrus.Infof("Successfully added the Git repository %s to database", args[0])
+	},
+}
+
+func init() {
+	addDownloadFlags(syncGitCmd)
+	addLockFlags(syncGitCmd)
+	addQueueFlags(syncGitCmd)
+	syncGitCmd.Flags().String("ref", "HEAD", "branch, tag or commit to index")
+	syncGitCmd.Flags().String("web-url", "", "URL of the web interface of the repository (e.g. https://github.com/helm/charts), used to link to the charts")
+}
@@ -24,6 +24,26 @@ type repo struct {
 	Name                string
 	URL                 string
 	AuthorizationHeader string `bson:"-"`
+	// Set if the authorization header comes from the stored credentials
+	StoredCredentials bool `bson:"-"`
+	// TLS configuration of the connections to the repo
+	CAFile             string `bson:"-"`
+	CertFile           string `bson:"-"`
+	KeyFile            string `bson:"-"`
+	InsecureSkipVerify bool   `bson:"-"`
+	// Path to the PGP keyring used to verify the provenance of the charts
+	Keyring string `bson:"-"`
+	// Use plain HTTP to talk to an OCI registry
+	PlainHTTP bool `bson:"-"`
+	// Type of the chart source, guessed from the URL if empty
+	SourceType string `bson:"-"`
+	// Ref indexed in a Git repository, and URL of its web interface
+	GitRef    string `bson:"-"`
+	GitWebURL string `bson:"-"`
+	// Generation the charts of the repo are written to during a sync
+	Generation int64 `bson:"-"`
+	// Copy the tarballs of the charts to the blob store
+	Mirror bool `bson:"-"`
 }
 
 type maintainer struct {
@@ -32,7 +52,7 @@ type maintainer struct {
 }
 
 type chart struct {
-	ID            string `bson:"_id"`
+	ID            string `bson:"_id,omitempty"`
 	Name          string
 	Repo          repo
 	Description   string
@@ -42,6 +62,9 @@ type chart struct {
 	Sources       []string
 	Icon          string
 	ChartVersions []chartVersion
+	// Generation of the repo the chart belongs to, only the charts of the
+	// active generation of the repo are visible
+	Generation int64 `bson:",omitempty"`
 }
 
 type chartVersion struct {
@@ -50,6 +73,12 @@ type chartVersion struct {
 	Created    time.Time
 	Digest     string
 	URLs       []string
+	// Set if the downloaded tarball doesn't match Digest
+	DigestMismatch bool `bson:",omitempty"`
+	// Only set if the repo has a keyring
+	Provenance *provenance `bson:",omitempty"`
+	// Only set if the repo is mirrored
+	Mirror *mirroredFiles `bson:",omitempty"`
 }
 
 type chartFiles struct {
@@ -58,4 +87,70 @@ type chartFiles struct {
 	Values string
 	Repo   repo
 	Digest string
+	// Kept along with the files so the chart version isn't verified again
+	// until its digest changes
+	Provenance *provenance `bson:",omitempty"`
+}
+
+// States of the provenance verification of a chart version
+const (
+	provenanceVerified = "verified"
+	provenanceUnsigned = "unsigned"
+	provenanceInvalid  = "invalid"
+)
+
+// provenance is the outcome of verifying the provenance file of a chart
+// version against the keyring of its repo
+type provenance struct {
+	State          string
+	SignedBy       string `bson:",omitempty"`
+	KeyFingerprint string `bson:",omitempty"`
+	Error          string `bson:",omitempty"`
+}
+
+// repoIndexInfo holds the validators and checksum of the last index imported
+// for a repository, used to skip syncing when the index hasn't changed
+type repoIndexInfo struct {
+	ETag         string
+	LastModified string
+	Checksum     string
+	// Settings of the repo the index was imported with, the index is imported
+	// again when they change
+	Mirror  bool   `bson:",omitempty"`
+	Keyring string `bson:",omitempty"`
+}
+
+// Outcomes of a repo sync
+const (
+	repoSyncSucceeded = "succeeded"
+	repoSyncFailed    = "failed"
+)
+
+// repoStatus is the document stored in the repos collection for every synced
+// repository
+type repoStatus struct {
+	ID                 string `bson:"_id"`
+	URL                string
+	LastSyncStart      time.Time
+	LastSyncEnd        time.Time
+	LastSuccessfulSync time.Time
+	Status             string
+	Error              string
+	ChartCount         int
+	VersionCount       int
+	Index              repoIndexInfo
+	// Active generation of the charts of the repo, and the one it replaced,
+	// kept to roll back to
+	Generation         int64
+	PreviousGeneration int64
+	// Problems found in the last index, chart versions with errors are skipped
+	Validation []indexProblem
+}
+
+// indexProblem is a problem found when validating an entry of an index
+type indexProblem struct {
+	Chart    string `json:"chart"`
+	Version  string `json:"version"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
 }
@@ -20,6 +20,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -36,6 +37,7 @@ import (
 
 	"github.com/disintegration/imaging"
 	"github.com/ghodss/yaml"
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/jinzhu/copier"
 	"github.com/kubeapps/common/datastore"
@@ -44,24 +46,28 @@ import (
 )
 
 const (
-	chartCollection       = "charts"
-	chartFilesCollection  = "files"
-	defaultTimeoutSeconds = 10
-	additionalCAFile      = "/usr/local/share/ca-certificates/ca.crt"
+	chartCollection      = "charts"
+	chartFilesCollection = "files"
+	reposCollection      = "repos"
+	additionalCAFile     = "/usr/local/share/ca-certificates/ca.crt"
 )
 
-type importChartFilesJob struct {
-	Name         string
-	Repo         repo
-	ChartVersion chartVersion
-}
-
 type httpClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
 var netClient httpClient = &http.Client{}
 
+// Clients for repos with their own TLS configuration
+var (
+	repoNetClients      = map[repoTLSConfig]httpClient{}
+	repoNetClientsMutex sync.Mutex
+)
+
+// errIndexNotModified is returned by fetchRepoIndex when the index is the same
+// as the one imported during the last sync
+var errIndexNotModified = errors.New("repo index not modified")
+
 func parseRepoUrl(repoURL string) (*url.URL, error) {
 	repoURL = strings.TrimSpace(repoURL)
 	return url.ParseRequestURI(repoURL)
@@ -75,135 +81,312 @@ func init() {
 	}
 }
 
-// Syncing is performed in the following steps:
-// 1. Update database to match chart metadata from index
-// 2. Concurrently process icons for charts (concurrently)
-// 3. Concurrently process the README and values.yaml for the latest chart version of each chart
-// 4. Concurrently process READMEs and values.yaml for historic chart versions
-//
-// These steps are processed in this way to ensure relevant chart data is
-// imported into the database as fast as possible. E.g. we want all icons for
-// charts before fetching readmes for each chart and version pair.
-func syncRepo(dbSession datastore.Session, repoName, repoURL string, authorizationHeader string) error {
-	url, err := parseRepoUrl(repoURL)
+// syncRepo imports the charts of the repo and records the outcome of the sync
+// in the repos collection. The sync stops if the lease of the repo is lost,
+// leaving the status to the process that took it over.
+func syncRepo(dbSession datastore.Session, r repo, held *heldLease) error {
+	url, err := parseRepoUrl(r.URL)
+	if err != nil {
+		log.WithFields(log.Fields{"url": r.URL}).WithError(err).Error("failed to parse URL")
+		return err
+	}
+	r.URL = url.String()
+
+	status, err := getRepoStatus(dbSession, r.Name)
 	if err != nil {
-		log.WithFields(log.Fields{"url": repoURL}).WithError(err).Error("failed to parse URL")
 		return err
 	}
+	// Cached validators are only meaningful if the repo URL and the settings
+	// the index was imported with haven't changed, e.g. turning on mirroring
+	// mirrors the charts of the current index
+	if status.URL != r.URL || status.Index.Mirror != r.Mirror || status.Index.Keyring != r.Keyring {
+		status.Index = repoIndexInfo{}
+	}
+	status.ID = r.Name
+	status.URL = r.URL
+	status.LastSyncStart = time.Now()
+	previousGeneration := status.Generation
 
-	r := repo{Name: repoName, URL: url.String(), AuthorizationHeader: authorizationHeader}
-	index, err := fetchRepoIndex(r)
+	err = importRepo(dbSession, r, &status, held)
+	if err == errLeaseLost {
+		return err
+	}
+	status.LastSyncEnd = time.Now()
 	if err != nil {
+		status.Status = repoSyncFailed
+		status.Error = err.Error()
+	} else {
+		status.Status = repoSyncSucceeded
+		status.Error = ""
+		status.LastSuccessfulSync = status.LastSyncEnd
+	}
+
+	// Storing the status activates the new generation, if any, so the lease
+	// must still be held by then
+	if err := held.renew(); err != nil {
+		log.WithFields(log.Fields{"repo": r.Name}).WithError(err).Error("failed to renew lease before updating repo status")
 		return err
 	}
+	if updateErr := updateRepoStatus(dbSession, status); updateErr != nil {
+		log.WithFields(log.Fields{"repo": r.Name}).WithError(updateErr).Error("failed to update repo status")
+		if err == nil {
+			err = updateErr
+		}
+	}
+	if err == nil && status.Generation != previousGeneration {
+		log.WithFields(log.Fields{"repo": r.Name, "generation": status.Generation}).Info("activated new generation")
+		if err := removeOldGenerations(dbSession, status); err != nil {
+			log.WithFields(log.Fields{"repo": r.Name}).WithError(err).Error("failed to remove old generations")
+		}
+	}
+	return err
+}
 
+// Importing is performed in the following steps:
+// 1. Write the chart metadata from the index to a new generation of the repo
+// 2. Enqueue the jobs importing the icons, READMEs and values.yaml of the charts
+// 3. Run the jobs along with any chart-repo worker, until all of them complete
+//
+// The jobs import the icons first, then the files of the latest version of
+// every chart, and then the files of historic chart versions, to ensure
+// relevant chart data is imported into the database as fast as possible.
+//
+// The generation, index info and counts of the status are only updated once
+// the index has been fully imported. An interrupted sync is resumed by the
+// next one: it writes the same generation, and the jobs already completed
+// aren't run again. Readers keep seeing the previous generation until the
+// status is stored.
+//
+// If the index hasn't changed since the last sync, the charts aren't written
+// again, but the icons and files that failed to be imported are retried.
+func importRepo(dbSession datastore.Session, r repo, status *repoStatus, held *heldLease) error {
+	source, err := newChartSource(r)
+	if err != nil {
+		return err
+	}
+	index, indexInfo, err := source.index(status.Index)
+	indexInfo.Mirror, indexInfo.Keyring = r.Mirror, r.Keyring
+	if err == errIndexNotModified {
+		log.WithFields(log.Fields{"repo": r.Name}).Info("repo index unchanged since last sync, skipping")
+		status.Index = indexInfo
+		return retryFailedImports(dbSession, r, *status, held)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Invalid chart versions are skipped instead of failing the whole sync
+	status.Validation = validateIndex(index)
+	if len(status.Validation) > 0 {
+		log.WithFields(log.Fields{"repo": r.Name, "problems": len(status.Validation)}).Warn("found problems in the repo index, see the validation report of the repo")
+	}
+
+	// The charts are written to a new generation of the repo, which only
+	// becomes visible once it's fully imported and the status of the repo
+	// points to it
+	r.Generation = status.Generation + 1
 	charts := chartsFromIndex(index, r)
 	if len(charts) == 0 {
 		return errors.New("no charts in repository index")
 	}
+	// Files of unchanged chart versions are carried over from the active
+	// generation
+	if err := copyChartFiles(dbSession, r, status.Generation, charts); err != nil {
+		return err
+	}
+	if r.Keyring != "" {
+		if err := loadKnownProvenance(dbSession, r, charts); err != nil {
+			return err
+		}
+	}
 	err = importCharts(dbSession, charts)
 	if err != nil {
 		return err
 	}
+	if err := held.err(); err != nil {
+		return err
+	}
 
-	// Process 10 charts at a time
-	numWorkers := 10
-	iconJobs := make(chan chart, numWorkers)
-	chartFilesJobs := make(chan importChartFilesJob, numWorkers)
-	var wg sync.WaitGroup
-
-	log.Debugf("starting %d workers", numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go importWorker(dbSession, &wg, iconJobs, chartFilesJobs)
+	if err := runImportJobs(dbSession, r, newImportJobs(r, charts), held); err != nil {
+		return err
 	}
 
-	// Enqueue jobs to process chart icons
+	status.PreviousGeneration = status.Generation
+	status.Generation = r.Generation
+	status.Index = indexInfo
+	status.ChartCount = len(charts)
+	status.VersionCount = 0
 	for _, c := range charts {
-		iconJobs <- c
+		status.VersionCount += len(c.ChartVersions)
 	}
-	// Close the iconJobs channel to signal the worker pools to move on to the
-	// chart files jobs
-	close(iconJobs)
+	return nil
+}
 
-	// Iterate through the list of charts and enqueue the latest chart version to
-	// be processed. Append the rest of the chart versions to a list to be
-	// enqueued later
-	var toEnqueue []importChartFilesJob
-	for _, c := range charts {
-		chartFilesJobs <- importChartFilesJob{c.Name, c.Repo, c.ChartVersions[0]}
-		for _, cv := range c.ChartVersions[1:] {
-			toEnqueue = append(toEnqueue, importChartFilesJob{c.Name, c.Repo, cv})
-		}
+// retryFailedImports imports the icons, files and mirrored tarballs missing
+// from the active generation of the repo, e.g. because their jobs failed
+// during the last sync
+func retryFailedImports(dbSession datastore.Session, r repo, status repoStatus, held *heldLease) error {
+	r.Generation = status.Generation
+	charts, err := newCatalog(dbSession).listGeneration(r.Name, r.Generation)
+	if err != nil {
+		return err
+	}
+	jobs, err := missingImportJobs(dbSession, r, charts)
+	if err != nil || len(jobs) == 0 {
+		return err
 	}
+	log.WithFields(log.Fields{"repo": r.Name, "jobs": len(jobs)}).Info("retrying failed imports")
+	return runImportJobs(dbSession, r, jobs, held)
+}
 
-	// Enqueue all the remaining chart versions
-	for _, cfj := range toEnqueue {
-		chartFilesJobs <- cfj
+// runImportJobs imports the icons and files of the charts of the generation
+// of the repo. The jobs are stored in the database, and are run by this sync
+// along with any chart-repo worker. The jobs completed by an interrupted sync
+// of the same generation aren't run again. The jobs are left to the workers
+// if the lease of the repo is lost.
+func runImportJobs(dbSession datastore.Session, r repo, jobs []importJob, held *heldLease) error {
+	if err := enqueueImportJobs(dbSession, r, jobs); err != nil {
+		return err
 	}
-	// Close the chartFilesJobs channel to signal the worker pools that there are
-	// no more jobs to process
-	close(chartFilesJobs)
+	if err := runSyncImportJobs(dbSession, r, held.stopped()); err != nil {
+		return err
+	}
+	if err := held.err(); err != nil {
+		return err
+	}
+	if err := removeImportJobs(dbSession, r.Name, r.Generation); err != nil {
+		log.WithFields(log.Fields{"repo": r.Name}).WithError(err).Error("failed to remove import jobs")
+	}
+	return nil
+}
 
-	// Wait for the worker pools to finish processing
-	wg.Wait()
+// getRepoStatus returns the stored status of the repo, or an empty status if
+// the repo hasn't been synced before
+func getRepoStatus(dbSession datastore.Session, repoName string) (repoStatus, error) {
+	db, closer := dbSession.DB()
+	defer closer()
+	var status repoStatus
+	err := db.C(reposCollection).FindId(repoName).One(&status)
+	if err == mgo.ErrNotFound {
+		return repoStatus{}, nil
+	}
+	return status, err
+}
 
-	return nil
+func updateRepoStatus(dbSession datastore.Session, status repoStatus) error {
+	db, closer := dbSession.DB()
+	defer closer()
+	_, err := db.C(reposCollection).UpsertId(status.ID, status)
+	return err
 }
 
 func deleteRepo(dbSession datastore.Session, repoName string) error {
+	if err := newCatalog(dbSession).deleteCharts(repoName); err != nil {
+		return err
+	}
+
 	db, closer := dbSession.DB()
 	defer closer()
-	_, err := db.C(chartCollection).RemoveAll(bson.M{
+	_, err := db.C(chartFilesCollection).RemoveAll(bson.M{
 		"repo.name": repoName,
 	})
 	if err != nil {
 		return err
 	}
+	if _, err := db.C(jobsCollection).RemoveAll(bson.M{"repo.name": repoName}); err != nil {
+		return err
+	}
 
-	_, err = db.C(chartFilesCollection).RemoveAll(bson.M{
-		"repo.name": repoName,
-	})
+	err = db.C(reposCollection).Remove(bson.M{"_id": repoName})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
 	return err
 }
 
-func fetchRepoIndex(r repo) (*helmrepo.IndexFile, error) {
+// fetchRepoIndex downloads and parses the index of the repo. The validators of
+// the last imported index are sent along with the request, and
+// errIndexNotModified is returned if the index hasn't changed since then.
+func fetchRepoIndex(r repo, lastIndex repoIndexInfo) (*helmrepo.IndexFile, repoIndexInfo, error) {
 	indexURL, err := parseRepoUrl(r.URL)
 	if err != nil {
 		log.WithFields(log.Fields{"url": r.URL}).WithError(err).Error("failed to parse URL")
-		return nil, err
+		return nil, repoIndexInfo{}, err
 	}
 	indexURL.Path = path.Join(indexURL.Path, "index.yaml")
-	req, err := http.NewRequest("GET", indexURL.String(), nil)
+	body, info, err := fetchRepoDocument(r, indexURL.String(), lastIndex)
+	if err != nil {
+		return nil, info, err
+	}
+
+	index, err := parseRepoIndex(body)
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	return index, info, nil
+}
+
+// fetchRepoDocument downloads the document listing the charts of the repo,
+// e.g. its index. The validators of the last imported document are sent along
+// with the request, and errIndexNotModified is returned if the document hasn't
+// changed since then.
+func fetchRepoDocument(r repo, docURL string, lastIndex repoIndexInfo) ([]byte, repoIndexInfo, error) {
+	req, err := http.NewRequest("GET", docURL, nil)
 	if err != nil {
 		log.WithFields(log.Fields{"url": req.URL.String()}).WithError(err).Error("could not build repo index request")
-		return nil, err
+		return nil, repoIndexInfo{}, err
 	}
 
 	req.Header.Set("User-Agent", userAgent())
 	if len(r.AuthorizationHeader) > 0 {
 		req.Header.Set("Authorization", r.AuthorizationHeader)
 	}
+	if lastIndex.ETag != "" {
+		req.Header.Set("If-None-Match", lastIndex.ETag)
+	}
+	if lastIndex.LastModified != "" {
+		req.Header.Set("If-Modified-Since", lastIndex.LastModified)
+	}
 
-	res, err := netClient.Do(req)
+	client, err := repoNetClient(r)
+	if err != nil {
+		return nil, repoIndexInfo{}, err
+	}
+	res, err := client.Do(req)
 	if res != nil {
 		defer res.Body.Close()
 	}
 	if err != nil {
 		log.WithFields(log.Fields{"url": req.URL.String()}).WithError(err).Error("error requesting repo index")
-		return nil, err
+		return nil, repoIndexInfo{}, err
+	}
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, lastIndex, errIndexNotModified
 	}
 
 	if res.StatusCode != http.StatusOK {
 		log.WithFields(log.Fields{"url": req.URL.String(), "status": res.StatusCode}).Error("error requesting repo index, are you sure this is a chart repository?")
-		return nil, errors.New("repo index request failed")
+		return nil, repoIndexInfo{}, errors.New("repo index request failed")
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return nil, repoIndexInfo{}, err
 	}
-	return parseRepoIndex(body)
+
+	info := repoIndexInfo{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Checksum:     fmt.Sprintf("%x", sha256.Sum256(body)),
+	}
+	// Not every server supports conditional requests, so compare the content as
+	// well
+	if lastIndex.Checksum != "" && info.Checksum == lastIndex.Checksum {
+		return nil, info, errIndexNotModified
+	}
+
+	return body, info, nil
 }
 
 func parseRepoIndex(body []byte) (*helmrepo.IndexFile, error) {
@@ -219,6 +402,9 @@ func parseRepoIndex(body []byte) (*helmrepo.IndexFile, error) {
 func chartsFromIndex(index *helmrepo.IndexFile, r repo) []chart {
 	var charts []chart
 	for _, entry := range index.Entries {
+		if len(entry) == 0 {
+			continue
+		}
 		if entry[0].GetDeprecated() {
 			log.WithFields(log.Fields{"name": entry[0].GetName()}).Info("skipping deprecated chart")
 			continue
@@ -235,52 +421,13 @@ func newChart(entry helmrepo.ChartVersions, r repo) chart {
 	copier.Copy(&c, entry[0])
 	copier.Copy(&c.ChartVersions, entry)
 	c.Repo = r
-	c.ID = fmt.Sprintf("%s/%s", r.Name, c.Name)
+	c.ID = chartDocID(r, c.Name)
+	c.Generation = r.Generation
 	return c
 }
 
 func importCharts(dbSession datastore.Session, charts []chart) error {
-	var pairs []interface{}
-	var chartIDs []string
-	for _, c := range charts {
-		chartIDs = append(chartIDs, c.ID)
-		// charts to upsert - pair of selector, chart
-		pairs = append(pairs, bson.M{"_id": c.ID}, c)
-	}
-
-	db, closer := dbSession.DB()
-	defer closer()
-	bulk := db.C(chartCollection).Bulk()
-
-	// Upsert pairs of selectors, charts
-	bulk.Upsert(pairs...)
-
-	// Remove charts no longer existing in index
-	bulk.RemoveAll(bson.M{
-		"_id": bson.M{
-			"$nin": chartIDs,
-		},
-		"repo.name": charts[0].Repo.Name,
-	})
-
-	_, err := bulk.Run()
-	return err
-}
-
-func importWorker(dbSession datastore.Session, wg *sync.WaitGroup, icons <-chan chart, chartFiles <-chan importChartFilesJob) {
-	defer wg.Done()
-	for c := range icons {
-		log.WithFields(log.Fields{"name": c.Name}).Debug("importing icon")
-		if err := fetchAndImportIcon(dbSession, c); err != nil {
-			log.WithFields(log.Fields{"name": c.Name}).WithError(err).Error("failed to import icon")
-		}
-	}
-	for j := range chartFiles {
-		log.WithFields(log.Fields{"name": j.Name, "version": j.ChartVersion.Version}).Debug("importing readme and values")
-		if err := fetchAndImportFiles(dbSession, j.Name, j.Repo, j.ChartVersion); err != nil {
-			log.WithFields(log.Fields{"name": j.Name, "version": j.ChartVersion.Version}).WithError(err).Error("failed to import files")
-		}
-	}
+	return newCatalog(dbSession).upsertCharts(charts)
 }
 
 func fetchAndImportIcon(dbSession datastore.Session, c chart) error {
@@ -298,7 +445,11 @@ func fetchAndImportIcon(dbSession datastore.Session, c chart) error {
 		req.Header.Set("Authorization", c.Repo.AuthorizationHeader)
 	}
 
-	res, err := netClient.Do(req)
+	client, err := repoNetClient(c.Repo)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -321,43 +472,50 @@ func fetchAndImportIcon(dbSession datastore.Session, c chart) error {
 	var b bytes.Buffer
 	imaging.Encode(&b, icon, imaging.PNG)
 
-	db, closer := dbSession.DB()
-	defer closer()
-	return db.C(chartCollection).UpdateId(c.ID, bson.M{"$set": bson.M{"raw_icon": b.Bytes()}})
+	return newCatalog(dbSession).setChartIcon(c.ID, b.Bytes())
 }
 
 func fetchAndImportFiles(dbSession datastore.Session, name string, r repo, cv chartVersion) error {
-	chartFilesID := fmt.Sprintf("%s/%s-%s", r.Name, name, cv.Version)
+	chartFilesID := chartFilesID(r, name, cv.Version)
 	db, closer := dbSession.DB()
 	defer closer()
 
-	// Check if we already have indexed files for this chart version and digest
-	if err := db.C(chartFilesCollection).Find(bson.M{"_id": chartFilesID, "digest": cv.Digest}).One(&chartFiles{}); err == nil {
+	// Check if we already have indexed files for this chart version and digest,
+	// and have verified its provenance if needed
+	query := bson.M{"_id": chartFilesID, "digest": cv.Digest}
+	if r.Keyring != "" {
+		query["provenance"] = bson.M{"$exists": true}
+	}
+	if err := db.C(chartFilesCollection).Find(query).One(&chartFiles{}); err == nil {
 		log.WithFields(log.Fields{"name": name, "version": cv.Version}).Debug("skipping existing files")
 		return nil
 	}
 	log.WithFields(log.Fields{"name": name, "version": cv.Version}).Debug("fetching files")
 
-	url := chartTarballURL(r, cv)
-	req, err := http.NewRequest("GET", url, nil)
+	source, err := newChartSource(r)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("User-Agent", userAgent())
-	if len(r.AuthorizationHeader) > 0 {
-		req.Header.Set("Authorization", r.AuthorizationHeader)
-	}
-
-	res, err := netClient.Do(req)
+	tarballReader, err := source.openTarball(name, cv)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
+	defer tarballReader.Close()
+
+	// The digest of the tarball is computed while it's being extracted, and the
+	// tarball is kept to verify its provenance
+	digest := sha256.New()
+	var tarball bytes.Buffer
+	var w io.Writer = digest
+	if r.Keyring != "" {
+		w = io.MultiWriter(digest, &tarball)
+	}
+	body := io.TeeReader(tarballReader, w)
 
 	// We read the whole chart into memory, this should be okay since the chart
 	// tarball needs to be small enough to fit into a GRPC call (Tiller
 	// requirement)
-	gzf, err := gzip.NewReader(res.Body)
+	gzf, err := gzip.NewReader(body)
 	if err != nil {
 		return err
 	}
@@ -374,6 +532,19 @@ func fetchAndImportFiles(dbSession datastore.Session, name string, r repo, cv ch
 		return err
 	}
 
+	// Read what's left of the tarball (e.g. the gzip footer) to complete the
+	// digest
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+	if actual := fmt.Sprintf("%x", digest.Sum(nil)); cv.Digest != "" && actual != cv.Digest {
+		log.WithFields(log.Fields{"name": name, "version": cv.Version, "digest": cv.Digest, "actual": actual}).Error("tarball digest doesn't match the index")
+		if err := updateChartVersion(dbSession, r, name, cv.Version, bson.M{"digestmismatch": true}); err != nil {
+			log.WithFields(log.Fields{"name": name, "version": cv.Version}).WithError(err).Error("failed to flag digest mismatch")
+		}
+		return fmt.Errorf("digest mismatch for %s %s: expected %s, got %s", name, cv.Version, cv.Digest, actual)
+	}
+
 	chartFiles := chartFiles{ID: chartFilesID, Repo: r, Digest: cv.Digest}
 	if v, ok := files[readmeFileName]; ok {
 		chartFiles.Readme = v
@@ -386,6 +557,20 @@ func fetchAndImportFiles(dbSession datastore.Session, name string, r repo, cv ch
 		log.WithFields(log.Fields{"name": name, "version": cv.Version}).Info("values.yaml not found")
 	}
 
+	if r.Keyring != "" {
+		prov, err := verifyProvenance(r, source, name, cv, tarball.Bytes())
+		if err != nil {
+			return err
+		}
+		if prov.State != provenanceVerified {
+			log.WithFields(log.Fields{"name": name, "version": cv.Version, "state": prov.State, "error": prov.Error}).Warn("chart provenance not verified")
+		}
+		chartFiles.Provenance = prov
+		if err := updateChartVersion(dbSession, r, name, cv.Version, bson.M{"provenance": prov}); err != nil {
+			log.WithFields(log.Fields{"name": name, "version": cv.Version}).WithError(err).Error("failed to record provenance")
+		}
+	}
+
 	// inserts the chart files if not already indexed, or updates the existing
 	// entry if digest has changed
 	db.C(chartFilesCollection).UpsertId(chartFilesID, chartFiles)
@@ -393,6 +578,117 @@ func fetchAndImportFiles(dbSession datastore.Session, name string, r repo, cv ch
 	return nil
 }
 
+// updateChartVersion sets the given fields of a chart version, e.g. to record
+// that its tarball doesn't match the digest in the index. In that case the
+// files of the chart version aren't imported, so the tarball is verified (and
+// flagged) again on every sync.
+func updateChartVersion(dbSession datastore.Session, r repo, name, version string, fields bson.M) error {
+	catalog := newCatalog(dbSession)
+	chartID := chartDocID(r, name)
+	c, err := catalog.getChart(chartID)
+	if err != nil {
+		return err
+	}
+	for i, cv := range c.ChartVersions {
+		if cv.Version == version {
+			return catalog.updateChartVersion(chartID, i, fields)
+		}
+	}
+	return fmt.Errorf("version %s not found in chart %s", version, chartID)
+}
+
+// chartFilesID returns the ID of the files document of a chart version in the
+// generation of the repo. Like the charts, every generation has its own copy of
+// the files, so that rolling back serves the files of the generation rolled
+// back to. Files written before generations existed have no generation in their
+// ID.
+func chartFilesID(r repo, chartName, version string) string {
+	if r.Generation == 0 {
+		return fmt.Sprintf("%s/%s-%s", r.Name, chartName, version)
+	}
+	return fmt.Sprintf("%s/%s-%s@%d", r.Name, chartName, version, r.Generation)
+}
+
+// chartGeneration returns the repo of a stored chart, along with the generation
+// the chart belongs to
+func chartGeneration(c chart) repo {
+	r := c.Repo
+	r.Generation = c.Generation
+	return r
+}
+
+// copyChartFiles copies the files of the chart versions whose digest hasn't
+// changed from the given generation of the repo to the generation being
+// imported, so that they aren't downloaded again. Files already copied by an
+// interrupted sync are kept.
+func copyChartFiles(dbSession datastore.Session, r repo, generation int64, charts []chart) error {
+	from := r
+	from.Generation = generation
+	type target struct {
+		id     string
+		digest string
+	}
+	targets := map[string]target{}
+	ids := []string{}
+	for _, c := range charts {
+		for _, cv := range c.ChartVersions {
+			fromID, toID := chartFilesID(from, c.Name, cv.Version), chartFilesID(r, c.Name, cv.Version)
+			targets[fromID] = target{toID, cv.Digest}
+			ids = append(ids, fromID, toID)
+		}
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+	var files []bson.M
+	if err := db.C(chartFilesCollection).Find(bson.M{"_id": bson.M{"$in": ids}}).All(&files); err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for _, f := range files {
+		existing[fmt.Sprint(f["_id"])] = true
+	}
+	var pairs []interface{}
+	for _, f := range files {
+		t, ok := targets[fmt.Sprint(f["_id"])]
+		if !ok || existing[t.id] || f["digest"] != t.digest {
+			continue
+		}
+		f["_id"] = t.id
+		pairs = append(pairs, bson.M{"_id": t.id}, f)
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	log.WithFields(log.Fields{"repo": r.Name, "generation": r.Generation, "count": len(pairs) / 2}).Debug("copying unchanged chart files")
+	bulk := db.C(chartFilesCollection).Bulk()
+	bulk.Upsert(pairs...)
+	_, err := bulk.Run()
+	return err
+}
+
+// pruneChartFiles removes the files of the repo that don't belong to any of the
+// given chart versions, e.g. versions removed from the index or generations
+// removed from the catalog
+func pruneChartFiles(dbSession datastore.Session, repoName string, charts []chart) error {
+	ids := []string{}
+	for _, c := range charts {
+		for _, cv := range c.ChartVersions {
+			ids = append(ids, chartFilesID(repo{Name: repoName, Generation: c.Generation}, c.Name, cv.Version))
+		}
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+	_, err := db.C(chartFilesCollection).RemoveAll(bson.M{
+		"_id": bson.M{
+			"$nin": ids,
+		},
+		"repo.name": repoName,
+	})
+	return err
+}
+
 func extractFilesFromTarball(filenames []string, tarf *tar.Reader) (map[string]string, error) {
 	ret := make(map[string]string)
 	for {
@@ -417,6 +713,9 @@ func extractFilesFromTarball(filenames []string, tarf *tar.Reader) (map[string]s
 }
 
 func chartTarballURL(r repo, cv chartVersion) string {
+	if len(cv.URLs) == 0 {
+		return ""
+	}
 	source := cv.URLs[0]
 	if _, err := parseRepoUrl(source); err != nil {
 		// If the chart URL is not absolute, join with repo URL. It's fine if the
@@ -429,7 +728,58 @@ func chartTarballURL(r repo, cv chartVersion) string {
 	return source
 }
 
+// repoNetClient returns the client to use for requests on behalf of the repo
+func repoNetClient(r repo) (httpClient, error) {
+	client, err := repoTLSClient(r)
+	if err != nil || !isOCIRepo(r) {
+		return client, err
+	}
+	return ociRegistryClient(r, client), nil
+}
+
+// repoTLSConfig is the TLS configuration of the connections to a repo
+type repoTLSConfig struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+}
+
+// repoTLSClient returns the client using the TLS configuration of the repo, if
+// any
+func repoTLSClient(r repo) (httpClient, error) {
+	config := repoTLSConfig{r.CAFile, r.CertFile, r.KeyFile, r.InsecureSkipVerify}
+	if config == (repoTLSConfig{}) {
+		return netClient, nil
+	}
+
+	repoNetClientsMutex.Lock()
+	defer repoNetClientsMutex.Unlock()
+	if c, ok := repoNetClients[config]; ok {
+		return c, nil
+	}
+	if r.CAFile != "" {
+		if _, err := os.Stat(r.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.insecureSkipVerify {
+		log.WithFields(log.Fields{"repo": r.Name}).Warn("the TLS certificate of the repo isn't verified")
+	}
+	c, err := newNetClient(config)
+	if err != nil {
+		return nil, err
+	}
+	repoNetClients[config] = c
+	return c, nil
+}
+
 func initNetClient(additionalCA string) (*http.Client, error) {
+	return newNetClient(repoTLSConfig{caFile: additionalCA})
+}
+
+func newNetClient(config repoTLSConfig) (*http.Client, error) {
+	additionalCA := config.caFile
 	// Get the SystemCertPool, continue with an empty pool on error
 	caCertPool, _ := x509.SystemCertPool()
 	if caCertPool == nil {
@@ -449,14 +799,30 @@ func initNetClient(additionalCA string) (*http.Client, error) {
 		}
 	}
 
+	tlsConfig := &tls.Config{
+		RootCAs:            caCertPool,
+		InsecureSkipVerify: config.insecureSkipVerify,
+	}
+	if config.certFile != "" {
+		// Fail early on an invalid key pair, then load it for every connection
+		// so that renewed certificates are used without a restart
+		if _, err := tls.LoadX509KeyPair(config.certFile, config.keyFile); err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate %s: %v", config.certFile, err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(config.certFile, config.keyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+
 	// Return Transport for testing purposes
 	return &http.Client{
-		Timeout: time.Second * defaultTimeoutSeconds,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: caCertPool,
-			},
-			Proxy: http.ProxyFromEnvironment,
-		},
+		Transport: newTransport(&http.Transport{
+			TLSClientConfig: tlsConfig,
+			Proxy:           http.ProxyFromEnvironment,
+		}),
 	}, nil
 }
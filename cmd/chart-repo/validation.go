@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Masterminds/semver"
+	helmrepo "k8s.io/helm/pkg/repo"
+)
+
+// Severities of the problems found in an index. Chart versions with errors
+// are skipped, warnings are only reported.
+const (
+	problemError   = "error"
+	problemWarning = "warning"
+)
+
+var digestRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// validateIndex checks every chart version of the index, removing the ones
+// that can't be imported, and returns the problems found
+func validateIndex(index *helmrepo.IndexFile) []indexProblem {
+	problems := []indexProblem{}
+	for key, versions := range index.Entries {
+		valid := helmrepo.ChartVersions{}
+		seen := map[string]bool{}
+		for _, cv := range versions {
+			var versionProblems []indexProblem
+			if cv == nil || cv.Metadata == nil {
+				versionProblems = []indexProblem{{Chart: key, Severity: problemError, Message: "empty chart version"}}
+			} else {
+				versionProblems = validateChartVersion(key, cv)
+				if !hasErrors(versionProblems) && seen[cv.Version] {
+					versionProblems = append(versionProblems, indexProblem{key, cv.Version, problemError, "duplicate version"})
+				}
+			}
+			problems = append(problems, versionProblems...)
+			if hasErrors(versionProblems) {
+				continue
+			}
+			seen[cv.Version] = true
+			valid = append(valid, cv)
+		}
+
+		if len(valid) == 0 {
+			if len(versions) == 0 {
+				problems = append(problems, indexProblem{Chart: key, Severity: problemError, Message: "no versions"})
+			}
+			delete(index.Entries, key)
+			continue
+		}
+		index.Entries[key] = valid
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Chart != problems[j].Chart {
+			return problems[i].Chart < problems[j].Chart
+		}
+		return problems[i].Version < problems[j].Version
+	})
+	return problems
+}
+
+func validateChartVersion(key string, cv *helmrepo.ChartVersion) []indexProblem {
+	var problems []indexProblem
+	add := func(severity, format string, args ...interface{}) {
+		problems = append(problems, indexProblem{key, cv.Version, severity, fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case cv.Name == "":
+		add(problemError, "missing name")
+	case cv.Name != key:
+		add(problemError, "name %q doesn't match the index entry", cv.Name)
+	case strings.Contains(cv.Name, "/"):
+		add(problemError, "invalid name %q", cv.Name)
+	}
+	if cv.Version == "" {
+		add(problemError, "missing version")
+	} else if _, err := semver.NewVersion(cv.Version); err != nil {
+		add(problemError, "invalid version: %v", err)
+	}
+	if len(cv.URLs) == 0 {
+		add(problemError, "no URLs")
+	}
+	for _, u := range cv.URLs {
+		if _, err := url.Parse(u); err != nil || u == "" {
+			add(problemError, "invalid URL %q", u)
+		}
+	}
+	if cv.Digest == "" {
+		add(problemWarning, "missing digest, the tarball can't be checked")
+	} else if !digestRegexp.MatchString(cv.Digest) {
+		add(problemError, "invalid digest %q, expected a SHA-256 hex digest", cv.Digest)
+	}
+	if cv.Created.IsZero() {
+		add(problemWarning, "missing creation time")
+	}
+	return problems
+}
+
+func hasErrors(problems []indexProblem) bool {
+	for _, p := range problems {
+		if p.Severity == problemError {
+			return true
+		}
+	}
+	return false
+}
+
+// printValidationReport writes the problems found in the index of a repo as a
+// table
+func printValidationReport(w io.Writer, repoName string, problems []indexProblem) {
+	if len(problems) == 0 {
+		fmt.Fprintf(w, "No problems found in the index of %s\n", repoName)
+		return
+	}
+	fmt.Fprintf(w, "Found %d problems in the index of %s:\n", len(problems), repoName)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHART\tVERSION\tSEVERITY\tPROBLEM")
+	for _, p := range problems {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Chart, p.Version, p.Severity, p.Message)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arschles/assert"
+	"github.com/helm/monocular/cmd/internal/localstore"
+)
+
+const testDigest = "a2b7c3b8d0e1c0d2e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7"
+
+const problematicRepoIndexYAML = `apiVersion: v1
+entries:
+  mysql:
+  - name: mysql
+    version: 1.1.0
+    urls: [https://charts.example.com/mysql-1.1.0.tgz]
+    digest: ` + testDigest + `
+    created: 2018-12-11T10:00:00Z
+  - name: mysql
+    version: 1.1.0
+    urls: [https://charts.example.com/mysql-1.1.0-again.tgz]
+    digest: ` + testDigest + `
+    created: 2018-12-11T10:00:00Z
+  - name: mysql
+    version: not-a-version
+    urls: [https://charts.example.com/mysql.tgz]
+  - name: mysql
+    version: 1.0.0
+    urls: [https://charts.example.com/mysql-1.0.0.tgz]
+  redis:
+  - name: redis
+    version: 2.0.0
+    digest: ` + testDigest + `
+    created: 2018-12-11T10:00:00Z
+  nginx:
+  - name: other
+    version: 1.0.0
+    urls: [https://charts.example.com/nginx-1.0.0.tgz]
+    digest: sha256:abc
+  empty: []
+`
+
+func Test_validateIndex(t *testing.T) {
+	index, err := parseRepoIndex([]byte(problematicRepoIndexYAML))
+	assert.NoErr(t, err)
+	problems := validateIndex(index)
+
+	// Only the valid versions of mysql are kept
+	assert.Equal(t, len(index.Entries), 1, "charts with valid versions")
+	mysql := index.Entries["mysql"]
+	assert.Equal(t, len(mysql), 2, "valid mysql versions")
+	assert.Equal(t, mysql[0].Version, "1.1.0", "first valid version")
+	assert.Equal(t, mysql[1].Version, "1.0.0", "second valid version")
+
+	assert.Equal(t, problems, []indexProblem{
+		{"empty", "", problemError, "no versions"},
+		{"mysql", "1.0.0", problemWarning, "missing digest, the tarball can't be checked"},
+		{"mysql", "1.0.0", problemWarning, "missing creation time"},
+		{"mysql", "1.1.0", problemError, "duplicate version"},
+		{"mysql", "not-a-version", problemError, "invalid version: Invalid Semantic Version"},
+		{"mysql", "not-a-version", problemWarning, "missing digest, the tarball can't be checked"},
+		{"mysql", "not-a-version", problemWarning, "missing creation time"},
+		{"nginx", "1.0.0", problemError, `name "other" doesn't match the index entry`},
+		{"nginx", "1.0.0", problemError, `invalid digest "sha256:abc", expected a SHA-256 hex digest`},
+		{"nginx", "1.0.0", problemWarning, "missing creation time"},
+		{"redis", "2.0.0", problemError, "no URLs"},
+	}, "problems")
+
+	// Valid indexes have no problems
+	index, err = parseRepoIndex([]byte(validRepoIndexYAML))
+	assert.NoErr(t, err)
+	charts := len(index.Entries)
+	assert.Equal(t, len(validateIndex(index)), 0, "problems in a valid index")
+	assert.Equal(t, len(index.Entries), charts, "charts of a valid index")
+}
+
+func Test_syncRepoInvalidIndex(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`apiVersion: v1
+entries:
+  redis:
+  - name: redis
+    version: 2.0.0
+`))
+	}))
+	defer server.Close()
+	netClient = server.Client()
+
+	dbSession := localstore.New()
+
+	// The sync fails without panicking, and the problems are reported
+	err := syncRepo(dbSession, repo{Name: "test", URL: server.URL}, nil)
+	assert.ExistsErr(t, err, "no valid charts")
+	status, err := getRepoStatus(dbSession, "test")
+	assert.NoErr(t, err)
+	assert.Equal(t, status.Status, repoSyncFailed, "status")
+	assert.Equal(t, len(status.Validation), 3, "problems")
+	assert.Equal(t, status.Validation[0].Message, "no URLs", "first problem")
+}
+
+func Test_printValidationReport(t *testing.T) {
+	var b bytes.Buffer
+	printValidationReport(&b, "stable", nil)
+	assert.Equal(t, b.String(), "No problems found in the index of stable\n", "empty report")
+
+	b.Reset()
+	printValidationReport(&b, "stable", []indexProblem{
+		{"mysql", "1.0.0", problemWarning, "missing creation time"},
+		{"redis", "2.0.0", problemError, "no URLs"},
+	})
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, lines, []string{
+		"Found 2 problems in the index of stable:",
+		"CHART  VERSION  SEVERITY  PROBLEM",
+		"mysql  1.0.0    warning   missing creation time",
+		"redis  2.0.0    error     no URLs",
+	}, "report")
+}
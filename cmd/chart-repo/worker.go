@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "run the jobs importing the icons and files, and mirroring the tarballs, of the chart repositories being synced",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := applyDownloadFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyQueueFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyMirrorFlags(cmd); err != nil {
+			log.Fatal(err)
+		}
+		keys := credentialsKeysFromFlags(cmd)
+		dbSession := connectMongo(cmd)
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		log.Infof("Starting %d workers", downloads.workers)
+		for i := 0; i < downloads.workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runWorker(dbSession, keys, stop)
+			}()
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Infof("Received %s, waiting for running jobs to finish", sig)
+		close(stop)
+		wg.Wait()
+	},
+}
+
+func init() {
+	addDownloadFlags(workerCmd)
+	addQueueFlags(workerCmd)
+	addMirrorFlags(workerCmd)
+	addCredentialsKeysFlag(workerCmd)
+}
+
+// runWorker runs the import jobs of any repo until stopped, using the stored
+// credentials of the repos. The jobs of repos with other credentials are left
+// to the sync that enqueued them.
+func runWorker(dbSession datastore.Session, keys credentialsKeys, stop <-chan struct{}) {
+	selector := bson.M{"repo.local": false}
+	repoOf := func(job importJob) (repo, error) {
+		return withStoredCredentials(dbSession, keys, job.Repo.repo(job.Generation))
+	}
+	worker := processName()
+	for {
+		if err := processImportJobs(dbSession, selector, worker, repoOf, stop); err != nil {
+			log.WithError(err).Error("failed to claim import job")
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(queue.pollInterval):
+		}
+	}
+}
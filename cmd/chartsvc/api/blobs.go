@@ -0,0 +1,86 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+)
+
+// Collections of the blobs written by chart-repo when mirroring repos, laid
+// out like GridFS with the blobs prefix
+const blobFilesCollection = "blobs.files"
+const blobChunksCollection = "blobs.chunks"
+
+// blobDir is the directory chart-repo stores the blobs in, or empty if they're
+// stored in MongoDB
+var blobDir string
+
+var errBlobNotFound = errors.New("blob not found")
+
+type blobFile struct {
+	ID     string `bson:"_id"`
+	Length int64  `bson:"length"`
+}
+
+type blobChunk struct {
+	N    int    `bson:"n"`
+	Data []byte `bson:"data"`
+}
+
+// openBlob opens the blob with the given SHA-256 digest, returning
+// errBlobNotFound if it isn't stored
+func openBlob(db datastore.Database, digest string) (io.ReadCloser, error) {
+	if len(digest) < 2 {
+		return nil, errBlobNotFound
+	}
+	if blobDir != "" {
+		f, err := os.Open(filepath.Join(blobDir, "sha256", digest[:2], digest))
+		if os.IsNotExist(err) {
+			return nil, errBlobNotFound
+		}
+		return f, err
+	}
+
+	var file blobFile
+	if err := db.C(blobFilesCollection).FindId(digest).One(&file); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errBlobNotFound
+		}
+		return nil, err
+	}
+	var chunks []blobChunk
+	if err := db.C(blobChunksCollection).Find(bson.M{"files_id": digest}).Sort("n").All(&chunks); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, c := range chunks {
+		buf.Write(c.Data)
+	}
+	if int64(buf.Len()) != file.Length {
+		return nil, errors.New("blob is missing chunks")
+	}
+	return ioutil.NopCloser(&buf), nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/kubeapps/common/datastore/mockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testBlobDigest = "a2b7c3b8d0e1c0d2e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7"
+
+func Test_openBlob(t *testing.T) {
+	t.Run("directory", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "chartsvc-blobs")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		blobDir = dir
+		defer func() { blobDir = "" }()
+
+		_, err = openBlob(nil, testBlobDigest)
+		assert.Equal(t, errBlobNotFound, err)
+
+		path := filepath.Join(dir, "sha256", testBlobDigest[:2], testBlobDigest)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte("tarball"), 0644))
+		blob, err := openBlob(nil, testBlobDigest)
+		assert.NoError(t, err)
+		defer blob.Close()
+		data, _ := ioutil.ReadAll(blob)
+		assert.Equal(t, "tarball", string(data))
+	})
+
+	t.Run("MongoDB", func(t *testing.T) {
+		var m mock.Mock
+		db, closer := mockstore.NewMockSession(&m).DB()
+		defer closer()
+		m.On("One", &blobFile{}).Return(nil).Run(func(args mock.Arguments) {
+			*args.Get(0).(*blobFile) = blobFile{ID: testBlobDigest, Length: 7}
+		})
+		var chunks []blobChunk
+		m.On("All", &chunks).Run(func(args mock.Arguments) {
+			*args.Get(0).(*[]blobChunk) = []blobChunk{{0, []byte("tar")}, {1, []byte("ball")}}
+		})
+		blob, err := openBlob(db, testBlobDigest)
+		assert.NoError(t, err)
+		data, _ := ioutil.ReadAll(blob)
+		assert.Equal(t, "tarball", string(data))
+
+		m = mock.Mock{}
+		m.On("One", &blobFile{}).Return(mgo.ErrNotFound)
+		_, err = openBlob(db, testBlobDigest)
+		assert.Equal(t, errBlobNotFound, err)
+	})
+}
@@ -0,0 +1,237 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"math"
+	"sort"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/chartsvc/models"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/kubeapps/common/datastore"
+)
+
+// chartQuery selects the charts of the active generations of the repos
+type chartQuery struct {
+	// Active generation of the repos synced with generations, the charts of
+	// the other repos are the ones without a generation
+	generations map[string]int64
+	// Only the charts of these repos if set
+	repos []string
+	// Only the charts with this name if set
+	name string
+	// Only the charts with a version matching this one if set
+	version *versionQuery
+	// Only the charts whose latest version, or the version matching the
+	// version query, has a verified provenance
+	signed bool
+}
+
+// versionQuery matches a chart version by its version and app version
+type versionQuery struct {
+	version    string
+	appVersion string
+}
+
+// chartCatalog is where the charts synced by chart-repo are read from
+type chartCatalog interface {
+	// listCharts returns the charts matching the query
+	listCharts(q chartQuery) ([]*models.Chart, error)
+	// pageCharts returns a page of the charts matching the query, keeping a
+	// single chart for every digest of their latest version, sorted by name,
+	// along with the number of pages. All the charts are returned if pageSize
+	// is 0.
+	pageCharts(q chartQuery, pageNumber, pageSize int) ([]*models.Chart, int, error)
+	// searchCharts returns the charts matching the query whose name,
+	// description, repo name, keywords, sources or maintainer names match
+	// the regular expression
+	searchCharts(q chartQuery, pattern string) ([]*models.Chart, error)
+	// getChart returns the chart with the given ID
+	getChart(id string) (*models.Chart, error)
+	// getChartVersion returns the chart with the given ID, with only the
+	// given version
+	getChartVersion(id, version string) (*models.Chart, error)
+}
+
+// postgresCatalog is the catalog opened by OpenPostgreSQL, nil if the charts
+// are read from the datastore
+var postgresCatalog *pgCatalog
+
+// newCatalog returns the catalog opened by OpenPostgreSQL if any, and the one
+// reading the charts from the datastore otherwise
+func newCatalog(db datastore.Database) chartCatalog {
+	if postgresCatalog != nil {
+		return postgresCatalog
+	}
+	return mongoCatalog{db}
+}
+
+// OpenPostgreSQL connects to the PostgreSQL database chart-repo stores the
+// charts in with --catalog=postgresql, the charts being read from it from then
+// on. It returns the datastore of the repos and files stored in the same
+// database, to be passed to NewRouter.
+func OpenPostgreSQL(url string) (datastore.Session, error) {
+	catalog, err := openPGCatalog(url)
+	if err != nil {
+		return nil, err
+	}
+	store, err := localstore.OpenPostgreSQL(url)
+	if err != nil {
+		catalog.db.Close()
+		return nil, err
+	}
+	postgresCatalog = catalog
+	return store, nil
+}
+
+// activeGenerations returns the active generation of the repos synced with
+// generations
+func activeGenerations(db datastore.Database) (map[string]int64, error) {
+	var repos []*models.RepoStatus
+	if err := db.C(reposCollection).Find(bson.M{"generation": bson.M{"$gt": 0}}).Select(bson.M{"generation": 1}).All(&repos); err != nil {
+		return nil, err
+	}
+	generations := map[string]int64{}
+	for _, r := range repos {
+		generations[r.Name] = r.Generation
+	}
+	return generations, nil
+}
+
+// mongoCatalog reads the charts from the charts collection of the datastore
+type mongoCatalog struct {
+	db datastore.Database
+}
+
+// filter returns the MongoDB filter of the query
+func (q chartQuery) filter() bson.M {
+	names := []string{}
+	for name := range q.generations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conditions := []bson.M{}
+	for _, name := range names {
+		conditions = append(conditions, bson.M{"repo.name": name, "generation": q.generations[name]})
+	}
+	conditions = append(conditions, bson.M{"repo.name": bson.M{"$nin": names}, "generation": bson.M{"$exists": false}})
+	and := []bson.M{{"$or": conditions}}
+
+	if len(q.repos) > 0 {
+		and = append(and, bson.M{"repo.name": bson.M{"$in": q.repos}})
+	}
+	if q.name != "" {
+		and = append(and, bson.M{"name": q.name})
+	}
+	if q.version != nil {
+		versionMatch := bson.M{"version": q.version.version, "appversion": q.version.appVersion}
+		if q.signed {
+			versionMatch["provenance.state"] = provenanceVerified
+		}
+		and = append(and, bson.M{"chartversions": bson.M{"$elemMatch": versionMatch}})
+	} else if q.signed {
+		// A chart is signed if its latest version has been verified
+		and = append(and, bson.M{"chartversions.0.provenance.state": provenanceVerified})
+	}
+	return bson.M{"$and": and}
+}
+
+func (c mongoCatalog) listCharts(q chartQuery) ([]*models.Chart, error) {
+	var charts []*models.Chart
+	err := c.db.C(chartCollection).Find(q.filter()).All(&charts)
+	return charts, err
+}
+
+func (c mongoCatalog) pageCharts(q chartQuery, pageNumber, pageSize int) ([]*models.Chart, int, error) {
+	coll := c.db.C(chartCollection)
+	pipeline := []bson.M{
+		{"$match": q.filter()},
+		// Add a new field to store the latest version
+		{"$addFields": bson.M{"firstChartVersion": bson.M{"$arrayElemAt": []interface{}{"$chartversions", 0}}}},
+		// Group by unique digest for the latest version (remove duplicates)
+		{"$group": bson.M{"_id": "$firstChartVersion.digest", "chart": bson.M{"$first": "$$ROOT"}}},
+		// Restore original object struct
+		{"$replaceRoot": bson.M{"newRoot": "$chart"}},
+		// Order by name
+		{"$sort": bson.M{"name": 1}},
+	}
+
+	totalPages := 1
+	if pageSize != 0 {
+		// If a pageSize is given, returns only the the specified number of charts and
+		// the number of pages
+		countPipeline := append(pipeline, bson.M{"$count": "count"})
+		cc := count{}
+		// $count doesn't return a document when no chart matches
+		if err := coll.Pipe(countPipeline).One(&cc); err != nil && err != mgo.ErrNotFound {
+			return nil, 0, err
+		}
+		totalPages = int(math.Ceil(float64(cc.Count) / float64(pageSize)))
+
+		// If the page number is out of range, return the last one
+		if pageNumber > totalPages {
+			pageNumber = totalPages
+		}
+		skip := pageSize * (pageNumber - 1)
+		if skip < 0 {
+			skip = 0
+		}
+
+		pipeline = append(pipeline,
+			bson.M{"$skip": skip},
+			bson.M{"$limit": pageSize},
+		)
+	}
+	var charts []*models.Chart
+	err := coll.Pipe(pipeline).All(&charts)
+	return charts, totalPages, err
+}
+
+func (c mongoCatalog) searchCharts(q chartQuery, pattern string) ([]*models.Chart, error) {
+	filter := q.filter()
+	filter["$or"] = []bson.M{
+		{"name": bson.M{"$regex": pattern}},
+		{"description": bson.M{"$regex": pattern}},
+		{"repo.name": bson.M{"$regex": pattern}},
+		{"keywords": bson.M{"$elemMatch": bson.M{"$regex": pattern}}},
+		{"sources": bson.M{"$elemMatch": bson.M{"$regex": pattern}}},
+		{"maintainers": bson.M{"$elemMatch": bson.M{"name": bson.M{"$regex": pattern}}}},
+	}
+	var charts []*models.Chart
+	err := c.db.C(chartCollection).Find(filter).All(&charts)
+	return charts, err
+}
+
+func (c mongoCatalog) getChart(id string) (*models.Chart, error) {
+	var chart models.Chart
+	err := c.db.C(chartCollection).FindId(id).One(&chart)
+	return &chart, err
+}
+
+func (c mongoCatalog) getChartVersion(id, version string) (*models.Chart, error) {
+	var chart models.Chart
+	err := c.db.C(chartCollection).Find(bson.M{
+		"_id":           id,
+		"chartversions": bson.M{"$elemMatch": bson.M{"version": version}},
+	}).Select(bson.M{
+		"name": 1, "repo": 1, "description": 1, "home": 1, "keywords": 1, "maintainers": 1, "sources": 1,
+		"generation": 1, "chartversions.$": 1,
+	}).One(&chart)
+	return &chart, err
+}
@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/chartsvc/models"
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// catalogCharts are the documents written by chart-repo the catalogs are
+// tested with: the stable repo is synced with generations, its generation 2
+// being active, while incubator was synced before generations existed
+func catalogCharts() []bson.M {
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	stable := bson.M{"name": "stable", "url": "https://kubernetes-charts.storage.googleapis.com"}
+	incubator := bson.M{"name": "incubator", "url": "https://kubernetes-charts-incubator.storage.googleapis.com"}
+	return []bson.M{
+		{"_id": "stable/mysql@1", "name": "mysql", "repo": stable, "generation": int64(1), "keywords": []string{"database"},
+			"chartversions": []bson.M{{"version": "0.1.0", "appversion": "5.7", "created": created, "digest": "mysql-0.1.0"}}},
+		{"_id": "stable/mysql@2", "name": "mysql", "repo": stable, "generation": int64(2), "keywords": []string{"database"}, "raw_icon": []byte("icon"),
+			"chartversions": []bson.M{
+				{"version": "0.2.0", "appversion": "5.7", "created": created, "digest": "mysql-0.2.0", "provenance": bson.M{"state": provenanceVerified}},
+				{"version": "0.1.0", "appversion": "5.7", "created": created, "digest": "mysql-0.1.0"},
+			}},
+		{"_id": "stable/wordpress@2", "name": "wordpress", "repo": stable, "generation": int64(2), "description": "Web publishing platform",
+			"chartversions": []bson.M{{"version": "1.0.0", "appversion": "4.9", "created": created, "digest": "wordpress-1.0.0"}}},
+		{"_id": "incubator/kafka", "name": "kafka", "repo": incubator, "maintainers": []bson.M{{"name": "Confluent"}},
+			"chartversions": []bson.M{{"version": "0.1.0", "appversion": "4.0", "created": created, "digest": "kafka-0.1.0"}}},
+		// Same latest version as stable/mysql@2
+		{"_id": "incubator/mysql", "name": "mysql", "repo": incubator,
+			"chartversions": []bson.M{{"version": "0.2.0", "appversion": "5.7", "created": created, "digest": "mysql-0.2.0"}}},
+	}
+}
+
+func Test_chartCatalog(t *testing.T) {
+	t.Run("mongodb", func(t *testing.T) {
+		store := localstore.New()
+		for _, doc := range catalogCharts() {
+			assert.NoError(t, store.Insert(chartCollection, doc))
+		}
+		db, closer := store.DB()
+		defer closer()
+		testChartCatalog(t, mongoCatalog{db})
+	})
+	t.Run("postgresql", func(t *testing.T) {
+		url := os.Getenv("MONOCULAR_TEST_POSTGRESQL_URL")
+		if url == "" {
+			t.Skip("MONOCULAR_TEST_POSTGRESQL_URL is not set")
+		}
+		c, err := openPGCatalog(url)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer c.db.Close()
+		insertPGCharts(t, c, catalogCharts())
+		testChartCatalog(t, c)
+	})
+}
+
+// testChartCatalog checks the behavior shared by the catalogs, holding the
+// charts of catalogCharts
+func testChartCatalog(t *testing.T, c chartCatalog) {
+	active := chartQuery{generations: map[string]int64{"stable": 2}}
+
+	charts, err := c.listCharts(active)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"incubator/kafka", "incubator/mysql", "stable/mysql@2", "stable/wordpress@2"}, sortedChartIDs(charts), "active charts")
+	charts, err = c.listCharts(chartQuery{generations: active.generations, repos: []string{"stable"}, signed: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stable/mysql@2"}, sortedChartIDs(charts), "signed charts of a repo")
+	charts, err = c.listCharts(chartQuery{generations: active.generations, name: "mysql", version: &versionQuery{"0.1.0", "5.7"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stable/mysql@2"}, sortedChartIDs(charts), "charts with a version")
+
+	charts, totalPages, err := c.pageCharts(active, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, totalPages)
+	assert.Len(t, charts, 3, "charts with the same latest version are listed once")
+	charts, totalPages, err = c.pageCharts(active, 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, totalPages)
+	if assert.Len(t, charts, 2) {
+		assert.Equal(t, "kafka", charts[0].Name, "charts are sorted by name")
+		assert.Equal(t, "mysql", charts[1].Name, "charts are sorted by name")
+	}
+	charts, _, err = c.pageCharts(active, 5, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, charts, 1, "the last page is returned") {
+		assert.Equal(t, "stable/wordpress@2", charts[0].ID)
+	}
+
+	for pattern, want := range map[string][]string{
+		"data":      {"stable/mysql@2"},
+		"^word":     {"stable/wordpress@2"},
+		"publish":   {"stable/wordpress@2"},
+		"incubator": {"incubator/kafka", "incubator/mysql"},
+		"Confluent": {"incubator/kafka"},
+		"redis":     {},
+	} {
+		charts, err := c.searchCharts(active, pattern)
+		assert.NoError(t, err)
+		assert.Equal(t, want, sortedChartIDs(charts), "charts matching %s", pattern)
+	}
+
+	chart, err := c.getChart("stable/mysql@2")
+	assert.NoError(t, err)
+	assert.Equal(t, "stable", chart.Repo.Name)
+	assert.Equal(t, int64(2), chart.Generation)
+	assert.Equal(t, []byte("icon"), chart.RawIcon)
+	if assert.Len(t, chart.ChartVersions, 2) {
+		assert.Equal(t, provenanceVerified, chart.ChartVersions[0].Provenance.State)
+	}
+	_, err = c.getChart("stable/mysql@3")
+	assert.Equal(t, mgo.ErrNotFound, err)
+
+	chart, err = c.getChartVersion("stable/mysql@2", "0.1.0")
+	assert.NoError(t, err)
+	if assert.Len(t, chart.ChartVersions, 1) {
+		assert.Equal(t, "mysql-0.1.0", chart.ChartVersions[0].Digest)
+	}
+	_, err = c.getChartVersion("stable/mysql@2", "0.3.0")
+	assert.Equal(t, mgo.ErrNotFound, err)
+}
+
+func sortedChartIDs(charts []*models.Chart) []string {
+	ids := []string{}
+	for _, c := range charts {
+		ids = append(ids, c.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func Test_chartQueryFilter(t *testing.T) {
+	active := bson.M{"$or": []bson.M{
+		{"repo.name": bson.M{"$nin": []string{}}, "generation": bson.M{"$exists": false}},
+	}}
+	tests := []struct {
+		name  string
+		query chartQuery
+		want  bson.M
+	}{
+		{"all charts", chartQuery{}, bson.M{"$and": []bson.M{active}}},
+		{"signed charts of a repo", chartQuery{repos: []string{"stable"}, signed: true}, bson.M{"$and": []bson.M{
+			active,
+			{"repo.name": bson.M{"$in": []string{"stable"}}},
+			{"chartversions.0.provenance.state": provenanceVerified},
+		}}},
+		{"signed version of a chart", chartQuery{name: "wordpress", version: &versionQuery{"1.0.0", "4.9"}, signed: true}, bson.M{"$and": []bson.M{
+			active,
+			{"name": "wordpress"},
+			{"chartversions": bson.M{"$elemMatch": bson.M{"version": "1.0.0", "appversion": "4.9", "provenance.state": provenanceVerified}}},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.query.filter())
+		})
+	}
+}
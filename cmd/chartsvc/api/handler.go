@@ -14,17 +14,19 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package api
 
 import (
 	"fmt"
-	"math"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/globalsign/mgo/bson"
 	"github.com/gorilla/mux"
 	"github.com/helm/monocular/cmd/chartsvc/models"
+	"github.com/kubeapps/common/datastore"
 	"github.com/kubeapps/common/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -42,6 +44,10 @@ func (h WithParams) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 const chartCollection = "charts"
 const filesCollection = "files"
+const reposCollection = "repos"
+
+// State of the chart versions whose provenance has been verified
+const provenanceVerified = "verified"
 
 type apiResponse struct {
 	ID            string      `json:"id"`
@@ -85,6 +91,12 @@ func getPageNumberAndSize(req *http.Request) (int, int) {
 	return int(pageInt), int(sizeInt)
 }
 
+// signedOnly returns whether only signed charts were requested
+func signedOnly(req *http.Request) bool {
+	signed, _ := strconv.ParseBool(req.FormValue("signed"))
+	return signed
+}
+
 // min returns the minimum of two integers.
 // We are not using math.Min since that compares float64
 // and it's unnecessarily complex.
@@ -110,52 +122,57 @@ func uniqChartList(charts []*models.Chart) []*models.Chart {
 	return res
 }
 
-func getPaginatedChartList(repo string, pageNumber, pageSize int) (apiListResponse, interface{}, error) {
-	db, closer := dbSession.DB()
-	defer closer()
-	var charts []*models.Chart
+// activeGeneration returns the active generation of the repo, or 0 if its
+// documents were written before generations existed
+func activeGeneration(db datastore.Database, repo string) int64 {
+	var status models.RepoStatus
+	if err := db.C(reposCollection).FindId(repo).Select(bson.M{"generation": 1}).One(&status); err != nil {
+		return 0
+	}
+	return status.Generation
+}
 
-	c := db.C(chartCollection)
-	pipeline := []bson.M{}
-	if repo != "" {
-		pipeline = append(pipeline, bson.M{"$match": bson.M{"repo.name": repo}})
+// activeChartID returns the ID of the document of the chart in the active
+// generation of the repo
+func activeChartID(db datastore.Database, repo, chartName string) string {
+	if generation := activeGeneration(db, repo); generation != 0 {
+		return fmt.Sprintf("%s/%s@%d", repo, chartName, generation)
 	}
+	return fmt.Sprintf("%s/%s", repo, chartName)
+}
 
-	// We should query unique charts
-	pipeline = append(pipeline,
-		// Add a new field to store the latest version
-		bson.M{"$addFields": bson.M{"firstChartVersion": bson.M{"$arrayElemAt": []interface{}{"$chartversions", 0}}}},
-		// Group by unique digest for the latest version (remove duplicates)
-		bson.M{"$group": bson.M{"_id": "$firstChartVersion.digest", "chart": bson.M{"$first": "$$ROOT"}}},
-		// Restore original object struct
-		bson.M{"$replaceRoot": bson.M{"newRoot": "$chart"}},
-		// Order by name
-		bson.M{"$sort": bson.M{"name": 1}},
-	)
-
-	totalPages := 1
-	if pageSize != 0 {
-		// If a pageSize is given, returns only the the specified number of charts and
-		// the number of pages
-		countPipeline := append(pipeline, bson.M{"$count": "count"})
-		cc := count{}
-		err := c.Pipe(countPipeline).One(&cc)
-		if err != nil {
-			return apiListResponse{}, 0, err
-		}
-		totalPages = int(math.Ceil(float64(cc.Count) / float64(pageSize)))
+// activeFilesID returns the ID of the files document of the chart version in
+// the active generation of the repo
+func activeFilesID(db datastore.Database, repo, chartName, version string) string {
+	if generation := activeGeneration(db, repo); generation != 0 {
+		return fmt.Sprintf("%s/%s-%s@%d", repo, chartName, version, generation)
+	}
+	return fmt.Sprintf("%s/%s-%s", repo, chartName, version)
+}
 
-		// If the page number is out of range, return the last one
-		if pageNumber > totalPages {
-			pageNumber = totalPages
-		}
+// apiChartID returns the ID of the chart in the API, which doesn't include its
+// generation
+func apiChartID(c *models.Chart) string {
+	if c.Generation == 0 {
+		return c.ID
+	}
+	return strings.TrimSuffix(c.ID, fmt.Sprintf("@%d", c.Generation))
+}
 
-		pipeline = append(pipeline,
-			bson.M{"$skip": pageSize * (pageNumber - 1)},
-			bson.M{"$limit": pageSize},
-		)
+func getPaginatedChartList(repo string, pageNumber, pageSize int, signed bool) (apiListResponse, interface{}, error) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	generations, err := activeGenerations(db)
+	if err != nil {
+		return apiListResponse{}, 0, err
 	}
-	err := c.Pipe(pipeline).All(&charts)
+	q := chartQuery{generations: generations, signed: signed}
+	if repo != "" {
+		q.repos = []string{repo}
+	}
+	// We should query unique charts
+	charts, totalPages, err := newCatalog(db).pageCharts(q, pageNumber, pageSize)
 	if err != nil {
 		return apiListResponse{}, 0, err
 	}
@@ -166,7 +183,7 @@ func getPaginatedChartList(repo string, pageNumber, pageSize int) (apiListRespon
 // listCharts returns a list of charts
 func listCharts(w http.ResponseWriter, req *http.Request) {
 	pageNumber, pageSize := getPageNumberAndSize(req)
-	cl, meta, err := getPaginatedChartList("", pageNumber, pageSize)
+	cl, meta, err := getPaginatedChartList("", pageNumber, pageSize, signedOnly(req))
 	if err != nil {
 		log.WithError(err).Error("could not fetch charts")
 		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch all charts").Write(w)
@@ -178,7 +195,7 @@ func listCharts(w http.ResponseWriter, req *http.Request) {
 // listRepoCharts returns a list of charts in the given repo
 func listRepoCharts(w http.ResponseWriter, req *http.Request, params Params) {
 	pageNumber, pageSize := getPageNumberAndSize(req)
-	cl, meta, err := getPaginatedChartList(params["repo"], pageNumber, pageSize)
+	cl, meta, err := getPaginatedChartList(params["repo"], pageNumber, pageSize, signedOnly(req))
 	if err != nil {
 		log.WithError(err).Error("could not fetch charts")
 		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch all charts").Write(w)
@@ -191,15 +208,15 @@ func listRepoCharts(w http.ResponseWriter, req *http.Request, params Params) {
 func getChart(w http.ResponseWriter, req *http.Request, params Params) {
 	db, closer := dbSession.DB()
 	defer closer()
-	var chart models.Chart
-	chartID := fmt.Sprintf("%s/%s", params["repo"], params["chartName"])
-	if err := db.C(chartCollection).FindId(chartID).One(&chart); err != nil {
+	chartID := activeChartID(db, params["repo"], params["chartName"])
+	chart, err := newCatalog(db).getChart(chartID)
+	if err != nil {
 		log.WithError(err).Errorf("could not find chart with id %s", chartID)
 		response.NewErrorResponse(http.StatusNotFound, "could not find chart").Write(w)
 		return
 	}
 
-	cr := newChartResponse(&chart)
+	cr := newChartResponse(chart)
 	response.NewDataResponse(cr).Write(w)
 }
 
@@ -207,15 +224,15 @@ func getChart(w http.ResponseWriter, req *http.Request, params Params) {
 func listChartVersions(w http.ResponseWriter, req *http.Request, params Params) {
 	db, closer := dbSession.DB()
 	defer closer()
-	var chart models.Chart
-	chartID := fmt.Sprintf("%s/%s", params["repo"], params["chartName"])
-	if err := db.C(chartCollection).FindId(chartID).One(&chart); err != nil {
+	chartID := activeChartID(db, params["repo"], params["chartName"])
+	chart, err := newCatalog(db).getChart(chartID)
+	if err != nil {
 		log.WithError(err).Errorf("could not find chart with id %s", chartID)
 		response.NewErrorResponse(http.StatusNotFound, "could not find chart").Write(w)
 		return
 	}
 
-	cvl := newChartVersionListResponse(&chart)
+	cvl := newChartVersionListResponse(chart)
 	response.NewDataResponse(cvl).Write(w)
 }
 
@@ -223,21 +240,15 @@ func listChartVersions(w http.ResponseWriter, req *http.Request, params Params)
 func getChartVersion(w http.ResponseWriter, req *http.Request, params Params) {
 	db, closer := dbSession.DB()
 	defer closer()
-	var chart models.Chart
-	chartID := fmt.Sprintf("%s/%s", params["repo"], params["chartName"])
-	if err := db.C(chartCollection).Find(bson.M{
-		"_id":           chartID,
-		"chartversions": bson.M{"$elemMatch": bson.M{"version": params["version"]}},
-	}).Select(bson.M{
-		"name": 1, "repo": 1, "description": 1, "home": 1, "keywords": 1, "maintainers": 1, "sources": 1,
-		"chartversions.$": 1,
-	}).One(&chart); err != nil {
+	chartID := activeChartID(db, params["repo"], params["chartName"])
+	chart, err := newCatalog(db).getChartVersion(chartID, params["version"])
+	if err != nil {
 		log.WithError(err).Errorf("could not find chart with id %s", chartID)
 		response.NewErrorResponse(http.StatusNotFound, "could not find chart version").Write(w)
 		return
 	}
 
-	cvr := newChartVersionResponse(&chart, chart.ChartVersions[0])
+	cvr := newChartVersionResponse(chart, chart.ChartVersions[0])
 	response.NewDataResponse(cvr).Write(w)
 }
 
@@ -245,9 +256,9 @@ func getChartVersion(w http.ResponseWriter, req *http.Request, params Params) {
 func getChartIcon(w http.ResponseWriter, req *http.Request, params Params) {
 	db, closer := dbSession.DB()
 	defer closer()
-	var chart models.Chart
-	chartID := fmt.Sprintf("%s/%s", params["repo"], params["chartName"])
-	if err := db.C(chartCollection).FindId(chartID).One(&chart); err != nil {
+	chartID := activeChartID(db, params["repo"], params["chartName"])
+	chart, err := newCatalog(db).getChart(chartID)
+	if err != nil {
 		log.WithError(err).Errorf("could not find chart with id %s", chartID)
 		http.NotFound(w, req)
 		return
@@ -266,7 +277,7 @@ func getChartVersionReadme(w http.ResponseWriter, req *http.Request, params Para
 	db, closer := dbSession.DB()
 	defer closer()
 	var files models.ChartFiles
-	fileID := fmt.Sprintf("%s/%s-%s", params["repo"], params["chartName"], params["version"])
+	fileID := activeFilesID(db, params["repo"], params["chartName"], params["version"])
 	if err := db.C(filesCollection).FindId(fileID).One(&files); err != nil {
 		log.WithError(err).Errorf("could not find files with id %s", fileID)
 		http.NotFound(w, req)
@@ -286,7 +297,7 @@ func getChartVersionValues(w http.ResponseWriter, req *http.Request, params Para
 	db, closer := dbSession.DB()
 	defer closer()
 	var files models.ChartFiles
-	fileID := fmt.Sprintf("%s/%s-%s", params["repo"], params["chartName"], params["version"])
+	fileID := activeFilesID(db, params["repo"], params["chartName"], params["version"])
 	if err := db.C(filesCollection).FindId(fileID).One(&files); err != nil {
 		log.WithError(err).Errorf("could not find values.yaml with id %s", fileID)
 		http.NotFound(w, req)
@@ -296,20 +307,76 @@ func getChartVersionValues(w http.ResponseWriter, req *http.Request, params Para
 	w.Write([]byte(files.Values))
 }
 
+// getChartVersionFile returns the tarball or provenance file of a chart
+// version of a mirrored repo
+func getChartVersionFile(w http.ResponseWriter, req *http.Request, params Params) {
+	db, closer := dbSession.DB()
+	defer closer()
+	chartID := activeChartID(db, params["repo"], params["chartName"])
+	chart, err := newCatalog(db).getChartVersion(chartID, params["version"])
+	if err != nil {
+		log.WithError(err).Errorf("could not find chart with id %s", chartID)
+		http.NotFound(w, req)
+		return
+	}
+	cv := chart.ChartVersions[0]
+	if cv.Mirror == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	var digest, contentType string
+	switch tarball := tarballFileName(params["chartName"], cv.Version); params["file"] {
+	case tarball:
+		digest, contentType = cv.Mirror.Tarball, "application/gzip"
+	case tarball + ".prov":
+		digest, contentType = cv.Mirror.Provenance, "application/pgp-signature"
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	// Blobs are addressed by their content
+	etag := `"` + digest + `"`
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	blob, err := openBlob(db, digest)
+	if err != nil {
+		log.WithError(err).Errorf("could not open blob %s of %s %s", digest, chartID, cv.Version)
+		http.NotFound(w, req)
+		return
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag)
+	io.Copy(w, blob)
+}
+
+// tarballFileName returns the file name of the tarball of a chart version
+func tarballFileName(chartName, version string) string {
+	return fmt.Sprintf("%s-%s.tgz", chartName, version)
+}
+
 // listChartsWithFilters returns the list of repos that contains the given chart and the latest version found
 func listChartsWithFilters(w http.ResponseWriter, req *http.Request, params Params) {
 	db, closer := dbSession.DB()
 	defer closer()
 
-	var charts []*models.Chart
-	if err := db.C(chartCollection).Find(bson.M{
-		"name": params["chartName"],
-		"chartversions": bson.M{
-			"$elemMatch": bson.M{"version": req.FormValue("version"), "appversion": req.FormValue("appversion")},
-		}}).Select(bson.M{
-		"name": 1, "repo": 1,
-		"chartversions": bson.M{"$slice": 1},
-	}).All(&charts); err != nil {
+	generations, err := activeGenerations(db)
+	if err != nil {
+		log.WithError(err).Error("could not find the active generations of the repos")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch charts").Write(w)
+		return
+	}
+	charts, err := newCatalog(db).listCharts(chartQuery{
+		generations: generations,
+		name:        params["chartName"],
+		version:     &versionQuery{req.FormValue("version"), req.FormValue("appversion")},
+		signed:      signedOnly(req),
+	})
+	if err != nil {
 		log.WithError(err).Errorf(
 			"could not find charts with the given name %s, version %s and appversion %s",
 			params["chartName"], req.FormValue("version"), req.FormValue("appversion"),
@@ -332,22 +399,19 @@ func searchCharts(w http.ResponseWriter, req *http.Request, params Params) {
 	db, closer := dbSession.DB()
 	defer closer()
 
-	query := req.FormValue("q")
-	var charts []*models.Chart
-	conditions := bson.M{
-		"$or": []bson.M{
-			{"name": bson.M{"$regex": query}},
-			{"description": bson.M{"$regex": query}},
-			{"repo.name": bson.M{"$regex": query}},
-			{"keywords": bson.M{"$elemMatch": bson.M{"$regex": query}}},
-			{"sources": bson.M{"$elemMatch": bson.M{"$regex": query}}},
-			{"maintainers": bson.M{"$elemMatch": bson.M{"name": bson.M{"$regex": query}}}},
-		},
+	generations, err := activeGenerations(db)
+	if err != nil {
+		log.WithError(err).Error("could not find the active generations of the repos")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch charts").Write(w)
+		return
 	}
+	query := req.FormValue("q")
+	q := chartQuery{generations: generations, signed: signedOnly(req)}
 	if params["repo"] != "" {
-		conditions["repo.name"] = params["repo"]
+		q.repos = []string{params["repo"]}
 	}
-	if err := db.C(chartCollection).Find(conditions).All(&charts); err != nil {
+	charts, err := newCatalog(db).searchCharts(q, query)
+	if err != nil {
 		log.WithError(err).Errorf(
 			"could not find charts with the given query %s",
 			query,
@@ -359,17 +423,48 @@ func searchCharts(w http.ResponseWriter, req *http.Request, params Params) {
 	response.NewDataResponse(cl).Write(w)
 }
 
+// listRepos returns the list of synced repositories and their sync status
+func listRepos(w http.ResponseWriter, req *http.Request) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var repos []*models.RepoStatus
+	if err := db.C(reposCollection).Find(nil).Sort("_id").All(&repos); err != nil {
+		log.WithError(err).Error("could not fetch repos")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch all repos").Write(w)
+		return
+	}
+
+	response.NewDataResponse(newRepoListResponse(repos)).Write(w)
+}
+
+// getRepo returns the given repository and its sync status
+func getRepo(w http.ResponseWriter, req *http.Request, params Params) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var repo models.RepoStatus
+	if err := db.C(reposCollection).FindId(params["repo"]).One(&repo); err != nil {
+		log.WithError(err).Errorf("could not find repo %s", params["repo"])
+		response.NewErrorResponse(http.StatusNotFound, "could not find repo").Write(w)
+		return
+	}
+
+	response.NewDataResponse(newRepoResponse(&repo)).Write(w)
+}
+
 func newChartResponse(c *models.Chart) *apiResponse {
 	latestCV := c.ChartVersions[0]
+	cid := apiChartID(c)
 	return &apiResponse{
 		Type:       "chart",
-		ID:         c.ID,
+		ID:         cid,
 		Attributes: chartAttributes(*c),
-		Links:      selfLink{pathPrefix + "/charts/" + c.ID},
+		Links:      selfLink{pathPrefix + "/charts/" + cid},
 		Relationships: relMap{
 			"latestChartVersion": rel{
-				Data:  chartVersionAttributes(c.ID, latestCV),
-				Links: selfLink{pathPrefix + "/charts/" + c.ID + "/versions/" + latestCV.Version},
+				Data:  chartVersionAttributes(cid, latestCV),
+				Links: selfLink{pathPrefix + "/charts/" + cid + "/versions/" + latestCV.Version},
 			},
 		},
 	}
@@ -386,12 +481,16 @@ func newChartListResponse(charts []*models.Chart) apiListResponse {
 func chartVersionAttributes(cid string, cv models.ChartVersion) models.ChartVersion {
 	cv.Readme = pathPrefix + "/assets/" + cid + "/versions/" + cv.Version + "/README.md"
 	cv.Values = pathPrefix + "/assets/" + cid + "/versions/" + cv.Version + "/values.yaml"
+	if cv.Mirror != nil {
+		chartName := cid[strings.LastIndex(cid, "/")+1:]
+		cv.URLs = []string{pathPrefix + "/assets/" + cid + "/versions/" + cv.Version + "/" + tarballFileName(chartName, cv.Version)}
+	}
 	return cv
 }
 
 func chartAttributes(c models.Chart) models.Chart {
 	if c.RawIcon != nil {
-		c.Icon = pathPrefix + "/assets/" + c.ID + "/logo-160x160-fit.png"
+		c.Icon = pathPrefix + "/assets/" + apiChartID(&c) + "/logo-160x160-fit.png"
 	} else {
 		// If the icon wasn't processed, it is either not set or invalid
 		c.Icon = ""
@@ -400,15 +499,16 @@ func chartAttributes(c models.Chart) models.Chart {
 }
 
 func newChartVersionResponse(c *models.Chart, cv models.ChartVersion) *apiResponse {
+	cid := apiChartID(c)
 	return &apiResponse{
 		Type:       "chartVersion",
-		ID:         fmt.Sprintf("%s-%s", c.ID, cv.Version),
-		Attributes: chartVersionAttributes(c.ID, cv),
-		Links:      selfLink{pathPrefix + "/charts/" + c.ID + "/versions/" + cv.Version},
+		ID:         fmt.Sprintf("%s-%s", cid, cv.Version),
+		Attributes: chartVersionAttributes(cid, cv),
+		Links:      selfLink{pathPrefix + "/charts/" + cid + "/versions/" + cv.Version},
 		Relationships: relMap{
 			"chart": rel{
 				Data:  chartAttributes(*c),
-				Links: selfLink{pathPrefix + "/charts/" + c.ID},
+				Links: selfLink{pathPrefix + "/charts/" + cid},
 			},
 		},
 	}
@@ -422,3 +522,20 @@ func newChartVersionListResponse(c *models.Chart) apiListResponse {
 
 	return cvl
 }
+
+func newRepoResponse(r *models.RepoStatus) *apiResponse {
+	return &apiResponse{
+		Type:       "repo",
+		ID:         r.Name,
+		Attributes: r,
+		Links:      selfLink{pathPrefix + "/repos/" + r.Name},
+	}
+}
+
+func newRepoListResponse(repos []*models.RepoStatus) apiListResponse {
+	rl := apiListResponse{}
+	for _, r := range repos {
+		rl = append(rl, newRepoResponse(r))
+	}
+	return rl
+}
@@ -14,19 +14,24 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package api
 
 import (
 	"bytes"
 	"encoding/json"
 	"errors"
 	"image/color"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/disintegration/imaging"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 	"github.com/helm/monocular/cmd/chartsvc/models"
 	"github.com/kubeapps/common/datastore/mockstore"
 	"github.com/stretchr/testify/assert"
@@ -43,6 +48,7 @@ type bodyAPIResponse struct {
 }
 
 var chartsList []*models.Chart
+var reposList []*models.RepoStatus
 var cc count
 
 const testChartReadme = "# Quickstart\n\n```bash\nhelm install my-repo/my-chart\n```"
@@ -99,6 +105,11 @@ func Test_chartVersionAttributes(t *testing.T) {
 			assert.Equal(t, cv.Values, pathPrefix+"/assets/"+tt.chart.ID+"/versions/"+tt.chart.ChartVersions[0].Version+"/values.yaml", "values.yaml resource path should be the same")
 		})
 	}
+
+	t.Run("mirrored chart version", func(t *testing.T) {
+		cv := chartVersionAttributes("my-repo/my-chart", models.ChartVersion{Version: "0.1.0", URLs: []string{"https://example.com/my-chart-0.1.0.tgz"}, Mirror: &models.MirroredFiles{Tarball: "abc"}})
+		assert.Equal(t, []string{pathPrefix + "/assets/my-repo/my-chart/versions/0.1.0/my-chart-0.1.0.tgz"}, cv.URLs, "URLs should point to the mirrored tarball")
+	})
 }
 
 func Test_newChartResponse(t *testing.T) {
@@ -237,6 +248,9 @@ func Test_listCharts(t *testing.T) {
 			{ID: "stable/drupal", ChartVersions: []models.ChartVersion{{Version: "1.2.3", Digest: "12345"}}},
 			{ID: "stable/wordpress", ChartVersions: []models.ChartVersion{{Version: "1.2.3", Digest: "123456"}}},
 		}, meta{2}},
+		{"signed charts", "?signed=true", []*models.Chart{
+			{ID: "my-repo/my-chart", ChartVersions: []models.ChartVersion{{Version: "0.0.1", Digest: "123", Provenance: &models.Provenance{State: "verified"}}}},
+		}, meta{1}},
 	}
 
 	for _, tt := range tests {
@@ -244,10 +258,11 @@ func Test_listCharts(t *testing.T) {
 			var m mock.Mock
 			dbSession = mockstore.NewMockSession(&m)
 
+			m.On("All", &reposList)
 			m.On("All", &chartsList).Run(func(args mock.Arguments) {
 				*args.Get(0).(*[]*models.Chart) = tt.charts
 			})
-			if tt.query != "" {
+			if strings.Contains(tt.query, "size") {
 				m.On("One", &cc).Run(func(args mock.Arguments) {
 					*args.Get(0).(*count) = count{len(tt.charts)}
 				})
@@ -307,6 +322,7 @@ func Test_listRepoCharts(t *testing.T) {
 			var m mock.Mock
 			dbSession = mockstore.NewMockSession(&m)
 
+			m.On("All", &reposList)
 			m.On("All", &chartsList).Run(func(args mock.Arguments) {
 				*args.Get(0).(*[]*models.Chart) = tt.charts
 			})
@@ -376,6 +392,7 @@ func Test_getChart(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.Chart) = tt.chart
 				})
@@ -405,6 +422,50 @@ func Test_getChart(t *testing.T) {
 	}
 }
 
+func Test_activeGenerations(t *testing.T) {
+	var m mock.Mock
+	dbSession = mockstore.NewMockSession(&m)
+	m.On("All", &reposList).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]*models.RepoStatus) = []*models.RepoStatus{{Name: "stable", Generation: 3}}
+	})
+	db, closer := dbSession.DB()
+	defer closer()
+
+	generations, err := activeGenerations(db)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"stable": 3}, generations)
+	assert.Equal(t, bson.M{"$and": []bson.M{{"$or": []bson.M{
+		{"repo.name": "stable", "generation": int64(3)},
+		{"repo.name": bson.M{"$nin": []string{"stable"}}, "generation": bson.M{"$exists": false}},
+	}}}}, chartQuery{generations: generations}.filter())
+}
+
+func Test_getChartGeneration(t *testing.T) {
+	var m mock.Mock
+	dbSession = mockstore.NewMockSession(&m)
+	m.On("One", &models.RepoStatus{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.RepoStatus) = models.RepoStatus{Name: "my-repo", Generation: 3}
+	})
+	m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*models.Chart) = models.Chart{ID: "my-repo/my-chart@3", Generation: 3, ChartVersions: []models.ChartVersion{{Version: "0.1.0"}}}
+	})
+
+	db, closer := dbSession.DB()
+	defer closer()
+	assert.Equal(t, "my-repo/my-chart@3", activeChartID(db, "my-repo", "my-chart"))
+	assert.Equal(t, "my-repo/my-chart-0.1.0@3", activeFilesID(db, "my-repo", "my-chart", "0.1.0"))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/charts/my-repo/my-chart", nil)
+	getChart(w, req, Params{"repo": "my-repo", "chartName": "my-chart"})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var b bodyAPIResponse
+	json.NewDecoder(w.Body).Decode(&b)
+	assert.Equal(t, "my-repo/my-chart", b.Data.ID, "the generation isn't part of the chart id")
+	assert.Equal(t, pathPrefix+"/charts/my-repo/my-chart", b.Data.Links.(map[string]interface{})["self"])
+}
+
 func Test_listChartVersions(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -440,6 +501,7 @@ func Test_listChartVersions(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.Chart) = tt.chart
 				})
@@ -496,6 +558,12 @@ func Test_getChartVersion(t *testing.T) {
 			models.Chart{ID: "my-repo/my-chart", ChartVersions: []models.ChartVersion{{Version: "0.1.0"}, {Version: "0.0.1"}}},
 			http.StatusOK,
 		},
+		{
+			"signed chart version",
+			nil,
+			models.Chart{ID: "my-repo/my-chart", ChartVersions: []models.ChartVersion{{Version: "0.1.0", Provenance: &models.Provenance{State: "verified", SignedBy: "Chart Signer <signer@example.com>"}}}},
+			http.StatusOK,
+		},
 	}
 
 	for _, tt := range tests {
@@ -506,6 +574,7 @@ func Test_getChartVersion(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.Chart) = tt.chart
 				})
@@ -530,6 +599,60 @@ func Test_getChartVersion(t *testing.T) {
 				assert.Equal(t, b.Data.ID, tt.chart.ID+"-"+tt.chart.ChartVersions[0].Version, "chart id in the response should be the same")
 				assert.Equal(t, b.Data.Type, "chartVersion", "response type is chartVersion")
 				assert.Equal(t, b.Data.Attributes.(map[string]interface{})["version"], tt.chart.ChartVersions[0].Version, "chart version should match")
+				if prov := tt.chart.ChartVersions[0].Provenance; prov != nil {
+					attrs := b.Data.Attributes.(map[string]interface{})["provenance"].(map[string]interface{})
+					assert.Equal(t, attrs["state"], prov.State, "provenance state should match")
+					assert.Equal(t, attrs["signed_by"], prov.SignedBy, "signer should match")
+				}
+			}
+		})
+	}
+}
+
+func Test_getChartVersionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chartsvc-blobs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	blobDir = dir
+	defer func() { blobDir = "" }()
+	path := filepath.Join(dir, "sha256", testBlobDigest[:2], testBlobDigest)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, ioutil.WriteFile(path, []byte("tarball"), 0644))
+
+	mirrored := models.ChartVersion{Version: "0.1.0", Mirror: &models.MirroredFiles{Tarball: testBlobDigest}}
+	tests := []struct {
+		name     string
+		cv       models.ChartVersion
+		file     string
+		etag     string
+		wantCode int
+	}{
+		{"tarball", mirrored, "my-chart-0.1.0.tgz", "", http.StatusOK},
+		{"not modified", mirrored, "my-chart-0.1.0.tgz", `"` + testBlobDigest + `"`, http.StatusNotModified},
+		{"unsigned chart version", mirrored, "my-chart-0.1.0.tgz.prov", "", http.StatusNotFound},
+		{"other file", mirrored, "my-chart-0.2.0.tgz", "", http.StatusNotFound},
+		{"not mirrored", models.ChartVersion{Version: "0.1.0"}, "my-chart-0.1.0.tgz", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m mock.Mock
+			dbSession = mockstore.NewMockSession(&m)
+			m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
+			m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
+				*args.Get(0).(*models.Chart) = models.Chart{ID: "my-repo/my-chart", ChartVersions: []models.ChartVersion{tt.cv}}
+			})
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/assets/my-repo/my-chart/versions/0.1.0/"+tt.file, nil)
+			if tt.etag != "" {
+				req.Header.Set("If-None-Match", tt.etag)
+			}
+			getChartVersionFile(w, req, Params{"repo": "my-repo", "chartName": "my-chart", "version": "0.1.0", "file": tt.file})
+
+			assert.Equal(t, tt.wantCode, w.Code, "http status code should match")
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, "tarball", w.Body.String(), "content of the tarball should match")
+				assert.Equal(t, `"`+testBlobDigest+`"`, w.Header().Get("ETag"), "ETag should be the digest")
 			}
 		})
 	}
@@ -570,6 +693,7 @@ func Test_getChartIcon(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.Chart) = tt.chart
 				})
@@ -633,6 +757,7 @@ func Test_getChartVersionReadme(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.ChartFiles{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.ChartFiles) = tt.files
 				})
@@ -697,6 +822,7 @@ func Test_getChartVersionValues(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.ChartFiles{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.ChartFiles) = tt.files
 				})
@@ -739,6 +865,7 @@ func Test_findLatestChart(t *testing.T) {
 
 		var m mock.Mock
 		dbSession = mockstore.NewMockSession(&m)
+		m.On("All", &reposList)
 		m.On("All", &chartsList).Run(func(args mock.Arguments) {
 			*args.Get(0).(*[]*models.Chart) = charts
 		})
@@ -774,6 +901,7 @@ func Test_findLatestChart(t *testing.T) {
 
 		var m mock.Mock
 		dbSession = mockstore.NewMockSession(&m)
+		m.On("All", &reposList)
 		m.On("All", &chartsList).Run(func(args mock.Arguments) {
 			*args.Get(0).(*[]*models.Chart) = charts
 		})
@@ -801,3 +929,91 @@ func Test_findLatestChart(t *testing.T) {
 		}
 	})
 }
+
+func Test_listRepos(t *testing.T) {
+	repos := []*models.RepoStatus{
+		{Name: "incubator", URL: "https://kubernetes-charts-incubator.storage.googleapis.com", Status: "failed", Error: "repo index request failed"},
+		{Name: "stable", URL: "https://kubernetes-charts.storage.googleapis.com", Status: "succeeded", ChartCount: 2, VersionCount: 5, Validation: []models.IndexProblem{
+			{Chart: "mysql", Version: "0.1.0", Severity: "warning", Message: "missing creation time"},
+		}},
+	}
+
+	var m mock.Mock
+	dbSession = mockstore.NewMockSession(&m)
+	m.On("All", &reposList).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]*models.RepoStatus) = repos
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/repos", nil)
+	listRepos(w, req)
+
+	m.AssertExpectations(t)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var b bodyAPIListResponse
+	json.NewDecoder(w.Body).Decode(&b)
+	data := *b.Data
+	assert.Len(t, data, len(repos))
+	for i, resp := range data {
+		assert.Equal(t, resp.ID, repos[i].Name, "repo id in the response should be the same")
+		assert.Equal(t, resp.Type, "repo", "response type is repo")
+		assert.Equal(t, resp.Links.(map[string]interface{})["self"], pathPrefix+"/repos/"+repos[i].Name, "self link should be the same")
+		assert.Equal(t, resp.Attributes.(map[string]interface{})["status"], repos[i].Status, "status should be the same")
+		assert.Equal(t, resp.Attributes.(map[string]interface{})["chart_count"], float64(repos[i].ChartCount), "chart count should be the same")
+		validation, _ := resp.Attributes.(map[string]interface{})["validation"].([]interface{})
+		assert.Len(t, validation, len(repos[i].Validation), "validation report should be the same")
+	}
+}
+
+func Test_getRepo(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		repo     models.RepoStatus
+		wantCode int
+	}{
+		{
+			"repo does not exist",
+			errors.New("return an error when checking if repo exists"),
+			models.RepoStatus{Name: "my-repo"},
+			http.StatusNotFound,
+		},
+		{
+			"repo exists",
+			nil,
+			models.RepoStatus{Name: "my-repo", URL: "https://my.examplerepo.com", Status: "succeeded", Index: models.RepoIndex{Checksum: "1234"}},
+			http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m mock.Mock
+			dbSession = mockstore.NewMockSession(&m)
+
+			if tt.err != nil {
+				m.On("One", mock.Anything).Return(tt.err)
+			} else {
+				m.On("One", &models.RepoStatus{}).Return(nil).Run(func(args mock.Arguments) {
+					*args.Get(0).(*models.RepoStatus) = tt.repo
+				})
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/repos/"+tt.repo.Name, nil)
+			getRepo(w, req, Params{"repo": tt.repo.Name})
+
+			m.AssertExpectations(t)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusOK {
+				var b bodyAPIResponse
+				json.NewDecoder(w.Body).Decode(&b)
+				assert.Equal(t, b.Data.ID, tt.repo.Name, "repo id in the response should be the same")
+				assert.Equal(t, b.Data.Type, "repo", "response type is repo")
+				assert.Equal(t, b.Data.Attributes.(map[string]interface{})["url"], tt.repo.URL, "url should be the same")
+				assert.Equal(t, b.Data.Attributes.(map[string]interface{})["index"], map[string]interface{}{"checksum": "1234"}, "index should be the same")
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/helm/monocular/cmd/chartsvc/models"
+	"github.com/kubeapps/common/datastore"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	helmrepo "k8s.io/helm/pkg/repo"
+)
+
+// getRepoIndex returns a Helm index.yaml of the charts of the given repo, so
+// that /v1/repos/{repo} can be added as a chart repository
+func getRepoIndex(w http.ResponseWriter, req *http.Request, params Params) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var repo models.RepoStatus
+	if err := db.C(reposCollection).FindId(params["repo"]).One(&repo); err != nil {
+		log.WithError(err).Errorf("could not find repo %s", params["repo"])
+		http.NotFound(w, req)
+		return
+	}
+	// The index is served at /v1/repos/{repo}/index.yaml
+	index, err := buildIndex(db, []*models.RepoStatus{&repo}, "../../", signedOnly(req), false)
+	if err != nil {
+		log.WithError(err).Errorf("could not build the index of repo %s", params["repo"])
+		http.Error(w, "could not build index", http.StatusInternalServerError)
+		return
+	}
+	writeIndex(w, req, index)
+}
+
+// getIndex returns a Helm index.yaml of the charts of all the repos, so that
+// /v1 can be added as a chart repository. The charts are named after their
+// repo, e.g. stable/mysql, unless merge=true is given to merge the charts with
+// the same name.
+func getIndex(w http.ResponseWriter, req *http.Request) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var repos []*models.RepoStatus
+	if err := db.C(reposCollection).Find(nil).Sort("_id").All(&repos); err != nil {
+		log.WithError(err).Error("could not fetch repos")
+		http.Error(w, "could not fetch repos", http.StatusInternalServerError)
+		return
+	}
+	// The index is served at /v1/index.yaml
+	merge, _ := strconv.ParseBool(req.FormValue("merge"))
+	index, err := buildIndex(db, repos, "", signedOnly(req), !merge)
+	if err != nil {
+		log.WithError(err).Error("could not build the index")
+		http.Error(w, "could not build index", http.StatusInternalServerError)
+		return
+	}
+	writeIndex(w, req, index)
+}
+
+// buildIndex returns the index of the active charts of the repos. The entries
+// are prefixed with the name of their repo if prefixRepos is set. Otherwise,
+// charts with the same name in several repos are merged, and a chart version
+// found in several repos is taken from the first one. The URLs of mirrored
+// chart versions are relative to the location of the index, given by
+// assetsPrefix. Deprecated charts aren't imported, so they aren't in the index
+// either.
+func buildIndex(db datastore.Database, repos []*models.RepoStatus, assetsPrefix string, signed, prefixRepos bool) (*helmrepo.IndexFile, error) {
+	index := helmrepo.NewIndexFile()
+	// The index only changes with the syncs of the repos, so that its ETag
+	// stays the same in between
+	index.Generated = time.Time{}
+	if len(repos) == 0 {
+		return index, nil
+	}
+	names := []string{}
+	order := map[string]int{}
+	for i, r := range repos {
+		names = append(names, r.Name)
+		order[r.Name] = i
+		if r.LastSuccessfulSync.After(index.Generated) {
+			index.Generated = r.LastSuccessfulSync
+		}
+	}
+
+	generations, err := activeGenerations(db)
+	if err != nil {
+		return nil, err
+	}
+	charts, err := newCatalog(db).listCharts(chartQuery{generations: generations, repos: names})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(charts, func(i, j int) bool {
+		return order[charts[i].Repo.Name] < order[charts[j].Repo.Name]
+	})
+
+	seen := map[string]bool{}
+	for _, c := range charts {
+		name := c.Name
+		if prefixRepos {
+			name = c.Repo.Name + "/" + c.Name
+		}
+		for _, cv := range c.ChartVersions {
+			if signed && (cv.Provenance == nil || cv.Provenance.State != provenanceVerified) {
+				continue
+			}
+			key := name + "-" + cv.Version
+			if seen[key] {
+				log.WithFields(log.Fields{"chart": c.Name, "version": cv.Version, "repo": c.Repo.Name}).Debug("chart version already in another repo, skipping")
+				continue
+			}
+			seen[key] = true
+			index.Entries[name] = append(index.Entries[name], indexChartVersion(c, cv, assetsPrefix))
+		}
+	}
+	index.SortEntries()
+	return index, nil
+}
+
+// indexChartVersion returns the entry of the chart version in an index
+func indexChartVersion(c *models.Chart, cv models.ChartVersion, assetsPrefix string) *helmrepo.ChartVersion {
+	var maintainers []*chart.Maintainer
+	for i := range c.Maintainers {
+		maintainers = append(maintainers, &c.Maintainers[i])
+	}
+	return &helmrepo.ChartVersion{
+		Metadata: &chart.Metadata{
+			ApiVersion:  "v1",
+			Name:        c.Name,
+			Version:     cv.Version,
+			AppVersion:  cv.AppVersion,
+			Description: c.Description,
+			Home:        c.Home,
+			Keywords:    c.Keywords,
+			Maintainers: maintainers,
+			Sources:     c.Sources,
+			Icon:        c.Icon,
+		},
+		URLs:    indexURLs(c, cv, assetsPrefix),
+		Created: cv.Created,
+		Digest:  cv.Digest,
+	}
+}
+
+// indexURLs returns the URLs of the tarball of the chart version. Mirrored
+// tarballs are served by chartsvc, and the other URLs are resolved against the
+// URL of the repo, as they may be relative to its index.
+func indexURLs(c *models.Chart, cv models.ChartVersion, assetsPrefix string) []string {
+	if cv.Mirror != nil {
+		return []string{assetsPrefix + "assets/" + c.Repo.Name + "/" + c.Name + "/versions/" + cv.Version + "/" + tarballFileName(c.Name, cv.Version)}
+	}
+	base, err := url.Parse(strings.TrimSuffix(c.Repo.URL, "/") + "/")
+	if err != nil {
+		return cv.URLs
+	}
+	urls := []string{}
+	for _, u := range cv.URLs {
+		ref, err := url.Parse(u)
+		if err != nil {
+			urls = append(urls, u)
+			continue
+		}
+		urls = append(urls, base.ResolveReference(ref).String())
+	}
+	return urls
+}
+
+// writeIndex writes the index as YAML, with an ETag so that clients only
+// download it again when it changes
+func writeIndex(w http.ResponseWriter, req *http.Request, index *helmrepo.IndexFile) {
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		log.WithError(err).Error("could not marshal index")
+		http.Error(w, "could not marshal index", http.StatusInternalServerError)
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+	w.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(data)
+}
@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/globalsign/mgo"
+	"github.com/helm/monocular/cmd/chartsvc/models"
+	"github.com/kubeapps/common/datastore/mockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	helmrepo "k8s.io/helm/pkg/repo"
+)
+
+var (
+	indexSyncTime = time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	indexRepos    = []*models.RepoStatus{
+		{Name: "incubator", URL: "https://incubator.example.com", LastSuccessfulSync: indexSyncTime},
+		{Name: "stable", URL: "https://stable.example.com/charts/", LastSuccessfulSync: indexSyncTime.Add(time.Hour)},
+	}
+	indexCharts = []*models.Chart{
+		{ID: "stable/wordpress", Name: "wordpress", Repo: models.Repo{Name: "stable", URL: "https://stable.example.com/charts/"}, Description: "Blog", ChartVersions: []models.ChartVersion{
+			{Version: "1.0.0", AppVersion: "4.9", Digest: "abc", URLs: []string{"wordpress-1.0.0.tgz"}, Provenance: &models.Provenance{State: provenanceVerified}},
+			{Version: "0.9.0", Digest: "def", URLs: []string{"https://cdn.example.com/wordpress-0.9.0.tgz"}},
+		}},
+		{ID: "incubator/wordpress", Name: "wordpress", Repo: models.Repo{Name: "incubator", URL: "https://incubator.example.com"}, ChartVersions: []models.ChartVersion{
+			{Version: "1.0.0", Digest: "123", URLs: []string{"wordpress-1.0.0.tgz"}},
+			{Version: "1.1.0", Digest: "456", URLs: []string{"wordpress-1.1.0.tgz"}, Mirror: &models.MirroredFiles{Tarball: "456"}},
+		}},
+	}
+)
+
+func Test_getRepoIndex(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		signed   bool
+		wantCode int
+		want     map[string][]string
+	}{
+		{"repo does not exist", mgo.ErrNotFound, false, http.StatusNotFound, nil},
+		{"all versions", nil, false, http.StatusOK, map[string][]string{
+			"wordpress": {"https://stable.example.com/charts/wordpress-1.0.0.tgz", "https://cdn.example.com/wordpress-0.9.0.tgz"},
+		}},
+		{"signed versions", nil, true, http.StatusOK, map[string][]string{
+			"wordpress": {"https://stable.example.com/charts/wordpress-1.0.0.tgz"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m mock.Mock
+			dbSession = mockstore.NewMockSession(&m)
+			m.On("One", &models.RepoStatus{}).Return(tt.err).Run(func(args mock.Arguments) {
+				*args.Get(0).(*models.RepoStatus) = *indexRepos[1]
+			})
+			m.On("All", &reposList).Return(nil)
+			var charts []*models.Chart
+			m.On("All", &charts).Return(nil).Run(func(args mock.Arguments) {
+				*args.Get(0).(*[]*models.Chart) = indexCharts[:1]
+			})
+
+			w := httptest.NewRecorder()
+			path := "/repos/stable/index.yaml"
+			if tt.signed {
+				path += "?signed=true"
+			}
+			req := httptest.NewRequest("GET", path, nil)
+			getRepoIndex(w, req, Params{"repo": "stable"})
+
+			assert.Equal(t, tt.wantCode, w.Code, "http status code should match")
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, "application/x-yaml", w.Header().Get("Content-Type"), "content type should be YAML")
+			var index helmrepo.IndexFile
+			assert.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &index))
+			assert.Equal(t, indexRepos[1].LastSuccessfulSync, index.Generated.UTC(), "index should be generated at the last sync")
+			assert.Equal(t, tt.want, indexURLsByChart(index), "URLs should match")
+		})
+	}
+}
+
+func Test_getIndex(t *testing.T) {
+	var m mock.Mock
+	dbSession = mockstore.NewMockSession(&m)
+	m.On("All", &reposList).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]*models.RepoStatus) = indexRepos
+	})
+	var charts []*models.Chart
+	m.On("All", &charts).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]*models.Chart) = indexCharts
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/index.yaml", nil)
+	getIndex(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "http status code should match")
+	var index helmrepo.IndexFile
+	assert.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &index))
+	assert.Equal(t, indexRepos[1].LastSuccessfulSync, index.Generated.UTC(), "index should be generated at the last sync of any repo")
+	// The charts are named after their repo, and the mirrored version is
+	// served by chartsvc
+	assert.Equal(t, map[string][]string{
+		"incubator/wordpress": {
+			"assets/incubator/wordpress/versions/1.1.0/wordpress-1.1.0.tgz",
+			"https://incubator.example.com/wordpress-1.0.0.tgz",
+		},
+		"stable/wordpress": {
+			"https://stable.example.com/charts/wordpress-1.0.0.tgz",
+			"https://cdn.example.com/wordpress-0.9.0.tgz",
+		},
+	}, indexURLsByChart(index), "URLs should match")
+	assert.Equal(t, "wordpress", index.Entries["stable/wordpress"][0].Name, "chart name should be kept")
+
+	t.Run("merged", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/index.yaml?merge=true", nil)
+		getIndex(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "http status code should match")
+		var index helmrepo.IndexFile
+		assert.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &index))
+		// wordpress 1.0.0 is taken from incubator, the first repo
+		assert.Equal(t, map[string][]string{
+			"wordpress": {
+				"assets/incubator/wordpress/versions/1.1.0/wordpress-1.1.0.tgz",
+				"https://incubator.example.com/wordpress-1.0.0.tgz",
+				"https://cdn.example.com/wordpress-0.9.0.tgz",
+			},
+		}, indexURLsByChart(index), "URLs should match")
+		assert.Equal(t, "123", index.Entries["wordpress"][1].Digest, "digest should be the one of the first repo")
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		etag := w.Header().Get("ETag")
+		assert.NotEmpty(t, etag, "ETag should be set")
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/index.yaml", nil)
+		req.Header.Set("If-None-Match", etag)
+		getIndex(w, req)
+		assert.Equal(t, http.StatusNotModified, w.Code, "http status code should match")
+		assert.Empty(t, w.Body.String(), "body should be empty")
+	})
+}
+
+// indexURLsByChart returns the URLs of the versions of every chart of the
+// index, in the order of the index
+func indexURLsByChart(index helmrepo.IndexFile) map[string][]string {
+	urls := map[string][]string{}
+	for name, versions := range index.Entries {
+		for _, cv := range versions {
+			urls[name] = append(urls[name], cv.URLs...)
+		}
+	}
+	return urls
+}
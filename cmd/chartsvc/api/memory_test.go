@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/helm/monocular/cmd/internal/localstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// The tests below run the handlers against the in-memory datastore seeded
+// with testdata/seed.json, which evaluates the queries and pipelines the way
+// MongoDB does instead of returning canned results like mockstore
+
+type memoryListResponse struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+	Meta struct {
+		TotalPages int `json:"totalPages"`
+	} `json:"meta"`
+}
+
+func newMemoryServer(t *testing.T, seed bool) *httptest.Server {
+	store := localstore.New()
+	if seed {
+		if err := store.SeedFile("testdata/seed.json"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return httptest.NewServer(NewRouter(store, ""))
+}
+
+func getMemoryList(t *testing.T, ts *httptest.Server, path string) ([]string, int) {
+	res, err := http.Get(ts.URL + pathPrefix + path)
+	if !assert.NoError(t, err) {
+		return nil, 0
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status code should match")
+	var body memoryListResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	ids := []string{}
+	for _, d := range body.Data {
+		ids = append(ids, d.ID)
+	}
+	return ids, body.Meta.TotalPages
+}
+
+func Test_memoryListCharts(t *testing.T) {
+	ts := newMemoryServer(t, true)
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		charts     []string
+		totalPages int
+	}{
+		{"all charts", "/charts", []string{"incubator/kafka", "stable/mysql", "stable/wordpress"}, 1},
+		{"second page", "/charts?page=2&size=2", []string{"stable/wordpress"}, 2},
+		{"page out of range", "/charts?page=5&size=2", []string{"stable/wordpress"}, 2},
+		{"repo charts", "/charts/mirror", []string{"mirror/wordpress"}, 1},
+		{"signed charts", "/charts?signed=true", []string{"stable/wordpress"}, 1},
+		{"unknown repo", "/charts/unknown?size=10", []string{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			charts, totalPages := getMemoryList(t, ts, tt.path)
+			assert.Equal(t, tt.charts, charts)
+			assert.Equal(t, tt.totalPages, totalPages)
+		})
+	}
+}
+
+func Test_memoryEmptyStore(t *testing.T) {
+	ts := newMemoryServer(t, false)
+	defer ts.Close()
+
+	charts, totalPages := getMemoryList(t, ts, "/charts?size=2")
+	assert.Equal(t, []string{}, charts)
+	assert.Equal(t, 0, totalPages)
+}
+
+func Test_memoryListChartsWithFilters(t *testing.T) {
+	ts := newMemoryServer(t, true)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		charts []string
+	}{
+		{"duplicated digest", "/charts?name=wordpress&version=1.0.0&appversion=4.9", []string{"stable/wordpress"}},
+		{"older version", "/charts?name=wordpress&version=0.9.0&appversion=4.8", []string{"stable/wordpress"}},
+		{"appversion of another version", "/charts?name=wordpress&version=1.0.0&appversion=4.8", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			charts, _ := getMemoryList(t, ts, tt.path)
+			assert.Equal(t, tt.charts, charts)
+		})
+	}
+}
+
+func Test_memorySearchCharts(t *testing.T) {
+	ts := newMemoryServer(t, true)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		charts []string
+	}{
+		{"keyword", "/charts/search?q=database", []string{"stable/mysql"}},
+		{"maintainer", "/charts/search?q=Bitnami", []string{"stable/wordpress"}},
+		{"repo", "/charts/incubator/search?q=kafka", []string{"incubator/kafka"}},
+		{"other repo", "/charts/stable/search?q=kafka", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			charts, _ := getMemoryList(t, ts, tt.path)
+			assert.Equal(t, tt.charts, charts)
+		})
+	}
+}
+
+func Test_memoryGetChartVersion(t *testing.T) {
+	ts := newMemoryServer(t, true)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + pathPrefix + "/charts/stable/wordpress/versions/0.9.0")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var body struct {
+		Data struct {
+			ID         string `json:"id"`
+			Attributes struct {
+				AppVersion string `json:"app_version"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, "stable/wordpress-0.9.0", body.Data.ID)
+	assert.Equal(t, "4.8", body.Data.Attributes.AppVersion)
+
+	res, err = http.Get(ts.URL + pathPrefix + "/charts/stable/wordpress/versions/2.0.0")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func Test_memoryGetChartVersionReadme(t *testing.T) {
+	ts := newMemoryServer(t, true)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + pathPrefix + "/assets/stable/wordpress/versions/1.0.0/README.md")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	data, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "# WordPress\n\nWeb publishing platform for building blogs and websites.\n", string(data))
+}
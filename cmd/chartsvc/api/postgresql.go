@@ -0,0 +1,219 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/chartsvc/models"
+	"github.com/lib/pq"
+)
+
+// pgCatalog reads the charts from the table written by chart-repo with
+// --catalog=postgresql, holding the chart documents as BSON extended JSON
+type pgCatalog struct {
+	db *sql.DB
+}
+
+// openPGCatalog connects to PostgreSQL
+func openPGCatalog(url string) (*pgCatalog, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &pgCatalog{db}, nil
+}
+
+// pgArgs holds the arguments of a statement
+type pgArgs []interface{}
+
+// add adds an argument and returns its placeholder
+func (a *pgArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return fmt.Sprintf("$%d", len(*a))
+}
+
+// pgArray returns a JSON array of the document, which may be null
+func pgArray(field string) string {
+	return fmt.Sprintf("CASE jsonb_typeof(doc->'%[1]s') WHEN 'array' THEN doc->'%[1]s' ELSE '[]' END", field)
+}
+
+// where returns the SQL condition of the query
+func (q chartQuery) where(args *pgArgs) (string, error) {
+	generations, err := json.Marshal(q.generations)
+	if err != nil {
+		return "", err
+	}
+	conditions := []string{fmt.Sprintf("generation = COALESCE((%s::jsonb ->> repo)::bigint, 0)", args.add(string(generations)))}
+	if len(q.repos) > 0 {
+		conditions = append(conditions, fmt.Sprintf("repo = ANY(%s)", args.add(pq.Array(q.repos))))
+	}
+	if q.name != "" {
+		conditions = append(conditions, "name = "+args.add(q.name))
+	}
+	if q.version != nil {
+		versionMatch := fmt.Sprintf("v->>'version' = %s AND v->>'appversion' = %s", args.add(q.version.version), args.add(q.version.appVersion))
+		if q.signed {
+			versionMatch += " AND v->'provenance'->>'state' = " + args.add(provenanceVerified)
+		}
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM jsonb_array_elements(%s) v WHERE %s)", pgArray("chartversions"), versionMatch))
+	} else if q.signed {
+		// A chart is signed if its latest version has been verified
+		conditions = append(conditions, "doc->'chartversions'->0->'provenance'->>'state' = "+args.add(provenanceVerified))
+	}
+	return strings.Join(conditions, " AND "), nil
+}
+
+func (c *pgCatalog) listCharts(q chartQuery) ([]*models.Chart, error) {
+	var args pgArgs
+	where, err := q.where(&args)
+	if err != nil {
+		return nil, err
+	}
+	return c.query("SELECT id, doc FROM charts WHERE "+where+" ORDER BY repo, name", args...)
+}
+
+func (c *pgCatalog) pageCharts(q chartQuery, pageNumber, pageSize int) ([]*models.Chart, int, error) {
+	var args pgArgs
+	where, err := q.where(&args)
+	if err != nil {
+		return nil, 0, err
+	}
+	// A single chart is kept for every digest of the latest version
+	unique := "SELECT DISTINCT ON (doc->'chartversions'->0->>'digest') id, name, doc FROM charts WHERE " + where +
+		" ORDER BY doc->'chartversions'->0->>'digest', id"
+
+	totalPages := 1
+	limit := ""
+	if pageSize != 0 {
+		var cnt int
+		if err := c.db.QueryRow("SELECT count(*) FROM ("+unique+") u", args...).Scan(&cnt); err != nil {
+			return nil, 0, err
+		}
+		totalPages = int(math.Ceil(float64(cnt) / float64(pageSize)))
+
+		// If the page number is out of range, return the last one
+		if pageNumber > totalPages {
+			pageNumber = totalPages
+		}
+		offset := pageSize * (pageNumber - 1)
+		if offset < 0 {
+			offset = 0
+		}
+		limit = fmt.Sprintf(" LIMIT %s OFFSET %s", args.add(pageSize), args.add(offset))
+	}
+	charts, err := c.query("SELECT id, doc FROM ("+unique+") u ORDER BY name, id"+limit, args...)
+	return charts, totalPages, err
+}
+
+func (c *pgCatalog) searchCharts(q chartQuery, pattern string) ([]*models.Chart, error) {
+	var args pgArgs
+	where, err := q.where(&args)
+	if err != nil {
+		return nil, err
+	}
+	p := args.add(pattern)
+	match := []string{
+		"name ~ " + p,
+		"doc->>'description' ~ " + p,
+		"repo ~ " + p,
+		fmt.Sprintf("EXISTS (SELECT 1 FROM jsonb_array_elements_text(%s) k WHERE k ~ %s)", pgArray("keywords"), p),
+		fmt.Sprintf("EXISTS (SELECT 1 FROM jsonb_array_elements_text(%s) s WHERE s ~ %s)", pgArray("sources"), p),
+		fmt.Sprintf("EXISTS (SELECT 1 FROM jsonb_array_elements(%s) m WHERE m->>'name' ~ %s)", pgArray("maintainers"), p),
+	}
+	return c.query("SELECT id, doc FROM charts WHERE "+where+" AND ("+strings.Join(match, " OR ")+") ORDER BY repo, name", args...)
+}
+
+func (c *pgCatalog) getChart(id string) (*models.Chart, error) {
+	var chart models.Chart
+	err := scanPGChart(c.db.QueryRow("SELECT id, doc, raw_icon FROM charts WHERE id = $1", id), &chart, true)
+	if err == sql.ErrNoRows {
+		err = mgo.ErrNotFound
+	}
+	return &chart, err
+}
+
+func (c *pgCatalog) getChartVersion(id, version string) (*models.Chart, error) {
+	chart, err := c.getChart(id)
+	if err != nil {
+		return chart, err
+	}
+	chart.RawIcon = nil
+	for _, cv := range chart.ChartVersions {
+		if cv.Version == version {
+			chart.ChartVersions = []models.ChartVersion{cv}
+			return chart, nil
+		}
+	}
+	return chart, mgo.ErrNotFound
+}
+
+func (c *pgCatalog) query(query string, args ...interface{}) ([]*models.Chart, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var charts []*models.Chart
+	for rows.Next() {
+		var chart models.Chart
+		if err := scanPGChart(rows, &chart, false); err != nil {
+			return nil, err
+		}
+		charts = append(charts, &chart)
+	}
+	return charts, rows.Err()
+}
+
+// scanPGChart reads a row of ID, document and optionally icon into chart
+func scanPGChart(row interface {
+	Scan(...interface{}) error
+}, chart *models.Chart, withIcon bool) error {
+	var id, data string
+	var icon []byte
+	dest := []interface{}{&id, &data}
+	if withIcon {
+		dest = append(dest, &icon)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	var doc bson.M
+	if err := bson.UnmarshalJSON([]byte(data), &doc); err != nil {
+		return fmt.Errorf("invalid document of chart %s: %v", id, err)
+	}
+	doc["_id"] = id
+	if icon != nil {
+		doc["raw_icon"] = icon
+	}
+	// The document is read through BSON, like when it's read from MongoDB
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, chart)
+}
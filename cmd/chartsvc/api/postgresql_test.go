@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/helm/monocular/cmd/chartsvc/models"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// insertPGCharts replaces the charts of the catalog with the documents, like
+// chart-repo writes them
+func insertPGCharts(t *testing.T, c *pgCatalog, docs []bson.M) {
+	_, err := c.db.Exec(`
+CREATE TABLE IF NOT EXISTS charts (
+	id text PRIMARY KEY,
+	repo text NOT NULL,
+	name text NOT NULL,
+	generation bigint NOT NULL DEFAULT 0,
+	raw_icon bytea,
+	doc jsonb NOT NULL
+);
+DELETE FROM charts;`)
+	assert.NoError(t, err)
+	for _, doc := range docs {
+		rest := bson.M{}
+		for k, v := range doc {
+			if k != "_id" && k != "raw_icon" {
+				rest[k] = v
+			}
+		}
+		data, err := bson.MarshalJSON(rest)
+		assert.NoError(t, err)
+		generation, _ := doc["generation"].(int64)
+		icon, _ := doc["raw_icon"].([]byte)
+		_, err = c.db.Exec(`INSERT INTO charts (id, repo, name, generation, raw_icon, doc) VALUES ($1, $2, $3, $4, $5, $6)`,
+			doc["_id"], doc["repo"].(bson.M)["name"], doc["name"], generation, icon, string(data))
+		assert.NoError(t, err)
+	}
+}
+
+// fakePGRow is a row read from PostgreSQL
+type fakePGRow []interface{}
+
+func (r fakePGRow) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *string:
+			*d = r[i].(string)
+		case *[]byte:
+			*d = r[i].([]byte)
+		}
+	}
+	return nil
+}
+
+func Test_chartQueryWhere(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     chartQuery
+		wantWhere string
+		wantArgs  pgArgs
+	}{
+		{
+			"active charts",
+			chartQuery{generations: map[string]int64{"stable": 3}},
+			"generation = COALESCE(($1::jsonb ->> repo)::bigint, 0)",
+			pgArgs{`{"stable":3}`},
+		},
+		{
+			"signed charts of a repo",
+			chartQuery{repos: []string{"stable"}, signed: true},
+			"generation = COALESCE(($1::jsonb ->> repo)::bigint, 0) AND repo = ANY($2) AND doc->'chartversions'->0->'provenance'->>'state' = $3",
+			pgArgs{"null", pq.Array([]string{"stable"}), provenanceVerified},
+		},
+		{
+			"version of a chart",
+			chartQuery{name: "wordpress", version: &versionQuery{"1.0.0", "4.9"}},
+			"generation = COALESCE(($1::jsonb ->> repo)::bigint, 0) AND name = $2 AND EXISTS (SELECT 1 FROM jsonb_array_elements(" + pgArray("chartversions") + ") v WHERE v->>'version' = $3 AND v->>'appversion' = $4)",
+			pgArgs{"null", "wordpress", "1.0.0", "4.9"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args pgArgs
+			where, err := tt.query.where(&args)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantWhere, where)
+			assert.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
+
+func Test_scanPGChart(t *testing.T) {
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	// Document written by chart-repo
+	data, err := bson.MarshalJSON(bson.M{
+		"name":       "mysql",
+		"repo":       bson.M{"name": "stable", "url": "https://kubernetes-charts.storage.googleapis.com"},
+		"generation": int64(2),
+		"chartversions": []bson.M{
+			{"version": "0.1.0", "created": created, "digest": "123", "provenance": bson.M{"state": provenanceVerified}},
+		},
+	})
+	assert.NoError(t, err)
+
+	var chart models.Chart
+	assert.NoError(t, scanPGChart(fakePGRow{"stable/mysql@2", string(data), []byte("icon")}, &chart, true))
+	assert.Equal(t, "stable/mysql@2", chart.ID)
+	assert.Equal(t, "stable/mysql", apiChartID(&chart), "generation is read")
+	assert.Equal(t, "stable", chart.Repo.Name)
+	assert.Equal(t, []byte("icon"), chart.RawIcon)
+	assert.Len(t, chart.ChartVersions, 1)
+	assert.True(t, created.Equal(chart.ChartVersions[0].Created), "creation time is read")
+	assert.Equal(t, provenanceVerified, chart.ChartVersions[0].Provenance.State)
+}
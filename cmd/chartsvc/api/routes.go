@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2017 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package api implements the HTTP API of chartsvc, serving the charts synced by
+// chart-repo from the datastore
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/heptiolabs/healthcheck"
+	"github.com/kubeapps/common/datastore"
+	"github.com/urfave/negroni"
+)
+
+const pathPrefix = "/v1"
+
+// dbSession is the datastore the charts are read from
+var dbSession datastore.Session
+
+// NewRouter returns the handler of the API and health checks, reading the
+// charts from the datastore and the mirrored tarballs from blobs, or from the
+// datastore if blobs is empty. If the datastore was returned by
+// OpenPostgreSQL, the charts are read from PostgreSQL instead.
+func NewRouter(session datastore.Session, blobs string) http.Handler {
+	dbSession = session
+	blobDir = blobs
+	return setupRoutes()
+}
+
+func setupRoutes() http.Handler {
+	r := mux.NewRouter()
+
+	// Healthcheck
+	health := healthcheck.NewHandler()
+	r.Handle("/live", health)
+	r.Handle("/ready", health)
+
+	// Routes
+	apiv1 := r.PathPrefix(pathPrefix).Subrouter()
+	apiv1.Methods("GET").Path("/charts").Queries("name", "{chartName}", "version", "{version}", "appversion", "{appversion}").Handler(WithParams(listChartsWithFilters))
+	apiv1.Methods("GET").Path("/charts").HandlerFunc(listCharts)
+	apiv1.Methods("GET").Path("/charts/search").Queries("q", "{query}").Handler(WithParams(searchCharts))
+	apiv1.Methods("GET").Path("/charts/{repo}").Handler(WithParams(listRepoCharts))
+	apiv1.Methods("GET").Path("/charts/{repo}/search").Queries("q", "{query}").Handler(WithParams(searchCharts))
+	apiv1.Methods("GET").Path("/charts/{repo}/{chartName}").Handler(WithParams(getChart))
+	apiv1.Methods("GET").Path("/charts/{repo}/{chartName}/versions").Handler(WithParams(listChartVersions))
+	apiv1.Methods("GET").Path("/charts/{repo}/{chartName}/versions/{version}").Handler(WithParams(getChartVersion))
+	apiv1.Methods("GET").Path("/assets/{repo}/{chartName}/logo-160x160-fit.png").Handler(WithParams(getChartIcon))
+	apiv1.Methods("GET").Path("/assets/{repo}/{chartName}/versions/{version}/README.md").Handler(WithParams(getChartVersionReadme))
+	apiv1.Methods("GET").Path("/assets/{repo}/{chartName}/versions/{version}/values.yaml").Handler(WithParams(getChartVersionValues))
+	apiv1.Methods("GET").Path("/assets/{repo}/{chartName}/versions/{version}/{file}").Handler(WithParams(getChartVersionFile))
+	apiv1.Methods("GET").Path("/repos").HandlerFunc(listRepos)
+	apiv1.Methods("GET").Path("/repos/{repo}").Handler(WithParams(getRepo))
+	apiv1.Methods("GET").Path("/repos/{repo}/index.yaml").Handler(WithParams(getRepoIndex))
+	apiv1.Methods("GET").Path("/index.yaml").HandlerFunc(getIndex)
+
+	n := negroni.Classic()
+	n.UseHandler(r)
+	return n
+}
@@ -14,7 +14,7 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package api
 
 import (
 	"encoding/json"
@@ -23,6 +23,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/globalsign/mgo"
 	"github.com/helm/monocular/cmd/chartsvc/models"
 	"github.com/kubeapps/common/datastore/mockstore"
 	"github.com/stretchr/testify/assert"
@@ -80,6 +81,7 @@ func Test_GetCharts(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			var m mock.Mock
 			dbSession = mockstore.NewMockSession(&m)
+			m.On("All", &reposList)
 			m.On("All", &chartsList).Run(func(args mock.Arguments) {
 				*args.Get(0).(*[]*models.Chart) = tt.charts
 			})
@@ -122,6 +124,7 @@ func Test_GetChartsInRepo(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			var m mock.Mock
 			dbSession = mockstore.NewMockSession(&m)
+			m.On("All", &reposList)
 			m.On("All", &chartsList).Run(func(args mock.Arguments) {
 				*args.Get(0).(*[]*models.Chart) = tt.charts
 			})
@@ -178,6 +181,7 @@ func Test_GetChartInRepo(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.Chart) = tt.chart
 				})
@@ -231,6 +235,7 @@ func Test_ListChartVersions(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.Chart) = tt.chart
 				})
@@ -284,6 +289,7 @@ func Test_GetChartVersion(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.Chart) = tt.chart
 				})
@@ -337,6 +343,7 @@ func Test_GetChartIcon(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.Chart{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.Chart) = tt.chart
 				})
@@ -394,6 +401,7 @@ func Test_GetChartReadme(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.ChartFiles{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.ChartFiles) = tt.files
 				})
@@ -451,6 +459,7 @@ func Test_GetChartValues(t *testing.T) {
 			if tt.err != nil {
 				m.On("One", mock.Anything).Return(tt.err)
 			} else {
+				m.On("One", &models.RepoStatus{}).Return(mgo.ErrNotFound)
 				m.On("One", &models.ChartFiles{}).Return(nil).Run(func(args mock.Arguments) {
 					*args.Get(0).(*models.ChartFiles) = tt.files
 				})
@@ -465,3 +474,62 @@ func Test_GetChartValues(t *testing.T) {
 		})
 	}
 }
+
+// tests the GET /{apiVersion}/repos endpoint
+func Test_GetRepos(t *testing.T) {
+	ts := httptest.NewServer(setupRoutes())
+	defer ts.Close()
+
+	var m mock.Mock
+	dbSession = mockstore.NewMockSession(&m)
+	m.On("All", &reposList).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]*models.RepoStatus) = []*models.RepoStatus{{Name: "stable"}}
+	})
+
+	res, err := http.Get(ts.URL + pathPrefix + "/repos")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	m.AssertExpectations(t)
+	assert.Equal(t, res.StatusCode, http.StatusOK, "http status code should match")
+
+	var b bodyAPIListResponse
+	json.NewDecoder(res.Body).Decode(&b)
+	assert.Len(t, *b.Data, 1)
+}
+
+// tests the GET /{apiVersion}/repos/{repo} endpoint
+func Test_GetRepo(t *testing.T) {
+	ts := httptest.NewServer(setupRoutes())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{"repo does not exist", errors.New("return an error when checking if repo exists"), http.StatusNotFound},
+		{"repo exists", nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m mock.Mock
+			dbSession = mockstore.NewMockSession(&m)
+			if tt.err != nil {
+				m.On("One", mock.Anything).Return(tt.err)
+			} else {
+				m.On("One", &models.RepoStatus{}).Return(nil).Run(func(args mock.Arguments) {
+					*args.Get(0).(*models.RepoStatus) = models.RepoStatus{Name: "stable"}
+				})
+			}
+
+			res, err := http.Get(ts.URL + pathPrefix + "/repos/stable")
+			assert.NoError(t, err)
+			defer res.Body.Close()
+
+			m.AssertExpectations(t)
+			assert.Equal(t, res.StatusCode, tt.wantCode, "http status code should match")
+		})
+	}
+}
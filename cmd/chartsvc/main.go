@@ -21,59 +21,71 @@ import (
 	"net/http"
 	"os"
 
-	"github.com/gorilla/mux"
-	"github.com/heptiolabs/healthcheck"
+	"github.com/helm/monocular/cmd/chartsvc/api"
+	"github.com/helm/monocular/cmd/internal/localstore"
 	"github.com/kubeapps/common/datastore"
 	log "github.com/sirupsen/logrus"
-	"github.com/urfave/negroni"
 )
 
-const pathPrefix = "/v1"
-
-var dbSession datastore.Session
-
-func setupRoutes() http.Handler {
-	r := mux.NewRouter()
-
-	// Healthcheck
-	health := healthcheck.NewHandler()
-	r.Handle("/live", health)
-	r.Handle("/ready", health)
-
-	// Routes
-	apiv1 := r.PathPrefix(pathPrefix).Subrouter()
-	apiv1.Methods("GET").Path("/charts").Queries("name", "{chartName}", "version", "{version}", "appversion", "{appversion}").Handler(WithParams(listChartsWithFilters))
-	apiv1.Methods("GET").Path("/charts").HandlerFunc(listCharts)
-	apiv1.Methods("GET").Path("/charts/search").Queries("q", "{query}").Handler(WithParams(searchCharts))
-	apiv1.Methods("GET").Path("/charts/{repo}").Handler(WithParams(listRepoCharts))
-	apiv1.Methods("GET").Path("/charts/{repo}/search").Queries("q", "{query}").Handler(WithParams(searchCharts))
-	apiv1.Methods("GET").Path("/charts/{repo}/{chartName}").Handler(WithParams(getChart))
-	apiv1.Methods("GET").Path("/charts/{repo}/{chartName}/versions").Handler(WithParams(listChartVersions))
-	apiv1.Methods("GET").Path("/charts/{repo}/{chartName}/versions/{version}").Handler(WithParams(getChartVersion))
-	apiv1.Methods("GET").Path("/assets/{repo}/{chartName}/logo-160x160-fit.png").Handler(WithParams(getChartIcon))
-	apiv1.Methods("GET").Path("/assets/{repo}/{chartName}/versions/{version}/README.md").Handler(WithParams(getChartVersionReadme))
-	apiv1.Methods("GET").Path("/assets/{repo}/{chartName}/versions/{version}/values.yaml").Handler(WithParams(getChartVersionValues))
+// Datastores the charts are read from
+const (
+	datastoreMongoDB = "mongodb"
+	datastoreMemory  = "memory"
+)
 
-	n := negroni.Classic()
-	n.UseHandler(r)
-	return n
-}
+// Backends chart-repo stores the charts in
+const (
+	catalogMongoDB    = "mongodb"
+	catalogPostgreSQL = "postgresql"
+)
 
 func main() {
+	dbType := flag.String("datastore", datastoreMongoDB, "datastore the charts are read from, mongodb or memory")
+	seedFile := flag.String("seed-file", "", "JSON file of the documents of each collection, in MongoDB extended JSON, loaded into --datastore=memory")
 	dbURL := flag.String("mongo-url", "localhost", "MongoDB URL (see https://godoc.org/github.com/globalsign/mgo#Dial for format)")
 	dbName := flag.String("mongo-database", "charts", "MongoDB database")
 	dbUsername := flag.String("mongo-user", "", "MongoDB user")
+	blobDir := flag.String("blob-dir", "", "directory chart-repo stores the tarballs of mirrored repos in, stored in MongoDB if empty")
+	catalog := flag.String("catalog", catalogMongoDB, "backend chart-repo stores the charts, repos and files in, mongodb or postgresql")
+	postgresURL := flag.String("postgresql-url", "", "PostgreSQL connection string for --catalog=postgresql (see https://godoc.org/github.com/lib/pq for format), the password can be set with PGPASSWORD")
 	dbPassword := os.Getenv("MONGO_PASSWORD")
 	flag.Parse()
 
-	mongoConfig := datastore.Config{URL: *dbURL, Database: *dbName, Username: *dbUsername, Password: dbPassword}
-	var err error
-	dbSession, err = datastore.NewSession(mongoConfig)
-	if err != nil {
-		log.WithFields(log.Fields{"host": *dbURL}).Fatal(err)
+	if *catalog != catalogMongoDB && *catalog != catalogPostgreSQL {
+		log.Fatalf("invalid --catalog %q, must be one of %s or %s", *catalog, catalogMongoDB, catalogPostgreSQL)
+	}
+
+	var dbSession datastore.Session
+	switch {
+	case *catalog == catalogPostgreSQL:
+		// --datastore is ignored, everything chart-repo writes is read
+		// from PostgreSQL
+		var err error
+		dbSession, err = api.OpenPostgreSQL(*postgresURL)
+		if err != nil {
+			log.WithFields(log.Fields{"catalog": *catalog}).Fatal(err)
+		}
+	case *dbType == datastoreMongoDB:
+		mongoConfig := datastore.Config{URL: *dbURL, Database: *dbName, Username: *dbUsername, Password: dbPassword}
+		var err error
+		dbSession, err = datastore.NewSession(mongoConfig)
+		if err != nil {
+			log.WithFields(log.Fields{"host": *dbURL}).Fatal(err)
+		}
+	case *dbType == datastoreMemory:
+		// The charts only live as long as the process, e.g. for demos
+		store := localstore.New()
+		if *seedFile != "" {
+			if err := store.SeedFile(*seedFile); err != nil {
+				log.WithFields(log.Fields{"file": *seedFile}).Fatal(err)
+			}
+		}
+		dbSession = store
+	default:
+		log.Fatalf("invalid --datastore %q, must be one of %s or %s", *dbType, datastoreMongoDB, datastoreMemory)
 	}
 
-	n := setupRoutes()
+	n := api.NewRouter(dbSession, *blobDir)
 
 	port := os.Getenv("PORT")
 	if port == "" {
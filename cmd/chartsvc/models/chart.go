@@ -41,6 +41,9 @@ type Chart struct {
 	Icon          string             `json:"icon"`
 	RawIcon       []byte             `json:"-" bson:"raw_icon"`
 	ChartVersions []ChartVersion     `json:"-"`
+	// Generation of the repo the chart was imported in, which is part of its
+	// ID in the database
+	Generation int64 `json:"-"`
 }
 
 // ChartVersion is a representation of a specific version of a chart
@@ -52,6 +55,29 @@ type ChartVersion struct {
 	URLs       []string  `json:"urls"`
 	Readme     string    `json:"readme" bson:"-"`
 	Values     string    `json:"values" bson:"-"`
+	// Set if the tarball of the chart version doesn't match its digest
+	DigestMismatch bool `json:"digest_mismatch"`
+	// Only set if the repo of the chart is synced with a keyring
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// Only set if the repo of the chart is mirrored, the URLs then point to
+	// the copies served by chartsvc
+	Mirror *MirroredFiles `json:"-"`
+}
+
+// MirroredFiles holds the digests of the blobs storing the tarball and
+// provenance file of a mirrored chart version
+type MirroredFiles struct {
+	Tarball    string
+	Provenance string
+}
+
+// Provenance holds the outcome of verifying the provenance file of a chart
+// version. State is one of verified, unsigned or invalid.
+type Provenance struct {
+	State          string `json:"state"`
+	SignedBy       string `json:"signed_by,omitempty"`
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+	Error          string `json:"error,omitempty"`
 }
 
 // ChartFiles holds the README and values for a given chart version
@@ -60,3 +86,36 @@ type ChartFiles struct {
 	Readme string
 	Values string
 }
+
+// RepoStatus holds the details of a repository and the outcome of its last
+// sync
+type RepoStatus struct {
+	Name               string    `json:"name" bson:"_id"`
+	URL                string    `json:"url"`
+	LastSyncStart      time.Time `json:"last_sync_start"`
+	LastSyncEnd        time.Time `json:"last_sync_end"`
+	LastSuccessfulSync time.Time `json:"last_successful_sync"`
+	Status             string    `json:"status"`
+	Error              string    `json:"error"`
+	ChartCount         int       `json:"chart_count"`
+	VersionCount       int       `json:"version_count"`
+	Index              RepoIndex `json:"index"`
+	// Generation of the charts of the repository served
+	Generation int64 `json:"generation"`
+	// Problems found in the last index of the repository
+	Validation []IndexProblem `json:"validation"`
+}
+
+// IndexProblem is a problem found in an entry of the index of a repository.
+// Chart versions with errors aren't imported.
+type IndexProblem struct {
+	Chart    string `json:"chart"`
+	Version  string `json:"version"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// RepoIndex holds the details of the last index imported for a repository
+type RepoIndex struct {
+	Checksum string `json:"checksum"`
+}
@@ -0,0 +1,172 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/globalsign/mgo/bson"
+)
+
+// dbFile is the bbolt database of a store opened from a directory. Every
+// collection is a bucket of BSON documents, keyed by a sequence number so
+// that the documents are loaded in insertion order.
+const dbFile = "localstore.db"
+
+// openTimeout is how long Open waits for another process to close the
+// database of the directory
+var openTimeout = time.Second
+
+// Open loads the store kept in the directory, creating it if needed. The
+// changes to the store are written to the directory as they're made. The
+// database of the directory is locked until the store is closed, so it can't
+// be opened by another process in the meantime.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, dbFile), 0600, &bolt.Options{Timeout: openTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("localstore: %s is in use by another process", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := New()
+	s.db = db
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the collections of the database
+func (s *Store) load() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			c, err := loadCollection(b)
+			if err != nil {
+				return fmt.Errorf("can't load collection %s: %v", name, err)
+			}
+			s.collections[string(name)] = c
+			return nil
+		})
+	})
+}
+
+// loadCollection reads the documents of the bucket of a collection
+func loadCollection(b *bolt.Bucket) (*collection, error) {
+	c := newCollection()
+	err := b.ForEach(func(k, v []byte) error {
+		doc := bson.M{}
+		if err := bson.Unmarshal(v, &doc); err != nil {
+			return err
+		}
+		key := idKey(doc["_id"])
+		c.byID[key] = len(c.docs)
+		c.docs = append(c.docs, doc)
+		// The key is only valid during the transaction
+		c.keys[key] = append([]byte(nil), k...)
+		return nil
+	})
+	return c, err
+}
+
+// update runs f on the collection in a transaction writing its changes to the
+// bucket of the collection. Like in MongoDB, the changes made before f fails
+// are kept. If the transaction can't be committed, the collection is loaded
+// again so that it matches the database.
+func (s *Store) update(name string, c *collection, f func(c *collection) error) error {
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	c.writer = boltWriter{c, bucket}
+	err = f(c)
+	c.writer = nil
+	if commitErr := tx.Commit(); commitErr != nil {
+		reloadErr := s.db.View(func(tx *bolt.Tx) error {
+			loaded := newCollection()
+			if b := tx.Bucket([]byte(name)); b != nil {
+				var err error
+				if loaded, err = loadCollection(b); err != nil {
+					return err
+				}
+			}
+			s.collections[name] = loaded
+			return nil
+		})
+		if reloadErr != nil {
+			return fmt.Errorf("%v, and can't reload collection %s: %v", commitErr, name, reloadErr)
+		}
+		return commitErr
+	}
+	return err
+}
+
+// boltWriter writes the changes made to a collection to its bucket
+type boltWriter struct {
+	c      *collection
+	bucket *bolt.Bucket
+}
+
+// storeDoc writes the document to the bucket of the collection, under the key
+// of the document it replaces if any
+func (w boltWriter) storeDoc(key string, doc bson.M) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	k, ok := w.c.keys[key]
+	if !ok {
+		seq, err := w.bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		k = make([]byte, 8)
+		binary.BigEndian.PutUint64(k, seq)
+	}
+	if err := w.bucket.Put(k, data); err != nil {
+		return err
+	}
+	w.c.keys[key] = k
+	return nil
+}
+
+// deleteDoc removes the document from the bucket of the collection
+func (w boltWriter) deleteDoc(key string) error {
+	k, ok := w.c.keys[key]
+	if !ok {
+		return nil
+	}
+	if err := w.bucket.Delete(k); err != nil {
+		return err
+	}
+	delete(w.c.keys, key)
+	return nil
+}
@@ -0,0 +1,735 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package localstore implements datastore.Session without a MongoDB server.
+// The documents are kept in memory and, if the store is opened from a
+// directory, stored in a bbolt database in that directory so that they survive
+// restarts. A store opened with OpenPostgreSQL keeps the documents in
+// PostgreSQL instead, where several processes can share them. A store can be
+// seeded with documents written in MongoDB extended JSON, see Seed.
+//
+// Only the subset of the MongoDB query language used by Monocular is
+// evaluated: the query operators $eq, $ne, $in, $nin, $gt, $gte, $lt, $lte,
+// $exists, $regex, $elemMatch, $and and $or, the update operators $set, $inc
+// and $setOnInsert, positional projections and the aggregation stages $match,
+// $addFields, $group, $replaceRoot, $sort, $count, $skip and $limit. Anything
+// else returns an error rather than being silently ignored.
+package localstore
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+)
+
+// Store is a database whose collections are kept in memory
+type Store struct {
+	// Database the collections are stored in, nil if the store is kept in
+	// memory only
+	db *bolt.DB
+	// PostgreSQL database the documents are read from and written to by every
+	// operation, if the store was opened with OpenPostgreSQL
+	pg *sql.DB
+
+	mutex       sync.RWMutex
+	collections map[string]*collection
+}
+
+// New returns an empty store kept in memory only
+func New() *Store {
+	return &Store{collections: map[string]*collection{}}
+}
+
+// Close closes the database of the store
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pg != nil {
+		return s.pg.Close()
+	}
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+// DB returns the database of the store. All the sessions share the same
+// documents, so the closer does nothing.
+func (s *Store) DB() (datastore.Database, func()) {
+	return database{s}, func() {}
+}
+
+// Insert adds the documents to the collection, e.g. to seed the store
+func (s *Store) Insert(name string, docs ...interface{}) error {
+	return database{s}.C(name).Insert(docs...)
+}
+
+// collection returns the named collection, creating it if needed. The store
+// must be locked for writing.
+func (s *Store) collection(name string) *collection {
+	c, ok := s.collections[name]
+	if !ok {
+		c = newCollection()
+		s.collections[name] = c
+	}
+	return c
+}
+
+// collection holds the documents of a collection in insertion order
+type collection struct {
+	docs []bson.M
+	byID map[string]int
+	// Keys of the documents in the bucket of the collection, by idKey, if the
+	// store has a bbolt database
+	keys map[string][]byte
+	// Writer the changes are stored with, only set while the collection is
+	// being written if the store has a database
+	writer docWriter
+}
+
+// docWriter stores the changes made to a collection in the database of the
+// store
+type docWriter interface {
+	storeDoc(key string, doc bson.M) error
+	deleteDoc(key string) error
+}
+
+func newCollection() *collection {
+	return &collection{byID: map[string]int{}, keys: map[string][]byte{}}
+}
+
+// idKey returns the key a document is indexed by
+func idKey(id interface{}) string {
+	return fmt.Sprintf("%T/%v", id, id)
+}
+
+func (c *collection) get(id interface{}) (bson.M, bool) {
+	i, ok := c.byID[idKey(id)]
+	if !ok {
+		return nil, false
+	}
+	return c.docs[i], true
+}
+
+// put stores the document, replacing the one with the same ID
+func (c *collection) put(doc bson.M) error {
+	key := idKey(doc["_id"])
+	if c.writer != nil {
+		if err := c.writer.storeDoc(key, doc); err != nil {
+			return err
+		}
+	}
+	if i, ok := c.byID[key]; ok {
+		c.docs[i] = doc
+	} else {
+		c.byID[key] = len(c.docs)
+		c.docs = append(c.docs, doc)
+	}
+	return nil
+}
+
+// remove deletes the documents with the given IDs
+func (c *collection) remove(ids []interface{}) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	removed := map[string]bool{}
+	for _, id := range ids {
+		key := idKey(id)
+		if c.writer != nil {
+			if err := c.writer.deleteDoc(key); err != nil {
+				return err
+			}
+		}
+		removed[key] = true
+	}
+	docs := c.docs[:0]
+	c.byID = map[string]int{}
+	for _, doc := range c.docs {
+		key := idKey(doc["_id"])
+		if removed[key] {
+			continue
+		}
+		c.byID[key] = len(docs)
+		docs = append(docs, doc)
+	}
+	// Release the removed documents
+	for i := len(docs); i < len(c.docs); i++ {
+		c.docs[i] = nil
+	}
+	c.docs = docs
+	return nil
+}
+
+// find returns the documents matching the selector
+func (c *collection) find(selector bson.M) ([]bson.M, error) {
+	var docs []bson.M
+	for _, doc := range c.docs {
+		ok, err := match(doc, selector)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+type database struct {
+	store *Store
+}
+
+func (d database) C(name string) datastore.Collection {
+	return &collectionRef{d.store, name}
+}
+
+// collectionRef implements datastore.Collection, locking the store around
+// each operation
+type collectionRef struct {
+	store *Store
+	name  string
+}
+
+// read runs f on the collection with the store locked for reading. The
+// collection is empty if it has never been written to. The documents with the
+// given keys are enough for f if keys isn't nil, so that only those are read
+// from PostgreSQL.
+func (r *collectionRef) read(keys []string, f func(c *collection) error) error {
+	if r.store.pg != nil {
+		return r.store.pgRead(r.name, keys, f)
+	}
+	r.store.mutex.RLock()
+	defer r.store.mutex.RUnlock()
+	c, ok := r.store.collections[r.name]
+	if !ok {
+		c = newCollection()
+	}
+	return f(c)
+}
+
+// write runs f on the collection with the store locked for writing. The
+// changes are stored in the database of the store, if any, in a single
+// transaction. Like for read, f only needs the documents with the given keys
+// if keys isn't nil.
+func (r *collectionRef) write(keys []string, f func(c *collection) error) error {
+	if r.store.pg != nil {
+		return r.store.pgUpdate(r.name, keys, f)
+	}
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+	c := r.store.collection(r.name)
+	if r.store.db == nil {
+		return f(c)
+	}
+	return r.store.update(r.name, c, f)
+}
+
+func (r *collectionRef) Bulk() datastore.Bulk {
+	return &bulk{coll: r}
+}
+
+func (r *collectionRef) Pipe(pipeline interface{}) datastore.Pipe {
+	return &pipe{coll: r, pipeline: pipeline}
+}
+
+func (r *collectionRef) Find(selector interface{}) datastore.Query {
+	return &query{coll: r, selector: selector}
+}
+
+func (r *collectionRef) FindId(id interface{}) datastore.Query {
+	return &query{coll: r, selector: bson.M{"_id": id}}
+}
+
+func (r *collectionRef) Count() (int, error) {
+	var n int
+	err := r.read(nil, func(c *collection) error {
+		n = len(c.docs)
+		return nil
+	})
+	return n, err
+}
+
+func (r *collectionRef) Insert(docs ...interface{}) error {
+	var normalized []bson.M
+	keys := []string{}
+	for _, d := range docs {
+		doc, err := toDoc(d)
+		if err != nil {
+			return err
+		}
+		if _, ok := doc["_id"]; !ok {
+			doc["_id"] = bson.NewObjectId()
+		}
+		normalized = append(normalized, doc)
+		keys = append(keys, idKey(doc["_id"]))
+	}
+	return r.write(keys, func(c *collection) error {
+		for _, doc := range normalized {
+			if _, ok := c.get(doc["_id"]); ok {
+				return dupError(doc["_id"])
+			}
+			if err := c.put(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *collectionRef) Remove(selector interface{}) error {
+	sel, err := toDoc(selector)
+	if err != nil {
+		return err
+	}
+	return r.write(selectedKeys(sel), func(c *collection) error {
+		docs, err := c.find(sel)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return mgo.ErrNotFound
+		}
+		return c.remove([]interface{}{docs[0]["_id"]})
+	})
+}
+
+func (r *collectionRef) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	sel, err := toDoc(selector)
+	if err != nil {
+		return nil, err
+	}
+	info := &mgo.ChangeInfo{}
+	err = r.write(selectedKeys(sel), func(c *collection) error {
+		return removeAll(c, sel, info)
+	})
+	return info, err
+}
+
+func removeAll(c *collection, selector bson.M, info *mgo.ChangeInfo) error {
+	docs, err := c.find(selector)
+	if err != nil {
+		return err
+	}
+	var ids []interface{}
+	for _, doc := range docs {
+		ids = append(ids, doc["_id"])
+	}
+	info.Matched += len(ids)
+	info.Removed += len(ids)
+	return c.remove(ids)
+}
+
+func (r *collectionRef) UpdateId(id, update interface{}) error {
+	upd, err := toDoc(update)
+	if err != nil {
+		return err
+	}
+	return r.write([]string{idKey(id)}, func(c *collection) error {
+		doc, ok := c.get(id)
+		if !ok {
+			return mgo.ErrNotFound
+		}
+		updated, err := applyUpdate(doc, upd, false)
+		if err != nil {
+			return err
+		}
+		return c.put(updated)
+	})
+}
+
+// Update updates the first document matching the selector, or returns
+// mgo.ErrNotFound, like mgo.Collection.Update. It isn't part of
+// datastore.Collection, but the collections of MongoDB sessions have it too.
+func (r *collectionRef) Update(selector, update interface{}) error {
+	sel, err := toDoc(selector)
+	if err != nil {
+		return err
+	}
+	upd, err := toDoc(update)
+	if err != nil {
+		return err
+	}
+	return r.write(selectedKeys(sel), func(c *collection) error {
+		docs, err := c.find(sel)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return mgo.ErrNotFound
+		}
+		updated, err := applyUpdate(docs[0], upd, false)
+		if err != nil {
+			return err
+		}
+		return c.put(updated)
+	})
+}
+
+func (r *collectionRef) Upsert(selector, update interface{}) (*mgo.ChangeInfo, error) {
+	sel, err := toDoc(selector)
+	if err != nil {
+		return nil, err
+	}
+	upd, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+	info := &mgo.ChangeInfo{}
+	err = r.write(selectedKeys(sel), func(c *collection) error {
+		return upsert(c, sel, upd, info)
+	})
+	return info, err
+}
+
+func (r *collectionRef) UpsertId(id, update interface{}) (*mgo.ChangeInfo, error) {
+	return r.Upsert(bson.M{"_id": id}, update)
+}
+
+// upsert updates the first document matching the selector, or inserts one
+// built from the equality conditions of the selector and the update
+func upsert(c *collection, selector, update bson.M, info *mgo.ChangeInfo) error {
+	docs, err := c.find(selector)
+	if err != nil {
+		return err
+	}
+	if len(docs) > 0 {
+		updated, err := applyUpdate(docs[0], update, false)
+		if err != nil {
+			return err
+		}
+		info.Matched++
+		info.Updated++
+		return c.put(updated)
+	}
+
+	doc := bson.M{}
+	for k, v := range selector {
+		if strings.HasPrefix(k, "$") || isOperatorDoc(v) {
+			continue
+		}
+		if err := setPath(doc, k, v); err != nil {
+			return err
+		}
+	}
+	inserted, err := applyUpdate(doc, update, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := inserted["_id"]; !ok {
+		inserted["_id"] = bson.NewObjectId()
+	}
+	// Like MongoDB, a document whose ID is taken isn't replaced
+	if _, ok := c.get(inserted["_id"]); ok {
+		return dupError(inserted["_id"])
+	}
+	info.UpsertedId = inserted["_id"]
+	return c.put(inserted)
+}
+
+// selectedKeys returns the keys of the documents the selector can match if it
+// selects them by ID, and nil otherwise
+func selectedKeys(selector bson.M) []string {
+	id, ok := selector["_id"]
+	if !ok {
+		return nil
+	}
+	if !isOperatorDoc(id) {
+		return []string{idKey(id)}
+	}
+	ops := id.(bson.M)
+	ids, ok := ops["$in"].([]interface{})
+	if len(ops) != 1 || !ok {
+		return nil
+	}
+	keys := []string{}
+	for _, id := range ids {
+		keys = append(keys, idKey(id))
+	}
+	return keys
+}
+
+// dupError is the error returned by MongoDB when inserting a document whose
+// ID is taken, so that mgo.IsDup recognizes it
+func dupError(id interface{}) error {
+	return &mgo.LastError{Code: 11000, Err: fmt.Sprintf("E11000 duplicate key error: _id %v", id)}
+}
+
+// query implements datastore.Query
+type query struct {
+	coll       *collectionRef
+	selector   interface{}
+	projection interface{}
+	sortFields []string
+}
+
+func (q *query) Sort(fields ...string) datastore.Query {
+	sorted := *q
+	sorted.sortFields = fields
+	return &sorted
+}
+
+func (q *query) Select(projection interface{}) datastore.Query {
+	selected := *q
+	selected.projection = projection
+	return &selected
+}
+
+func (q *query) run() ([]bson.M, error) {
+	sel, err := toDoc(q.selector)
+	if err != nil {
+		return nil, err
+	}
+	var proj bson.M
+	if q.projection != nil {
+		if proj, err = toDoc(q.projection); err != nil {
+			return nil, err
+		}
+	}
+	var docs []bson.M
+	err = q.coll.read(selectedKeys(sel), func(c *collection) error {
+		found, err := c.find(sel)
+		if err != nil {
+			return err
+		}
+		if len(q.sortFields) > 0 {
+			var keys bson.D
+			for _, f := range q.sortFields {
+				if strings.HasPrefix(f, "-") {
+					keys = append(keys, bson.DocElem{Name: f[1:], Value: -1})
+				} else {
+					keys = append(keys, bson.DocElem{Name: strings.TrimPrefix(f, "+"), Value: 1})
+				}
+			}
+			found = sortDocs(found, keys)
+		}
+		for _, doc := range found {
+			if proj != nil {
+				if doc, err = project(doc, proj, sel); err != nil {
+					return err
+				}
+			}
+			docs = append(docs, doc)
+		}
+		return nil
+	})
+	return docs, err
+}
+
+func (q *query) All(result interface{}) error {
+	docs, err := q.run()
+	if err != nil {
+		return err
+	}
+	return decodeAll(docs, result)
+}
+
+func (q *query) One(result interface{}) error {
+	docs, err := q.run()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+	return decode(docs[0], result)
+}
+
+// pipe implements datastore.Pipe
+type pipe struct {
+	coll     *collectionRef
+	pipeline interface{}
+}
+
+func (p *pipe) run() ([]bson.M, error) {
+	stages, err := parsePipeline(p.pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	err = p.coll.read(nil, func(c *collection) error {
+		var err error
+		docs, err = aggregate(c.docs, stages)
+		return err
+	})
+	return docs, err
+}
+
+func (p *pipe) All(result interface{}) error {
+	docs, err := p.run()
+	if err != nil {
+		return err
+	}
+	return decodeAll(docs, result)
+}
+
+func (p *pipe) One(result interface{}) error {
+	docs, err := p.run()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+	return decode(docs[0], result)
+}
+
+// bulk implements datastore.Bulk, running the queued operations in order
+type bulk struct {
+	coll *collectionRef
+	ops  []func(c *collection, info *mgo.ChangeInfo) error
+	err  error
+}
+
+func (b *bulk) Upsert(pairs ...interface{}) {
+	if len(pairs)%2 != 0 {
+		b.err = fmt.Errorf("localstore: Bulk.Upsert requires an even number of parameters")
+		return
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		sel, err := toDoc(pairs[i])
+		if err != nil {
+			b.err = err
+			return
+		}
+		upd, err := toDoc(pairs[i+1])
+		if err != nil {
+			b.err = err
+			return
+		}
+		b.ops = append(b.ops, func(c *collection, info *mgo.ChangeInfo) error {
+			return upsert(c, sel, upd, info)
+		})
+	}
+}
+
+func (b *bulk) RemoveAll(selectors ...interface{}) {
+	for _, s := range selectors {
+		sel, err := toDoc(s)
+		if err != nil {
+			b.err = err
+			return
+		}
+		b.ops = append(b.ops, func(c *collection, info *mgo.ChangeInfo) error {
+			return removeAll(c, sel, info)
+		})
+	}
+}
+
+func (b *bulk) Run() (*mgo.BulkResult, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	info := &mgo.ChangeInfo{}
+	err := b.coll.write(nil, func(c *collection) error {
+		for _, op := range b.ops {
+			if err := op(c, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	b.ops = nil
+	if err != nil {
+		return nil, err
+	}
+	return &mgo.BulkResult{Matched: info.Matched, Modified: info.Updated}, nil
+}
+
+// toDoc returns a copy of the value as a document, decoded from its BSON
+// encoding like the documents stored by MongoDB
+func toDoc(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// decode decodes the document into result
+func decode(doc bson.M, result interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// decodeAll decodes the documents into result, a pointer to a slice
+func decodeAll(docs []bson.M, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("localstore: result argument must be a slice address, got %T", result)
+	}
+	slice := rv.Elem()
+	elemType := slice.Type().Elem()
+	out := reflect.MakeSlice(slice.Type(), 0, len(docs))
+	for _, doc := range docs {
+		elem := reflect.New(elemType)
+		if err := decode(doc, elem.Interface()); err != nil {
+			return err
+		}
+		out = reflect.Append(out, elem.Elem())
+	}
+	slice.Set(out)
+	return nil
+}
+
+// sortDocs returns the documents sorted by the keys, 1 for ascending and -1
+// for descending order
+func sortDocs(docs []bson.M, keys bson.D) []bson.M {
+	sorted := append([]bson.M(nil), docs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for _, k := range keys {
+			c := compare(firstValue(sorted[i], k.Name), firstValue(sorted[j], k.Name))
+			if c == 0 {
+				continue
+			}
+			if desc, _ := toFloat(k.Value); desc < 0 {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return sorted
+}
+
+// firstValue returns the value at the dotted path, nil if it's missing
+func firstValue(doc bson.M, path string) interface{} {
+	values := lookup(doc, strings.Split(path, "."))
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
@@ -0,0 +1,284 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/kubeapps/common/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ datastore.Session = &Store{}
+
+type job struct {
+	ID         string    `bson:"_id,omitempty"`
+	State      string    `bson:"state"`
+	Priority   int       `bson:"priority"`
+	ClaimToken string    `bson:"claimtoken"`
+	Attempts   int       `bson:"attempts"`
+	VisibleAt  time.Time `bson:"visibleat"`
+}
+
+func Test_collection(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testCollection(t, New())
+	})
+	t.Run("postgresql", func(t *testing.T) {
+		s := openTestPostgreSQL(t)
+		defer s.Close()
+		testCollection(t, s)
+	})
+}
+
+func testCollection(t *testing.T, s *Store) {
+	db, closer := s.DB()
+	defer closer()
+	c := db.C("jobs")
+
+	now := time.Now()
+	assert.NoError(t, c.Insert(
+		job{ID: "b", State: "pending", Priority: 1, ClaimToken: "1", VisibleAt: now},
+		job{ID: "a", State: "pending", Priority: 0, ClaimToken: "2", VisibleAt: now.Add(time.Hour)},
+	))
+	assert.True(t, mgo.IsDup(c.Insert(job{ID: "a"})), "IDs are unique")
+
+	n, err := c.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	t.Run("find", func(t *testing.T) {
+		var jobs []job
+		assert.NoError(t, c.Find(nil).Sort("priority").All(&jobs))
+		assert.Equal(t, []string{"a", "b"}, jobIDs(jobs))
+		assert.NoError(t, c.Find(bson.M{"state": "pending"}).Sort("-priority").All(&jobs))
+		assert.Equal(t, []string{"b", "a"}, jobIDs(jobs))
+
+		var j job
+		assert.NoError(t, c.Find(bson.M{"visibleat": bson.M{"$lte": now}}).One(&j))
+		assert.Equal(t, "b", j.ID)
+		assert.Equal(t, mgo.ErrNotFound, c.FindId("c").One(&j))
+
+		var ids []bson.M
+		assert.NoError(t, c.Find(nil).Select(bson.M{"_id": 1}).All(&ids))
+		assert.Equal(t, []bson.M{{"_id": "b"}, {"_id": "a"}}, ids)
+	})
+
+	t.Run("upsert", func(t *testing.T) {
+		// The upsert of a claimed job fails on the duplicated ID
+		_, err := c.Upsert(bson.M{"_id": "b", "claimtoken": "other"}, bson.M{"$set": bson.M{"state": "running"}})
+		assert.True(t, mgo.IsDup(err))
+
+		info, err := c.Upsert(bson.M{"_id": "b", "claimtoken": "1"}, bson.M{"$set": bson.M{"state": "running"}, "$inc": bson.M{"attempts": 1}})
+		assert.NoError(t, err)
+		assert.Nil(t, info.UpsertedId)
+		var j job
+		assert.NoError(t, c.FindId("b").One(&j))
+		assert.Equal(t, "running", j.State)
+		assert.Equal(t, 1, j.Attempts)
+
+		info, err = c.Upsert(bson.M{"_id": "c", "claimtoken": "3"}, bson.M{"$setOnInsert": bson.M{"state": "pending"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "c", info.UpsertedId)
+		assert.NoError(t, c.FindId("c").One(&j))
+		assert.Equal(t, job{ID: "c", State: "pending", ClaimToken: "3"}, j, "the document is built from the selector")
+
+		_, err = c.UpsertId("c", job{State: "done"})
+		assert.NoError(t, err)
+		assert.NoError(t, c.FindId("c").One(&j))
+		assert.Equal(t, job{ID: "c", State: "done"}, j, "the document is replaced")
+	})
+
+	t.Run("update", func(t *testing.T) {
+		assert.NoError(t, c.UpdateId("c", bson.M{"$set": bson.M{"priority": 5}}))
+		assert.Equal(t, mgo.ErrNotFound, c.UpdateId("d", bson.M{"$set": bson.M{"priority": 5}}))
+
+		updater := c.(interface {
+			Update(selector, update interface{}) error
+		})
+		assert.NoError(t, updater.Update(bson.M{"_id": "c", "priority": 5}, bson.M{"$inc": bson.M{"attempts": 1}}))
+		var j job
+		assert.NoError(t, c.FindId("c").One(&j))
+		assert.Equal(t, 1, j.Attempts)
+		assert.Equal(t, mgo.ErrNotFound, updater.Update(bson.M{"_id": "c", "priority": 4}, bson.M{"$inc": bson.M{"attempts": 1}}), "the document doesn't match")
+		n, err := c.Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n, "no document is inserted")
+	})
+
+	t.Run("bulk", func(t *testing.T) {
+		b := c.Bulk()
+		b.Upsert(bson.M{"_id": "d"}, bson.M{"$setOnInsert": bson.M{"state": "pending"}}, bson.M{"_id": "a"}, bson.M{"$setOnInsert": bson.M{"state": "pending"}})
+		b.RemoveAll(bson.M{"_id": bson.M{"$nin": []string{"a", "d"}}})
+		_, err := b.Run()
+		assert.NoError(t, err)
+
+		var jobs []job
+		assert.NoError(t, c.Find(nil).Sort("_id").All(&jobs))
+		assert.Equal(t, []string{"a", "d"}, jobIDs(jobs))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		info, err := c.RemoveAll(bson.M{"state": "pending"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, info.Removed)
+		assert.Equal(t, mgo.ErrNotFound, c.Remove(bson.M{"_id": "a"}))
+	})
+}
+
+func jobIDs(jobs []job) []string {
+	ids := []string{}
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+	return ids
+}
+
+func Test_Open(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir)
+	assert.NoError(t, err)
+	db, _ := s.DB()
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, db.C("charts").Insert(bson.M{"_id": "stable/wordpress"}))
+	assert.NoError(t, db.C("charts").Insert(bson.M{"_id": "stable/mysql", "created": created, "raw_icon": []byte("icon")}))
+	assert.NoError(t, db.C("charts").Insert(bson.M{"_id": "stable/kafka"}))
+	assert.NoError(t, db.C("charts").UpdateId("stable/mysql", bson.M{"$set": bson.M{"name": "mysql"}}))
+	_, err = db.C("charts").RemoveAll(bson.M{"_id": "stable/kafka"})
+	assert.NoError(t, err)
+
+	// The database is locked until the store is closed
+	openTimeout = 10 * time.Millisecond
+	defer func() { openTimeout = time.Second }()
+	_, err = Open(dir)
+	assert.Error(t, err, "the directory is in use")
+	assert.NoError(t, s.Close())
+
+	s, err = Open(dir)
+	assert.NoError(t, err)
+	db, _ = s.DB()
+	var charts []bson.M
+	assert.NoError(t, db.C("charts").Find(nil).All(&charts))
+	if assert.Len(t, charts, 2) {
+		assert.Equal(t, "stable/wordpress", charts[0]["_id"], "documents are loaded in insertion order")
+		assert.Equal(t, "mysql", charts[1]["name"])
+		assert.True(t, created.Equal(charts[1]["created"].(time.Time)))
+		assert.Equal(t, []byte("icon"), charts[1]["raw_icon"])
+	}
+
+	// A document inserted after reopening the store doesn't replace another
+	assert.NoError(t, db.C("charts").Insert(bson.M{"_id": "stable/redis"}))
+	assert.NoError(t, s.Close())
+	s, err = Open(dir)
+	assert.NoError(t, err)
+	defer s.Close()
+	db, _ = s.DB()
+	n, err := db.C("charts").Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	_, err = Open(filepath.Join(dir, dbFile))
+	assert.Error(t, err, "the directory is a file")
+}
+
+// openTestPostgreSQL returns an empty store kept in the database set by
+// MONOCULAR_TEST_POSTGRESQL_URL, skipping the test if it isn't set
+func openTestPostgreSQL(t *testing.T) *Store {
+	url := os.Getenv("MONOCULAR_TEST_POSTGRESQL_URL")
+	if url == "" {
+		t.Skip("MONOCULAR_TEST_POSTGRESQL_URL is not set")
+	}
+	s, err := OpenPostgreSQL(url)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = s.pg.Exec(`DELETE FROM documents`)
+	assert.NoError(t, err)
+	return s
+}
+
+func Test_OpenPostgreSQL(t *testing.T) {
+	s := openTestPostgreSQL(t)
+	defer s.Close()
+	db, _ := s.DB()
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, db.C("files").Insert(bson.M{"_id": "stable/wordpress"}))
+	assert.NoError(t, db.C("files").Insert(bson.M{"_id": "stable/mysql", "created": created, "readme": []byte("README")}))
+	assert.NoError(t, db.C("repos").Insert(bson.M{"_id": "stable/mysql"}))
+
+	// The documents are shared with the other stores of the database
+	other, err := OpenPostgreSQL(os.Getenv("MONOCULAR_TEST_POSTGRESQL_URL"))
+	assert.NoError(t, err)
+	defer other.Close()
+	otherDB, _ := other.DB()
+	assert.NoError(t, otherDB.C("files").UpdateId("stable/mysql", bson.M{"$set": bson.M{"name": "mysql"}}))
+	assert.True(t, mgo.IsDup(otherDB.C("files").Insert(bson.M{"_id": "stable/wordpress"})), "IDs are unique")
+
+	var files []bson.M
+	assert.NoError(t, db.C("files").Find(nil).All(&files))
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, "stable/wordpress", files[0]["_id"], "documents are read in insertion order")
+		assert.Equal(t, "mysql", files[1]["name"])
+		assert.True(t, created.Equal(files[1]["created"].(time.Time)))
+		assert.Equal(t, []byte("README"), files[1]["readme"])
+	}
+	assert.NoError(t, db.C("files").Find(bson.M{"_id": bson.M{"$in": []string{"stable/mysql", "stable/kafka"}}}).All(&files))
+	assert.Len(t, files, 1, "documents selected by ID")
+
+	// Collections are kept apart
+	_, err = otherDB.C("files").RemoveAll(nil)
+	assert.NoError(t, err)
+	n, err := db.C("files").Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = db.C("repos").Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func Test_Seed(t *testing.T) {
+	s := New()
+	assert.NoError(t, s.Seed([]byte(`{
+		"repos": [{"_id": "stable", "generation": {"$numberLong": "2"}}],
+		"charts": [{"_id": "stable/mysql@2", "repo": {"name": "stable"}, "chartversions": [{"created": {"$date": "2018-06-01T12:00:00Z"}}]}]
+	}`)))
+	db, _ := s.DB()
+
+	var repo bson.M
+	assert.NoError(t, db.C("repos").FindId("stable").One(&repo))
+	assert.Equal(t, int64(2), repo["generation"])
+
+	var chart struct {
+		ChartVersions []struct{ Created time.Time }
+	}
+	assert.NoError(t, db.C("charts").Find(bson.M{"repo.name": "stable"}).One(&chart))
+	if assert.Len(t, chart.ChartVersions, 1) {
+		assert.True(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC).Equal(chart.ChartVersions[0].Created))
+	}
+
+	assert.Error(t, s.Seed([]byte(`{"charts": {"_id": "x"}}`)), "documents must be listed")
+	assert.Error(t, s.Seed([]byte(`{"repos": [{"_id": "stable"}]}`)), "IDs are unique")
+}
@@ -0,0 +1,354 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// stage is a stage of an aggregation pipeline
+type stage struct {
+	name string
+	arg  interface{}
+	// Keys of $sort, in order
+	sortKeys bson.D
+}
+
+// parsePipeline returns the stages of the pipeline, a list of documents
+// holding a single stage each
+func parsePipeline(pipeline interface{}) ([]stage, error) {
+	data, err := bson.Marshal(bson.M{"stages": pipeline})
+	if err != nil {
+		return nil, err
+	}
+	var wrapped struct {
+		Stages []bson.Raw `bson:"stages"`
+	}
+	if err := bson.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("localstore: the pipeline must be a list of documents: %v", err)
+	}
+	var stages []stage
+	for _, raw := range wrapped.Stages {
+		var doc bson.M
+		if err := raw.Unmarshal(&doc); err != nil {
+			return nil, err
+		}
+		if len(doc) != 1 {
+			return nil, fmt.Errorf("localstore: a pipeline stage must have a single field, got %d", len(doc))
+		}
+		var s stage
+		for name, arg := range doc {
+			s = stage{name: name, arg: arg}
+		}
+		if s.name == "$sort" {
+			// The order of the keys is kept by decoding them into a bson.D
+			var sortStage struct {
+				Keys bson.D `bson:"$sort"`
+			}
+			if err := raw.Unmarshal(&sortStage); err != nil {
+				return nil, err
+			}
+			s.sortKeys = sortStage.Keys
+		}
+		stages = append(stages, s)
+	}
+	return stages, nil
+}
+
+// aggregate runs the stages on the documents, returning new documents
+func aggregate(docs []bson.M, stages []stage) ([]bson.M, error) {
+	for _, s := range stages {
+		var err error
+		switch s.name {
+		case "$match":
+			docs, err = matchStage(docs, s.arg)
+		case "$addFields":
+			docs, err = addFieldsStage(docs, s.arg)
+		case "$group":
+			docs, err = groupStage(docs, s.arg)
+		case "$replaceRoot":
+			docs, err = replaceRootStage(docs, s.arg)
+		case "$sort":
+			if len(s.sortKeys) == 0 {
+				return nil, fmt.Errorf("localstore: $sort needs at least one key")
+			}
+			docs = sortDocs(docs, s.sortKeys)
+		case "$count":
+			field, ok := s.arg.(string)
+			if !ok || field == "" || strings.HasPrefix(field, "$") {
+				return nil, fmt.Errorf("localstore: $count needs a field name")
+			}
+			// Like MongoDB, nothing is returned if there are no documents
+			if len(docs) > 0 {
+				docs = []bson.M{{field: len(docs)}}
+			}
+		case "$skip":
+			n, ok := toInt(s.arg)
+			if !ok || n < 0 {
+				return nil, fmt.Errorf("localstore: $skip needs a non-negative integer, got %v", s.arg)
+			}
+			if int(n) >= len(docs) {
+				docs = nil
+			} else {
+				docs = docs[n:]
+			}
+		case "$limit":
+			n, ok := toInt(s.arg)
+			if !ok || n <= 0 {
+				return nil, fmt.Errorf("localstore: $limit needs a positive integer, got %v", s.arg)
+			}
+			if int(n) < len(docs) {
+				docs = docs[:n]
+			}
+		default:
+			return nil, fmt.Errorf("localstore: unsupported pipeline stage %s", s.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func matchStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	selector, ok := arg.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("localstore: $match needs a document")
+	}
+	var matched []bson.M
+	for _, doc := range docs {
+		ok, err := match(doc, selector)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+	return matched, nil
+}
+
+func addFieldsStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	fields, ok := arg.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("localstore: $addFields needs a document")
+	}
+	var out []bson.M
+	for _, doc := range docs {
+		added := copyDoc(doc)
+		for _, name := range sortedKeys(fields) {
+			v, ok, err := evalExpr(doc, fields[name])
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if err := setPath(added, name, v); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, added)
+	}
+	return out, nil
+}
+
+func groupStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	spec, ok := arg.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("localstore: $group needs a document")
+	}
+	idExpr, ok := spec["_id"]
+	if !ok {
+		return nil, fmt.Errorf("localstore: $group needs an _id")
+	}
+	accumulators := map[string]interface{}{}
+	for name, acc := range spec {
+		if name == "_id" {
+			continue
+		}
+		op, ok := acc.(bson.M)
+		if !ok || len(op) != 1 {
+			return nil, fmt.Errorf("localstore: the accumulator of %s must be a document with a single operator", name)
+		}
+		expr, ok := op["$first"]
+		if !ok {
+			return nil, fmt.Errorf("localstore: unsupported accumulator of %s, only $first is supported", name)
+		}
+		accumulators[name] = expr
+	}
+
+	// The groups are returned in the order they're first seen
+	var groups []bson.M
+	seen := map[string]bool{}
+	for _, doc := range docs {
+		id, _, err := evalExpr(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		key, err := groupKey(id)
+		if err != nil {
+			return nil, err
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		group := bson.M{"_id": id}
+		for name, expr := range accumulators {
+			v, _, err := evalExpr(doc, expr)
+			if err != nil {
+				return nil, err
+			}
+			group[name] = v
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// groupKey returns the key telling apart the groups of $group
+func groupKey(id interface{}) (string, error) {
+	if f, ok := toFloat(id); ok {
+		// Numbers of different types are in the same group
+		return fmt.Sprintf("number/%v", f), nil
+	}
+	switch id.(type) {
+	case bson.M, []interface{}:
+		data, err := bson.Marshal(bson.M{"id": id})
+		if err != nil {
+			return "", err
+		}
+		return "doc/" + string(data), nil
+	}
+	return idKey(id), nil
+}
+
+func replaceRootStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	spec, ok := arg.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("localstore: $replaceRoot needs a document")
+	}
+	var out []bson.M
+	for _, doc := range docs {
+		v, _, err := evalExpr(doc, spec["newRoot"])
+		if err != nil {
+			return nil, err
+		}
+		root, ok := v.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("localstore: the newRoot of $replaceRoot must be a document, got %T", v)
+		}
+		out = append(out, root)
+	}
+	return out, nil
+}
+
+// evalExpr evaluates the aggregation expression on the document, returning
+// whether the value exists. Field paths ("$field.subfield"), $$ROOT,
+// $arrayElemAt and literal values are supported.
+func evalExpr(doc bson.M, expr interface{}) (interface{}, bool, error) {
+	switch e := expr.(type) {
+	case string:
+		if e == "$$ROOT" {
+			return doc, true, nil
+		}
+		if strings.HasPrefix(e, "$$") {
+			return nil, false, fmt.Errorf("localstore: unsupported variable %s", e)
+		}
+		if strings.HasPrefix(e, "$") {
+			values := lookup(doc, strings.Split(e[1:], "."))
+			switch len(values) {
+			case 0:
+				return nil, false, nil
+			case 1:
+				return values[0], true, nil
+			}
+			return values, true, nil
+		}
+		return e, true, nil
+	case bson.M:
+		if isOperatorDoc(e) {
+			if len(e) != 1 {
+				return nil, false, fmt.Errorf("localstore: an expression must have a single operator")
+			}
+			args, ok := e["$arrayElemAt"].([]interface{})
+			if !ok {
+				for op := range e {
+					return nil, false, fmt.Errorf("localstore: unsupported expression operator %s", op)
+				}
+			}
+			return arrayElemAt(doc, args)
+		}
+		out := bson.M{}
+		for k, sub := range e {
+			v, ok, err := evalExpr(doc, sub)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				out[k] = v
+			}
+		}
+		return out, true, nil
+	case []interface{}:
+		out := make([]interface{}, len(e))
+		for i, sub := range e {
+			v, _, err := evalExpr(doc, sub)
+			if err != nil {
+				return nil, false, err
+			}
+			out[i] = v
+		}
+		return out, true, nil
+	}
+	return expr, true, nil
+}
+
+// arrayElemAt evaluates {"$arrayElemAt": [array, index]}, a negative index
+// counting from the end of the array
+func arrayElemAt(doc bson.M, args []interface{}) (interface{}, bool, error) {
+	if len(args) != 2 {
+		return nil, false, fmt.Errorf("localstore: $arrayElemAt needs 2 arguments, got %d", len(args))
+	}
+	v, ok, err := evalExpr(doc, args[0])
+	if err != nil || !ok || v == nil {
+		return nil, false, err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("localstore: the first argument of $arrayElemAt must be an array, got %T", v)
+	}
+	idx, _, err := evalExpr(doc, args[1])
+	if err != nil {
+		return nil, false, err
+	}
+	i, ok := toInt(idx)
+	if !ok {
+		return nil, false, fmt.Errorf("localstore: the second argument of $arrayElemAt must be an integer, got %v", idx)
+	}
+	if i < 0 {
+		i += int64(len(list))
+	}
+	if i < 0 || i >= int64(len(list)) {
+		return nil, false, nil
+	}
+	return list[i], true, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+// uniqueChartsPipeline is the pipeline chartsvc lists the charts with
+func uniqueChartsPipeline(extra ...bson.M) []bson.M {
+	return append([]bson.M{
+		{"$match": bson.M{"repo.name": bson.M{"$in": []string{"stable", "mirror"}}}},
+		{"$addFields": bson.M{"firstChartVersion": bson.M{"$arrayElemAt": []interface{}{"$chartversions", 0}}}},
+		{"$group": bson.M{"_id": "$firstChartVersion.digest", "chart": bson.M{"$first": "$$ROOT"}}},
+		{"$replaceRoot": bson.M{"newRoot": "$chart"}},
+		{"$sort": bson.M{"name": 1}},
+	}, extra...)
+}
+
+func Test_pipe(t *testing.T) {
+	s := New()
+	assert.NoError(t, s.Insert("charts",
+		bson.M{"_id": "stable/wordpress", "name": "wordpress", "repo": bson.M{"name": "stable"}, "chartversions": []bson.M{{"digest": "1"}}},
+		bson.M{"_id": "stable/mysql", "name": "mysql", "repo": bson.M{"name": "stable"}, "chartversions": []bson.M{{"digest": "2"}}},
+		bson.M{"_id": "mirror/wordpress", "name": "wordpress", "repo": bson.M{"name": "mirror"}, "chartversions": []bson.M{{"digest": "1"}}},
+		bson.M{"_id": "incubator/kafka", "name": "kafka", "repo": bson.M{"name": "incubator"}, "chartversions": []bson.M{{"digest": "3"}}},
+	))
+	db, closer := s.DB()
+	defer closer()
+	c := db.C("charts")
+
+	var charts []struct {
+		ID                string `bson:"_id"`
+		FirstChartVersion bson.M `bson:"firstChartVersion"`
+	}
+	assert.NoError(t, c.Pipe(uniqueChartsPipeline()).All(&charts))
+	if assert.Len(t, charts, 2, "duplicated charts are removed") {
+		assert.Equal(t, "stable/mysql", charts[0].ID)
+		assert.Equal(t, "stable/wordpress", charts[1].ID, "the first chart of a digest is kept")
+		assert.Equal(t, bson.M{"digest": "1"}, charts[1].FirstChartVersion)
+	}
+
+	var cnt struct{ Count int }
+	assert.NoError(t, c.Pipe(uniqueChartsPipeline(bson.M{"$count": "count"})).One(&cnt))
+	assert.Equal(t, 2, cnt.Count)
+
+	assert.NoError(t, c.Pipe(uniqueChartsPipeline(bson.M{"$skip": 1}, bson.M{"$limit": 1})).All(&charts))
+	if assert.Len(t, charts, 1, "page") {
+		assert.Equal(t, "stable/wordpress", charts[0].ID)
+	}
+
+	err := c.Pipe([]bson.M{{"$match": bson.M{"name": "nginx"}}, {"$count": "count"}}).One(&cnt)
+	assert.Equal(t, mgo.ErrNotFound, err, "nothing is counted without documents")
+
+	err = c.Pipe([]bson.M{{"$skip": -1}}).All(&charts)
+	assert.Error(t, err, "negative skip")
+
+	err = c.Pipe([]bson.M{{"$lookup": bson.M{"from": "files"}}}).All(&charts)
+	assert.Error(t, err, "unsupported stage")
+}
+
+func Test_sortStageKeepsKeyOrder(t *testing.T) {
+	stages, err := parsePipeline([]bson.D{{{Name: "$sort", Value: bson.D{{Name: "name", Value: 1}, {Name: "version", Value: -1}}}}})
+	assert.NoError(t, err)
+	if assert.Len(t, stages, 1) {
+		assert.Equal(t, bson.D{{Name: "name", Value: 1}, {Name: "version", Value: -1}}, stages[0].sortKeys)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/lib/pq"
+)
+
+// pgSchema creates the table holding the documents of every collection of a
+// store opened with OpenPostgreSQL. The documents are stored as BSON extended
+// JSON, keyed by their collection and the idKey of their ID, and numbered so
+// that they are read in insertion order.
+const pgSchema = `
+CREATE TABLE IF NOT EXISTS documents (
+	collection text NOT NULL,
+	id text NOT NULL,
+	seq bigserial NOT NULL,
+	doc jsonb NOT NULL,
+	PRIMARY KEY (collection, id)
+);
+CREATE INDEX IF NOT EXISTS documents_collection_seq ON documents (collection, seq);
+`
+
+// OpenPostgreSQL returns a store keeping its documents in the PostgreSQL
+// database at url, creating their table if needed. The documents aren't kept in
+// memory: every operation reads the ones it needs from PostgreSQL, so that the
+// processes sharing the database see each other's changes. The writes to a
+// collection are serialized with an advisory lock.
+func OpenPostgreSQL(url string) (*Store, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(pgSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("localstore: can't create the documents table in PostgreSQL: %v", err)
+	}
+	s := New()
+	s.pg = db
+	return s, nil
+}
+
+// pgQueryer is implemented by sql.DB and sql.Tx
+type pgQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// pgRead runs f on the documents of the collection with the given keys, or on
+// all of them if keys is nil
+func (s *Store) pgRead(name string, keys []string, f func(c *collection) error) error {
+	c, err := pgLoad(s.pg, name, keys)
+	if err != nil {
+		return err
+	}
+	return f(c)
+}
+
+// pgUpdate runs f like pgRead, in a transaction writing its changes to
+// PostgreSQL. Like in MongoDB, the changes made before f fails are kept.
+func (s *Store) pgUpdate(name string, keys []string, f func(c *collection) error) error {
+	tx, err := s.pg.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// The writers of the collection take turns, so that the documents read
+	// by f aren't changed before its own changes are committed
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('localstore'), hashtext($1))`, name); err != nil {
+		return err
+	}
+	c, err := pgLoad(tx, name, keys)
+	if err != nil {
+		return err
+	}
+	c.writer = pgWriter{tx, name}
+	err = f(c)
+	c.writer = nil
+	if commitErr := tx.Commit(); commitErr != nil {
+		return commitErr
+	}
+	return err
+}
+
+// pgLoad reads the documents of the collection with the given keys, or all of
+// them if keys is nil
+func pgLoad(q pgQueryer, name string, keys []string) (*collection, error) {
+	query := `SELECT id, doc FROM documents WHERE collection = $1 ORDER BY seq`
+	args := []interface{}{name}
+	if keys != nil {
+		query = `SELECT id, doc FROM documents WHERE collection = $1 AND id = ANY($2) ORDER BY seq`
+		args = append(args, pq.Array(keys))
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c := newCollection()
+	for rows.Next() {
+		var key, data string
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, err
+		}
+		doc := bson.M{}
+		if err := bson.UnmarshalJSON([]byte(data), &doc); err != nil {
+			return nil, fmt.Errorf("localstore: invalid document %s of collection %s: %v", key, name, err)
+		}
+		c.byID[key] = len(c.docs)
+		c.docs = append(c.docs, doc)
+	}
+	return c, rows.Err()
+}
+
+// pgWriter writes the changes made to a collection in a transaction
+type pgWriter struct {
+	tx   *sql.Tx
+	name string
+}
+
+func (w pgWriter) storeDoc(key string, doc bson.M) error {
+	data, err := bson.MarshalJSON(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.tx.Exec(`
+INSERT INTO documents (collection, id, doc) VALUES ($1, $2, $3)
+ON CONFLICT (collection, id) DO UPDATE SET doc = excluded.doc`, w.name, key, string(data))
+	return err
+}
+
+func (w pgWriter) deleteDoc(key string) error {
+	_, err := w.tx.Exec(`DELETE FROM documents WHERE collection = $1 AND id = $2`, w.name, key)
+	return err
+}
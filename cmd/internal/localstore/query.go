@@ -0,0 +1,535 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// match tells whether the document matches the selector
+func match(doc bson.M, selector bson.M) (bool, error) {
+	for k, cond := range selector {
+		var ok bool
+		var err error
+		switch k {
+		case "$and", "$or":
+			var subs []bson.M
+			if subs, err = condList(k, cond); err != nil {
+				return false, err
+			}
+			ok = k == "$and"
+			for _, sub := range subs {
+				m, err := match(doc, sub)
+				if err != nil {
+					return false, err
+				}
+				if m != ok {
+					ok = m
+					break
+				}
+			}
+		default:
+			if strings.HasPrefix(k, "$") {
+				return false, fmt.Errorf("localstore: unsupported query operator %s", k)
+			}
+			ok, err = matchValues(lookup(doc, strings.Split(k, ".")), cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// condList returns the selectors of $and and $or
+func condList(op string, cond interface{}) ([]bson.M, error) {
+	list, ok := cond.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("localstore: %s needs a non-empty array", op)
+	}
+	var subs []bson.M
+	for _, c := range list {
+		sub, ok := c.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("localstore: %s entries must be documents", op)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// lookup returns the values at the path in v. Like in MongoDB, numeric parts
+// index arrays, and other parts are looked up in every document of arrays.
+func lookup(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+	switch v := v.(type) {
+	case bson.M:
+		child, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookup(child, path[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return lookup(v[i], path[1:])
+		}
+		var values []interface{}
+		for _, e := range v {
+			if doc, ok := e.(bson.M); ok {
+				values = append(values, lookup(doc, path)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// isOperatorDoc tells whether the condition is a document of operators,
+// e.g. {"$in": [...]}, rather than a value to compare with
+func isOperatorDoc(cond interface{}) bool {
+	doc, ok := cond.(bson.M)
+	if !ok || len(doc) == 0 {
+		return false
+	}
+	for k := range doc {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchValues tells whether the values found at a path match the condition
+func matchValues(values []interface{}, cond interface{}) (bool, error) {
+	if !isOperatorDoc(cond) {
+		return anyValue(values, func(v interface{}) bool { return equal(v, cond) }), nil
+	}
+	ops := cond.(bson.M)
+	for op, arg := range ops {
+		ok, err := matchOperator(values, op, arg, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// anyValue tells whether one of the values, or of the elements of the values
+// that are arrays, satisfies the predicate. A missing value is null.
+func anyValue(values []interface{}, pred func(interface{}) bool) bool {
+	if len(values) == 0 {
+		return pred(nil)
+	}
+	for _, v := range values {
+		if pred(v) {
+			return true
+		}
+		if list, ok := v.([]interface{}); ok {
+			for _, e := range list {
+				if pred(e) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchOperator(values []interface{}, op string, arg interface{}, ops bson.M) (bool, error) {
+	switch op {
+	case "$eq":
+		return anyValue(values, func(v interface{}) bool { return equal(v, arg) }), nil
+	case "$ne":
+		return !anyValue(values, func(v interface{}) bool { return equal(v, arg) }), nil
+	case "$in", "$nin":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("localstore: %s needs an array", op)
+		}
+		in := anyValue(values, func(v interface{}) bool {
+			for _, e := range list {
+				if equal(v, e) {
+					return true
+				}
+			}
+			return false
+		})
+		return in == (op == "$in"), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return anyValue(values, func(v interface{}) bool {
+			if v == nil || typeRank(v) != typeRank(arg) {
+				return false
+			}
+			c := compare(v, arg)
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		}), nil
+	case "$exists":
+		return (len(values) > 0) == truthy(arg), nil
+	case "$regex":
+		re, err := compileRegex(arg, ops["$options"])
+		if err != nil {
+			return false, err
+		}
+		return anyValue(values, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		}), nil
+	case "$options":
+		// Read along with $regex
+		return true, nil
+	case "$elemMatch":
+		sub, ok := arg.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("localstore: $elemMatch needs a document")
+		}
+		for _, v := range values {
+			list, ok := v.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, e := range list {
+				m, err := matchElement(e, sub)
+				if err != nil {
+					return false, err
+				}
+				if m {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("localstore: unsupported query operator %s", op)
+}
+
+// matchElement tells whether the element of an array matches the condition
+// of $elemMatch, either operators applied to the element or a selector
+// applied to the document
+func matchElement(e interface{}, cond bson.M) (bool, error) {
+	if isOperatorDoc(cond) {
+		if _, ok := cond["$and"]; !ok {
+			if _, ok := cond["$or"]; !ok {
+				return matchValues([]interface{}{e}, cond)
+			}
+		}
+	}
+	doc, ok := e.(bson.M)
+	if !ok {
+		return false, nil
+	}
+	return match(doc, cond)
+}
+
+func compileRegex(pattern, options interface{}) (*regexp.Regexp, error) {
+	var expr, flags string
+	switch p := pattern.(type) {
+	case string:
+		expr = p
+	case bson.RegEx:
+		expr, flags = p.Pattern, p.Options
+	default:
+		return nil, fmt.Errorf("localstore: $regex needs a string, got %T", pattern)
+	}
+	if o, ok := options.(string); ok {
+		flags += o
+	}
+	prefix := ""
+	for _, f := range flags {
+		switch f {
+		case 'i', 'm', 's':
+			prefix += string(f)
+		default:
+			return nil, fmt.Errorf("localstore: unsupported $regex option %c", f)
+		}
+	}
+	if prefix != "" {
+		expr = "(?" + prefix + ")" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+// toFloat returns the value of a number
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// typeRank returns the position of the type of the value in the order
+// MongoDB sorts values of different types in
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case int, int32, int64, float64:
+		return 2
+	case string, bson.Symbol:
+		return 3
+	case bson.M:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte, bson.Binary:
+		return 6
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	}
+	return 10
+}
+
+// compare returns -1, 0 or 1 if a is lower, equal or greater than b
+func compare(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return sign(ra - rb)
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case bson.ObjectId:
+		return strings.Compare(string(a), string(b.(bson.ObjectId)))
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		if a {
+			return 1
+		}
+		return -1
+	case time.Time:
+		bt := b.(time.Time)
+		if a.Before(bt) {
+			return -1
+		}
+		if a.After(bt) {
+			return 1
+		}
+		return 0
+	case []byte:
+		if bb, ok := b.([]byte); ok {
+			return bytes.Compare(a, bb)
+		}
+	case []interface{}:
+		bl := b.([]interface{})
+		for i := 0; i < len(a) && i < len(bl); i++ {
+			if c := compare(a[i], bl[i]); c != 0 {
+				return c
+			}
+		}
+		return sign(len(a) - len(bl))
+	case bson.M:
+		return compareDocs(a, b.(bson.M))
+	}
+	if fa, ok := toFloat(a); ok {
+		fb, _ := toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// compareDocs compares documents by their sorted keys, as the key order of
+// bson.M is lost
+func compareDocs(a, b bson.M) int {
+	if len(a) != len(b) {
+		return sign(len(a) - len(b))
+	}
+	for _, k := range sortedKeys(a) {
+		bv, ok := b[k]
+		if !ok {
+			return 1
+		}
+		if c := compare(a[k], bv); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// equal tells whether the values are equal, numbers of different types being
+// equal if they have the same value
+func equal(a, b interface{}) bool {
+	return typeRank(a) == typeRank(b) && compare(a, b) == 0
+}
+
+// project returns the fields of the document selected by the projection.
+// The "field.$" projection returns the first element of the array matched by
+// the $elemMatch of the selector on the field.
+func project(doc bson.M, projection bson.M, selector bson.M) (bson.M, error) {
+	// Like in MongoDB, {"_id": 1} alone includes the ID only
+	include, excludeOthers := false, false
+	for k, v := range projection {
+		if truthy(v) {
+			include = include || k != "_id" || len(projection) == 1
+		} else if k != "_id" {
+			excludeOthers = true
+		}
+	}
+	include = include && !excludeOthers
+
+	if !include {
+		out := copyDoc(doc)
+		for k := range projection {
+			unsetPath(out, strings.Split(k, "."))
+		}
+		return out, nil
+	}
+
+	out := bson.M{}
+	if id, ok := doc["_id"]; ok {
+		if v, ok := projection["_id"]; !ok || truthy(v) {
+			out["_id"] = id
+		}
+	}
+	for k, v := range projection {
+		if k == "_id" || !truthy(v) {
+			continue
+		}
+		if strings.HasSuffix(k, ".$") {
+			field := strings.TrimSuffix(k, ".$")
+			i, err := elemMatchIndex(doc, selector, field)
+			if err != nil {
+				return nil, err
+			}
+			if i >= 0 {
+				out[field] = []interface{}{doc[field].([]interface{})[i]}
+			}
+			continue
+		}
+		includePath(out, doc, strings.Split(k, "."))
+	}
+	return out, nil
+}
+
+// elemMatchIndex returns the index of the first element of the array field
+// matching the $elemMatch of the selector on the field
+func elemMatchIndex(doc bson.M, selector bson.M, field string) (int, error) {
+	conds := []bson.M{selector}
+	if and, ok := selector["$and"]; ok {
+		subs, err := condList("$and", and)
+		if err != nil {
+			return -1, err
+		}
+		conds = append(conds, subs...)
+	}
+	for _, c := range conds {
+		cond, ok := c[field].(bson.M)
+		if !ok {
+			continue
+		}
+		em, ok := cond["$elemMatch"].(bson.M)
+		if !ok {
+			continue
+		}
+		list, _ := doc[field].([]interface{})
+		for i, e := range list {
+			m, err := matchElement(e, em)
+			if err != nil {
+				return -1, err
+			}
+			if m {
+				return i, nil
+			}
+		}
+		return -1, nil
+	}
+	return -1, fmt.Errorf("localstore: the positional projection of %s needs an $elemMatch on it in the query", field)
+}
+
+// includePath copies the value at the path of doc to out
+func includePath(out, doc bson.M, path []string) {
+	v, ok := doc[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		out[path[0]] = v
+		return
+	}
+	sub, ok := v.(bson.M)
+	if !ok {
+		return
+	}
+	outSub, ok := out[path[0]].(bson.M)
+	if !ok {
+		outSub = bson.M{}
+		out[path[0]] = outSub
+	}
+	includePath(outSub, sub, path[1:])
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_match(t *testing.T) {
+	synced := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	doc, err := toDoc(bson.M{
+		"_id":        "stable/wordpress",
+		"name":       "wordpress",
+		"repo":       bson.M{"name": "stable"},
+		"generation": int64(2),
+		"keywords":   []string{"blog", "cms"},
+		"syncedat":   synced,
+		"chartversions": []bson.M{
+			{"version": "1.0.0", "appversion": "4.9", "provenance": bson.M{"state": "verified"}},
+			{"version": "0.9.0", "appversion": "4.8"},
+		},
+		"maintainers": []bson.M{{"name": "Bitnami"}},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		selector bson.M
+		want     bool
+	}{
+		{"empty selector", bson.M{}, true},
+		{"equality", bson.M{"name": "wordpress"}, true},
+		{"nested field", bson.M{"repo.name": "stable"}, true},
+		{"numbers of different types", bson.M{"generation": 2}, true},
+		{"array index", bson.M{"chartversions.0.provenance.state": "verified"}, true},
+		{"array index out of range", bson.M{"chartversions.5.version": "1.0.0"}, false},
+		{"field of array elements", bson.M{"chartversions.version": "0.9.0"}, true},
+		{"array element", bson.M{"keywords": "cms"}, true},
+		{"missing field is null", bson.M{"home": nil}, true},
+		{"$ne", bson.M{"name": bson.M{"$ne": "wordpress"}}, false},
+		{"$in", bson.M{"repo.name": bson.M{"$in": []string{"incubator", "stable"}}}, true},
+		{"$nin", bson.M{"repo.name": bson.M{"$nin": []string{"stable"}}}, false},
+		{"$nin of missing field", bson.M{"home": bson.M{"$nin": []string{"x"}}}, true},
+		{"$exists", bson.M{"generation": bson.M{"$exists": true}}, true},
+		{"not $exists", bson.M{"generation": bson.M{"$exists": false}}, false},
+		{"$gt", bson.M{"generation": bson.M{"$gt": 0}}, true},
+		{"$lte", bson.M{"generation": bson.M{"$lte": 1}}, false},
+		{"$lt of times", bson.M{"syncedat": bson.M{"$lt": synced.Add(time.Second)}}, true},
+		{"$gt of other types", bson.M{"name": bson.M{"$gt": 0}}, false},
+		{"$regex", bson.M{"name": bson.M{"$regex": "^word"}}, true},
+		{"$regex with options", bson.M{"name": bson.M{"$regex": "PRESS", "$options": "i"}}, true},
+		{"$elemMatch of documents", bson.M{"chartversions": bson.M{"$elemMatch": bson.M{"version": "1.0.0", "appversion": "4.9", "provenance.state": "verified"}}}, true},
+		{"$elemMatch needs a single element", bson.M{"chartversions": bson.M{"$elemMatch": bson.M{"version": "1.0.0", "appversion": "4.8"}}}, false},
+		{"$elemMatch of values", bson.M{"keywords": bson.M{"$elemMatch": bson.M{"$regex": "^bl"}}}, true},
+		{"$elemMatch of missing field", bson.M{"sources": bson.M{"$elemMatch": bson.M{"$regex": "."}}}, false},
+		{"$or", bson.M{"$or": []bson.M{{"name": "mysql"}, {"maintainers": bson.M{"$elemMatch": bson.M{"name": bson.M{"$regex": "nami"}}}}}}, true},
+		{"$and", bson.M{"$and": []bson.M{{"name": "wordpress"}, {"repo.name": "incubator"}}}, false},
+		{"active charts", bson.M{"$or": []bson.M{
+			{"repo.name": "stable", "generation": 2},
+			{"repo.name": bson.M{"$nin": []string{"stable"}}, "generation": bson.M{"$exists": false}},
+		}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := toDoc(tt.selector)
+			assert.NoError(t, err)
+			got, err := match(doc, sel)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("unsupported operator", func(t *testing.T) {
+		_, err := match(doc, bson.M{"name": bson.M{"$where": "true"}})
+		assert.Error(t, err)
+	})
+}
+
+func Test_project(t *testing.T) {
+	doc, err := toDoc(bson.M{
+		"_id":      "stable/wordpress",
+		"name":     "wordpress",
+		"raw_icon": []byte("icon"),
+		"chartversions": []bson.M{
+			{"version": "1.0.0"},
+			{"version": "0.9.0"},
+		},
+	})
+	assert.NoError(t, err)
+
+	t.Run("exclusion", func(t *testing.T) {
+		got, err := project(doc, bson.M{"raw_icon": 0}, bson.M{})
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{"_id": "stable/wordpress", "name": "wordpress", "chartversions": doc["chartversions"]}, got)
+	})
+
+	t.Run("inclusion", func(t *testing.T) {
+		got, err := project(doc, bson.M{"name": 1}, bson.M{})
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{"_id": "stable/wordpress", "name": "wordpress"}, got)
+	})
+
+	t.Run("positional", func(t *testing.T) {
+		selector, err := toDoc(bson.M{"chartversions": bson.M{"$elemMatch": bson.M{"version": "0.9.0"}}})
+		assert.NoError(t, err)
+		got, err := project(doc, bson.M{"name": 1, "chartversions.$": 1}, selector)
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{bson.M{"version": "0.9.0"}}, got["chartversions"])
+	})
+}
+
+func Test_applyUpdate(t *testing.T) {
+	doc := bson.M{"_id": "1", "attempts": 1, "chartversions": []interface{}{bson.M{"version": "1.0.0"}}}
+
+	got, err := applyUpdate(doc, bson.M{
+		"$set":         bson.M{"chartversions.0.readme": "README", "repo.name": "stable"},
+		"$inc":         bson.M{"attempts": 1},
+		"$setOnInsert": bson.M{"state": "pending"},
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{
+		"_id":           "1",
+		"attempts":      2,
+		"repo":          bson.M{"name": "stable"},
+		"chartversions": []interface{}{bson.M{"version": "1.0.0", "readme": "README"}},
+	}, got)
+	assert.Equal(t, bson.M{"version": "1.0.0"}, doc["chartversions"].([]interface{})[0], "the document isn't modified in place")
+
+	got, err = applyUpdate(doc, bson.M{"name": "wordpress"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "name": "wordpress"}, got, "replacement keeps the ID")
+
+	_, err = applyUpdate(doc, bson.M{"$set": bson.M{"_id": "2"}}, false)
+	assert.Error(t, err, "the ID can't be changed")
+
+	_, err = applyUpdate(doc, bson.M{"$push": bson.M{"keywords": "cms"}}, false)
+	assert.Error(t, err, "unsupported operator")
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Seed inserts the documents of a seed file, a JSON object listing the
+// documents of each collection in MongoDB extended JSON, e.g.
+//
+//	{
+//	  "repos": [{"_id": "stable", "url": "https://kubernetes-charts.storage.googleapis.com"}],
+//	  "charts": [{
+//	    "_id": "stable/wordpress",
+//	    "name": "wordpress",
+//	    "repo": {"name": "stable", "url": "https://kubernetes-charts.storage.googleapis.com"},
+//	    "chartversions": [{"version": "1.0.0", "created": {"$date": "2018-06-01T12:00:00Z"}}]
+//	  }]
+//	}
+func (s *Store) Seed(data []byte) error {
+	var seed bson.M
+	if err := bson.UnmarshalJSON(data, &seed); err != nil {
+		return fmt.Errorf("invalid seed: %v", err)
+	}
+	for _, name := range sortedKeys(seed) {
+		docs, ok := seed[name].([]interface{})
+		if !ok {
+			return fmt.Errorf("invalid seed: the documents of collection %s must be an array", name)
+		}
+		if err := s.Insert(name, docs...); err != nil {
+			return fmt.Errorf("can't seed collection %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// SeedFile inserts the documents of the seed file at path, see Seed
+func (s *Store) SeedFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return s.Seed(data)
+}
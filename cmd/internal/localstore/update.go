@@ -0,0 +1,218 @@
+/*
+Copyright (c) 2018 The Helm Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localstore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// applyUpdate returns the document updated with the update operators, or
+// replaced by the update if it has no operators. $setOnInsert is only applied
+// when inserting the document.
+func applyUpdate(doc bson.M, update bson.M, inserting bool) (bson.M, error) {
+	id, hasID := doc["_id"]
+	if !hasOperators(update) {
+		replaced := copyDoc(update)
+		if hasID {
+			if newID, ok := replaced["_id"]; ok && !equal(newID, id) {
+				return nil, fmt.Errorf("localstore: the _id of document %v can't be changed", id)
+			}
+			replaced["_id"] = id
+		}
+		return replaced, nil
+	}
+
+	updated := copyDoc(doc)
+	// Apply the operators in a stable order
+	for _, op := range sortedKeys(update) {
+		fields, ok := update[op].(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("localstore: %s needs a document", op)
+		}
+		for _, path := range sortedKeys(fields) {
+			v := fields[path]
+			switch op {
+			case "$set":
+			case "$setOnInsert":
+				if !inserting {
+					continue
+				}
+			case "$inc":
+				var err error
+				if v, err = increment(firstValue(updated, path), v); err != nil {
+					return nil, fmt.Errorf("localstore: can't increment %s: %v", path, err)
+				}
+			default:
+				return nil, fmt.Errorf("localstore: unsupported update operator %s", op)
+			}
+			if path == "_id" && hasID && !equal(v, id) {
+				return nil, fmt.Errorf("localstore: the _id of document %v can't be changed", id)
+			}
+			if err := setPath(updated, path, copyValue(v)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return updated, nil
+}
+
+func hasOperators(update bson.M) bool {
+	for k := range update {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// increment returns the current value incremented by n, keeping integers
+// integers
+func increment(current, n interface{}) (interface{}, error) {
+	if current == nil {
+		current = 0
+	}
+	if _, ok := toFloat(current); !ok {
+		return nil, fmt.Errorf("%v is not a number", current)
+	}
+	if _, ok := toFloat(n); !ok {
+		return nil, fmt.Errorf("%v is not a number", n)
+	}
+	ci, cInt := toInt(current)
+	ni, nInt := toInt(n)
+	if cInt && nInt {
+		sum := ci + ni
+		_, cIs64 := current.(int64)
+		_, nIs64 := n.(int64)
+		if !cIs64 && !nIs64 && int64(int(int32(sum))) == sum {
+			return int(sum), nil
+		}
+		return sum, nil
+	}
+	cf, _ := toFloat(current)
+	nf, _ := toFloat(n)
+	return cf + nf, nil
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// setPath sets the value at the dotted path of the document, creating the
+// documents on the way. Numeric parts index arrays, which are padded with
+// nulls like in MongoDB.
+func setPath(doc bson.M, path string, v interface{}) error {
+	parts := strings.Split(path, ".")
+	var cur interface{} = doc
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch c := cur.(type) {
+		case bson.M:
+			if last {
+				c[part] = v
+				return nil
+			}
+			next, ok := c[part]
+			if !ok || next == nil {
+				next = bson.M{}
+				c[part] = next
+			}
+			cur = next
+		case []interface{}:
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return fmt.Errorf("localstore: can't set %s, %s is not an array index", path, part)
+			}
+			if n >= len(c) {
+				// The array grows, so it's set again in its parent
+				grown := make([]interface{}, n+1)
+				copy(grown, c)
+				if err := setPath(doc, strings.Join(parts[:i], "."), grown); err != nil {
+					return err
+				}
+				c = grown
+			}
+			if last {
+				c[n] = v
+				return nil
+			}
+			if c[n] == nil {
+				c[n] = bson.M{}
+			}
+			cur = c[n]
+		default:
+			return fmt.Errorf("localstore: can't set %s, %s is not a document", path, strings.Join(parts[:i], "."))
+		}
+	}
+	return nil
+}
+
+// unsetPath removes the value at the path of the document
+func unsetPath(doc bson.M, path []string) {
+	if len(path) == 1 {
+		delete(doc, path[0])
+		return
+	}
+	if sub, ok := doc[path[0]].(bson.M); ok {
+		unsetPath(sub, path[1:])
+	}
+}
+
+// copyDoc returns a deep copy of the document, so that stored documents are
+// never modified in place
+func copyDoc(doc bson.M) bson.M {
+	out := make(bson.M, len(doc))
+	for k, v := range doc {
+		out[k] = copyValue(v)
+	}
+	return out
+}
+
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		return copyDoc(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = copyValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+func sortedKeys(doc bson.M) []string {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -7,4 +7,11 @@ export class Repo {
 export class RepoAttributes {
   name: string = '';
   url: string = '';
+  last_sync_start?: string;
+  last_sync_end?: string;
+  last_successful_sync?: string;
+  status?: string;
+  error?: string;
+  chart_count?: number;
+  version_count?: number;
 }
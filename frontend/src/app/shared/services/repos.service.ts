@@ -1,5 +1,5 @@
 import { Injectable } from '@angular/core';
-import { RepoAttributes } from '../models/repo';
+import { Repo, RepoAttributes } from '../models/repo';
 import { ConfigService } from './config.service';
 
 import { Observable } from 'rxjs';
@@ -11,9 +11,13 @@ import { Http, Response } from '@angular/http';
 
 @Injectable()
 export class ReposService {
+  hostname: string;
+
   constructor(
     private http: Http,
+    private config: ConfigService
   ) {
+    this.hostname = `${config.backendHostname}/chartsvc`;
   }
 
   /**
@@ -22,8 +26,9 @@ export class ReposService {
    * @return {Observable} An observable that will an array with all repos
    */
   getRepos(): Observable<RepoAttributes[]> {
-    return this.http.get(`/assets/js/repos.json`)
+    return this.http.get(`${this.hostname}/v1/repos`)
                   .map(this.extractData)
+                  .map((repos: Repo[]) => repos.map(r => r.attributes))
                   .catch(this.handleError);
   }
 